@@ -0,0 +1,145 @@
+package apikeys
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/go-playground/validator/v10"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog"
+	"gorm.io/gorm"
+
+	e "backend/api/resource/common/error"
+	validatorUtil "backend/utils/validator"
+)
+
+type API struct {
+	repository *Repository
+	validator  *validator.Validate
+	logger     *zerolog.Logger
+}
+
+func New(l *zerolog.Logger, db *gorm.DB, v *validator.Validate) *API {
+	return &API{
+		repository: NewRepository(db),
+		validator:  v,
+		logger:     l,
+	}
+}
+
+// List godoc
+//
+//	@summary		List API keys
+//	@description	List API keys, including revoked and expired ones
+//	@tags			api-keys
+//	@accept			json
+//	@produce		json
+//	@success		200	{array}		Response
+//	@failure		403	{object}	error.Error
+//	@failure		500	{object}	error.Error
+//	@router			/api-keys [get]
+func (a *API) List(w http.ResponseWriter, _ *http.Request) {
+	keys, err := a.repository.List()
+	if err != nil {
+		a.logger.Error().Err(err).Msg("List API keys failed")
+		e.ServerError(w, e.RespDBDataAccessFailure)
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(keys.ToResponse()); err != nil {
+		a.logger.Error().Err(err).Msg("List API keys failed")
+		e.ServerError(w, e.RespJSONEncodeFailure)
+		return
+	}
+}
+
+// Create godoc
+//
+//	@summary		Create API key
+//	@description	Create API key. The key is only returned in this response.
+//	@tags			api-keys
+//	@accept			json
+//	@produce		json
+//	@param			body	body	Form	true	"API key form"
+//	@success		201	{object}	CreatedResponse
+//	@failure		403	{object}	error.Error
+//	@failure		422	{object}	error.Errors
+//	@failure		500	{object}	error.Error
+//	@router			/api-keys [post]
+func (a *API) Create(w http.ResponseWriter, r *http.Request) {
+	form := &Form{}
+	if err := json.NewDecoder(r.Body).Decode(form); err != nil {
+		a.logger.Error().Err(err).Msg("Create API key failed")
+		e.ServerError(w, e.RespJSONDecodeFailure)
+		return
+	}
+
+	if err := a.validator.Struct(form); err != nil {
+		a.logger.Error().Err(err).Msg("Create API key failed")
+		respBody, err := json.Marshal(validatorUtil.ToErrResponse(err))
+		if err != nil {
+			e.ServerError(w, e.RespJSONEncodeFailure)
+			return
+		}
+
+		e.ValidationErrors(w, respBody)
+		return
+	}
+
+	newKey, key, err := form.ToModel()
+	if err != nil {
+		a.logger.Error().Err(err).Msg("Create API key failed")
+		e.ServerError(w, e.RespTokenGenerateFailure)
+		return
+	}
+
+	if _, err := a.repository.Create(newKey); err != nil {
+		a.logger.Error().Err(err).Msg("Create API key failed")
+		e.ServerError(w, e.RespDBDataInsertFailure)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	response := &CreatedResponse{Response: newKey.ToResponse(), Key: key}
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		a.logger.Error().Err(err).Msg("Create API key failed")
+		e.ServerError(w, e.RespJSONEncodeFailure)
+		return
+	}
+}
+
+// Revoke godoc
+//
+//	@summary		Revoke API key
+//	@description	Revoke API key
+//	@tags			api-keys
+//	@accept			json
+//	@produce		json
+//	@param			id	path	string	true	"API key ID"
+//	@success		200
+//	@failure		400	{object}	error.Error
+//	@failure		403	{object}	error.Error
+//	@failure		404
+//	@failure		500	{object}	error.Error
+//	@router			/api-keys/{id} [delete]
+func (a *API) Revoke(w http.ResponseWriter, r *http.Request) {
+	id, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		a.logger.Error().Err(err).Msg("Revoke API key failed")
+		e.BadRequest(w, e.RespInvalidURLParamID)
+		return
+	}
+
+	rows, err := a.repository.Revoke(id, time.Now())
+	if err != nil {
+		a.logger.Error().Err(err).Msg("Revoke API key failed")
+		e.ServerError(w, e.RespDBDataUpdateFailure)
+		return
+	}
+	if rows == 0 {
+		e.NotFound(w)
+		return
+	}
+}
@@ -0,0 +1,176 @@
+package apikeys
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql/driver"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	ScopeUsersRead  = "users:read"
+	ScopeUsersWrite = "users:write"
+	ScopeUsersAdmin = "users:admin"
+)
+
+// implied lists the scopes granted by each scope, so that an admin key does
+// not have to enumerate read and write as well.
+var implied = map[string][]string{
+	ScopeUsersRead:  {ScopeUsersRead},
+	ScopeUsersWrite: {ScopeUsersWrite, ScopeUsersRead},
+	ScopeUsersAdmin: {ScopeUsersAdmin, ScopeUsersWrite, ScopeUsersRead},
+}
+
+func IsScope(s string) bool {
+	_, ok := implied[s]
+	return ok
+}
+
+var GenerateKey = func() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "hh_" + hex.EncodeToString(b), nil
+}
+
+func HashKey(key string) []byte {
+	sum := sha256.Sum256([]byte(key))
+	return sum[:]
+}
+
+// Scopes is stored as a space separated list, like an OAuth scope string.
+type Scopes []string
+
+func (s Scopes) Value() (driver.Value, error) {
+	return strings.Join(s, " "), nil
+}
+
+func (s *Scopes) Scan(value any) error {
+	switch v := value.(type) {
+	case string:
+		*s = strings.Fields(v)
+	case []byte:
+		*s = strings.Fields(string(v))
+	case nil:
+		*s = nil
+	default:
+		return fmt.Errorf("cannot scan %T into Scopes", value)
+	}
+	return nil
+}
+
+type Form struct {
+	Name      string     `json:"name" form:"required,max=255"`
+	Scopes    []string   `json:"scopes" form:"required,min=1,dive,scope"`
+	ExpiresAt *time.Time `json:"expiresAt"`
+}
+
+type Response struct {
+	ID         uuid.UUID  `json:"id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Scopes     []string   `json:"scopes"`
+	ExpiresAt  *time.Time `json:"expiresAt"`
+	LastUsedAt *time.Time `json:"lastUsedAt"`
+	RevokedAt  *time.Time `json:"revokedAt"`
+	CreatedAt  time.Time  `json:"createdAt"`
+}
+
+// CreatedResponse is only returned once, the plain key is not stored.
+type CreatedResponse struct {
+	*Response
+	Key string `json:"key"`
+}
+
+type APIKey struct {
+	ID         uuid.UUID `gorm:"primarykey"`
+	Name       string
+	Prefix     string
+	KeyHash    []byte
+	Scopes     Scopes `gorm:"type:text"`
+	ExpiresAt  *time.Time
+	LastUsedAt *time.Time
+	RevokedAt  *time.Time
+	CreatedAt  time.Time
+}
+
+type APIKeys []*APIKey
+
+func (k *APIKey) HasScope(scope string) bool {
+	for _, s := range k.Scopes {
+		if slices.Contains(implied[s], scope) {
+			return true
+		}
+	}
+	return false
+}
+
+func (k *APIKey) IsActive(now time.Time) bool {
+	return k.RevokedAt == nil && (k.ExpiresAt == nil || now.Before(*k.ExpiresAt))
+}
+
+func (k *APIKey) ToResponse() *Response {
+	return &Response{
+		ID:         k.ID,
+		Name:       k.Name,
+		Prefix:     k.Prefix,
+		Scopes:     k.Scopes,
+		ExpiresAt:  k.ExpiresAt,
+		LastUsedAt: k.LastUsedAt,
+		RevokedAt:  k.RevokedAt,
+		CreatedAt:  k.CreatedAt,
+	}
+}
+
+func (keys APIKeys) ToResponse() []*Response {
+	response := make([]*Response, 0, len(keys))
+	for _, k := range keys {
+		response = append(response, k.ToResponse())
+	}
+	return response
+}
+
+// ToModel returns the key to store together with the plain key, which is
+// handed to the caller once and never persisted.
+func (f *Form) ToModel() (*APIKey, string, error) {
+	key, err := GenerateKey()
+	if err != nil {
+		return nil, "", err
+	}
+
+	return &APIKey{
+		ID:        uuid.New(),
+		Name:      f.Name,
+		Prefix:    key[:11],
+		KeyHash:   HashKey(key),
+		Scopes:    f.Scopes,
+		ExpiresAt: f.ExpiresAt,
+	}, key, nil
+}
+
+type keyCtx struct{}
+
+// WithKey returns a copy of ctx carrying the API key the request was made with.
+func WithKey(ctx context.Context, key *APIKey) context.Context {
+	return context.WithValue(ctx, keyCtx{}, key)
+}
+
+// FromContext returns the API key stored by WithKey, if any.
+func FromContext(ctx context.Context) (*APIKey, bool) {
+	key, ok := ctx.Value(keyCtx{}).(*APIKey)
+	return key, ok
+}
+
+// HasScope reports whether the request was made with an API key granting scope.
+func HasScope(ctx context.Context, scope string) bool {
+	key, ok := FromContext(ctx)
+	return ok && key.HasScope(scope)
+}
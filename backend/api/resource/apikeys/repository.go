@@ -0,0 +1,58 @@
+package apikeys
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+type Repository struct {
+	db *gorm.DB
+}
+
+func NewRepository(db *gorm.DB) *Repository {
+	return &Repository{
+		db: db,
+	}
+}
+
+func (r *Repository) List() (APIKeys, error) {
+	var keys APIKeys
+	if err := r.db.Order("created_at desc").Find(&keys).Error; err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+func (r *Repository) Create(key *APIKey) (*APIKey, error) {
+	if err := r.db.Create(key).Error; err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+func (r *Repository) GetByHash(hash []byte) (*APIKey, error) {
+	key := &APIKey{}
+	if err := r.db.Where("key_hash = ?", hash).First(key).Error; err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+func (r *Repository) Revoke(id uuid.UUID, now time.Time) (int64, error) {
+	result := r.db.Model(&APIKey{}).
+		Where("id = ? AND revoked_at IS NULL", id).
+		Update("revoked_at", now)
+
+	return result.RowsAffected, result.Error
+}
+
+func (r *Repository) Touch(id uuid.UUID, now time.Time) error {
+	return r.db.Model(&APIKey{}).
+		Where("id = ?", id).
+		Update("last_used_at", now).Error
+}
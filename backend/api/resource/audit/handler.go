@@ -0,0 +1,217 @@
+package audit
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/rs/zerolog"
+	"gorm.io/gorm"
+
+	e "backend/api/resource/common/error"
+	"backend/utils/pagination"
+	validatorUtil "backend/utils/validator"
+)
+
+type API struct {
+	repository *Repository
+	validator  *validator.Validate
+	logger     *zerolog.Logger
+}
+
+func New(l *zerolog.Logger, db *gorm.DB, v *validator.Validate) *API {
+	return &API{
+		repository: NewRepository(db),
+		validator:  v,
+		logger:     l,
+	}
+}
+
+// List godoc
+//
+//	@summary		List audit events
+//	@description	List audit events, the latest first
+//	@tags			audit
+//	@accept			json
+//	@produce		json
+//	@param			page		query	int		false	"Page number"
+//	@param			limit		query	int		false	"Number of items per page"
+//	@param			cursor		query	string	false	"Lists the page after nextCursor or before prevCursor instead of a page number, empty for the first page"
+//	@param			actorId		query	string	false	"User or API key the events were caused by"
+//	@param			action		query	string	false	"Action, e.g. user.delete, or a prefix ending in a dot, e.g. user."
+//	@param			targetId	query	string	false	"ID of the account or resource acted on"
+//	@param			outcome		query	string	false	"success, denied or failure"
+//	@param			from		query	string	false	"First day, YYYY-MM-DD"
+//	@param			to			query	string	false	"Last day, YYYY-MM-DD"
+//	@success		200	{object}	ListResponse
+//	@failure		400	{object}	error.Error
+//	@failure		403	{object}	error.Error
+//	@failure		422	{object}	error.Errors
+//	@failure		500	{object}	error.Error
+//	@router			/audit [get]
+func (a *API) List(w http.ResponseWriter, r *http.Request) {
+	pagination := &pagination.Pagination{}
+	pagination.Parse(r.URL.Query())
+	// The role parameter filters users, events have none.
+	pagination.Role = nil
+	query := ParseListQuery(r.URL.Query())
+	for _, form := range []any{pagination, query} {
+		if err := a.validator.Struct(form); err != nil {
+			a.logger.Error().Err(err).Msg("List audit events failed")
+			respBody, err := json.Marshal(validatorUtil.ToErrResponse(err))
+			if err != nil {
+				e.ServerError(w, e.RespJSONEncodeFailure)
+				return
+			}
+
+			e.ValidationErrors(w, respBody)
+			return
+		}
+	}
+	pagination.Filters = query.Filters()
+	if err := pagination.DecodeCursor(); err != nil {
+		a.logger.Error().Err(err).Msg("List audit events failed")
+		e.BadRequest(w, e.RespInvalidURLParamCursor)
+		return
+	}
+
+	pagination = a.repository.List(*pagination)
+
+	events, ok := pagination.Rows.(Events)
+	if !ok {
+		a.logger.Error().Msg("List audit events failed")
+		e.ServerError(w, e.RespDBDataAccessFailure)
+		return
+	}
+
+	response := events.ToResponse()
+	response.TotalItems = pagination.TotalRows
+	response.NumberOfPages = pagination.TotalPages
+	response.CurrentPage = pagination.Page
+	response.NextCursor = pagination.NextCursor
+	response.PrevCursor = pagination.PrevCursor
+
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		a.logger.Error().Err(err).Msg("List audit events failed")
+		e.ServerError(w, e.RespJSONEncodeFailure)
+		return
+	}
+}
+
+// Export godoc
+//
+//	@summary		Export audit events
+//	@description	Download the audit events matching the filters in the order they were recorded, as newline delimited JSON or CSV. Exports are audited themselves.
+//	@tags			audit
+//	@produce		json
+//	@produce		text/csv
+//	@param			format		query	string	false	"ndjson (default) or csv"
+//	@param			actorId		query	string	false	"User or API key the events were caused by"
+//	@param			action		query	string	false	"Action, e.g. user.delete, or a prefix ending in a dot, e.g. user."
+//	@param			targetId	query	string	false	"ID of the account or resource acted on"
+//	@param			outcome		query	string	false	"success, denied or failure"
+//	@param			from		query	string	false	"First day, YYYY-MM-DD"
+//	@param			to			query	string	false	"Last day, YYYY-MM-DD"
+//	@success		200	{array}		EventResponse
+//	@failure		403	{object}	error.Error
+//	@failure		422	{object}	error.Errors
+//	@failure		500	{object}	error.Error
+//	@router			/audit/export [get]
+func (a *API) Export(w http.ResponseWriter, r *http.Request) {
+	query := ParseListQuery(r.URL.Query())
+	format := r.URL.Query().Get("format")
+	if err := a.validator.Struct(query); err != nil || (format != "" && format != "ndjson" && format != "csv") {
+		a.logger.Error().Err(err).Msg("Export audit events failed")
+		errResp := &validatorUtil.ErrResponse{Errors: []string{"format must be one of the following: ndjson, csv"}}
+		if err != nil {
+			errResp = validatorUtil.ToErrResponse(err)
+		}
+		respBody, err := json.Marshal(errResp)
+		if err != nil {
+			e.ServerError(w, e.RespJSONEncodeFailure)
+			return
+		}
+
+		e.ValidationErrors(w, respBody)
+		return
+	}
+
+	Record(r.Context(), "audit.export", "", "", nil, query)
+
+	filename := "audit-" + Now().UTC().Format("20060102T150405Z")
+	var write func(*Event) error
+	var flush func() error
+	if format == "csv" {
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`.csv"`)
+		cw := csv.NewWriter(w)
+		_ = cw.Write([]string{"id", "occurredAt", "actorId", "actorType", "actorRole", "action", "targetType", "targetId", "ip", "userAgent", "changes", "outcome", "hash"})
+		write = func(event *Event) error {
+			response := event.ToResponse()
+			actorID := ""
+			if response.ActorID != nil {
+				actorID = response.ActorID.String()
+			}
+			return cw.Write([]string{
+				strconv.FormatInt(response.ID, 10), response.OccurredAt.UTC().Format(time.RFC3339Nano), actorID,
+				response.ActorType, response.ActorRole, response.Action, response.TargetType, response.TargetID,
+				response.IP, response.UserAgent, string(response.Changes), string(response.Outcome), response.Hash,
+			})
+		}
+		flush = func() error {
+			cw.Flush()
+			return cw.Error()
+		}
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`.ndjson"`)
+		encoder := json.NewEncoder(w)
+		write = func(event *Event) error {
+			return encoder.Encode(event.ToResponse())
+		}
+		flush = func() error { return nil }
+	}
+
+	// Once streaming started the status cannot change anymore, a failure is
+	// only logged and cuts the export short.
+	if err := a.repository.Each(query.Filters(), write); err != nil {
+		a.logger.Error().Err(err).Msg("Export audit events failed")
+	}
+	if err := flush(); err != nil {
+		a.logger.Error().Err(err).Msg("Export audit events failed")
+	}
+}
+
+// Verify godoc
+//
+//	@summary		Verify audit log
+//	@description	Recompute the hash chain of the audit log to detect events that were changed or removed
+//	@tags			audit
+//	@produce		json
+//	@success		200	{object}	VerifyResponse
+//	@failure		403	{object}	error.Error
+//	@failure		500	{object}	error.Error
+//	@router			/audit/verify [get]
+func (a *API) Verify(w http.ResponseWriter, r *http.Request) {
+	checked, broken, err := a.repository.Verify()
+	if err != nil {
+		a.logger.Error().Err(err).Msg("Verify audit log failed")
+		e.ServerError(w, e.RespDBDataAccessFailure)
+		return
+	}
+
+	response := &VerifyResponse{Valid: broken == nil, Checked: checked}
+	if broken != nil {
+		a.logger.Error().Int64("event", broken.ID).Msg("Audit log chain is broken")
+		response.BrokenAt = &broken.ID
+	}
+
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		a.logger.Error().Err(err).Msg("Verify audit log failed")
+		e.ServerError(w, e.RespJSONEncodeFailure)
+		return
+	}
+}
@@ -0,0 +1,322 @@
+package audit
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/url"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+type Outcome string
+
+const (
+	OutcomeSuccess Outcome = "success"
+	// OutcomeDenied is the outcome of requests that were not authenticated
+	// or not authorized.
+	OutcomeDenied  Outcome = "denied"
+	OutcomeFailure Outcome = "failure"
+)
+
+const (
+	ActorAnonymous = "anonymous"
+	ActorUser      = "user"
+	ActorAPIKey    = "api_key"
+)
+
+// Event records who did what to whom. Each event is chained to the previous
+// one by its hash, so that changing or removing an event breaks the chain.
+type Event struct {
+	ID         int64 `gorm:"primarykey"`
+	OccurredAt time.Time
+	ActorID    *uuid.UUID
+	ActorType  string
+	ActorRole  string
+	Action     string
+	TargetType string
+	TargetID   string
+	IP         string
+	UserAgent  string
+	Changes    *string `gorm:"type:json"`
+	Outcome    Outcome
+	PrevHash   []byte
+	Hash       []byte
+}
+
+func (Event) TableName() string {
+	return "audit_events"
+}
+
+type Events []*Event
+
+// chained holds what the hash of an event is computed over.
+type chained struct {
+	OccurredAt string          `json:"occurredAt"`
+	ActorID    string          `json:"actorId"`
+	ActorType  string          `json:"actorType"`
+	ActorRole  string          `json:"actorRole"`
+	Action     string          `json:"action"`
+	TargetType string          `json:"targetType"`
+	TargetID   string          `json:"targetId"`
+	IP         string          `json:"ip"`
+	UserAgent  string          `json:"userAgent"`
+	Changes    json.RawMessage `json:"changes"`
+	Outcome    Outcome         `json:"outcome"`
+}
+
+// Digest returns the hash of the event chained to the hash of the previous
+// one. Times are hashed with the precision the database keeps.
+func (e *Event) Digest(prevHash []byte) []byte {
+	c := chained{
+		OccurredAt: e.OccurredAt.UTC().Truncate(time.Microsecond).Format(time.RFC3339Nano),
+		ActorType:  e.ActorType,
+		ActorRole:  e.ActorRole,
+		Action:     e.Action,
+		TargetType: e.TargetType,
+		TargetID:   e.TargetID,
+		IP:         e.IP,
+		UserAgent:  e.UserAgent,
+		Outcome:    e.Outcome,
+	}
+	if e.ActorID != nil {
+		c.ActorID = e.ActorID.String()
+	}
+	if e.Changes != nil {
+		c.Changes = json.RawMessage(*e.Changes)
+	}
+
+	b, _ := json.Marshal(c)
+	sum := sha256.Sum256(append(append([]byte{}, prevHash...), b...))
+	return sum[:]
+}
+
+type EventResponse struct {
+	ID         int64           `json:"id"`
+	OccurredAt time.Time       `json:"occurredAt"`
+	ActorID    *uuid.UUID      `json:"actorId"`
+	ActorType  string          `json:"actorType"`
+	ActorRole  string          `json:"actorRole,omitempty"`
+	Action     string          `json:"action"`
+	TargetType string          `json:"targetType,omitempty"`
+	TargetID   string          `json:"targetId,omitempty"`
+	IP         string          `json:"ip"`
+	UserAgent  string          `json:"userAgent"`
+	Changes    json.RawMessage `json:"changes,omitempty" swaggertype:"object"`
+	Outcome    Outcome         `json:"outcome"`
+	Hash       string          `json:"hash"`
+}
+
+type ListResponse struct {
+	Events        []*EventResponse `json:"events"`
+	TotalItems    int64            `json:"total"`
+	NumberOfPages int              `json:"pages"`
+	CurrentPage   int              `json:"currentPage"`
+	NextCursor    string           `json:"nextCursor,omitempty"`
+	PrevCursor    string           `json:"prevCursor,omitempty"`
+}
+
+type VerifyResponse struct {
+	Valid   bool  `json:"valid"`
+	Checked int64 `json:"checked"`
+	// BrokenAt is the first event whose hash does not match.
+	BrokenAt *int64 `json:"brokenAt,omitempty"`
+}
+
+// ListQuery holds the filters of the audit log.
+type ListQuery struct {
+	ActorID  string `json:"actorId" form:"omitempty,uuid"`
+	Action   string `json:"action" form:"max=255"`
+	TargetID string `json:"targetId" form:"max=255"`
+	Outcome  string `json:"outcome" form:"omitempty,oneof=success denied failure"`
+	From     string `json:"from" form:"omitempty,datetime=2006-01-02"`
+	To       string `json:"to" form:"omitempty,datetime=2006-01-02"`
+}
+
+func ParseListQuery(query url.Values) *ListQuery {
+	return &ListQuery{
+		ActorID:  query.Get("actorId"),
+		Action:   strings.TrimSpace(query.Get("action")),
+		TargetID: strings.TrimSpace(query.Get("targetId")),
+		Outcome:  query.Get("outcome"),
+		From:     query.Get("from"),
+		To:       query.Get("to"),
+	}
+}
+
+// Filters returns the conditions of the validated query. An action ending in
+// a dot matches every action starting with it, e.g. user. matches user.delete.
+func (q *ListQuery) Filters() []func(*gorm.DB) *gorm.DB {
+	var filters []func(*gorm.DB) *gorm.DB
+	if q.ActorID != "" {
+		filters = append(filters, func(db *gorm.DB) *gorm.DB {
+			return db.Where("actor_id = ?", q.ActorID)
+		})
+	}
+	if prefix, ok := strings.CutSuffix(q.Action, "."); ok {
+		filters = append(filters, func(db *gorm.DB) *gorm.DB {
+			return db.Where("action LIKE ?", escapeLike(prefix)+".%")
+		})
+	} else if q.Action != "" {
+		filters = append(filters, func(db *gorm.DB) *gorm.DB {
+			return db.Where("action = ?", q.Action)
+		})
+	}
+	if q.TargetID != "" {
+		filters = append(filters, func(db *gorm.DB) *gorm.DB {
+			return db.Where("target_id = ?", q.TargetID)
+		})
+	}
+	if q.Outcome != "" {
+		filters = append(filters, func(db *gorm.DB) *gorm.DB {
+			return db.Where("outcome = ?", q.Outcome)
+		})
+	}
+	if from, err := time.Parse(time.DateOnly, q.From); err == nil {
+		filters = append(filters, func(db *gorm.DB) *gorm.DB {
+			return db.Where("occurred_at >= ?", from)
+		})
+	}
+	// The end date is inclusive.
+	if to, err := time.Parse(time.DateOnly, q.To); err == nil {
+		filters = append(filters, func(db *gorm.DB) *gorm.DB {
+			return db.Where("occurred_at < ?", to.AddDate(0, 0, 1))
+		})
+	}
+	return filters
+}
+
+// escapeLike escapes the wildcards of a LIKE pattern.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
+
+func (e *Event) ToResponse() *EventResponse {
+	response := &EventResponse{
+		ID:         e.ID,
+		OccurredAt: e.OccurredAt,
+		ActorID:    e.ActorID,
+		ActorType:  e.ActorType,
+		ActorRole:  e.ActorRole,
+		Action:     e.Action,
+		TargetType: e.TargetType,
+		TargetID:   e.TargetID,
+		IP:         e.IP,
+		UserAgent:  e.UserAgent,
+		Outcome:    e.Outcome,
+		Hash:       hex.EncodeToString(e.Hash),
+	}
+	if e.Changes != nil {
+		response.Changes = json.RawMessage(*e.Changes)
+	}
+	return response
+}
+
+func (events Events) ToResponse() *ListResponse {
+	response := &ListResponse{Events: []*EventResponse{}}
+	for _, e := range events {
+		response.Events = append(response.Events, e.ToResponse())
+	}
+	return response
+}
+
+type eventKey struct{}
+
+// WithEvent attaches the event of a request to its context, for handlers to
+// describe it.
+func WithEvent(ctx context.Context, event *Event) context.Context {
+	return context.WithValue(ctx, eventKey{}, event)
+}
+
+func EventFrom(ctx context.Context) (*Event, bool) {
+	event, ok := ctx.Value(eventKey{}).(*Event)
+	return event, ok
+}
+
+// SetActor tells who makes the request, once it is authenticated.
+func SetActor(ctx context.Context, actorType string, id uuid.UUID, role string) {
+	if event, ok := EventFrom(ctx); ok {
+		event.ActorType = actorType
+		event.ActorID = &id
+		event.ActorRole = role
+	}
+}
+
+// Fail marks the event of the request as failed, for handlers which report
+// failures without an error status, e.g. by redirecting.
+func Fail(ctx context.Context) {
+	if event, ok := EventFrom(ctx); ok {
+		event.Outcome = OutcomeFailure
+	}
+}
+
+// Record describes the event of the request: the action, its target and,
+// when given, the fields of the target which it changed. Requests of
+// actions recorded this way are audited whatever their method.
+func Record(ctx context.Context, action, targetType, targetID string, before, after any) {
+	event, ok := EventFrom(ctx)
+	if !ok {
+		return
+	}
+
+	event.Action = action
+	event.TargetType = targetType
+	event.TargetID = targetID
+	if before == nil && after == nil {
+		return
+	}
+	if changes := diff(before, after); changes != nil {
+		s := string(changes)
+		event.Changes = &s
+	}
+}
+
+// diff returns the members of before and after which differ, as
+// {"before": {...}, "after": {...}}.
+func diff(before, after any) []byte {
+	b := toMap(before)
+	a := toMap(after)
+	changedBefore := map[string]any{}
+	changedAfter := map[string]any{}
+	for k, v := range b {
+		if w, ok := a[k]; !ok || !reflect.DeepEqual(v, w) {
+			changedBefore[k] = v
+		}
+	}
+	for k, v := range a {
+		if w, ok := b[k]; !ok || !reflect.DeepEqual(v, w) {
+			changedAfter[k] = v
+		}
+	}
+	if len(changedBefore) == 0 && len(changedAfter) == 0 {
+		return nil
+	}
+
+	changes := map[string]any{}
+	if before != nil {
+		changes["before"] = changedBefore
+	}
+	if after != nil {
+		changes["after"] = changedAfter
+	}
+	result, _ := json.Marshal(changes)
+	return result
+}
+
+func toMap(v any) map[string]any {
+	m := map[string]any{}
+	if v == nil || (reflect.ValueOf(v).Kind() == reflect.Pointer && reflect.ValueOf(v).IsNil()) {
+		return m
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return m
+	}
+	_ = json.Unmarshal(b, &m)
+	return m
+}
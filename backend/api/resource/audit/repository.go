@@ -0,0 +1,116 @@
+package audit
+
+import (
+	"bytes"
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+
+	"backend/utils/pagination"
+)
+
+var Now = time.Now
+
+var errBroken = errors.New("audit chain is broken")
+
+// chainLock is the key of the advisory lock serializing appends, so that
+// every event is chained to the one appended right before it.
+const chainLock = 7_366_843_210
+
+// batchSize of the events read at once when exporting or verifying.
+const batchSize = 500
+
+type Repository struct {
+	db *gorm.DB
+}
+
+func NewRepository(db *gorm.DB) *Repository {
+	return &Repository{
+		db: db,
+	}
+}
+
+// Append chains the event to the last one and stores it.
+func (r *Repository) Append(event *Event) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("SELECT pg_advisory_xact_lock(?)", chainLock).Error; err != nil {
+			return err
+		}
+
+		var last []*Event
+		if err := tx.Select("hash").Order("id desc").Limit(1).Find(&last).Error; err != nil {
+			return err
+		}
+		if len(last) > 0 {
+			event.PrevHash = last[0].Hash
+		}
+		event.Hash = event.Digest(event.PrevHash)
+
+		return tx.Create(event).Error
+	})
+}
+
+// List returns a page of events, the latest first.
+func (r *Repository) List(p pagination.Pagination) *pagination.Pagination {
+	var events Events
+
+	p.Count(r.db.Model(&Event{}))
+	r.db.Scopes(pagination.Paginate(&p)).Find(&events)
+
+	p.Rows = pagination.Cursors(&p, events, func(e *Event, _ string) (any, any) {
+		return nil, e.ID
+	})
+
+	return &p
+}
+
+// Each calls fn with the events matching the filters in the order they were
+// appended, reading them in batches.
+func (r *Repository) Each(filters []func(*gorm.DB) *gorm.DB, fn func(*Event) error) error {
+	var after int64
+	for {
+		var events Events
+		if err := r.db.Scopes(filters...).
+			Where("id > ?", after).
+			Order("id").
+			Limit(batchSize).
+			Find(&events).Error; err != nil {
+			return err
+		}
+
+		for _, e := range events {
+			if err := fn(e); err != nil {
+				return err
+			}
+		}
+		if len(events) < batchSize {
+			return nil
+		}
+		after = events[len(events)-1].ID
+	}
+}
+
+// Verify walks the chain and returns the number of events checked and the
+// first event whose hash or link to the previous event does not match.
+func (r *Repository) Verify() (int64, *Event, error) {
+	var (
+		checked  int64
+		prevHash []byte
+		broken   *Event
+	)
+	err := r.Each(nil, func(e *Event) error {
+		if !bytes.Equal(e.PrevHash, prevHash) || !bytes.Equal(e.Hash, e.Digest(e.PrevHash)) {
+			broken = e
+			return errBroken
+		}
+		checked++
+		prevHash = e.Hash
+		return nil
+	})
+	if err != nil && !errors.Is(err, errBroken) {
+		return checked, nil, err
+	}
+
+	return checked, broken, nil
+}
@@ -0,0 +1,170 @@
+package auth
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog"
+	"gorm.io/gorm"
+
+	e "backend/api/resource/common/error"
+	"backend/api/resource/users"
+	"backend/utils/token"
+)
+
+type API struct {
+	repository *users.Repository
+	tokens     *token.Manager
+	logger     *zerolog.Logger
+}
+
+func New(l *zerolog.Logger, db *gorm.DB, t *token.Manager) *API {
+	return &API{
+		repository: users.NewRepository(db),
+		tokens:     t,
+		logger:     l,
+	}
+}
+
+// JWKS godoc
+//
+//	@summary		JSON Web Key Set
+//	@description	Public keys that verify access tokens issued by this service
+//	@tags			auth
+//	@produce		json
+//	@success		200	{object}	token.JWKS
+//	@router			/../.well-known/jwks.json [get]
+func (a *API) JWKS(w http.ResponseWriter, _ *http.Request) {
+	set := &token.JWKS{Keys: []token.JWK{}}
+	if a.tokens != nil {
+		set = a.tokens.JWKS()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	if err := json.NewEncoder(w).Encode(set); err != nil {
+		a.logger.Error().Err(err).Msg("JWKS failed")
+		e.ServerError(w, e.RespJSONEncodeFailure)
+		return
+	}
+}
+
+// Introspect godoc
+//
+//	@summary		Introspect token
+//	@description	RFC 7662 token introspection. The role is read from the database, so it reflects changes made after the token was issued.
+//	@tags			auth
+//	@accept			x-www-form-urlencoded
+//	@produce		json
+//	@param			token			formData	string	true	"Access, OAuth or refresh token"
+//	@param			token_type_hint	formData	string	false	"access, oauth or refresh"
+//	@success		200	{object}	IntrospectionResponse
+//	@failure		400	{object}	error.Error
+//	@failure		401
+//	@failure		403	{object}	error.Error
+//	@failure		500	{object}	error.Error
+//	@router			/auth/introspect [post]
+func (a *API) Introspect(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		a.logger.Error().Err(err).Msg("Introspect token failed")
+		e.BadRequest(w, e.RespMissingFormToken)
+		return
+	}
+
+	raw := r.PostForm.Get("token")
+	if raw == "" {
+		e.BadRequest(w, e.RespMissingFormToken)
+		return
+	}
+
+	response := &IntrospectionResponse{Active: false}
+	if claims := a.parse(raw, r.PostForm.Get("token_type_hint")); claims != nil {
+		active, err := a.activeResponse(claims)
+		if err != nil {
+			a.logger.Error().Err(err).Msg("Introspect token failed")
+			e.ServerError(w, e.RespDBDataAccessFailure)
+			return
+		}
+		if active != nil {
+			response = active
+		}
+	}
+
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		a.logger.Error().Err(err).Msg("Introspect token failed")
+		e.ServerError(w, e.RespJSONEncodeFailure)
+		return
+	}
+}
+
+// parse tries the hinted token type first, as RFC 7662 allows the hint to be
+// wrong.
+func (a *API) parse(raw, hint string) *token.Claims {
+	if a.tokens == nil {
+		return nil
+	}
+
+	types := []string{token.TypeAccess, token.TypeOAuth, token.TypeRefresh}
+	if i := slices.Index(types, hint); i > 0 {
+		types = append([]string{hint}, slices.Delete(types, i, i+1)...)
+	}
+
+	for _, t := range types {
+		if claims, err := a.tokens.Parse(raw, t); err == nil {
+			return claims
+		}
+	}
+
+	return nil
+}
+
+func (a *API) activeResponse(claims *token.Claims) (*IntrospectionResponse, error) {
+	id, err := uuid.Parse(claims.Subject)
+	if err != nil {
+		return nil, nil
+	}
+
+	user, err := a.repository.Read(id)
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if !user.Status.CanLogin() {
+		return nil, nil
+	}
+
+	// Tokens issued at login die with the session they were issued for.
+	if claims.SessionID != "" {
+		sid, err := uuid.Parse(claims.SessionID)
+		if err != nil {
+			return nil, nil
+		}
+		session, err := a.repository.GetSession(sid)
+		if err != nil {
+			if err == gorm.ErrRecordNotFound {
+				return nil, nil
+			}
+			return nil, err
+		}
+		if session.UserID != user.ID {
+			return nil, nil
+		}
+	}
+
+	return &IntrospectionResponse{
+		Active:    true,
+		Subject:   user.ID.String(),
+		Email:     user.Email,
+		Role:      user.Role.ToString(),
+		TokenType: claims.Type,
+		Issuer:    claims.Issuer,
+		IssuedAt:  claims.IssuedAt,
+		ExpiresAt: claims.ExpiresAt,
+		ClientID:  claims.ClientID,
+		Scope:     claims.Scope,
+	}, nil
+}
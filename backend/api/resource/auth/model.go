@@ -0,0 +1,15 @@
+package auth
+
+// IntrospectionResponse follows RFC 7662, hence the snake case field names.
+type IntrospectionResponse struct {
+	Active    bool   `json:"active"`
+	Subject   string `json:"sub,omitempty"`
+	Email     string `json:"email,omitempty"`
+	Role      string `json:"role,omitempty"`
+	TokenType string `json:"token_type,omitempty"` // nolint:tagliatelle
+	Issuer    string `json:"iss,omitempty"`
+	IssuedAt  int64  `json:"iat,omitempty"`
+	ExpiresAt int64  `json:"exp,omitempty"`
+	ClientID  string `json:"client_id,omitempty"` // nolint:tagliatelle
+	Scope     string `json:"scope,omitempty"`
+}
@@ -0,0 +1,433 @@
+package availability
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/go-playground/validator/v10"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog"
+	"gorm.io/gorm"
+
+	e "backend/api/resource/common/error"
+	"backend/api/resource/users"
+	validatorUtil "backend/utils/validator"
+)
+
+var Now = time.Now
+
+type API struct {
+	repository *Repository
+	users      *users.Repository
+	validator  *validator.Validate
+	logger     *zerolog.Logger
+}
+
+func New(l *zerolog.Logger, db *gorm.DB, v *validator.Validate) *API {
+	return &API{
+		repository: NewRepository(db),
+		users:      users.NewRepository(db),
+		validator:  v,
+		logger:     l,
+	}
+}
+
+// Read godoc
+//
+//	@summary		Read availability
+//	@description	Expand the working hours of an active doctor into time windows, with exceptions such as vacations cut out. Bookings are not taken into account. Dates without a time start at midnight in the time zone of the doctor.
+//	@tags			availability
+//	@accept			json
+//	@produce		json
+//	@param			id		path		string	true	"Doctor ID"
+//	@param			from	query		string	false	"Start as RFC 3339 time or YYYY-MM-DD date, defaults to now"
+//	@param			to		query		string	false	"End as RFC 3339 time or YYYY-MM-DD date, defaults to 7 days after from, at most 92 days after it"
+//	@success		200		{object}	AvailabilityResponse
+//	@failure		400		{object}	error.Error
+//	@failure		404
+//	@failure		500		{object}	error.Error
+//	@router			/doctors/{id}/availability [get]
+func (a *API) Read(w http.ResponseWriter, r *http.Request) {
+	id, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		a.logger.Error().Err(err).Msg("Read availability failed")
+		e.BadRequest(w, e.RespInvalidURLParamID)
+		return
+	}
+
+	doctor, ok := a.doctor(w, id)
+	if !ok {
+		return
+	}
+	if doctor.Status != users.StatusActive {
+		e.NotFound(w)
+		return
+	}
+
+	schedule, err := a.repository.GetSchedule(id)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		schedule, err = &Schedule{UserID: id, TimeZone: "UTC"}, nil
+	}
+	if err != nil {
+		a.logger.Error().Err(err).Msg("Read availability failed")
+		e.ServerError(w, e.RespDBDataAccessFailure)
+		return
+	}
+
+	loc, err := time.LoadLocation(schedule.TimeZone)
+	if err != nil {
+		a.logger.Error().Err(err).Msg("Read availability failed")
+		e.ServerError(w, e.RespDBDataAccessFailure)
+		return
+	}
+
+	from, to, ok := parseRange(r.URL.Query(), loc)
+	if !ok {
+		e.BadRequest(w, e.RespInvalidURLParamDate)
+		return
+	}
+
+	exceptions, err := a.repository.ListExceptions(id, from, to)
+	if err != nil {
+		a.logger.Error().Err(err).Msg("Read availability failed")
+		e.ServerError(w, e.RespDBDataAccessFailure)
+		return
+	}
+
+	windows, err := schedule.Expand(exceptions, from, to)
+	if err != nil {
+		a.logger.Error().Err(err).Msg("Read availability failed")
+		e.ServerError(w, e.RespDBDataAccessFailure)
+		return
+	}
+
+	response := &AvailabilityResponse{
+		DoctorID: id,
+		TimeZone: schedule.TimeZone,
+		From:     from.In(loc),
+		To:       to.In(loc),
+		Windows:  windows,
+	}
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		a.logger.Error().Err(err).Msg("Read availability failed")
+		e.ServerError(w, e.RespJSONEncodeFailure)
+		return
+	}
+}
+
+// ReadWorkingHours godoc
+//
+//	@summary		Read working hours
+//	@description	Read the weekly working hours of an active doctor
+//	@tags			availability
+//	@accept			json
+//	@produce		json
+//	@param			id	path		string	true	"Doctor ID"
+//	@success		200	{object}	WorkingHoursResponse
+//	@failure		400	{object}	error.Error
+//	@failure		404
+//	@failure		500	{object}	error.Error
+//	@router			/doctors/{id}/working-hours [get]
+func (a *API) ReadWorkingHours(w http.ResponseWriter, r *http.Request) {
+	id, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		a.logger.Error().Err(err).Msg("Read working hours failed")
+		e.BadRequest(w, e.RespInvalidURLParamID)
+		return
+	}
+
+	doctor, ok := a.doctor(w, id)
+	if !ok {
+		return
+	}
+	if doctor.Status != users.StatusActive {
+		e.NotFound(w)
+		return
+	}
+
+	schedule, err := a.repository.GetSchedule(id)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			e.NotFound(w)
+			return
+		}
+
+		a.logger.Error().Err(err).Msg("Read working hours failed")
+		e.ServerError(w, e.RespDBDataAccessFailure)
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(schedule.ToResponse()); err != nil {
+		a.logger.Error().Err(err).Msg("Read working hours failed")
+		e.ServerError(w, e.RespJSONEncodeFailure)
+		return
+	}
+}
+
+// UpdateWorkingHours godoc
+//
+//	@summary		Update working hours
+//	@description	Replace the weekly working hours of a doctor
+//	@tags			availability
+//	@accept			json
+//	@produce		json
+//	@param			id		path	string				true	"Doctor ID"
+//	@param			body	body	WorkingHoursForm	true	"Working hours form"
+//	@success		200	{object}	WorkingHoursResponse
+//	@failure		400	{object}	error.Error
+//	@failure		403	{object}	error.Error
+//	@failure		404
+//	@failure		422	{object}	error.Errors
+//	@failure		500	{object}	error.Error
+//	@router			/doctors/{id}/working-hours [put]
+func (a *API) UpdateWorkingHours(w http.ResponseWriter, r *http.Request) {
+	id, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		a.logger.Error().Err(err).Msg("Update working hours failed")
+		e.BadRequest(w, e.RespInvalidURLParamID)
+		return
+	}
+
+	form := &WorkingHoursForm{}
+	if err := json.NewDecoder(r.Body).Decode(form); err != nil {
+		a.logger.Error().Err(err).Msg("Update working hours failed")
+		e.ServerError(w, e.RespJSONDecodeFailure)
+		return
+	}
+
+	if err := a.validator.Struct(form); err != nil {
+		a.logger.Error().Err(err).Msg("Update working hours failed")
+		respBody, err := json.Marshal(validatorUtil.ToErrResponse(err))
+		if err != nil {
+			e.ServerError(w, e.RespJSONEncodeFailure)
+			return
+		}
+
+		e.ValidationErrors(w, respBody)
+		return
+	}
+
+	if problems := form.Problems(); len(problems) > 0 {
+		respBody, err := json.Marshal(&validatorUtil.ErrResponse{Errors: problems})
+		if err != nil {
+			e.ServerError(w, e.RespJSONEncodeFailure)
+			return
+		}
+
+		e.ValidationErrors(w, respBody)
+		return
+	}
+
+	if _, ok := a.doctor(w, id); !ok {
+		return
+	}
+
+	schedule, err := a.repository.SaveSchedule(form.ToModel(id))
+	if err != nil {
+		a.logger.Error().Err(err).Msg("Update working hours failed")
+		e.ServerError(w, e.RespDBDataUpdateFailure)
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(schedule.ToResponse()); err != nil {
+		a.logger.Error().Err(err).Msg("Update working hours failed")
+		e.ServerError(w, e.RespJSONEncodeFailure)
+		return
+	}
+}
+
+// ListExceptions godoc
+//
+//	@summary		List exceptions
+//	@description	List the current and upcoming exceptions from the working hours of a doctor
+//	@tags			availability
+//	@accept			json
+//	@produce		json
+//	@param			id	path	string	true	"Doctor ID"
+//	@success		200	{array}		ExceptionResponse
+//	@failure		400	{object}	error.Error
+//	@failure		403	{object}	error.Error
+//	@failure		500	{object}	error.Error
+//	@router			/doctors/{id}/exceptions [get]
+func (a *API) ListExceptions(w http.ResponseWriter, r *http.Request) {
+	id, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		a.logger.Error().Err(err).Msg("List exceptions failed")
+		e.BadRequest(w, e.RespInvalidURLParamID)
+		return
+	}
+
+	exceptions, err := a.repository.ListUpcomingExceptions(id, Now())
+	if err != nil {
+		a.logger.Error().Err(err).Msg("List exceptions failed")
+		e.ServerError(w, e.RespDBDataAccessFailure)
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(exceptions.ToResponse()); err != nil {
+		a.logger.Error().Err(err).Msg("List exceptions failed")
+		e.ServerError(w, e.RespJSONEncodeFailure)
+		return
+	}
+}
+
+// CreateException godoc
+//
+//	@summary		Create exception
+//	@description	Add a period, e.g. a vacation, in which the doctor does not work despite the working hours
+//	@tags			availability
+//	@accept			json
+//	@produce		json
+//	@param			id		path	string			true	"Doctor ID"
+//	@param			body	body	ExceptionForm	true	"Exception form"
+//	@success		201	{object}	ExceptionResponse
+//	@failure		400	{object}	error.Error
+//	@failure		403	{object}	error.Error
+//	@failure		404
+//	@failure		422	{object}	error.Errors
+//	@failure		500	{object}	error.Error
+//	@router			/doctors/{id}/exceptions [post]
+func (a *API) CreateException(w http.ResponseWriter, r *http.Request) {
+	id, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		a.logger.Error().Err(err).Msg("Create exception failed")
+		e.BadRequest(w, e.RespInvalidURLParamID)
+		return
+	}
+
+	form := &ExceptionForm{}
+	if err := json.NewDecoder(r.Body).Decode(form); err != nil {
+		a.logger.Error().Err(err).Msg("Create exception failed")
+		e.ServerError(w, e.RespJSONDecodeFailure)
+		return
+	}
+
+	if err := a.validator.Struct(form); err != nil {
+		a.logger.Error().Err(err).Msg("Create exception failed")
+		respBody, err := json.Marshal(validatorUtil.ToErrResponse(err))
+		if err != nil {
+			e.ServerError(w, e.RespJSONEncodeFailure)
+			return
+		}
+
+		e.ValidationErrors(w, respBody)
+		return
+	}
+
+	if _, ok := a.doctor(w, id); !ok {
+		return
+	}
+
+	exception, err := a.repository.CreateException(form.ToModel(id))
+	if err != nil {
+		a.logger.Error().Err(err).Msg("Create exception failed")
+		e.ServerError(w, e.RespDBDataInsertFailure)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(exception.ToResponse()); err != nil {
+		a.logger.Error().Err(err).Msg("Create exception failed")
+		e.ServerError(w, e.RespJSONEncodeFailure)
+		return
+	}
+}
+
+// DeleteException godoc
+//
+//	@summary		Delete exception
+//	@description	Delete an exception from the working hours of a doctor
+//	@tags			availability
+//	@accept			json
+//	@produce		json
+//	@param			id			path	string	true	"Doctor ID"
+//	@param			exceptionId	path	string	true	"Exception ID"
+//	@success		200
+//	@failure		400	{object}	error.Error
+//	@failure		403	{object}	error.Error
+//	@failure		404
+//	@failure		500	{object}	error.Error
+//	@router			/doctors/{id}/exceptions/{exceptionId} [delete]
+func (a *API) DeleteException(w http.ResponseWriter, r *http.Request) {
+	id, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		a.logger.Error().Err(err).Msg("Delete exception failed")
+		e.BadRequest(w, e.RespInvalidURLParamID)
+		return
+	}
+	exceptionID, err := uuid.Parse(chi.URLParam(r, "exceptionId"))
+	if err != nil {
+		a.logger.Error().Err(err).Msg("Delete exception failed")
+		e.BadRequest(w, e.RespInvalidURLParamID)
+		return
+	}
+
+	rows, err := a.repository.DeleteException(id, exceptionID)
+	if err != nil {
+		a.logger.Error().Err(err).Msg("Delete exception failed")
+		e.ServerError(w, e.RespDBDataRemoveFailure)
+		return
+	}
+	if rows == 0 {
+		e.NotFound(w)
+		return
+	}
+}
+
+// doctor writes 404 unless the user exists and is a doctor.
+func (a *API) doctor(w http.ResponseWriter, id uuid.UUID) (*users.User, bool) {
+	user, err := a.users.Read(id)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			e.NotFound(w)
+			return nil, false
+		}
+
+		a.logger.Error().Err(err).Msg("Read user failed")
+		e.ServerError(w, e.RespDBDataAccessFailure)
+		return nil, false
+	}
+	if user.Role != users.Doctor {
+		e.NotFound(w)
+		return nil, false
+	}
+
+	return user, true
+}
+
+// parseRange reads the from and to query parameters. Dates are taken as
+// midnight in loc.
+func parseRange(query url.Values, loc *time.Location) (from, to time.Time, ok bool) {
+	from = Now()
+	if query.Has("from") {
+		if from, ok = parseTime(query.Get("from"), loc); !ok {
+			return time.Time{}, time.Time{}, false
+		}
+	}
+
+	to = from.Add(DefaultRange)
+	if query.Has("to") {
+		if to, ok = parseTime(query.Get("to"), loc); !ok {
+			return time.Time{}, time.Time{}, false
+		}
+	}
+
+	if !to.After(from) || to.Sub(from) > MaxRange {
+		return time.Time{}, time.Time{}, false
+	}
+	return from, to, true
+}
+
+func parseTime(value string, loc *time.Location) (time.Time, bool) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, true
+	}
+	if t, err := time.ParseInLocation(time.DateOnly, value, loc); err == nil {
+		return t, true
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,308 @@
+package availability
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// MaxRange limits how far availability is expanded in a single request.
+const MaxRange = 92 * 24 * time.Hour
+
+// DefaultRange is expanded when the end of the range is not given.
+const DefaultRange = 7 * 24 * time.Hour
+
+var weekdays = map[string]time.Weekday{
+	"sunday":    time.Sunday,
+	"monday":    time.Monday,
+	"tuesday":   time.Tuesday,
+	"wednesday": time.Wednesday,
+	"thursday":  time.Thursday,
+	"friday":    time.Friday,
+	"saturday":  time.Saturday,
+}
+
+type HoursForm struct {
+	Weekday string `json:"weekday" form:"required,oneof=monday tuesday wednesday thursday friday saturday sunday"`
+	Start   string `json:"start" form:"required,clock"`
+	End     string `json:"end" form:"required,clock"`
+	Clinic  string `json:"clinic" form:"max=255"`
+}
+
+// WorkingHoursForm replaces the whole weekly schedule of a doctor. Times are
+// local to the time zone.
+type WorkingHoursForm struct {
+	TimeZone string       `json:"timeZone" form:"required,timezone"`
+	Hours    []*HoursForm `json:"hours" form:"dive"`
+}
+
+type HoursResponse struct {
+	Weekday string `json:"weekday"`
+	Start   string `json:"start"`
+	End     string `json:"end"`
+	Clinic  string `json:"clinic"`
+}
+
+type WorkingHoursResponse struct {
+	TimeZone  string           `json:"timeZone"`
+	Hours     []*HoursResponse `json:"hours"`
+	UpdatedAt time.Time        `json:"updatedAt"`
+}
+
+type ExceptionForm struct {
+	StartsAt time.Time `json:"startsAt" form:"required"`
+	EndsAt   time.Time `json:"endsAt" form:"required,gtfield=StartsAt"`
+	Reason   string    `json:"reason" form:"max=255"`
+}
+
+type ExceptionResponse struct {
+	ID        uuid.UUID `json:"id"`
+	StartsAt  time.Time `json:"startsAt"`
+	EndsAt    time.Time `json:"endsAt"`
+	Reason    string    `json:"reason"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// Window is a period the doctor works in, in the time zone of the doctor.
+type Window struct {
+	Start  time.Time `json:"start"`
+	End    time.Time `json:"end"`
+	Clinic string    `json:"clinic"`
+}
+
+type AvailabilityResponse struct {
+	DoctorID uuid.UUID `json:"doctorId"`
+	TimeZone string    `json:"timeZone"`
+	From     time.Time `json:"from"`
+	To       time.Time `json:"to"`
+	Windows  []*Window `json:"windows"`
+}
+
+// Schedule holds the time zone the working hours of a doctor are given in.
+type Schedule struct {
+	UserID    uuid.UUID `gorm:"primarykey"`
+	TimeZone  string
+	UpdatedAt time.Time
+
+	Hours []*WorkingHours `gorm:"foreignKey:UserID;references:UserID"`
+}
+
+func (Schedule) TableName() string {
+	return "doctor_schedules"
+}
+
+// WorkingHours recur every week on the weekday. Minutes count from local
+// midnight, an end of 1440 is the following midnight.
+type WorkingHours struct {
+	ID          uuid.UUID `gorm:"primarykey"`
+	UserID      uuid.UUID
+	Weekday     time.Weekday
+	StartMinute int
+	EndMinute   int
+	Clinic      string
+}
+
+func (WorkingHours) TableName() string {
+	return "working_hours"
+}
+
+// Exception is a period the doctor does not work in despite the working
+// hours, e.g. a vacation.
+type Exception struct {
+	ID        uuid.UUID `gorm:"primarykey"`
+	UserID    uuid.UUID
+	StartsAt  time.Time
+	EndsAt    time.Time
+	Reason    string
+	CreatedAt time.Time
+}
+
+func (Exception) TableName() string {
+	return "availability_exceptions"
+}
+
+type Exceptions []*Exception
+
+// Problems lists hours ending before they start and hours overlapping others
+// on the same weekday.
+func (f *WorkingHoursForm) Problems() []string {
+	var problems []string
+	for i, h := range f.Hours {
+		if clockMinutes(h.End) <= clockMinutes(h.Start) {
+			problems = append(problems, fmt.Sprintf("hours[%d].end must be after start", i))
+			continue
+		}
+		for j, other := range f.Hours[:i] {
+			if other.Weekday == h.Weekday &&
+				clockMinutes(h.Start) < clockMinutes(other.End) &&
+				clockMinutes(other.Start) < clockMinutes(h.End) {
+				problems = append(problems, fmt.Sprintf("hours[%d] overlaps hours[%d]", i, j))
+			}
+		}
+	}
+	return problems
+}
+
+func (f *WorkingHoursForm) ToModel(userID uuid.UUID) *Schedule {
+	schedule := &Schedule{
+		UserID:   userID,
+		TimeZone: f.TimeZone,
+		Hours:    make([]*WorkingHours, 0, len(f.Hours)),
+	}
+	for _, h := range f.Hours {
+		schedule.Hours = append(schedule.Hours, &WorkingHours{
+			ID:          uuid.New(),
+			UserID:      userID,
+			Weekday:     weekdays[h.Weekday],
+			StartMinute: clockMinutes(h.Start),
+			EndMinute:   clockMinutes(h.End),
+			Clinic:      h.Clinic,
+		})
+	}
+	schedule.sortHours()
+
+	return schedule
+}
+
+func (s *Schedule) ToResponse() *WorkingHoursResponse {
+	response := &WorkingHoursResponse{
+		TimeZone:  s.TimeZone,
+		Hours:     make([]*HoursResponse, 0, len(s.Hours)),
+		UpdatedAt: s.UpdatedAt,
+	}
+	s.sortHours()
+	for _, h := range s.Hours {
+		response.Hours = append(response.Hours, &HoursResponse{
+			Weekday: strings.ToLower(h.Weekday.String()),
+			Start:   clock(h.StartMinute),
+			End:     clock(h.EndMinute),
+			Clinic:  h.Clinic,
+		})
+	}
+
+	return response
+}
+
+// sortHours orders the hours from Monday to Sunday.
+func (s *Schedule) sortHours() {
+	sort.SliceStable(s.Hours, func(i, j int) bool {
+		a, b := (s.Hours[i].Weekday+6)%7, (s.Hours[j].Weekday+6)%7
+		if a != b {
+			return a < b
+		}
+		return s.Hours[i].StartMinute < s.Hours[j].StartMinute
+	})
+}
+
+func (f *ExceptionForm) ToModel(userID uuid.UUID) *Exception {
+	return &Exception{
+		ID:       uuid.New(),
+		UserID:   userID,
+		StartsAt: f.StartsAt,
+		EndsAt:   f.EndsAt,
+		Reason:   f.Reason,
+	}
+}
+
+func (e *Exception) ToResponse() *ExceptionResponse {
+	return &ExceptionResponse{
+		ID:        e.ID,
+		StartsAt:  e.StartsAt,
+		EndsAt:    e.EndsAt,
+		Reason:    e.Reason,
+		CreatedAt: e.CreatedAt,
+	}
+}
+
+func (exceptions Exceptions) ToResponse() []*ExceptionResponse {
+	response := make([]*ExceptionResponse, 0, len(exceptions))
+	for _, e := range exceptions {
+		response = append(response, e.ToResponse())
+	}
+	return response
+}
+
+// Expand turns the working hours into the windows between from and to, with
+// the exceptions cut out. Hours are placed on the local calendar, so they
+// keep their wall clock times across daylight saving time changes.
+func (s *Schedule) Expand(exceptions Exceptions, from, to time.Time) ([]*Window, error) {
+	loc, err := time.LoadLocation(s.TimeZone)
+	if err != nil {
+		return nil, err
+	}
+
+	windows := []*Window{}
+	start := from.In(loc)
+	for i := 0; ; i++ {
+		day := time.Date(start.Year(), start.Month(), start.Day()+i, 0, 0, 0, 0, loc)
+		if !day.Before(to) {
+			break
+		}
+
+		for _, h := range s.Hours {
+			if h.Weekday != day.Weekday() {
+				continue
+			}
+			windowStart := time.Date(day.Year(), day.Month(), day.Day(), 0, h.StartMinute, 0, 0, loc)
+			windowEnd := time.Date(day.Year(), day.Month(), day.Day(), 0, h.EndMinute, 0, 0, loc)
+			if windowStart.Before(from) {
+				windowStart = from.In(loc)
+			}
+			if windowEnd.After(to) {
+				windowEnd = to.In(loc)
+			}
+			windows = append(windows, subtract(&Window{Start: windowStart, End: windowEnd, Clinic: h.Clinic}, exceptions)...)
+		}
+	}
+
+	sort.SliceStable(windows, func(i, j int) bool {
+		return windows[i].Start.Before(windows[j].Start)
+	})
+
+	return windows, nil
+}
+
+// subtract cuts the exceptions out of the window, leaving the non-empty rest.
+func subtract(window *Window, exceptions Exceptions) []*Window {
+	rest := []*Window{window}
+	for _, e := range exceptions {
+		var next []*Window
+		for _, w := range rest {
+			if !e.StartsAt.Before(w.End) || !e.EndsAt.After(w.Start) {
+				next = append(next, w)
+				continue
+			}
+			if e.StartsAt.After(w.Start) {
+				next = append(next, &Window{Start: w.Start, End: e.StartsAt.In(w.Start.Location()), Clinic: w.Clinic})
+			}
+			if e.EndsAt.Before(w.End) {
+				next = append(next, &Window{Start: e.EndsAt.In(w.End.Location()), End: w.End, Clinic: w.Clinic})
+			}
+		}
+		rest = next
+	}
+
+	nonEmpty := make([]*Window, 0, len(rest))
+	for _, w := range rest {
+		if w.End.After(w.Start) {
+			nonEmpty = append(nonEmpty, w)
+		}
+	}
+	return nonEmpty
+}
+
+// clockMinutes converts a validated HH:MM time to minutes since midnight.
+func clockMinutes(clock string) int {
+	var hours, minutes int
+	if _, err := fmt.Sscanf(clock, "%d:%d", &hours, &minutes); err != nil {
+		return 0
+	}
+	return hours*60 + minutes
+}
+
+func clock(minutes int) string {
+	return fmt.Sprintf("%02d:%02d", minutes/60, minutes%60)
+}
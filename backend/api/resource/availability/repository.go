@@ -0,0 +1,91 @@
+package availability
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type Repository struct {
+	db *gorm.DB
+}
+
+func NewRepository(db *gorm.DB) *Repository {
+	return &Repository{
+		db: db,
+	}
+}
+
+func (r *Repository) GetSchedule(userID uuid.UUID) (*Schedule, error) {
+	schedule := &Schedule{}
+	if err := r.db.Preload("Hours").Where("user_id = ?", userID).First(schedule).Error; err != nil {
+		return nil, err
+	}
+
+	return schedule, nil
+}
+
+// SaveSchedule creates the schedule or replaces the existing one together with
+// its working hours.
+func (r *Repository) SaveSchedule(schedule *Schedule) (*Schedule, error) {
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Omit(clause.Associations).Clauses(clause.OnConflict{UpdateAll: true}).Create(schedule).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("user_id = ?", schedule.UserID).Delete(&WorkingHours{}).Error; err != nil {
+			return err
+		}
+		if len(schedule.Hours) == 0 {
+			return nil
+		}
+
+		return tx.Create(schedule.Hours).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return schedule, nil
+}
+
+// ListExceptions returns the exceptions of the doctor overlapping the period
+// from from to to.
+func (r *Repository) ListExceptions(userID uuid.UUID, from, to time.Time) (Exceptions, error) {
+	var exceptions Exceptions
+	if err := r.db.Where("user_id = ? AND starts_at < ? AND ends_at > ?", userID, to, from).
+		Order("starts_at").
+		Find(&exceptions).Error; err != nil {
+		return nil, err
+	}
+
+	return exceptions, nil
+}
+
+func (r *Repository) CreateException(exception *Exception) (*Exception, error) {
+	if err := r.db.Create(exception).Error; err != nil {
+		return nil, err
+	}
+
+	return exception, nil
+}
+
+func (r *Repository) DeleteException(userID, id uuid.UUID) (int64, error) {
+	result := r.db.Where("id = ? AND user_id = ?", id, userID).Delete(&Exception{})
+
+	return result.RowsAffected, result.Error
+}
+
+// ListUpcomingExceptions returns the exceptions of the doctor that have not
+// ended yet.
+func (r *Repository) ListUpcomingExceptions(userID uuid.UUID, now time.Time) (Exceptions, error) {
+	var exceptions Exceptions
+	if err := r.db.Where("user_id = ? AND ends_at > ?", userID, now).
+		Order("starts_at").
+		Find(&exceptions).Error; err != nil {
+		return nil, err
+	}
+
+	return exceptions, nil
+}
@@ -0,0 +1,399 @@
+package careteam
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/go-chi/chi"
+	"github.com/go-playground/validator/v10"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog"
+	"gorm.io/gorm"
+
+	"backend/api/resource/audit"
+	e "backend/api/resource/common/error"
+	"backend/api/resource/common/policy"
+	"backend/api/resource/users"
+	validatorUtil "backend/utils/validator"
+)
+
+type API struct {
+	repository *Repository
+	users      *users.Repository
+	validator  *validator.Validate
+	logger     *zerolog.Logger
+}
+
+func New(l *zerolog.Logger, db *gorm.DB, v *validator.Validate) *API {
+	return &API{
+		repository: NewRepository(db),
+		users:      users.NewRepository(db),
+		validator:  v,
+		logger:     l,
+	}
+}
+
+// ListDoctors godoc
+//
+//	@summary		List doctors of patient
+//	@description	List the care team of a patient, including relationships still waiting for consent
+//	@tags			care-team
+//	@accept			json
+//	@produce		json
+//	@param			id	path	string	true	"Patient ID"
+//	@success		200	{array}		RelationshipResponse
+//	@failure		400	{object}	error.Error
+//	@failure		403	{object}	error.Error
+//	@failure		404
+//	@failure		500	{object}	error.Error
+//	@router			/users/{id}/doctors [get]
+func (a *API) ListDoctors(w http.ResponseWriter, r *http.Request) {
+	id, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		a.logger.Error().Err(err).Msg("List doctors of patient failed")
+		e.BadRequest(w, e.RespInvalidURLParamID)
+		return
+	}
+
+	if _, ok := a.hasRole(w, id, users.Patient); !ok {
+		return
+	}
+
+	relationships, err := a.repository.ListDoctors(id, Now())
+	if err != nil {
+		a.logger.Error().Err(err).Msg("List doctors of patient failed")
+		e.ServerError(w, e.RespDBDataAccessFailure)
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(relationships.ToResponse()); err != nil {
+		a.logger.Error().Err(err).Msg("List doctors of patient failed")
+		e.ServerError(w, e.RespJSONEncodeFailure)
+		return
+	}
+}
+
+// AddDoctor godoc
+//
+//	@summary		Add doctor to patient
+//	@description	Add a doctor to the care team of a patient. Consent is granted when the patient adds the doctor, otherwise the patient has to grant it.
+//	@tags			care-team
+//	@accept			json
+//	@produce		json
+//	@param			id		path	string	true	"Patient ID"
+//	@param			body	body	Form	true	"Care relationship form"
+//	@success		201	{object}	RelationshipResponse
+//	@failure		400	{object}	error.Error
+//	@failure		403	{object}	error.Error
+//	@failure		404
+//	@failure		409
+//	@failure		422	{object}	error.Errors
+//	@failure		500	{object}	error.Error
+//	@router			/users/{id}/doctors [post]
+func (a *API) AddDoctor(w http.ResponseWriter, r *http.Request) {
+	id, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		a.logger.Error().Err(err).Msg("Add doctor to patient failed")
+		e.BadRequest(w, e.RespInvalidURLParamID)
+		return
+	}
+	audit.Record(r.Context(), "care_relationship.create", "care_relationship", "", nil, nil)
+
+	form := &Form{}
+	if err := json.NewDecoder(r.Body).Decode(form); err != nil {
+		a.logger.Error().Err(err).Msg("Add doctor to patient failed")
+		e.ServerError(w, e.RespJSONDecodeFailure)
+		return
+	}
+
+	if err := a.validator.Struct(form); err != nil {
+		a.logger.Error().Err(err).Msg("Add doctor to patient failed")
+		respBody, err := json.Marshal(validatorUtil.ToErrResponse(err))
+		if err != nil {
+			e.ServerError(w, e.RespJSONEncodeFailure)
+			return
+		}
+
+		e.ValidationErrors(w, respBody)
+		return
+	}
+
+	now := Now()
+	if form.EndsAt != nil && !form.EndsAt.After(now) {
+		validationError(w, "endsAt must be in the future")
+		return
+	}
+
+	patient, ok := a.hasRole(w, id, users.Patient)
+	if !ok {
+		return
+	}
+
+	doctor, err := a.users.Read(form.DoctorID)
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		a.logger.Error().Err(err).Msg("Add doctor to patient failed")
+		e.ServerError(w, e.RespDBDataAccessFailure)
+		return
+	}
+	if doctor == nil || doctor.Role != users.Doctor || doctor.Status != users.StatusActive {
+		validationError(w, "doctorId must be an active doctor")
+		return
+	}
+
+	_, err = a.repository.GetCurrent(id, form.DoctorID, now)
+	if err == nil {
+		http.Error(w, "Doctor is already in the care team!", http.StatusConflict)
+		return
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		a.logger.Error().Err(err).Msg("Add doctor to patient failed")
+		e.ServerError(w, e.RespDBDataAccessFailure)
+		return
+	}
+
+	relationship, err := a.repository.Create(form.ToModel(id, isPatient(r, id), now))
+	if err != nil {
+		a.logger.Error().Err(err).Msg("Add doctor to patient failed")
+		e.ServerError(w, e.RespDBDataInsertFailure)
+		return
+	}
+	relationship.Patient = patient
+	relationship.Doctor = doctor
+
+	w.WriteHeader(http.StatusCreated)
+	response := relationship.ToResponse()
+	audit.Record(r.Context(), "care_relationship.create", "care_relationship", relationship.ID.String(), nil, response)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		a.logger.Error().Err(err).Msg("Add doctor to patient failed")
+		e.ServerError(w, e.RespJSONEncodeFailure)
+		return
+	}
+}
+
+// UpdateDoctor godoc
+//
+//	@summary		Update care relationship
+//	@description	Change the primary physician flag or consent status. Only the patient can grant consent.
+//	@tags			care-team
+//	@accept			json
+//	@produce		json
+//	@param			id			path	string		true	"Patient ID"
+//	@param			doctorId	path	string		true	"Doctor ID"
+//	@param			body		body	UpdateForm	true	"Care relationship update form"
+//	@success		200	{object}	RelationshipResponse
+//	@failure		400	{object}	error.Error
+//	@failure		403	{object}	error.Error
+//	@failure		404
+//	@failure		422	{object}	error.Errors
+//	@failure		500	{object}	error.Error
+//	@router			/users/{id}/doctors/{doctorId} [patch]
+func (a *API) UpdateDoctor(w http.ResponseWriter, r *http.Request) {
+	id, doctorID, ok := a.parseIDs(w, r, "Update care relationship failed")
+	if !ok {
+		return
+	}
+	audit.Record(r.Context(), "care_relationship.update", "care_relationship", "", nil, nil)
+
+	form := &UpdateForm{}
+	if err := json.NewDecoder(r.Body).Decode(form); err != nil {
+		a.logger.Error().Err(err).Msg("Update care relationship failed")
+		e.ServerError(w, e.RespJSONDecodeFailure)
+		return
+	}
+
+	if err := a.validator.Struct(form); err != nil {
+		a.logger.Error().Err(err).Msg("Update care relationship failed")
+		respBody, err := json.Marshal(validatorUtil.ToErrResponse(err))
+		if err != nil {
+			e.ServerError(w, e.RespJSONEncodeFailure)
+			return
+		}
+
+		e.ValidationErrors(w, respBody)
+		return
+	}
+
+	if ConsentStatus(form.ConsentStatus) == ConsentGranted && !isPatient(r, id) {
+		a.logger.Error().Msg("Only the patient can grant consent")
+		e.Forbidden(w)
+		return
+	}
+
+	now := Now()
+	relationship, err := a.repository.GetCurrent(id, doctorID, now)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			e.NotFound(w)
+			return
+		}
+
+		a.logger.Error().Err(err).Msg("Update care relationship failed")
+		e.ServerError(w, e.RespDBDataAccessFailure)
+		return
+	}
+
+	before := relationship.ToResponse()
+	if form.PrimaryPhysician != nil {
+		relationship.PrimaryPhysician = *form.PrimaryPhysician
+	}
+	if form.ConsentStatus != "" {
+		relationship.ConsentStatus = ConsentStatus(form.ConsentStatus)
+	}
+
+	if err := a.repository.Update(relationship, now); err != nil {
+		a.logger.Error().Err(err).Msg("Update care relationship failed")
+		e.ServerError(w, e.RespDBDataUpdateFailure)
+		return
+	}
+
+	response := relationship.ToResponse()
+	audit.Record(r.Context(), "care_relationship.update", "care_relationship", relationship.ID.String(), before, response)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		a.logger.Error().Err(err).Msg("Update care relationship failed")
+		e.ServerError(w, e.RespJSONEncodeFailure)
+		return
+	}
+}
+
+// RemoveDoctor godoc
+//
+//	@summary		Remove doctor from patient
+//	@description	End the care relationship of a patient and doctor. It is kept for the record.
+//	@tags			care-team
+//	@accept			json
+//	@produce		json
+//	@param			id			path	string	true	"Patient ID"
+//	@param			doctorId	path	string	true	"Doctor ID"
+//	@success		200
+//	@failure		400	{object}	error.Error
+//	@failure		403	{object}	error.Error
+//	@failure		404
+//	@failure		500	{object}	error.Error
+//	@router			/users/{id}/doctors/{doctorId} [delete]
+func (a *API) RemoveDoctor(w http.ResponseWriter, r *http.Request) {
+	id, doctorID, ok := a.parseIDs(w, r, "Remove doctor from patient failed")
+	if !ok {
+		return
+	}
+	audit.Record(r.Context(), "care_relationship.end", "care_relationship", "", nil, nil)
+
+	now := Now()
+	relationship, err := a.repository.GetCurrent(id, doctorID, now)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			e.NotFound(w)
+			return
+		}
+
+		a.logger.Error().Err(err).Msg("Remove doctor from patient failed")
+		e.ServerError(w, e.RespDBDataAccessFailure)
+		return
+	}
+
+	if _, err := a.repository.End(relationship.ID, now); err != nil {
+		a.logger.Error().Err(err).Msg("Remove doctor from patient failed")
+		e.ServerError(w, e.RespDBDataRemoveFailure)
+		return
+	}
+
+	ended := *relationship
+	ended.EndedAt = &now
+	ended.PrimaryPhysician = false
+	audit.Record(r.Context(), "care_relationship.end", "care_relationship", relationship.ID.String(), relationship.ToResponse(), ended.ToResponse())
+}
+
+// ListPatients godoc
+//
+//	@summary		List patients of doctor
+//	@description	List the patients who consented to be treated by a doctor
+//	@tags			care-team
+//	@accept			json
+//	@produce		json
+//	@param			id	path	string	true	"Doctor ID"
+//	@success		200	{array}		RelationshipResponse
+//	@failure		400	{object}	error.Error
+//	@failure		403	{object}	error.Error
+//	@failure		404
+//	@failure		500	{object}	error.Error
+//	@router			/users/{id}/patients [get]
+func (a *API) ListPatients(w http.ResponseWriter, r *http.Request) {
+	id, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		a.logger.Error().Err(err).Msg("List patients of doctor failed")
+		e.BadRequest(w, e.RespInvalidURLParamID)
+		return
+	}
+
+	if _, ok := a.hasRole(w, id, users.Doctor); !ok {
+		return
+	}
+
+	relationships, err := a.repository.ListPatients(id, Now())
+	if err != nil {
+		a.logger.Error().Err(err).Msg("List patients of doctor failed")
+		e.ServerError(w, e.RespDBDataAccessFailure)
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(relationships.ToResponse()); err != nil {
+		a.logger.Error().Err(err).Msg("List patients of doctor failed")
+		e.ServerError(w, e.RespJSONEncodeFailure)
+		return
+	}
+}
+
+// hasRole writes 404 unless the user exists and has the role.
+func (a *API) hasRole(w http.ResponseWriter, id uuid.UUID, role users.Role) (*users.User, bool) {
+	user, err := a.users.Read(id)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			e.NotFound(w)
+			return nil, false
+		}
+
+		a.logger.Error().Err(err).Msg("Read user failed")
+		e.ServerError(w, e.RespDBDataAccessFailure)
+		return nil, false
+	}
+	if user.Role != role {
+		e.NotFound(w)
+		return nil, false
+	}
+
+	return user, true
+}
+
+func (a *API) parseIDs(w http.ResponseWriter, r *http.Request, msg string) (uuid.UUID, uuid.UUID, bool) {
+	id, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		a.logger.Error().Err(err).Msg(msg)
+		e.BadRequest(w, e.RespInvalidURLParamID)
+		return uuid.Nil, uuid.Nil, false
+	}
+	doctorID, err := uuid.Parse(chi.URLParam(r, "doctorId"))
+	if err != nil {
+		a.logger.Error().Err(err).Msg(msg)
+		e.BadRequest(w, e.RespInvalidURLParamID)
+		return uuid.Nil, uuid.Nil, false
+	}
+
+	return id, doctorID, true
+}
+
+// isPatient reports whether the request is made by the patient themselves
+// rather than an admin or a service.
+func isPatient(r *http.Request, patientID uuid.UUID) bool {
+	identity, ok := policy.IdentityFrom(r.Context())
+	return ok && identity.ID == patientID.String()
+}
+
+func validationError(w http.ResponseWriter, msg string) {
+	respBody, err := json.Marshal(&validatorUtil.ErrResponse{Errors: []string{msg}})
+	if err != nil {
+		e.ServerError(w, e.RespJSONEncodeFailure)
+		return
+	}
+
+	e.ValidationErrors(w, respBody)
+}
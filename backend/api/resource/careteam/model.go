@@ -0,0 +1,118 @@
+package careteam
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+
+	"backend/api/resource/users"
+)
+
+// ConsentStatus tells whether the patient agreed to be treated by the doctor.
+// Only relationships the patient granted consent to give the doctor access.
+type ConsentStatus string
+
+const (
+	// ConsentPending is the status of relationships added on behalf of the
+	// patient, e.g. by an admin, until the patient grants consent.
+	ConsentPending   ConsentStatus = "pending"
+	ConsentGranted   ConsentStatus = "granted"
+	ConsentWithdrawn ConsentStatus = "withdrawn"
+)
+
+type Form struct {
+	DoctorID         uuid.UUID `json:"doctorId" form:"required"`
+	PrimaryPhysician bool      `json:"primaryPhysician"`
+	// EndsAt limits the relationship, e.g. to a hospital stay.
+	EndsAt *time.Time `json:"endsAt"`
+}
+
+type UpdateForm struct {
+	PrimaryPhysician *bool  `json:"primaryPhysician"`
+	ConsentStatus    string `json:"consentStatus" form:"omitempty,oneof=granted withdrawn"`
+}
+
+type PersonResponse struct {
+	ID    uuid.UUID `json:"id"`
+	Name  string    `json:"name"`
+	Email string    `json:"email"`
+}
+
+type RelationshipResponse struct {
+	ID               uuid.UUID       `json:"id"`
+	Patient          *PersonResponse `json:"patient"`
+	Doctor           *PersonResponse `json:"doctor"`
+	PrimaryPhysician bool            `json:"primaryPhysician"`
+	ConsentStatus    ConsentStatus   `json:"consentStatus"`
+	StartedAt        time.Time       `json:"startedAt"`
+	EndedAt          *time.Time      `json:"endedAt"`
+}
+
+// Relationship links a patient to a doctor treating them.
+type Relationship struct {
+	ID               uuid.UUID `gorm:"primarykey"`
+	PatientID        uuid.UUID
+	DoctorID         uuid.UUID
+	PrimaryPhysician bool
+	ConsentStatus    ConsentStatus
+	StartedAt        time.Time
+	EndedAt          *time.Time
+	CreatedAt        time.Time
+
+	Patient *users.User `gorm:"foreignKey:PatientID"`
+	Doctor  *users.User `gorm:"foreignKey:DoctorID"`
+}
+
+func (Relationship) TableName() string {
+	return "care_relationships"
+}
+
+type Relationships []*Relationship
+
+// ToModel creates the relationship. Consent is granted right away when the
+// patient adds the doctor themselves.
+func (f *Form) ToModel(patientID uuid.UUID, byPatient bool, now time.Time) *Relationship {
+	consent := ConsentPending
+	if byPatient {
+		consent = ConsentGranted
+	}
+
+	return &Relationship{
+		ID:               uuid.New(),
+		PatientID:        patientID,
+		DoctorID:         f.DoctorID,
+		PrimaryPhysician: f.PrimaryPhysician,
+		ConsentStatus:    consent,
+		StartedAt:        now,
+		EndedAt:          f.EndsAt,
+	}
+}
+
+func (r *Relationship) ToResponse() *RelationshipResponse {
+	return &RelationshipResponse{
+		ID:               r.ID,
+		Patient:          toPerson(r.PatientID, r.Patient),
+		Doctor:           toPerson(r.DoctorID, r.Doctor),
+		PrimaryPhysician: r.PrimaryPhysician,
+		ConsentStatus:    r.ConsentStatus,
+		StartedAt:        r.StartedAt,
+		EndedAt:          r.EndedAt,
+	}
+}
+
+func (relationships Relationships) ToResponse() []*RelationshipResponse {
+	response := make([]*RelationshipResponse, 0, len(relationships))
+	for _, r := range relationships {
+		response = append(response, r.ToResponse())
+	}
+	return response
+}
+
+func toPerson(id uuid.UUID, user *users.User) *PersonResponse {
+	person := &PersonResponse{ID: id}
+	if user != nil {
+		person.Name = user.Name
+		person.Email = user.Email
+	}
+	return person
+}
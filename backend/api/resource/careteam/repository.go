@@ -0,0 +1,149 @@
+package careteam
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+var Now = time.Now
+
+type Repository struct {
+	db *gorm.DB
+}
+
+func NewRepository(db *gorm.DB) *Repository {
+	return &Repository{
+		db: db,
+	}
+}
+
+// ListDoctors returns the relationships of the patient that have not ended,
+// whatever their consent status, primary physician first.
+func (r *Repository) ListDoctors(patientID uuid.UUID, now time.Time) (Relationships, error) {
+	var relationships Relationships
+	if err := r.db.Scopes(current(now)).
+		Preload("Patient").
+		Preload("Doctor").
+		Where("patient_id = ?", patientID).
+		Order("primary_physician DESC, started_at").
+		Find(&relationships).Error; err != nil {
+		return nil, err
+	}
+
+	return relationships, nil
+}
+
+// ListPatients returns the relationships the doctor may treat patients in.
+func (r *Repository) ListPatients(doctorID uuid.UUID, now time.Time) (Relationships, error) {
+	var relationships Relationships
+	if err := r.db.Scopes(active(now)).
+		Preload("Patient").
+		Preload("Doctor").
+		Where("doctor_id = ?", doctorID).
+		Order("started_at").
+		Find(&relationships).Error; err != nil {
+		return nil, err
+	}
+
+	return relationships, nil
+}
+
+// GetCurrent returns the relationship of the patient and doctor that has not
+// ended.
+func (r *Repository) GetCurrent(patientID, doctorID uuid.UUID, now time.Time) (*Relationship, error) {
+	relationship := &Relationship{}
+	if err := r.db.Scopes(current(now)).
+		Preload("Patient").
+		Preload("Doctor").
+		Where("patient_id = ? AND doctor_id = ?", patientID, doctorID).
+		First(relationship).Error; err != nil {
+		return nil, err
+	}
+
+	return relationship, nil
+}
+
+// Create adds the relationship. A new primary physician replaces the previous
+// one.
+func (r *Repository) Create(relationship *Relationship) (*Relationship, error) {
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		if relationship.PrimaryPhysician {
+			if err := clearPrimary(tx, relationship, relationship.StartedAt); err != nil {
+				return err
+			}
+		}
+
+		return tx.Omit("Patient", "Doctor").Create(relationship).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return relationship, nil
+}
+
+// Update saves the primary physician flag and consent status of the
+// relationship.
+func (r *Repository) Update(relationship *Relationship, now time.Time) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		if relationship.PrimaryPhysician {
+			if err := clearPrimary(tx, relationship, now); err != nil {
+				return err
+			}
+		}
+
+		return tx.Model(&Relationship{}).
+			Where("id = ?", relationship.ID).
+			Updates(map[string]any{
+				"primary_physician": relationship.PrimaryPhysician,
+				"consent_status":    relationship.ConsentStatus,
+			}).Error
+	})
+}
+
+// End ends the relationship, which is kept for the record.
+func (r *Repository) End(id uuid.UUID, now time.Time) (int64, error) {
+	result := r.db.Model(&Relationship{}).
+		Where("id = ?", id).
+		Updates(map[string]any{"ended_at": now, "primary_physician": false})
+
+	return result.RowsAffected, result.Error
+}
+
+// IsPatientOf reports whether the patient consented to be treated by the
+// doctor and the relationship has not ended.
+func (r *Repository) IsPatientOf(patientID, doctorID uuid.UUID) (bool, error) {
+	var count int64
+	if err := r.db.Model(&Relationship{}).
+		Scopes(active(Now())).
+		Where("patient_id = ? AND doctor_id = ?", patientID, doctorID).
+		Count(&count).Error; err != nil {
+		return false, err
+	}
+
+	return count > 0, nil
+}
+
+func clearPrimary(tx *gorm.DB, relationship *Relationship, now time.Time) error {
+	return tx.Model(&Relationship{}).
+		Scopes(current(now)).
+		Where("patient_id = ? AND id <> ? AND primary_physician", relationship.PatientID, relationship.ID).
+		Update("primary_physician", false).Error
+}
+
+// current limits to relationships that have not ended.
+func current(now time.Time) func(db *gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		return db.Where("ended_at IS NULL OR ended_at > ?", now)
+	}
+}
+
+// active limits to relationships that have not ended and the patient
+// consented to.
+func active(now time.Time) func(db *gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		return db.Scopes(current(now)).Where("consent_status = ? AND started_at <= ?", ConsentGranted, now)
+	}
+}
@@ -13,10 +13,19 @@ var (
 
 	RespJSONEncodeFailure = []byte(`{"error": "json encode failure"}`)
 	RespJSONDecodeFailure = []byte(`{"error": "json decode failure"}`)
+	RespInvalidPatch      = []byte(`{"error": "invalid patch document"}`)
 
-	RespInvalidURLParamID = []byte(`{"error": "invalid url param-id"}`)
+	RespInvalidURLParamID     = []byte(`{"error": "invalid url param-id"}`)
+	RespMissingFormToken      = []byte(`{"error": "missing form param-token"}`)
+	RespInvalidURLParamRole   = []byte(`{"error": "invalid url param-role"}`)
+	RespInvalidURLParamDate   = []byte(`{"error": "invalid url param-from or param-to"}`)
+	RespInvalidURLParamCursor = []byte(`{"error": "invalid url param-cursor"}`)
 
 	RespSessionAccessFailure = []byte(`{"error": "session access failure"}`)
+	RespForbidden            = []byte(`{"error": "forbidden"}`)
+
+	RespTokenGenerateFailure = []byte(`{"error": "token generate failure"}`)
+	RespInvalidToken         = []byte(`{"error": "invalid or expired token"}`)
 )
 
 type Error struct {
@@ -41,6 +50,13 @@ func BadRequest(w http.ResponseWriter, error []byte) {
 	}
 }
 
+func Forbidden(w http.ResponseWriter) {
+	w.WriteHeader(http.StatusForbidden)
+	if _, err := w.Write(RespForbidden); err != nil {
+		log.Fatalf("Write failed: %s", err)
+	}
+}
+
 func NotFound(w http.ResponseWriter) {
 	w.WriteHeader(http.StatusNotFound)
 }
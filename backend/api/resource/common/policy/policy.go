@@ -0,0 +1,242 @@
+package policy
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/go-chi/chi"
+	"github.com/google/uuid"
+
+	"backend/api/resource/apikeys"
+	e "backend/api/resource/common/error"
+)
+
+type Permission string
+
+const (
+	UsersList        Permission = "users:list"
+	UsersRead        Permission = "users:read"
+	UsersUpdate      Permission = "users:update"
+	UsersPassword    Permission = "users:password"
+	UsersDelete      Permission = "users:delete"
+	UsersRole        Permission = "users:role"
+	UsersUnlock      Permission = "users:unlock"
+	UsersStatus      Permission = "users:status"
+	UsersCreateStaff Permission = "users:create-staff"
+	UsersCreateAdmin Permission = "users:create-admin"
+	UsersInvite      Permission = "users:invite"
+	UsersSessions    Permission = "users:sessions"
+	ProfileRead      Permission = "patient-profile:read"
+	ProfileUpdate    Permission = "patient-profile:update"
+	DoctorsManage    Permission = "doctors:manage"
+	ScheduleManage   Permission = "schedule:manage"
+	CareTeamRead     Permission = "care-team:read"
+	CareTeamManage   Permission = "care-team:manage"
+	PatientsList     Permission = "patients:list"
+	APIKeysManage    Permission = "api-keys:manage"
+	ClientsManage    Permission = "clients:manage"
+	ProvidersManage  Permission = "identity-providers:manage"
+	TwoFactorManage  Permission = "2fa:manage"
+	AuthIntrospect   Permission = "auth:introspect"
+	AuditRead        Permission = "audit:read"
+)
+
+// Grant tells on whose accounts a role holds a permission.
+type Grant int
+
+const (
+	None Grant = iota
+	// Own allows acting on the caller's own account only.
+	Own
+	// Patients allows acting on the caller's own account and on the accounts
+	// of patients the caller treats.
+	Patients
+	// Any allows acting on every account.
+	Any
+)
+
+const (
+	rolePatient = "patient"
+	roleDoctor  = "doctor"
+	roleAdmin   = "admin"
+)
+
+var roles = map[string]map[Permission]Grant{
+	rolePatient: {
+		UsersRead:      Own,
+		UsersUpdate:    Own,
+		UsersPassword:  Own,
+		ProfileRead:    Own,
+		ProfileUpdate:  Own,
+		CareTeamRead:   Own,
+		CareTeamManage: Own,
+	},
+	roleDoctor: {
+		UsersRead:      Patients,
+		UsersUpdate:    Own,
+		UsersPassword:  Own,
+		ProfileRead:    Patients,
+		ProfileUpdate:  Patients,
+		ScheduleManage: Own,
+		PatientsList:   Own,
+	},
+	roleAdmin: {
+		UsersList:        Any,
+		UsersRead:        Any,
+		UsersUpdate:      Any,
+		UsersPassword:    Any,
+		UsersDelete:      Any,
+		UsersRole:        Any,
+		UsersUnlock:      Any,
+		UsersStatus:      Any,
+		UsersCreateStaff: Any,
+		UsersInvite:      Any,
+		UsersSessions:    Any,
+		ProfileRead:      Any,
+		ProfileUpdate:    Any,
+		DoctorsManage:    Any,
+		ScheduleManage:   Any,
+		CareTeamRead:     Any,
+		CareTeamManage:   Any,
+		PatientsList:     Any,
+		APIKeysManage:    Any,
+		ClientsManage:    Any,
+		ProvidersManage:  Any,
+		TwoFactorManage:  Any,
+		AuthIntrospect:   Any,
+		AuditRead:        Any,
+	},
+}
+
+// scopes lists the API key scope needed for each permission. A key holding the
+// scope is granted the permission on every account.
+var scopes = map[Permission]string{
+	UsersList:        apikeys.ScopeUsersRead,
+	UsersRead:        apikeys.ScopeUsersRead,
+	UsersUpdate:      apikeys.ScopeUsersWrite,
+	UsersPassword:    apikeys.ScopeUsersWrite,
+	UsersDelete:      apikeys.ScopeUsersAdmin,
+	UsersRole:        apikeys.ScopeUsersAdmin,
+	UsersUnlock:      apikeys.ScopeUsersAdmin,
+	UsersStatus:      apikeys.ScopeUsersAdmin,
+	UsersCreateStaff: apikeys.ScopeUsersAdmin,
+	UsersCreateAdmin: apikeys.ScopeUsersAdmin,
+	UsersInvite:      apikeys.ScopeUsersAdmin,
+	UsersSessions:    apikeys.ScopeUsersAdmin,
+	ProfileRead:      apikeys.ScopeUsersRead,
+	ProfileUpdate:    apikeys.ScopeUsersWrite,
+	DoctorsManage:    apikeys.ScopeUsersAdmin,
+	ScheduleManage:   apikeys.ScopeUsersWrite,
+	CareTeamRead:     apikeys.ScopeUsersRead,
+	CareTeamManage:   apikeys.ScopeUsersWrite,
+	PatientsList:     apikeys.ScopeUsersRead,
+	APIKeysManage:    apikeys.ScopeUsersAdmin,
+	ClientsManage:    apikeys.ScopeUsersAdmin,
+	ProvidersManage:  apikeys.ScopeUsersAdmin,
+	TwoFactorManage:  apikeys.ScopeUsersAdmin,
+	AuthIntrospect:   apikeys.ScopeUsersRead,
+	AuditRead:        apikeys.ScopeUsersAdmin,
+}
+
+// Identity is the user a request is made on behalf of.
+type Identity struct {
+	ID    string
+	Email string
+	Role  string
+	// SessionID is the login session the request belongs to.
+	SessionID string
+}
+
+type identityKey struct{}
+
+func WithIdentity(ctx context.Context, identity *Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, identity)
+}
+
+func IdentityFrom(ctx context.Context) (*Identity, bool) {
+	identity, ok := ctx.Value(identityKey{}).(*Identity)
+	return identity, ok
+}
+
+// CareTeam tells whether a doctor treats a patient.
+type CareTeam interface {
+	IsPatientOf(patientID, doctorID uuid.UUID) (bool, error)
+}
+
+type Policy struct {
+	careTeam CareTeam
+}
+
+func New(c CareTeam) *Policy {
+	return &Policy{careTeam: c}
+}
+
+// Can reports whether the caller holds perm on every account, which is what
+// actions without a target account (e.g. creating a doctor) require.
+func Can(ctx context.Context, perm Permission) bool {
+	if key, ok := apikeys.FromContext(ctx); ok {
+		scope, ok := scopes[perm]
+		return ok && key.HasScope(scope)
+	}
+
+	identity, ok := IdentityFrom(ctx)
+	return ok && roles[identity.Role][perm] == Any
+}
+
+// Allows reports whether the caller holds perm on the account with the given
+// id.
+func (p *Policy) Allows(ctx context.Context, perm Permission, target string) (bool, error) {
+	if Can(ctx, perm) {
+		return true, nil
+	}
+
+	identity, ok := IdentityFrom(ctx)
+	if !ok {
+		return false, nil
+	}
+
+	switch roles[identity.Role][perm] {
+	case Own:
+		return target == identity.ID, nil
+	case Patients:
+		if target == identity.ID {
+			return true, nil
+		}
+		return p.treats(identity.ID, target)
+	default:
+		return false, nil
+	}
+}
+
+func (p *Policy) treats(doctor, patient string) (bool, error) {
+	doctorID, err := uuid.Parse(doctor)
+	if err != nil {
+		return false, nil
+	}
+
+	patientID, err := uuid.Parse(patient)
+	if err != nil {
+		return false, nil
+	}
+
+	return p.careTeam.IsPatientOf(patientID, doctorID)
+}
+
+// Require rejects requests whose caller does not hold perm on the account
+// named by the {id} URL parameter, or on every account for routes without it.
+func (p *Policy) Require(perm Permission) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			allowed, err := p.Allows(r.Context(), perm, chi.URLParam(r, "id"))
+			if err != nil {
+				e.ServerError(w, e.RespDBDataAccessFailure)
+				return
+			}
+			if !allowed {
+				e.Forbidden(w)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,475 @@
+package federation
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/go-playground/validator/v10"
+	"github.com/google/uuid"
+	"github.com/gorilla/sessions"
+	"github.com/rs/zerolog"
+	"gorm.io/gorm"
+
+	"backend/api/resource/audit"
+	e "backend/api/resource/common/error"
+	"backend/api/resource/common/policy"
+	"backend/api/resource/users"
+	"backend/utils/oidcclient"
+	"backend/utils/sessionstore"
+	validatorUtil "backend/utils/validator"
+)
+
+// Session values of a sign in in progress at a provider.
+var stateKeys = []string{"fedProvider", "fedState", "fedNonce", "fedVerifier", "fedReturnTo", "fedAt"}
+
+type API struct {
+	repository *Repository
+	users      *users.API
+	store      sessionstore.Store
+	client     *oidcclient.Client
+	validator  *validator.Validate
+	logger     *zerolog.Logger
+	config     *Config
+}
+
+func New(l *zerolog.Logger, db *gorm.DB, v *validator.Validate, s sessionstore.Store, u *users.API, oc *oidcclient.Client, c *Config) *API {
+	if oc == nil {
+		oc = oidcclient.New(nil, time.Hour)
+	}
+	if c == nil {
+		c = &DefaultConfig
+	}
+
+	return &API{
+		repository: NewRepository(db),
+		users:      u,
+		store:      s,
+		client:     oc,
+		validator:  v,
+		logger:     l,
+		config:     c,
+	}
+}
+
+// List godoc
+//
+//	@summary		List identity providers
+//	@description	List the upstream OpenID Connect providers users can sign in with
+//	@tags			identity-providers
+//	@accept			json
+//	@produce		json
+//	@success		200	{array}		ProviderResponse
+//	@failure		403	{object}	error.Error
+//	@failure		500	{object}	error.Error
+//	@router			/identity-providers [get]
+func (a *API) List(w http.ResponseWriter, _ *http.Request) {
+	providers, err := a.repository.List()
+	if err != nil {
+		a.logger.Error().Err(err).Msg("List identity providers failed")
+		e.ServerError(w, e.RespDBDataAccessFailure)
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(providers.ToResponse(a.config)); err != nil {
+		a.logger.Error().Err(err).Msg("List identity providers failed")
+		e.ServerError(w, e.RespJSONEncodeFailure)
+		return
+	}
+}
+
+// Create godoc
+//
+//	@summary		Create identity provider
+//	@description	Register an upstream OpenID Connect provider. The callbackUrl of the response has to be registered as redirect URI at the provider. Mapping a claim to the admin role requires an API key with the users:admin scope.
+//	@tags			identity-providers
+//	@accept			json
+//	@produce		json
+//	@param			body	body	ProviderForm	true	"Identity provider form"
+//	@success		201	{object}	ProviderResponse
+//	@failure		403	{object}	error.Error
+//	@failure		409
+//	@failure		422	{object}	error.Errors
+//	@failure		500	{object}	error.Error
+//	@router			/identity-providers [post]
+func (a *API) Create(w http.ResponseWriter, r *http.Request) {
+	form := &ProviderForm{}
+	if err := json.NewDecoder(r.Body).Decode(form); err != nil {
+		a.logger.Error().Err(err).Msg("Create identity provider failed")
+		e.ServerError(w, e.RespJSONDecodeFailure)
+		return
+	}
+
+	if err := a.validator.Struct(form); err != nil {
+		a.logger.Error().Err(err).Msg("Create identity provider failed")
+		respBody, err := json.Marshal(validatorUtil.ToErrResponse(err))
+		if err != nil {
+			e.ServerError(w, e.RespJSONEncodeFailure)
+			return
+		}
+
+		e.ValidationErrors(w, respBody)
+		return
+	}
+
+	for _, role := range form.Roles() {
+		perm := policy.UsersCreateStaff
+		if role == users.Admin {
+			perm = policy.UsersCreateAdmin
+		}
+		if !policy.Can(r.Context(), perm) {
+			a.logger.Error().Str("role", role.ToString()).Msg("Not allowed to map role")
+			e.Forbidden(w)
+			return
+		}
+	}
+
+	existing, err := a.repository.GetBySlug(form.Slug)
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		a.logger.Error().Err(err).Msg("Create identity provider failed")
+		e.ServerError(w, e.RespDBDataAccessFailure)
+		return
+	} else if existing != nil {
+		a.logger.Error().Msg("Identity provider already exists")
+		http.Error(w, "Identity provider already exists!", http.StatusConflict)
+		return
+	}
+
+	provider, err := a.repository.Create(form.ToModel())
+	if err != nil {
+		a.logger.Error().Err(err).Msg("Create identity provider failed")
+		e.ServerError(w, e.RespDBDataInsertFailure)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(provider.ToResponse(a.config)); err != nil {
+		a.logger.Error().Err(err).Msg("Create identity provider failed")
+		e.ServerError(w, e.RespJSONEncodeFailure)
+		return
+	}
+}
+
+// Delete godoc
+//
+//	@summary		Delete identity provider
+//	@description	Delete an identity provider and unlink its identities. Accounts without a password have to reset one to log in again.
+//	@tags			identity-providers
+//	@accept			json
+//	@produce		json
+//	@param			id	path	string	true	"Identity provider ID"
+//	@success		200
+//	@failure		400	{object}	error.Error
+//	@failure		403	{object}	error.Error
+//	@failure		404
+//	@failure		500	{object}	error.Error
+//	@router			/identity-providers/{id} [delete]
+func (a *API) Delete(w http.ResponseWriter, r *http.Request) {
+	id, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		a.logger.Error().Err(err).Msg("Delete identity provider failed")
+		e.BadRequest(w, e.RespInvalidURLParamID)
+		return
+	}
+
+	rows, err := a.repository.Delete(id)
+	if err != nil {
+		a.logger.Error().Err(err).Msg("Delete identity provider failed")
+		e.ServerError(w, e.RespDBDataRemoveFailure)
+		return
+	}
+	if rows == 0 {
+		e.NotFound(w)
+		return
+	}
+}
+
+// LoginOptions godoc
+//
+//	@summary		List sign in options
+//	@description	Identity providers to offer on the login page
+//	@tags			auth
+//	@accept			json
+//	@produce		json
+//	@success		200	{array}		LoginOption
+//	@failure		500	{object}	error.Error
+//	@router			/auth/providers [get]
+func (a *API) LoginOptions(w http.ResponseWriter, _ *http.Request) {
+	providers, err := a.repository.List()
+	if err != nil {
+		a.logger.Error().Err(err).Msg("List sign in options failed")
+		e.ServerError(w, e.RespDBDataAccessFailure)
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(providers.ToLoginOptions(a.config)); err != nil {
+		a.logger.Error().Err(err).Msg("List sign in options failed")
+		e.ServerError(w, e.RespJSONEncodeFailure)
+		return
+	}
+}
+
+// Login godoc
+//
+//	@summary		Sign in with identity provider
+//	@description	Redirect to the identity provider. After signing in there the user is logged in and sent to returnTo, which has to start with one of the configured return URLs.
+//	@tags			auth
+//	@param			slug		path	string	true	"Identity provider slug"
+//	@param			returnTo	query	string	false	"Where to send the user afterwards"
+//	@success		302
+//	@failure		400
+//	@failure		404
+//	@failure		500	{object}	error.Error
+//	@failure		502
+//	@router			/auth/providers/{slug}/login [get]
+func (a *API) Login(w http.ResponseWriter, r *http.Request) {
+	provider, err := a.repository.GetBySlug(chi.URLParam(r, "slug"))
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			e.NotFound(w)
+			return
+		}
+		a.logger.Error().Err(err).Msg("Sign in with identity provider failed")
+		e.ServerError(w, e.RespDBDataAccessFailure)
+		return
+	}
+
+	returnTo := r.URL.Query().Get("returnTo")
+	if returnTo == "" {
+		returnTo = a.config.ReturnURLs[0]
+	} else if !a.allowedReturn(returnTo) {
+		a.logger.Error().Str("returnTo", returnTo).Msg("Return URL not allowed")
+		http.Error(w, "Return URL is not allowed!", http.StatusBadRequest)
+		return
+	}
+
+	metadata, err := a.client.Discover(r.Context(), provider.Issuer)
+	if err != nil {
+		a.logger.Error().Err(err).Str("provider", provider.Slug).Msg("Identity provider discovery failed")
+		http.Error(w, "Identity provider is unavailable!", http.StatusBadGateway)
+		return
+	}
+
+	request, err := oidcclient.NewRequest()
+	if err != nil {
+		a.logger.Error().Err(err).Msg("Sign in with identity provider failed")
+		e.ServerError(w, e.RespTokenGenerateFailure)
+		return
+	}
+
+	session, err := a.store.Get(r, "session")
+	if err != nil && session == nil {
+		a.logger.Error().Err(err).Msg("Sign in with identity provider failed")
+		e.ServerError(w, e.RespSessionAccessFailure)
+		return
+	}
+	session.Values["fedProvider"] = provider.Slug
+	session.Values["fedState"] = request.State
+	session.Values["fedNonce"] = request.Nonce
+	session.Values["fedVerifier"] = request.Verifier
+	session.Values["fedReturnTo"] = returnTo
+	session.Values["fedAt"] = time.Now().Unix()
+	if err := session.Save(r, w); err != nil {
+		a.logger.Error().Err(err).Msg("Sign in with identity provider failed")
+		e.ServerError(w, e.RespSessionAccessFailure)
+		return
+	}
+
+	http.Redirect(w, r, a.client.AuthCodeURL(metadata, provider.ClientConfig(a.config), request, Scope), http.StatusFound)
+}
+
+// Callback godoc
+//
+//	@summary		Identity provider callback
+//	@description	Complete signing in with an identity provider. The identity is linked to the account with the same verified email, or an account without a password is created with the role mapped from the provider's claims. Users who have to pass a second factor are sent to the first return URL with twoFactor=required (or setup) and returnTo, and complete the login with POST /users/login/2fa. Failures are reported to the first return URL as the error query parameter.
+//	@tags			auth
+//	@param			slug	path	string	true	"Identity provider slug"
+//	@param			code	query	string	false	"Authorization code"
+//	@param			state	query	string	true	"State of the sign in"
+//	@success		302
+//	@failure		404
+//	@failure		500	{object}	error.Error
+//	@router			/auth/providers/{slug}/callback [get]
+func (a *API) Callback(w http.ResponseWriter, r *http.Request) {
+	provider, err := a.repository.GetBySlug(chi.URLParam(r, "slug"))
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			e.NotFound(w)
+			return
+		}
+		a.logger.Error().Err(err).Msg("Identity provider callback failed")
+		e.ServerError(w, e.RespDBDataAccessFailure)
+		return
+	}
+
+	audit.Record(r.Context(), "user.login", "user", "", nil, map[string]string{"provider": provider.Slug})
+
+	session, err := a.store.Get(r, "session")
+	if err != nil && session == nil {
+		a.logger.Error().Err(err).Msg("Identity provider callback failed")
+		e.ServerError(w, e.RespSessionAccessFailure)
+		return
+	}
+
+	state, _ := session.Values["fedState"].(string)
+	slug, _ := session.Values["fedProvider"].(string)
+	nonce, _ := session.Values["fedNonce"].(string)
+	verifier, _ := session.Values["fedVerifier"].(string)
+	returnTo, _ := session.Values["fedReturnTo"].(string)
+	startedAt, _ := session.Values["fedAt"].(int64)
+	for _, key := range stateKeys {
+		delete(session.Values, key)
+	}
+
+	q := r.URL.Query()
+	if state == "" || slug != provider.Slug ||
+		subtle.ConstantTimeCompare([]byte(q.Get("state")), []byte(state)) != 1 ||
+		time.Since(time.Unix(startedAt, 0)) > a.config.StateTTL {
+		a.logger.Error().Str("provider", provider.Slug).Msg("Identity provider state mismatch")
+		a.fail(w, r, session, "invalid_state")
+		return
+	}
+
+	if q.Get("error") != "" {
+		a.logger.Error().Str("provider", provider.Slug).Str("error", q.Get("error")).Msg("Identity provider returned an error")
+		a.fail(w, r, session, "access_denied")
+		return
+	}
+
+	claims, err := a.verify(r, provider, q.Get("code"), verifier, nonce)
+	if err != nil {
+		a.logger.Error().Err(err).Str("provider", provider.Slug).Msg("Identity provider callback failed")
+		a.fail(w, r, session, "provider_error")
+		return
+	}
+
+	user, err := a.repository.Link(provider, provider.ToIdentity(claims), time.Now())
+	if err != nil {
+		a.logger.Error().Err(err).Str("provider", provider.Slug).Msg("Linking external identity failed")
+		switch {
+		case errors.Is(err, ErrEmailNotVerified):
+			a.fail(w, r, session, "email_not_verified")
+		case errors.Is(err, ErrNoRole):
+			a.fail(w, r, session, "no_account")
+		case errors.Is(err, ErrAccountDeleted):
+			a.fail(w, r, session, "account_inactive")
+		default:
+			a.fail(w, r, session, "server_error")
+		}
+		return
+	}
+
+	if !user.Status.CanLogin() {
+		a.logger.Error().Str("status", user.Status.ToString()).Msg("Account is inactive")
+		a.fail(w, r, session, "account_inactive")
+		return
+	}
+
+	audit.Record(r.Context(), "user.login", "user", user.ID.String(), nil, map[string]string{"provider": provider.Slug})
+
+	challenge, err := a.users.SignIn(w, r, user)
+	if err != nil {
+		a.logger.Error().Err(err).Msg("Identity provider callback failed")
+		a.fail(w, r, session, "server_error")
+		return
+	}
+
+	// The provider does not vouch for a second factor, so users who need one
+	// complete the login like after a password check.
+	if challenge != nil {
+		step := "required"
+		if challenge.SetupRequired {
+			step = "setup"
+		}
+		u, err := a.firstReturnURL(url.Values{"twoFactor": {step}, "returnTo": {returnTo}})
+		if err != nil {
+			http.Error(w, "Two-factor authentication required", http.StatusUnauthorized)
+			return
+		}
+		http.Redirect(w, r, u, http.StatusFound)
+		return
+	}
+
+	http.Redirect(w, r, returnTo, http.StatusFound)
+}
+
+func (a *API) verify(r *http.Request, provider *Provider, code, verifier, nonce string) (oidcclient.Claims, error) {
+	metadata, err := a.client.Discover(r.Context(), provider.Issuer)
+	if err != nil {
+		return nil, err
+	}
+
+	config := provider.ClientConfig(a.config)
+	idToken, err := a.client.Exchange(r.Context(), metadata, config, code, verifier)
+	if err != nil {
+		return nil, err
+	}
+
+	return a.client.Verify(r.Context(), metadata, config, idToken, nonce)
+}
+
+// fail sends the user to the default return URL with the error code, and
+// saves the session so that the sign in cannot be resumed.
+func (a *API) fail(w http.ResponseWriter, r *http.Request, session *sessions.Session, code string) {
+	audit.Fail(r.Context())
+	if err := session.Save(r, w); err != nil {
+		a.logger.Error().Err(err).Msg("Saving session failed")
+	}
+
+	u, err := a.firstReturnURL(url.Values{"error": {code}})
+	if err != nil {
+		http.Error(w, "Signing in failed: "+code, http.StatusBadRequest)
+		return
+	}
+
+	http.Redirect(w, r, u, http.StatusFound)
+}
+
+// firstReturnURL returns the first return URL with the parameters added to
+// its query.
+func (a *API) firstReturnURL(params url.Values) (string, error) {
+	u, err := url.Parse(a.config.ReturnURLs[0])
+	if err != nil {
+		return "", err
+	}
+	query := u.Query()
+	for key, values := range params {
+		query[key] = values
+	}
+	u.RawQuery = query.Encode()
+
+	return u.String(), nil
+}
+
+// allowedReturn reports whether the URL has the scheme and host of a
+// configured return URL and a path below its path, so that signing in cannot be
+// used to redirect users to other sites.
+func (a *API) allowedReturn(returnTo string) bool {
+	u, err := url.Parse(returnTo)
+	if err != nil || u.User != nil {
+		return false
+	}
+
+	for _, entry := range a.config.ReturnURLs {
+		allowed, err := url.Parse(entry)
+		if err != nil {
+			continue
+		}
+		if u.Scheme == allowed.Scheme && u.Host == allowed.Host && underPath(u.Path, allowed.Path) {
+			return true
+		}
+	}
+	return false
+}
+
+// underPath reports whether path is base or lies below it, counting whole
+// segments only, e.g. /app/x is below /app but /application is not.
+func underPath(path, base string) bool {
+	base = strings.TrimSuffix(base, "/")
+	return path == base || strings.HasPrefix(path, base+"/")
+}
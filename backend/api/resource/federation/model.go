@@ -0,0 +1,270 @@
+package federation
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	"backend/api/resource/users"
+	"backend/utils/oidcclient"
+)
+
+// Scope requested from upstream providers.
+const Scope = "openid email profile"
+
+// Config configures signing in with upstream providers.
+type Config struct {
+	// BaseURL is the public URL of this service, which the callback URL
+	// registered at the providers starts with.
+	BaseURL string
+	// ReturnURLs are the URLs users may be sent back to after signing in,
+	// together with the paths below them on the same scheme and host. The
+	// first one is the default and also receives failures as the error query
+	// parameter.
+	ReturnURLs []string
+	// StateTTL limits how long a user may take at the provider.
+	StateTTL time.Duration
+}
+
+var DefaultConfig = Config{
+	BaseURL:    "http://127.0.0.1:8080",
+	ReturnURLs: []string{"http://127.0.0.1:3000/"},
+	StateTTL:   10 * time.Minute,
+}
+
+// RoleMapping maps values of the role claim to roles. It is stored as JSON.
+type RoleMapping map[string]string
+
+func (m RoleMapping) Value() (driver.Value, error) {
+	if m == nil {
+		return "{}", nil
+	}
+	b, err := json.Marshal(m)
+	return string(b), err
+}
+
+func (m *RoleMapping) Scan(value any) error {
+	switch v := value.(type) {
+	case string:
+		return json.Unmarshal([]byte(v), m)
+	case []byte:
+		return json.Unmarshal(v, m)
+	case nil:
+		*m = nil
+		return nil
+	default:
+		return fmt.Errorf("cannot scan %T into RoleMapping", value)
+	}
+}
+
+type ProviderForm struct {
+	Slug         string            `json:"slug" form:"required,max=64,slug"`
+	Name         string            `json:"name" form:"required,max=255"`
+	Issuer       string            `json:"issuer" form:"required,url,max=2048"`
+	ClientID     string            `json:"clientId" form:"required,max=255"`
+	ClientSecret string            `json:"clientSecret" form:"max=1024"`
+	RoleClaim    string            `json:"roleClaim" form:"required_with=RoleMapping,max=255"`
+	RoleMapping  map[string]string `json:"roleMapping" form:"dive,keys,required,max=255,endkeys,role"`
+	// DefaultRole is given to new accounts whose role claim matches no entry
+	// of the mapping. Without it such users cannot sign in.
+	DefaultRole string `json:"defaultRole" form:"omitempty,role"`
+}
+
+type ProviderResponse struct {
+	ID          uuid.UUID         `json:"id"`
+	Slug        string            `json:"slug"`
+	Name        string            `json:"name"`
+	Issuer      string            `json:"issuer"`
+	ClientID    string            `json:"clientId"`
+	RoleClaim   string            `json:"roleClaim"`
+	RoleMapping map[string]string `json:"roleMapping"`
+	DefaultRole string            `json:"defaultRole"`
+	CallbackURL string            `json:"callbackUrl"`
+	CreatedAt   time.Time         `json:"createdAt"`
+}
+
+// LoginOption is a provider as offered on the login page.
+type LoginOption struct {
+	Slug     string `json:"slug"`
+	Name     string `json:"name"`
+	LoginURL string `json:"loginUrl"`
+}
+
+// Provider is an upstream OpenID Connect provider users can sign in with.
+// The client secret is never returned by the API.
+type Provider struct {
+	ID           uuid.UUID `gorm:"primarykey"`
+	Slug         string
+	Name         string
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RoleClaim    string
+	RoleMapping  RoleMapping `gorm:"type:jsonb"`
+	DefaultRole  string
+	CreatedAt    time.Time
+}
+
+func (Provider) TableName() string {
+	return "identity_providers"
+}
+
+type Providers []*Provider
+
+// ExternalIdentity links an account at a provider to a user.
+type ExternalIdentity struct {
+	ID          uuid.UUID `gorm:"primarykey"`
+	UserID      uuid.UUID
+	ProviderID  uuid.UUID
+	Subject     string
+	Email       string
+	CreatedAt   time.Time
+	LastLoginAt time.Time
+}
+
+// Identity is what a provider asserts about the user signing in.
+type Identity struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+	// Role is the role of a new account, or nil when the user may not have
+	// one created.
+	Role *users.Role
+}
+
+func (f *ProviderForm) ToModel() *Provider {
+	return &Provider{
+		ID:           uuid.New(),
+		Slug:         f.Slug,
+		Name:         f.Name,
+		Issuer:       f.Issuer,
+		ClientID:     f.ClientID,
+		ClientSecret: f.ClientSecret,
+		RoleClaim:    f.RoleClaim,
+		RoleMapping:  f.RoleMapping,
+		DefaultRole:  f.DefaultRole,
+	}
+}
+
+// Roles lists every role the provider can give to new accounts.
+func (f *ProviderForm) Roles() []users.Role {
+	roles := []users.Role{}
+	if f.DefaultRole != "" {
+		roles = append(roles, users.ToRole(f.DefaultRole))
+	}
+	for _, role := range f.RoleMapping {
+		roles = append(roles, users.ToRole(role))
+	}
+	return roles
+}
+
+func (p *Provider) ToResponse(c *Config) *ProviderResponse {
+	mapping := p.RoleMapping
+	if mapping == nil {
+		mapping = RoleMapping{}
+	}
+
+	return &ProviderResponse{
+		ID:          p.ID,
+		Slug:        p.Slug,
+		Name:        p.Name,
+		Issuer:      p.Issuer,
+		ClientID:    p.ClientID,
+		RoleClaim:   p.RoleClaim,
+		RoleMapping: mapping,
+		DefaultRole: p.DefaultRole,
+		CallbackURL: p.CallbackURL(c),
+		CreatedAt:   p.CreatedAt,
+	}
+}
+
+func (providers Providers) ToResponse(c *Config) []*ProviderResponse {
+	response := make([]*ProviderResponse, 0, len(providers))
+	for _, p := range providers {
+		response = append(response, p.ToResponse(c))
+	}
+	return response
+}
+
+func (providers Providers) ToLoginOptions(c *Config) []*LoginOption {
+	options := make([]*LoginOption, 0, len(providers))
+	for _, p := range providers {
+		options = append(options, &LoginOption{
+			Slug:     p.Slug,
+			Name:     p.Name,
+			LoginURL: p.url(c, "login"),
+		})
+	}
+	return options
+}
+
+// CallbackURL is the redirect URI to register at the provider.
+func (p *Provider) CallbackURL(c *Config) string {
+	return p.url(c, "callback")
+}
+
+func (p *Provider) url(c *Config, action string) string {
+	return strings.TrimSuffix(c.BaseURL, "/") + "/api/v1/auth/providers/" + p.Slug + "/" + action
+}
+
+func (p *Provider) ClientConfig(c *Config) *oidcclient.Config {
+	return &oidcclient.Config{
+		ClientID:     p.ClientID,
+		ClientSecret: p.ClientSecret,
+		RedirectURI:  p.CallbackURL(c),
+	}
+}
+
+// RoleFor maps the role claim to a role. The first value of the claim with a
+// mapping wins, otherwise the default role is used if the provider has one.
+func (p *Provider) RoleFor(claims oidcclient.Claims) *users.Role {
+	if p.RoleClaim != "" {
+		for _, value := range claims.Strings(p.RoleClaim) {
+			if role, ok := p.RoleMapping[value]; ok {
+				r := users.ToRole(role)
+				return &r
+			}
+		}
+	}
+
+	if p.DefaultRole == "" {
+		return nil
+	}
+	r := users.ToRole(p.DefaultRole)
+	return &r
+}
+
+// ToIdentity reads the identity of the user from verified ID token claims.
+func (p *Provider) ToIdentity(claims oidcclient.Claims) *Identity {
+	return &Identity{
+		Subject:       claims.String("sub"),
+		Email:         claims.String("email"),
+		EmailVerified: claims.Bool("email_verified"),
+		Name:          claims.String("name"),
+		Role:          p.RoleFor(claims),
+	}
+}
+
+// ToUser creates the account of a user signing in for the first time. It has
+// no password, the user can only sign in with the provider until they reset
+// one.
+func (i *Identity) ToUser(now time.Time) *users.User {
+	name := i.Name
+	if name == "" {
+		name, _, _ = strings.Cut(i.Email, "@")
+	}
+
+	return &users.User{
+		ID:              uuid.New(),
+		Name:            name,
+		Email:           i.Email,
+		Role:            *i.Role,
+		Status:          users.StatusActive,
+		EmailVerifiedAt: &now,
+	}
+}
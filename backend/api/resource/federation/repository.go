@@ -0,0 +1,142 @@
+package federation
+
+import (
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+
+	"backend/api/resource/users"
+)
+
+var (
+	ErrEmailNotVerified = errors.New("provider did not verify the email address")
+	ErrNoRole           = errors.New("provider assigns no role to new accounts")
+	ErrAccountDeleted   = errors.New("account is deleted")
+)
+
+type Repository struct {
+	db *gorm.DB
+}
+
+func NewRepository(db *gorm.DB) *Repository {
+	return &Repository{
+		db: db,
+	}
+}
+
+func (r *Repository) List() (Providers, error) {
+	var providers Providers
+	if err := r.db.Order("name").Find(&providers).Error; err != nil {
+		return nil, err
+	}
+
+	return providers, nil
+}
+
+func (r *Repository) Create(provider *Provider) (*Provider, error) {
+	if err := r.db.Create(provider).Error; err != nil {
+		return nil, err
+	}
+
+	return provider, nil
+}
+
+func (r *Repository) GetBySlug(slug string) (*Provider, error) {
+	provider := &Provider{}
+	if err := r.db.Where("slug = ?", slug).First(provider).Error; err != nil {
+		return nil, err
+	}
+
+	return provider, nil
+}
+
+// Delete removes the provider and unlinks every identity of it. Accounts stay,
+// users without a password have to reset one to log in again.
+func (r *Repository) Delete(id uuid.UUID) (int64, error) {
+	result := r.db.Where("id = ?", id).Delete(&Provider{})
+
+	return result.RowsAffected, result.Error
+}
+
+// Link returns the user an external identity belongs to. An identity seen for
+// the first time is linked to the account with the same email, provided the
+// provider verified it, or to a new account without a password.
+func (r *Repository) Link(provider *Provider, identity *Identity, now time.Time) (*users.User, error) {
+	user := &users.User{}
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		link := &ExternalIdentity{}
+		err := tx.Where("provider_id = ? AND subject = ?", provider.ID, identity.Subject).First(link).Error
+		if err == nil {
+			if err := tx.Unscoped().Where("id = ?", link.UserID).First(user).Error; err != nil {
+				return err
+			}
+			if user.DeletedAt.Valid {
+				return ErrAccountDeleted
+			}
+
+			return tx.Model(&ExternalIdentity{}).
+				Where("id = ?", link.ID).
+				Updates(map[string]any{"email": identity.Email, "last_login_at": now}).Error
+		}
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+
+		if identity.Email == "" || !identity.EmailVerified {
+			return ErrEmailNotVerified
+		}
+
+		err = tx.Unscoped().Where("lower(email) = lower(?)", identity.Email).First(user).Error
+		switch {
+		case err == nil:
+			if user.DeletedAt.Valid {
+				return ErrAccountDeleted
+			}
+			// Whoever registered an unverified address did not prove they own
+			// it, so their password must not keep working next to the
+			// identity of the real owner.
+			if user.EmailVerifiedAt == nil {
+				if user.Status == users.StatusPending {
+					user.Status = users.StatusActive
+				}
+				if err := tx.Model(&users.User{}).
+					Where("id = ?", user.ID).
+					Updates(map[string]any{"email_verified_at": now, "password": nil, "status": user.Status}).Error; err != nil {
+					return err
+				}
+				if err := tx.Where("user_id = ?", user.ID).Delete(&users.UserSession{}).Error; err != nil {
+					return err
+				}
+				user.EmailVerifiedAt = &now
+				user.Password = nil
+			}
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			if identity.Role == nil {
+				return ErrNoRole
+			}
+			user = identity.ToUser(now)
+			if err := tx.Create(user).Error; err != nil {
+				return err
+			}
+		default:
+			return err
+		}
+
+		return tx.Create(&ExternalIdentity{
+			ID:          uuid.New(),
+			UserID:      user.ID,
+			ProviderID:  provider.ID,
+			Subject:     identity.Subject,
+			Email:       identity.Email,
+			CreatedAt:   now,
+			LastLoginAt: now,
+		}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
@@ -0,0 +1,389 @@
+package invitations
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/go-playground/validator/v10"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog"
+	"gorm.io/gorm"
+
+	"backend/api/resource/audit"
+	e "backend/api/resource/common/error"
+	"backend/api/resource/common/policy"
+	"backend/api/resource/users"
+	"backend/utils/mailer"
+	validatorUtil "backend/utils/validator"
+)
+
+type API struct {
+	repository *Repository
+	users      *users.Repository
+	validator  *validator.Validate
+	logger     *zerolog.Logger
+	mail       *mailer.Sender
+	config     *Config
+}
+
+func New(l *zerolog.Logger, db *gorm.DB, v *validator.Validate, m *mailer.Sender, c *Config) *API {
+	if m == nil {
+		m = mailer.NewSender(mailer.NewLog(l), mailer.DefaultLocale)
+	}
+	if c == nil {
+		c = &DefaultConfig
+	}
+
+	return &API{
+		repository: NewRepository(db),
+		users:      users.NewRepository(db),
+		validator:  v,
+		logger:     l,
+		mail:       m,
+		config:     c,
+	}
+}
+
+// List godoc
+//
+//	@summary		List invitations
+//	@description	List invitations, including accepted, revoked and expired ones
+//	@tags			invitations
+//	@accept			json
+//	@produce		json
+//	@success		200	{array}		Response
+//	@failure		403	{object}	error.Error
+//	@failure		500	{object}	error.Error
+//	@router			/invitations [get]
+func (a *API) List(w http.ResponseWriter, _ *http.Request) {
+	invitations, err := a.repository.List()
+	if err != nil {
+		a.logger.Error().Err(err).Msg("List invitations failed")
+		e.ServerError(w, e.RespDBDataAccessFailure)
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(invitations.ToResponse()); err != nil {
+		a.logger.Error().Err(err).Msg("List invitations failed")
+		e.ServerError(w, e.RespJSONEncodeFailure)
+		return
+	}
+}
+
+// Create godoc
+//
+//	@summary		Create invitation
+//	@description	Invite a user with the given role. The invitee chooses their name and password when accepting.
+//	@tags			invitations
+//	@accept			json
+//	@produce		json
+//	@param			body	body	Form	true	"Invitation form"
+//	@success		201	{object}	Response
+//	@failure		403	{object}	error.Error
+//	@failure		409
+//	@failure		422	{object}	error.Errors
+//	@failure		500	{object}	error.Error
+//	@router			/invitations [post]
+func (a *API) Create(w http.ResponseWriter, r *http.Request) {
+	form := &Form{}
+	if err := json.NewDecoder(r.Body).Decode(form); err != nil {
+		a.logger.Error().Err(err).Msg("Create invitation failed")
+		e.ServerError(w, e.RespJSONDecodeFailure)
+		return
+	}
+
+	if err := a.validator.Struct(form); err != nil {
+		a.logger.Error().Err(err).Msg("Create invitation failed")
+		respBody, err := json.Marshal(validatorUtil.ToErrResponse(err))
+		if err != nil {
+			e.ServerError(w, e.RespJSONEncodeFailure)
+			return
+		}
+
+		e.ValidationErrors(w, respBody)
+		return
+	}
+
+	perm := policy.UsersCreateStaff
+	if form.Role == users.Admin {
+		perm = policy.UsersCreateAdmin
+	}
+	if !policy.Can(r.Context(), perm) {
+		a.logger.Error().Str("role", form.Role.ToString()).Msg("Not allowed to invite role")
+		e.Forbidden(w)
+		return
+	}
+
+	user, err := a.users.GetByEmailWithDeleted(form.Email)
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		a.logger.Error().Err(err).Msg("Create invitation failed")
+		e.ServerError(w, e.RespDBDataAccessFailure)
+		return
+	} else if user != nil {
+		a.logger.Error().Msg("User already exists")
+		http.Error(w, "User already exists!", http.StatusConflict)
+		return
+	}
+
+	open, err := a.repository.GetOpen(form.Email)
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		a.logger.Error().Err(err).Msg("Create invitation failed")
+		e.ServerError(w, e.RespDBDataAccessFailure)
+		return
+	} else if open != nil {
+		a.logger.Error().Msg("Invitation already exists")
+		http.Error(w, "Invitation already sent, resend or revoke it!", http.StatusConflict)
+		return
+	}
+
+	token, err := users.GenerateToken()
+	if err != nil {
+		a.logger.Error().Err(err).Msg("Create invitation failed")
+		e.ServerError(w, e.RespTokenGenerateFailure)
+		return
+	}
+
+	invitation := &Invitation{
+		ID:        users.GetUUID(),
+		Email:     form.Email,
+		Role:      form.Role,
+		TokenHash: users.HashToken(token),
+		InvitedBy: inviterID(r),
+		ExpiresAt: time.Now().Add(a.config.TTL),
+	}
+	if _, err := a.repository.Create(invitation); err != nil {
+		a.logger.Error().Err(err).Msg("Create invitation failed")
+		e.ServerError(w, e.RespDBDataInsertFailure)
+		return
+	}
+
+	a.send(r, invitation, token)
+
+	w.WriteHeader(http.StatusCreated)
+	response := invitation.ToResponse()
+	audit.Record(r.Context(), "invitation.create", "invitation", invitation.ID.String(), nil, response)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		a.logger.Error().Err(err).Msg("Create invitation failed")
+		e.ServerError(w, e.RespJSONEncodeFailure)
+		return
+	}
+}
+
+// Resend godoc
+//
+//	@summary		Resend invitation
+//	@description	Send the invitation again with a new link, which invalidates the previous one and restarts the expiry
+//	@tags			invitations
+//	@accept			json
+//	@produce		json
+//	@param			id	path	string	true	"Invitation ID"
+//	@success		200	{object}	Response
+//	@failure		400	{object}	error.Error
+//	@failure		403	{object}	error.Error
+//	@failure		404
+//	@failure		500	{object}	error.Error
+//	@router			/invitations/{id}/resend [post]
+func (a *API) Resend(w http.ResponseWriter, r *http.Request) {
+	id, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		a.logger.Error().Err(err).Msg("Resend invitation failed")
+		e.BadRequest(w, e.RespInvalidURLParamID)
+		return
+	}
+	audit.Record(r.Context(), "invitation.resend", "invitation", id.String(), nil, nil)
+
+	current, ok := a.read(w, id, "Resend invitation failed")
+	if !ok {
+		return
+	}
+
+	token, err := users.GenerateToken()
+	if err != nil {
+		a.logger.Error().Err(err).Msg("Resend invitation failed")
+		e.ServerError(w, e.RespTokenGenerateFailure)
+		return
+	}
+
+	rows, err := a.repository.Renew(id, users.HashToken(token), time.Now().Add(a.config.TTL))
+	if err != nil {
+		a.logger.Error().Err(err).Msg("Resend invitation failed")
+		e.ServerError(w, e.RespDBDataUpdateFailure)
+		return
+	}
+	if rows == 0 {
+		e.NotFound(w)
+		return
+	}
+
+	invitation, err := a.repository.Read(id)
+	if err != nil {
+		a.logger.Error().Err(err).Msg("Resend invitation failed")
+		e.ServerError(w, e.RespDBDataAccessFailure)
+		return
+	}
+
+	a.send(r, invitation, token)
+
+	response := invitation.ToResponse()
+	audit.Record(r.Context(), "invitation.resend", "invitation", id.String(), current.ToResponse(), response)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		a.logger.Error().Err(err).Msg("Resend invitation failed")
+		e.ServerError(w, e.RespJSONEncodeFailure)
+		return
+	}
+}
+
+// Revoke godoc
+//
+//	@summary		Revoke invitation
+//	@description	Revoke an invitation that was not accepted yet
+//	@tags			invitations
+//	@accept			json
+//	@produce		json
+//	@param			id	path	string	true	"Invitation ID"
+//	@success		200
+//	@failure		400	{object}	error.Error
+//	@failure		403	{object}	error.Error
+//	@failure		404
+//	@failure		500	{object}	error.Error
+//	@router			/invitations/{id} [delete]
+func (a *API) Revoke(w http.ResponseWriter, r *http.Request) {
+	id, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		a.logger.Error().Err(err).Msg("Revoke invitation failed")
+		e.BadRequest(w, e.RespInvalidURLParamID)
+		return
+	}
+	audit.Record(r.Context(), "invitation.revoke", "invitation", id.String(), nil, nil)
+
+	current, ok := a.read(w, id, "Revoke invitation failed")
+	if !ok {
+		return
+	}
+
+	now := time.Now()
+	rows, err := a.repository.Revoke(id, now)
+	if err != nil {
+		a.logger.Error().Err(err).Msg("Revoke invitation failed")
+		e.ServerError(w, e.RespDBDataUpdateFailure)
+		return
+	}
+	if rows == 0 {
+		e.NotFound(w)
+		return
+	}
+
+	revoked := *current
+	revoked.RevokedAt = &now
+	audit.Record(r.Context(), "invitation.revoke", "invitation", id.String(), current.ToResponse(), revoked.ToResponse())
+}
+
+// Accept godoc
+//
+//	@summary		Accept invitation
+//	@description	Create the invited account with the token from the invitation link
+//	@tags			invitations
+//	@accept			json
+//	@produce		json
+//	@param			body	body	AcceptForm	true	"Accept form"
+//	@success		201	{object}	users.UserResponse
+//	@failure		400
+//	@failure		409
+//	@failure		422	{object}	error.Errors
+//	@failure		500	{object}	error.Error
+//	@router			/invitations/accept [post]
+func (a *API) Accept(w http.ResponseWriter, r *http.Request) {
+	form := &AcceptForm{}
+	if err := json.NewDecoder(r.Body).Decode(form); err != nil {
+		a.logger.Error().Err(err).Msg("Accept invitation failed")
+		e.ServerError(w, e.RespJSONDecodeFailure)
+		return
+	}
+
+	if err := a.validator.Struct(form); err != nil {
+		a.logger.Error().Err(err).Msg("Accept invitation failed")
+		respBody, err := json.Marshal(validatorUtil.ToErrResponse(err))
+		if err != nil {
+			e.ServerError(w, e.RespJSONEncodeFailure)
+			return
+		}
+
+		e.ValidationErrors(w, respBody)
+		return
+	}
+
+	user, err := a.repository.Accept(users.HashToken(form.Token), form, time.Now())
+	if err != nil {
+		a.logger.Error().Err(err).Msg("Accept invitation failed")
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			http.Error(w, "Invalid or expired token!", http.StatusBadRequest)
+		case errors.Is(err, ErrUserExists):
+			http.Error(w, "User already exists!", http.StatusConflict)
+		default:
+			e.ServerError(w, e.RespDBDataInsertFailure)
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	response := user.ToResponse()
+	audit.Record(r.Context(), "user.create", "user", user.ID.String(), nil, response)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		a.logger.Error().Err(err).Msg("Accept invitation failed")
+		e.ServerError(w, e.RespJSONEncodeFailure)
+		return
+	}
+}
+
+// read writes 404 unless the invitation exists.
+func (a *API) read(w http.ResponseWriter, id uuid.UUID, msg string) (*Invitation, bool) {
+	invitation, err := a.repository.Read(id)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			e.NotFound(w)
+			return nil, false
+		}
+
+		a.logger.Error().Err(err).Msg(msg)
+		e.ServerError(w, e.RespDBDataAccessFailure)
+		return nil, false
+	}
+
+	return invitation, true
+}
+
+// send mails the invitation link. A failure is only logged, the invitation
+// can be resent.
+func (a *API) send(r *http.Request, invitation *Invitation, token string) {
+	data := map[string]any{
+		"Role":  invitation.Role.ToString(),
+		"Link":  a.config.URL + "?token=" + url.QueryEscape(token),
+		"Hours": int(math.Ceil(a.config.TTL.Hours())),
+	}
+
+	if err := a.mail.Send(r.Context(), invitation.Email, r.Header.Get("Accept-Language"), "invitation", data); err != nil {
+		a.logger.Error().Err(err).Str("invitation", invitation.ID.String()).Msg("Sending invitation failed")
+	}
+}
+
+// inviterID returns the id of the user sending the invitation, or nil when it
+// is sent with an API key.
+func inviterID(r *http.Request) *uuid.UUID {
+	identity, ok := policy.IdentityFrom(r.Context())
+	if !ok {
+		return nil
+	}
+
+	id, err := uuid.Parse(identity.ID)
+	if err != nil {
+		return nil
+	}
+
+	return &id
+}
@@ -0,0 +1,115 @@
+package invitations
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+
+	"backend/api/resource/users"
+)
+
+const (
+	StatusPending  = "pending"
+	StatusAccepted = "accepted"
+	StatusRevoked  = "revoked"
+	StatusExpired  = "expired"
+)
+
+// Config configures the invitation links.
+type Config struct {
+	// URL of the frontend page the link points to; the token is appended as
+	// the token query parameter.
+	URL string
+	TTL time.Duration
+}
+
+var DefaultConfig = Config{TTL: 72 * time.Hour}
+
+type Form struct {
+	Email string     `json:"email" form:"required,email,max=255"`
+	Role  users.Role `json:"role" form:"required,role"`
+}
+
+type AcceptForm struct {
+	Token    string `json:"token" form:"required,max=255"`
+	Name     string `json:"name" form:"required,alpha_space,max=255"`
+	Password string `json:"password" form:"required,password,max=255"`
+}
+
+type Response struct {
+	ID         uuid.UUID  `json:"id"`
+	Email      string     `json:"email"`
+	Role       string     `json:"role"`
+	Status     string     `json:"status"`
+	InvitedBy  *uuid.UUID `json:"invitedBy"`
+	ExpiresAt  time.Time  `json:"expiresAt"`
+	AcceptedAt *time.Time `json:"acceptedAt"`
+	CreatedAt  time.Time  `json:"createdAt"`
+}
+
+type Invitation struct {
+	ID         uuid.UUID `gorm:"primarykey"`
+	Email      string
+	Role       users.Role `gorm:"type:Role"`
+	TokenHash  []byte
+	InvitedBy  *uuid.UUID
+	ExpiresAt  time.Time
+	AcceptedAt *time.Time
+	RevokedAt  *time.Time
+	CreatedAt  time.Time
+}
+
+type Invitations []*Invitation
+
+func (i *Invitation) Status(now time.Time) string {
+	switch {
+	case i.AcceptedAt != nil:
+		return StatusAccepted
+	case i.RevokedAt != nil:
+		return StatusRevoked
+	case !now.Before(i.ExpiresAt):
+		return StatusExpired
+	default:
+		return StatusPending
+	}
+}
+
+func (i *Invitation) ToResponse() *Response {
+	return &Response{
+		ID:         i.ID,
+		Email:      i.Email,
+		Role:       i.Role.ToString(),
+		Status:     i.Status(time.Now()),
+		InvitedBy:  i.InvitedBy,
+		ExpiresAt:  i.ExpiresAt,
+		AcceptedAt: i.AcceptedAt,
+		CreatedAt:  i.CreatedAt,
+	}
+}
+
+func (invitations Invitations) ToResponse() []*Response {
+	response := make([]*Response, 0, len(invitations))
+	for _, i := range invitations {
+		response = append(response, i.ToResponse())
+	}
+	return response
+}
+
+func (f *AcceptForm) ToUser(invitation *Invitation, now time.Time) (*users.User, error) {
+	password, err := users.GenerateHash([]byte(f.Password))
+	if err != nil {
+		return nil, err
+	}
+
+	// The invitation link was delivered to the address, so it needs no
+	// further verification.
+	return &users.User{
+		ID:              users.GetUUID(),
+		Name:            f.Name,
+		Email:           invitation.Email,
+		Password:        password,
+		Role:            invitation.Role,
+		Status:          users.StatusActive,
+		EmailVerifiedAt: &now,
+	}, nil
+}
@@ -0,0 +1,126 @@
+package invitations
+
+import (
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"backend/api/resource/users"
+)
+
+var ErrUserExists = errors.New("user already exists")
+
+type Repository struct {
+	db *gorm.DB
+}
+
+func NewRepository(db *gorm.DB) *Repository {
+	return &Repository{
+		db: db,
+	}
+}
+
+func (r *Repository) List() (Invitations, error) {
+	var invitations Invitations
+	if err := r.db.Order("created_at desc").Find(&invitations).Error; err != nil {
+		return nil, err
+	}
+
+	return invitations, nil
+}
+
+func (r *Repository) Create(invitation *Invitation) (*Invitation, error) {
+	if err := r.db.Create(invitation).Error; err != nil {
+		return nil, err
+	}
+
+	return invitation, nil
+}
+
+func (r *Repository) Read(id uuid.UUID) (*Invitation, error) {
+	invitation := &Invitation{}
+	if err := r.db.Where("id = ?", id).First(invitation).Error; err != nil {
+		return nil, err
+	}
+
+	return invitation, nil
+}
+
+// GetOpen returns the invitation for email that was neither accepted nor
+// revoked, expired or not.
+func (r *Repository) GetOpen(email string) (*Invitation, error) {
+	invitation := &Invitation{}
+	if err := r.db.Where("lower(email) = lower(?) AND accepted_at IS NULL AND revoked_at IS NULL", email).
+		First(invitation).Error; err != nil {
+		return nil, err
+	}
+
+	return invitation, nil
+}
+
+// Renew replaces the token of an open invitation, which invalidates the link
+// sent before.
+func (r *Repository) Renew(id uuid.UUID, tokenHash []byte, expiresAt time.Time) (int64, error) {
+	result := r.db.Model(&Invitation{}).
+		Where("id = ? AND accepted_at IS NULL AND revoked_at IS NULL", id).
+		Updates(map[string]any{
+			"token_hash": tokenHash,
+			"expires_at": expiresAt,
+		})
+
+	return result.RowsAffected, result.Error
+}
+
+func (r *Repository) Revoke(id uuid.UUID, now time.Time) (int64, error) {
+	result := r.db.Model(&Invitation{}).
+		Where("id = ? AND accepted_at IS NULL AND revoked_at IS NULL", id).
+		Update("revoked_at", now)
+
+	return result.RowsAffected, result.Error
+}
+
+// Accept creates the account of a valid invitation and marks the invitation
+// as accepted. The invitation row is locked so that a link cannot be redeemed
+// twice concurrently.
+func (r *Repository) Accept(tokenHash []byte, form *AcceptForm, now time.Time) (*users.User, error) {
+	var user *users.User
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		invitation := &Invitation{}
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("token_hash = ? AND accepted_at IS NULL AND revoked_at IS NULL AND expires_at > ?", tokenHash, now).
+			First(invitation).Error; err != nil {
+			return err
+		}
+
+		var count int64
+		if err := tx.Unscoped().Model(&users.User{}).
+			Where("lower(email) = lower(?)", invitation.Email).
+			Count(&count).Error; err != nil {
+			return err
+		}
+		if count > 0 {
+			return ErrUserExists
+		}
+
+		u, err := form.ToUser(invitation, now)
+		if err != nil {
+			return err
+		}
+		if err := tx.Create(u).Error; err != nil {
+			return err
+		}
+		user = u
+
+		return tx.Model(&Invitation{}).
+			Where("id = ?", invitation.ID).
+			Update("accepted_at", now).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
@@ -0,0 +1,679 @@
+package oidc
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/go-playground/validator/v10"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog"
+	"gorm.io/gorm"
+
+	"backend/api/resource/audit"
+	e "backend/api/resource/common/error"
+	"backend/api/resource/users"
+	"backend/utils/sessionstore"
+	"backend/utils/token"
+	validatorUtil "backend/utils/validator"
+)
+
+type API struct {
+	repository *Repository
+	users      *users.Repository
+	store      sessionstore.Store
+	tokens     *token.Manager
+	validator  *validator.Validate
+	logger     *zerolog.Logger
+	config     *Config
+}
+
+func New(l *zerolog.Logger, db *gorm.DB, v *validator.Validate, s sessionstore.Store, t *token.Manager, c *Config) *API {
+	if c == nil {
+		c = &DefaultConfig
+	}
+	if !c.Enabled {
+		t = nil
+	}
+
+	return &API{
+		repository: NewRepository(db),
+		users:      users.NewRepository(db),
+		store:      s,
+		tokens:     t,
+		validator:  v,
+		logger:     l,
+		config:     c,
+	}
+}
+
+// Discovery godoc
+//
+//	@summary		OpenID Provider configuration
+//	@description	OpenID Connect Discovery metadata. Only available when the provider is enabled.
+//	@tags			oidc
+//	@produce		json
+//	@success		200	{object}	Discovery
+//	@failure		404
+//	@router			/../.well-known/openid-configuration [get]
+func (a *API) Discovery(w http.ResponseWriter, _ *http.Request) {
+	if a.tokens == nil {
+		e.NotFound(w)
+		return
+	}
+
+	issuer := a.issuer()
+	discovery := &Discovery{
+		Issuer:                            issuer,
+		AuthorizationEndpoint:             issuer + "/oauth/authorize",
+		TokenEndpoint:                     issuer + "/oauth/token",
+		UserInfoEndpoint:                  issuer + "/userinfo",
+		JWKSURI:                           issuer + "/.well-known/jwks.json",
+		ResponseTypesSupported:            []string{"code"},
+		GrantTypesSupported:               []string{"authorization_code"},
+		SubjectTypesSupported:             []string{"public"},
+		IDTokenSigningAlgValuesSupported:  []string{a.tokens.Algorithm()},
+		ScopesSupported:                   supportedScopes,
+		TokenEndpointAuthMethodsSupported: []string{"client_secret_basic", "client_secret_post", "none"},
+		CodeChallengeMethodsSupported:     []string{"S256"},
+		ClaimsSupported:                   []string{"sub", "iss", "aud", "exp", "iat", "auth_time", "nonce", "sid", "name", "role", "email", "email_verified"},
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	if err := json.NewEncoder(w).Encode(discovery); err != nil {
+		a.logger.Error().Err(err).Msg("OpenID configuration failed")
+		e.ServerError(w, e.RespJSONEncodeFailure)
+		return
+	}
+}
+
+// Authorize godoc
+//
+//	@summary		Authorization endpoint
+//	@description	Authorization code flow with PKCE (S256 only). Users without a session are sent to the login page first. The code is returned to the registered redirect URI.
+//	@tags			oidc
+//	@param			client_id				query	string	true	"Client ID"
+//	@param			redirect_uri			query	string	true	"Registered redirect URI"
+//	@param			response_type			query	string	true	"code"
+//	@param			scope					query	string	true	"openid, optionally profile and email"
+//	@param			code_challenge			query	string	true	"PKCE code challenge"
+//	@param			code_challenge_method	query	string	true	"S256"
+//	@param			state					query	string	false	"Returned unchanged"
+//	@param			nonce					query	string	false	"Copied into the ID token"
+//	@param			prompt					query	string	false	"none to fail instead of showing the login page"
+//	@success		302
+//	@failure		400	{object}	ErrorResponse
+//	@failure		404
+//	@failure		500	{object}	error.Error
+//	@router			/../oauth/authorize [get]
+func (a *API) Authorize(w http.ResponseWriter, r *http.Request) {
+	if a.tokens == nil {
+		e.NotFound(w)
+		return
+	}
+
+	q := r.URL.Query()
+	clientID, err := uuid.Parse(q.Get("client_id"))
+	if err != nil {
+		oauthError(w, http.StatusBadRequest, "invalid_request", "client_id is invalid")
+		return
+	}
+
+	client, err := a.repository.GetClient(clientID)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			oauthError(w, http.StatusBadRequest, "invalid_request", "client_id is unknown")
+			return
+		}
+		a.logger.Error().Err(err).Msg("Authorize failed")
+		e.ServerError(w, e.RespDBDataAccessFailure)
+		return
+	}
+
+	// Errors are only sent back to a redirect URI the client registered, so
+	// that the endpoint cannot be used as an open redirector.
+	redirectURI := q.Get("redirect_uri")
+	if !client.AllowsRedirect(redirectURI) {
+		oauthError(w, http.StatusBadRequest, "invalid_request", "redirect_uri is not registered")
+		return
+	}
+
+	state := q.Get("state")
+	if q.Get("response_type") != "code" {
+		redirect(w, r, redirectURI, url.Values{"error": {"unsupported_response_type"}, "state": {state}})
+		return
+	}
+
+	scope, ok := ParseScope(q.Get("scope"))
+	if !ok {
+		redirect(w, r, redirectURI, url.Values{"error": {"invalid_scope"}, "error_description": {"scope must include openid"}, "state": {state}})
+		return
+	}
+
+	challenge := q.Get("code_challenge")
+	if q.Get("code_challenge_method") != "S256" || len(challenge) != 43 {
+		redirect(w, r, redirectURI, url.Values{"error": {"invalid_request"}, "error_description": {"PKCE with the S256 method is required"}, "state": {state}})
+		return
+	}
+
+	session, err := a.loggedIn(r)
+	if err != nil {
+		a.logger.Error().Err(err).Msg("Authorize failed")
+		e.ServerError(w, e.RespDBDataAccessFailure)
+		return
+	}
+	if session == nil {
+		if q.Get("prompt") == "none" {
+			redirect(w, r, redirectURI, url.Values{"error": {"login_required"}, "state": {state}})
+			return
+		}
+
+		returnTo := a.issuer() + "/oauth/authorize?" + r.URL.RawQuery
+		http.Redirect(w, r, a.config.LoginURL+"?returnTo="+url.QueryEscape(returnTo), http.StatusFound)
+		return
+	}
+
+	code, err := users.GenerateToken()
+	if err != nil {
+		a.logger.Error().Err(err).Msg("Authorize failed")
+		e.ServerError(w, e.RespTokenGenerateFailure)
+		return
+	}
+
+	now := time.Now()
+	authorizationCode := &AuthorizationCode{
+		CodeHash:      users.HashToken(code),
+		ClientID:      client.ID,
+		UserID:        session.UserID,
+		SessionID:     session.ID,
+		RedirectURI:   redirectURI,
+		Scope:         scope,
+		Nonce:         q.Get("nonce"),
+		CodeChallenge: challenge,
+		AuthTime:      session.CreatedAt,
+		ExpiresAt:     now.Add(a.config.CodeTTL),
+	}
+	if err := a.repository.CreateCode(authorizationCode); err != nil {
+		a.logger.Error().Err(err).Msg("Authorize failed")
+		e.ServerError(w, e.RespDBDataInsertFailure)
+		return
+	}
+
+	if err := a.repository.DeleteExpiredCodes(now); err != nil {
+		a.logger.Error().Err(err).Msg("Deleting expired authorization codes failed")
+	}
+
+	audit.Record(r.Context(), "oauth.authorize", "user", session.UserID.String(), nil, map[string]string{"clientId": client.ID.String(), "scope": scope})
+
+	redirect(w, r, redirectURI, url.Values{"code": {code}, "state": {state}})
+}
+
+// Token godoc
+//
+//	@summary		Token endpoint
+//	@description	Exchange an authorization code for an access token and an ID token. Confidential clients authenticate with HTTP Basic or the client_secret field, public clients only send client_id.
+//	@tags			oidc
+//	@accept			x-www-form-urlencoded
+//	@produce		json
+//	@param			grant_type		formData	string	true	"authorization_code"
+//	@param			code			formData	string	true	"Authorization code"
+//	@param			redirect_uri	formData	string	true	"Redirect URI of the authorization request"
+//	@param			code_verifier	formData	string	true	"PKCE code verifier"
+//	@param			client_id		formData	string	false	"Client ID, unless sent with HTTP Basic"
+//	@param			client_secret	formData	string	false	"Client secret, unless sent with HTTP Basic"
+//	@success		200	{object}	TokenResponse
+//	@failure		400	{object}	ErrorResponse
+//	@failure		401	{object}	ErrorResponse
+//	@failure		404
+//	@failure		500	{object}	error.Error
+//	@router			/../oauth/token [post]
+func (a *API) Token(w http.ResponseWriter, r *http.Request) {
+	if a.tokens == nil {
+		e.NotFound(w)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		oauthError(w, http.StatusBadRequest, "invalid_request", "malformed form")
+		return
+	}
+
+	audit.Record(r.Context(), "oauth.token", "user", "", nil, nil)
+
+	if r.PostForm.Get("grant_type") != "authorization_code" {
+		oauthError(w, http.StatusBadRequest, "unsupported_grant_type", "")
+		return
+	}
+
+	client, err := a.authenticateClient(r)
+	if err != nil {
+		a.logger.Error().Err(err).Msg("Token exchange failed")
+		e.ServerError(w, e.RespDBDataAccessFailure)
+		return
+	}
+	if client == nil {
+		oauthError(w, http.StatusUnauthorized, "invalid_client", "client authentication failed")
+		return
+	}
+
+	code, err := a.repository.RedeemCode(users.HashToken(r.PostForm.Get("code")), time.Now())
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			oauthError(w, http.StatusBadRequest, "invalid_grant", "code is invalid or expired")
+			return
+		}
+		a.logger.Error().Err(err).Msg("Token exchange failed")
+		e.ServerError(w, e.RespDBDataUpdateFailure)
+		return
+	}
+
+	if code.ClientID != client.ID || code.RedirectURI != r.PostForm.Get("redirect_uri") {
+		oauthError(w, http.StatusBadRequest, "invalid_grant", "code was issued to another client or redirect_uri")
+		return
+	}
+	if !VerifyPKCE(r.PostForm.Get("code_verifier"), code.CodeChallenge) {
+		oauthError(w, http.StatusBadRequest, "invalid_grant", "code_verifier does not match")
+		return
+	}
+
+	// The code is deleted with its session, so only the account is left to
+	// check.
+	user, err := a.users.Read(code.UserID)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			oauthError(w, http.StatusBadRequest, "invalid_grant", "account no longer exists")
+			return
+		}
+		a.logger.Error().Err(err).Msg("Token exchange failed")
+		e.ServerError(w, e.RespDBDataAccessFailure)
+		return
+	}
+	if !user.Status.CanLogin() {
+		oauthError(w, http.StatusBadRequest, "invalid_grant", "account is "+user.Status.ToString())
+		return
+	}
+
+	sid := code.SessionID.String()
+	accessToken, err := a.tokens.IssueOAuth(user.ID.String(), client.ID.String(), code.Scope, sid)
+	if err != nil {
+		a.logger.Error().Err(err).Msg("Token exchange failed")
+		e.ServerError(w, e.RespTokenGenerateFailure)
+		return
+	}
+
+	claims := &token.IDClaims{
+		Issuer:    a.issuer(),
+		Subject:   user.ID.String(),
+		Audience:  client.ID.String(),
+		AuthTime:  code.AuthTime.Unix(),
+		Nonce:     code.Nonce,
+		SessionID: sid,
+	}
+	if hasScope(code.Scope, ScopeProfile) {
+		claims.Name = user.Name
+		claims.Role = user.Role.ToString()
+	}
+	if hasScope(code.Scope, ScopeEmail) {
+		claims.Email = user.Email
+		claims.EmailVerified = emailVerified(user)
+	}
+	idToken, err := a.tokens.SignIDToken(claims)
+	if err != nil {
+		a.logger.Error().Err(err).Msg("Token exchange failed")
+		e.ServerError(w, e.RespTokenGenerateFailure)
+		return
+	}
+
+	audit.Record(r.Context(), "oauth.token", "user", user.ID.String(), nil, map[string]string{"clientId": client.ID.String()})
+
+	response := &TokenResponse{
+		AccessToken: accessToken,
+		TokenType:   "Bearer",
+		ExpiresIn:   int64(a.tokens.AccessTTL().Seconds()),
+		IDToken:     idToken,
+		Scope:       code.Scope,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		a.logger.Error().Err(err).Msg("Token exchange failed")
+		e.ServerError(w, e.RespJSONEncodeFailure)
+		return
+	}
+}
+
+// UserInfo godoc
+//
+//	@summary		UserInfo endpoint
+//	@description	Claims about the user an access token from the token endpoint was issued for. name and role require the profile scope, email the email scope.
+//	@tags			oidc
+//	@produce		json
+//	@param			Authorization	header	string	true	"Bearer ACCESS_TOKEN"
+//	@success		200	{object}	UserInfo
+//	@failure		401
+//	@failure		404
+//	@failure		500	{object}	error.Error
+//	@router			/../userinfo [get]
+func (a *API) UserInfo(w http.ResponseWriter, r *http.Request) {
+	if a.tokens == nil {
+		e.NotFound(w)
+		return
+	}
+
+	audit.Record(r.Context(), "oauth.userinfo", "user", "", nil, nil)
+
+	raw, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		invalidToken(w)
+		return
+	}
+
+	claims, err := a.tokens.Parse(raw, token.TypeOAuth)
+	if err != nil {
+		invalidToken(w)
+		return
+	}
+
+	user, ok, err := a.tokenUser(claims)
+	if err != nil {
+		a.logger.Error().Err(err).Msg("UserInfo failed")
+		e.ServerError(w, e.RespDBDataAccessFailure)
+		return
+	}
+	if !ok {
+		invalidToken(w)
+		return
+	}
+
+	audit.Record(r.Context(), "oauth.userinfo", "user", user.ID.String(), nil, map[string]string{"clientId": claims.ClientID})
+
+	info := &UserInfo{Subject: user.ID.String()}
+	if hasScope(claims.Scope, ScopeProfile) {
+		info.Name = user.Name
+		info.Role = user.Role.ToString()
+	}
+	if hasScope(claims.Scope, ScopeEmail) {
+		info.Email = user.Email
+		info.EmailVerified = emailVerified(user)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(info); err != nil {
+		a.logger.Error().Err(err).Msg("UserInfo failed")
+		e.ServerError(w, e.RespJSONEncodeFailure)
+		return
+	}
+}
+
+// ListClients godoc
+//
+//	@summary		List OAuth clients
+//	@description	List the relying parties that can log users in, including revoked ones
+//	@tags			clients
+//	@accept			json
+//	@produce		json
+//	@success		200	{array}		ClientResponse
+//	@failure		403	{object}	error.Error
+//	@failure		500	{object}	error.Error
+//	@router			/clients [get]
+func (a *API) ListClients(w http.ResponseWriter, _ *http.Request) {
+	clients, err := a.repository.ListClients()
+	if err != nil {
+		a.logger.Error().Err(err).Msg("List clients failed")
+		e.ServerError(w, e.RespDBDataAccessFailure)
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(clients.ToResponse()); err != nil {
+		a.logger.Error().Err(err).Msg("List clients failed")
+		e.ServerError(w, e.RespJSONEncodeFailure)
+		return
+	}
+}
+
+// CreateClient godoc
+//
+//	@summary		Create OAuth client
+//	@description	Register a relying party. The secret of a confidential client is only returned in this response.
+//	@tags			clients
+//	@accept			json
+//	@produce		json
+//	@param			body	body	ClientForm	true	"Client form"
+//	@success		201	{object}	ClientCreatedResponse
+//	@failure		403	{object}	error.Error
+//	@failure		422	{object}	error.Errors
+//	@failure		500	{object}	error.Error
+//	@router			/clients [post]
+func (a *API) CreateClient(w http.ResponseWriter, r *http.Request) {
+	form := &ClientForm{}
+	if err := json.NewDecoder(r.Body).Decode(form); err != nil {
+		a.logger.Error().Err(err).Msg("Create client failed")
+		e.ServerError(w, e.RespJSONDecodeFailure)
+		return
+	}
+
+	if err := a.validator.Struct(form); err != nil {
+		a.logger.Error().Err(err).Msg("Create client failed")
+		respBody, err := json.Marshal(validatorUtil.ToErrResponse(err))
+		if err != nil {
+			e.ServerError(w, e.RespJSONEncodeFailure)
+			return
+		}
+
+		e.ValidationErrors(w, respBody)
+		return
+	}
+
+	client, secret, err := form.ToModel()
+	if err != nil {
+		a.logger.Error().Err(err).Msg("Create client failed")
+		e.ServerError(w, e.RespTokenGenerateFailure)
+		return
+	}
+
+	if _, err := a.repository.CreateClient(client); err != nil {
+		a.logger.Error().Err(err).Msg("Create client failed")
+		e.ServerError(w, e.RespDBDataInsertFailure)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	response := &ClientCreatedResponse{ClientResponse: client.ToResponse(), Secret: secret}
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		a.logger.Error().Err(err).Msg("Create client failed")
+		e.ServerError(w, e.RespJSONEncodeFailure)
+		return
+	}
+}
+
+// RevokeClient godoc
+//
+//	@summary		Revoke OAuth client
+//	@description	Revoke a relying party. Its unredeemed codes are deleted; issued tokens expire on their own.
+//	@tags			clients
+//	@accept			json
+//	@produce		json
+//	@param			id	path	string	true	"Client ID"
+//	@success		200
+//	@failure		400	{object}	error.Error
+//	@failure		403	{object}	error.Error
+//	@failure		404
+//	@failure		500	{object}	error.Error
+//	@router			/clients/{id} [delete]
+func (a *API) RevokeClient(w http.ResponseWriter, r *http.Request) {
+	id, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		a.logger.Error().Err(err).Msg("Revoke client failed")
+		e.BadRequest(w, e.RespInvalidURLParamID)
+		return
+	}
+
+	rows, err := a.repository.RevokeClient(id, time.Now())
+	if err != nil {
+		a.logger.Error().Err(err).Msg("Revoke client failed")
+		e.ServerError(w, e.RespDBDataUpdateFailure)
+		return
+	}
+	if rows == 0 {
+		e.NotFound(w)
+		return
+	}
+}
+
+func (a *API) issuer() string {
+	return strings.TrimSuffix(a.config.Issuer, "/")
+}
+
+// loggedIn returns the login session of the request, or nil when there is no
+// valid one or the account is no longer active.
+func (a *API) loggedIn(r *http.Request) (*users.UserSession, error) {
+	cookie, err := a.store.Get(r, "session")
+	if err != nil {
+		return nil, nil
+	}
+
+	sid, _ := cookie.Values["sid"].(string)
+	id, _ := cookie.Values["id"].(string)
+	sessionID, err := uuid.Parse(sid)
+	if err != nil {
+		return nil, nil
+	}
+	userID, err := uuid.Parse(id)
+	if err != nil {
+		return nil, nil
+	}
+
+	session, err := a.users.GetSession(sessionID)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if session.UserID != userID {
+		return nil, nil
+	}
+
+	active, err := a.users.IsActive(userID)
+	if err != nil || !active {
+		return nil, err
+	}
+
+	return session, nil
+}
+
+// authenticateClient returns the client of a token request, or nil when its
+// credentials are wrong. Public clients must not send a secret.
+func (a *API) authenticateClient(r *http.Request) (*Client, error) {
+	id, secret, ok := r.BasicAuth()
+	if ok {
+		// RFC 6749 form-encodes the credentials before Basic encoding them.
+		id, _ = url.QueryUnescape(id)
+		secret, _ = url.QueryUnescape(secret)
+	} else {
+		id = r.PostForm.Get("client_id")
+		secret = r.PostForm.Get("client_secret")
+	}
+
+	clientID, err := uuid.Parse(id)
+	if err != nil {
+		return nil, nil
+	}
+
+	client, err := a.repository.GetClient(clientID)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	if client.IsPublic() {
+		if secret != "" {
+			return nil, nil
+		}
+		return client, nil
+	}
+	if subtle.ConstantTimeCompare(HashSecret(secret), client.SecretHash) != 1 {
+		return nil, nil
+	}
+
+	return client, nil
+}
+
+// tokenUser returns the user of an access token as long as the account is
+// active and the login session the token was issued for was not ended.
+func (a *API) tokenUser(claims *token.Claims) (*users.User, bool, error) {
+	id, err := uuid.Parse(claims.Subject)
+	if err != nil {
+		return nil, false, nil
+	}
+	sid, err := uuid.Parse(claims.SessionID)
+	if err != nil {
+		return nil, false, nil
+	}
+
+	user, err := a.users.Read(id)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+	if !user.Status.CanLogin() {
+		return nil, false, nil
+	}
+
+	if _, err := a.users.GetSession(sid); err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+
+	return user, true, nil
+}
+
+func emailVerified(user *users.User) *bool {
+	verified := user.EmailVerifiedAt != nil
+	return &verified
+}
+
+// redirect sends the user agent back to the client with the parameters added
+// to the query of the redirect URI. Empty parameters are left out.
+func redirect(w http.ResponseWriter, r *http.Request, redirectURI string, params url.Values) {
+	u, err := url.Parse(redirectURI)
+	if err != nil {
+		oauthError(w, http.StatusBadRequest, "invalid_request", "redirect_uri is invalid")
+		return
+	}
+
+	q := u.Query()
+	for k, v := range params {
+		if len(v) > 0 && v[0] != "" {
+			q.Set(k, v[0])
+		}
+	}
+	u.RawQuery = q.Encode()
+
+	http.Redirect(w, r, u.String(), http.StatusFound)
+}
+
+func oauthError(w http.ResponseWriter, status int, code, description string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(&ErrorResponse{Error: code, Description: description})
+}
+
+func invalidToken(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+	http.Error(w, "Invalid or expired token!", http.StatusUnauthorized)
+}
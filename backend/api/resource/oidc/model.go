@@ -0,0 +1,253 @@
+package oidc
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql/driver"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	ScopeOpenID  = "openid"
+	ScopeProfile = "profile"
+	ScopeEmail   = "email"
+)
+
+var supportedScopes = []string{ScopeOpenID, ScopeProfile, ScopeEmail}
+
+// Config configures the provider.
+type Config struct {
+	// Enabled turns the provider on. ID tokens are signed with the active
+	// token key, which has to be an RS256 key published in the JWKS.
+	Enabled bool
+	// Issuer is the public base URL of the service. Relying parties compare it
+	// with the iss claim of ID tokens.
+	Issuer string
+	// LoginURL is the frontend page users without a session are sent to. The
+	// authorization request to resume afterwards is passed as the returnTo
+	// query parameter.
+	LoginURL string
+	CodeTTL  time.Duration
+}
+
+var DefaultConfig = Config{
+	Enabled:  true,
+	Issuer:   "http://127.0.0.1:8080",
+	LoginURL: "http://127.0.0.1:3000/login",
+	CodeTTL:  time.Minute,
+}
+
+var GenerateSecret = func() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "hhs_" + hex.EncodeToString(b), nil
+}
+
+func HashSecret(secret string) []byte {
+	sum := sha256.Sum256([]byte(secret))
+	return sum[:]
+}
+
+// RedirectURIs is stored as a space separated list; registered URIs cannot
+// contain spaces.
+type RedirectURIs []string
+
+func (u RedirectURIs) Value() (driver.Value, error) {
+	return strings.Join(u, " "), nil
+}
+
+func (u *RedirectURIs) Scan(value any) error {
+	switch v := value.(type) {
+	case string:
+		*u = strings.Fields(v)
+	case []byte:
+		*u = strings.Fields(string(v))
+	case nil:
+		*u = nil
+	default:
+		return fmt.Errorf("cannot scan %T into RedirectURIs", value)
+	}
+	return nil
+}
+
+type ClientForm struct {
+	Name         string   `json:"name" form:"required,max=255"`
+	RedirectURIs []string `json:"redirectUris" form:"required,min=1,dive,url,max=2048"`
+	// Public clients, e.g. single page or mobile apps, cannot keep a secret
+	// and only authenticate with PKCE.
+	Public bool `json:"public"`
+}
+
+type ClientResponse struct {
+	ID           uuid.UUID  `json:"id"`
+	Name         string     `json:"name"`
+	RedirectURIs []string   `json:"redirectUris"`
+	Public       bool       `json:"public"`
+	RevokedAt    *time.Time `json:"revokedAt"`
+	CreatedAt    time.Time  `json:"createdAt"`
+}
+
+// ClientCreatedResponse is only returned once, the plain secret is not stored.
+type ClientCreatedResponse struct {
+	*ClientResponse
+	Secret string `json:"secret,omitempty"`
+}
+
+// Client is a relying party registered to log users in with this service.
+// Its ID is the OAuth client_id.
+type Client struct {
+	ID           uuid.UUID `gorm:"primarykey"`
+	Name         string
+	SecretHash   []byte
+	RedirectURIs RedirectURIs `gorm:"type:text"`
+	RevokedAt    *time.Time
+	CreatedAt    time.Time
+}
+
+type Clients []*Client
+
+func (c *Client) IsPublic() bool {
+	return c.SecretHash == nil
+}
+
+// AllowsRedirect reports whether uri is registered. URIs are compared as
+// strings, as OAuth 2.0 Security Best Current Practice requires.
+func (c *Client) AllowsRedirect(uri string) bool {
+	return slices.Contains(c.RedirectURIs, uri)
+}
+
+func (c *Client) ToResponse() *ClientResponse {
+	return &ClientResponse{
+		ID:           c.ID,
+		Name:         c.Name,
+		RedirectURIs: c.RedirectURIs,
+		Public:       c.IsPublic(),
+		RevokedAt:    c.RevokedAt,
+		CreatedAt:    c.CreatedAt,
+	}
+}
+
+func (clients Clients) ToResponse() []*ClientResponse {
+	response := make([]*ClientResponse, 0, len(clients))
+	for _, c := range clients {
+		response = append(response, c.ToResponse())
+	}
+	return response
+}
+
+// ToModel returns the client to store together with the plain secret, which
+// is handed to the caller once and never persisted. Public clients get none.
+func (f *ClientForm) ToModel() (*Client, string, error) {
+	client := &Client{
+		ID:           uuid.New(),
+		Name:         f.Name,
+		RedirectURIs: f.RedirectURIs,
+	}
+	if f.Public {
+		return client, "", nil
+	}
+
+	secret, err := GenerateSecret()
+	if err != nil {
+		return nil, "", err
+	}
+	client.SecretHash = HashSecret(secret)
+
+	return client, secret, nil
+}
+
+// AuthorizationCode is issued by the authorization endpoint and redeemed once
+// at the token endpoint. It belongs to the login session of the user and is
+// deleted together with it.
+type AuthorizationCode struct {
+	CodeHash      []byte `gorm:"primarykey"`
+	ClientID      uuid.UUID
+	UserID        uuid.UUID
+	SessionID     uuid.UUID
+	RedirectURI   string
+	Scope         string
+	Nonce         string
+	CodeChallenge string
+	AuthTime      time.Time
+	ExpiresAt     time.Time
+	UsedAt        *time.Time
+	CreatedAt     time.Time
+}
+
+// Discovery is the OpenID Provider Metadata.
+type Discovery struct {
+	Issuer                            string   `json:"issuer"`
+	AuthorizationEndpoint             string   `json:"authorization_endpoint"`
+	TokenEndpoint                     string   `json:"token_endpoint"`
+	UserInfoEndpoint                  string   `json:"userinfo_endpoint"`
+	JWKSURI                           string   `json:"jwks_uri"`
+	ResponseTypesSupported            []string `json:"response_types_supported"`
+	GrantTypesSupported               []string `json:"grant_types_supported"`
+	SubjectTypesSupported             []string `json:"subject_types_supported"`
+	IDTokenSigningAlgValuesSupported  []string `json:"id_token_signing_alg_values_supported"`
+	ScopesSupported                   []string `json:"scopes_supported"`
+	TokenEndpointAuthMethodsSupported []string `json:"token_endpoint_auth_methods_supported"`
+	CodeChallengeMethodsSupported     []string `json:"code_challenge_methods_supported"`
+	ClaimsSupported                   []string `json:"claims_supported"`
+}
+
+type TokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int64  `json:"expires_in"`
+	IDToken     string `json:"id_token"`
+	Scope       string `json:"scope"`
+}
+
+// ErrorResponse is the error format of RFC 6749.
+type ErrorResponse struct {
+	Error       string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+}
+
+type UserInfo struct {
+	Subject       string `json:"sub"`
+	Name          string `json:"name,omitempty"`
+	Email         string `json:"email,omitempty"`
+	EmailVerified *bool  `json:"email_verified,omitempty"`
+	Role          string `json:"role,omitempty"`
+}
+
+// ParseScope drops scopes that are not supported and reports whether openid,
+// which makes the request an OpenID Connect one, was requested.
+func ParseScope(scope string) (string, bool) {
+	var granted []string
+	for _, s := range strings.Fields(scope) {
+		if slices.Contains(supportedScopes, s) && !slices.Contains(granted, s) {
+			granted = append(granted, s)
+		}
+	}
+
+	return strings.Join(granted, " "), slices.Contains(granted, ScopeOpenID)
+}
+
+func hasScope(scope, s string) bool {
+	return slices.Contains(strings.Fields(scope), s)
+}
+
+var verifierPattern = regexp.MustCompile(`^[A-Za-z0-9\-._~]{43,128}$`)
+
+// VerifyPKCE checks a code verifier against an S256 code challenge.
+func VerifyPKCE(verifier, challenge string) bool {
+	if !verifierPattern.MatchString(verifier) {
+		return false
+	}
+
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:]) == challenge
+}
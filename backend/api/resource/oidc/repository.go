@@ -0,0 +1,95 @@
+package oidc
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type Repository struct {
+	db *gorm.DB
+}
+
+func NewRepository(db *gorm.DB) *Repository {
+	return &Repository{
+		db: db,
+	}
+}
+
+func (r *Repository) ListClients() (Clients, error) {
+	var clients Clients
+	if err := r.db.Order("created_at desc").Find(&clients).Error; err != nil {
+		return nil, err
+	}
+
+	return clients, nil
+}
+
+func (r *Repository) CreateClient(client *Client) (*Client, error) {
+	if err := r.db.Create(client).Error; err != nil {
+		return nil, err
+	}
+
+	return client, nil
+}
+
+// GetClient returns a client that was not revoked.
+func (r *Repository) GetClient(id uuid.UUID) (*Client, error) {
+	client := &Client{}
+	if err := r.db.Where("id = ? AND revoked_at IS NULL", id).First(client).Error; err != nil {
+		return nil, err
+	}
+
+	return client, nil
+}
+
+// RevokeClient revokes the client together with its pending codes.
+func (r *Repository) RevokeClient(id uuid.UUID, now time.Time) (int64, error) {
+	var rows int64
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&Client{}).
+			Where("id = ? AND revoked_at IS NULL", id).
+			Update("revoked_at", now)
+		if result.Error != nil {
+			return result.Error
+		}
+		rows = result.RowsAffected
+
+		return tx.Where("client_id = ?", id).Delete(&AuthorizationCode{}).Error
+	})
+
+	return rows, err
+}
+
+func (r *Repository) CreateCode(code *AuthorizationCode) error {
+	return r.db.Create(code).Error
+}
+
+// RedeemCode marks a valid code as used and returns it. The row is locked so
+// that a code cannot be exchanged twice concurrently.
+func (r *Repository) RedeemCode(codeHash []byte, now time.Time) (*AuthorizationCode, error) {
+	code := &AuthorizationCode{}
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("code_hash = ? AND used_at IS NULL AND expires_at > ?", codeHash, now).
+			First(code).Error; err != nil {
+			return err
+		}
+
+		return tx.Model(&AuthorizationCode{}).
+			Where("code_hash = ?", codeHash).
+			Update("used_at", now).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return code, nil
+}
+
+// DeleteExpiredCodes removes codes that can no longer be redeemed.
+func (r *Repository) DeleteExpiredCodes(now time.Time) error {
+	return r.db.Where("expires_at <= ?", now).Delete(&AuthorizationCode{}).Error
+}
@@ -0,0 +1,549 @@
+package profiles
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+
+	"github.com/go-chi/chi"
+	"github.com/go-playground/validator/v10"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog"
+	"gorm.io/gorm"
+
+	e "backend/api/resource/common/error"
+	"backend/api/resource/users"
+	"backend/utils/pagination"
+	validatorUtil "backend/utils/validator"
+)
+
+type API struct {
+	repository *Repository
+	users      *users.Repository
+	validator  *validator.Validate
+	logger     *zerolog.Logger
+}
+
+func New(l *zerolog.Logger, db *gorm.DB, v *validator.Validate) *API {
+	return &API{
+		repository: NewRepository(db),
+		users:      users.NewRepository(db),
+		validator:  v,
+		logger:     l,
+	}
+}
+
+// ReadPatient godoc
+//
+//	@summary		Read patient profile
+//	@description	Read the personal data of a patient
+//	@tags			profiles
+//	@accept			json
+//	@produce		json
+//	@param			id	path		string	true	"User ID"
+//	@success		200	{object}	PatientProfileResponse
+//	@failure		400	{object}	error.Error
+//	@failure		403	{object}	error.Error
+//	@failure		404
+//	@failure		500	{object}	error.Error
+//	@router			/users/{id}/patient-profile [get]
+func (a *API) ReadPatient(w http.ResponseWriter, r *http.Request) {
+	id, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		a.logger.Error().Err(err).Msg("Read patient profile failed")
+		e.BadRequest(w, e.RespInvalidURLParamID)
+		return
+	}
+
+	if !a.hasRole(w, id, users.Patient) {
+		return
+	}
+
+	profile, err := a.repository.GetPatient(id)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			e.NotFound(w)
+			return
+		}
+
+		a.logger.Error().Err(err).Msg("Read patient profile failed")
+		e.ServerError(w, e.RespDBDataAccessFailure)
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(profile.ToResponse()); err != nil {
+		a.logger.Error().Err(err).Msg("Read patient profile failed")
+		e.ServerError(w, e.RespJSONEncodeFailure)
+		return
+	}
+}
+
+// UpdatePatient godoc
+//
+//	@summary		Update patient profile
+//	@description	Create or replace the personal data of a patient. A PESEL has to match the date of birth and sex, the date of birth is taken from it when left out.
+//	@tags			profiles
+//	@accept			json
+//	@produce		json
+//	@param			id		path	string				true	"User ID"
+//	@param			body	body	PatientProfileForm	true	"Patient profile form"
+//	@success		200	{object}	PatientProfileResponse
+//	@failure		400	{object}	error.Error
+//	@failure		403	{object}	error.Error
+//	@failure		404
+//	@failure		409
+//	@failure		422	{object}	error.Errors
+//	@failure		500	{object}	error.Error
+//	@router			/users/{id}/patient-profile [put]
+func (a *API) UpdatePatient(w http.ResponseWriter, r *http.Request) {
+	id, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		a.logger.Error().Err(err).Msg("Update patient profile failed")
+		e.BadRequest(w, e.RespInvalidURLParamID)
+		return
+	}
+
+	form := &PatientProfileForm{}
+	if err := json.NewDecoder(r.Body).Decode(form); err != nil {
+		a.logger.Error().Err(err).Msg("Update patient profile failed")
+		e.ServerError(w, e.RespJSONDecodeFailure)
+		return
+	}
+
+	if err := a.validator.Struct(form); err != nil {
+		a.logger.Error().Err(err).Msg("Update patient profile failed")
+		respBody, err := json.Marshal(validatorUtil.ToErrResponse(err))
+		if err != nil {
+			e.ServerError(w, e.RespJSONEncodeFailure)
+			return
+		}
+
+		e.ValidationErrors(w, respBody)
+		return
+	}
+
+	if mismatches := form.Mismatches(); len(mismatches) > 0 {
+		respBody, err := json.Marshal(&validatorUtil.ErrResponse{Errors: mismatches})
+		if err != nil {
+			e.ServerError(w, e.RespJSONEncodeFailure)
+			return
+		}
+
+		e.ValidationErrors(w, respBody)
+		return
+	}
+
+	if !a.hasRole(w, id, users.Patient) {
+		return
+	}
+
+	if form.PESEL != "" {
+		taken, err := a.repository.PESELTaken(form.PESEL, id)
+		if err != nil {
+			a.logger.Error().Err(err).Msg("Update patient profile failed")
+			e.ServerError(w, e.RespDBDataAccessFailure)
+			return
+		}
+		if taken {
+			http.Error(w, "PESEL already belongs to another patient!", http.StatusConflict)
+			return
+		}
+	}
+
+	profile, err := a.repository.SavePatient(form.ToModel(id))
+	if err != nil {
+		a.logger.Error().Err(err).Msg("Update patient profile failed")
+		e.ServerError(w, e.RespDBDataUpdateFailure)
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(profile.ToResponse()); err != nil {
+		a.logger.Error().Err(err).Msg("Update patient profile failed")
+		e.ServerError(w, e.RespJSONEncodeFailure)
+		return
+	}
+}
+
+// Directory godoc
+//
+//	@summary		List doctors
+//	@description	Public directory of active doctors, ordered by name
+//	@tags			doctors
+//	@accept			json
+//	@produce		json
+//	@param			page		query	int		false	"Page number"
+//	@param			limit		query	int		false	"Number of items per page"
+//	@param			specialty	query	string	false	"Specialty slug to filter by"
+//	@param			language	query	string	false	"Language tag to filter by"
+//	@success		200	{object}	DirectoryResponse
+//	@failure		422	{object}	error.Errors
+//	@failure		500	{object}	error.Error
+//	@router			/doctors [get]
+func (a *API) Directory(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	pagination := &pagination.Pagination{}
+	pagination.Parse(query)
+	if err := a.validator.Struct(pagination); err != nil {
+		a.logger.Error().Err(err).Msg("List doctors failed")
+		respBody, err := json.Marshal(validatorUtil.ToErrResponse(err))
+		if err != nil {
+			e.ServerError(w, e.RespJSONEncodeFailure)
+			return
+		}
+
+		e.ValidationErrors(w, respBody)
+		return
+	}
+
+	filter := DirectoryFilter{
+		Specialty: query.Get("specialty"),
+		Language:  query.Get("language"),
+	}
+	pagination, err := a.repository.Directory(filter, *pagination)
+	if err != nil {
+		a.logger.Error().Err(err).Msg("List doctors failed")
+		e.ServerError(w, e.RespDBDataAccessFailure)
+		return
+	}
+
+	profiles, ok := pagination.Rows.(DoctorProfiles)
+	if !ok {
+		a.logger.Error().Msg("List doctors failed")
+		e.ServerError(w, e.RespJSONEncodeFailure)
+		return
+	}
+
+	response := profiles.ToResponse()
+	response.TotalItems = pagination.TotalRows
+	response.NumberOfPages = pagination.TotalPages
+	response.CurrentPage = pagination.Page
+
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		a.logger.Error().Err(err).Msg("List doctors failed")
+		e.ServerError(w, e.RespJSONEncodeFailure)
+		return
+	}
+}
+
+// ReadDoctor godoc
+//
+//	@summary		Read doctor profile
+//	@description	Read the profile of a doctor
+//	@tags			doctors
+//	@accept			json
+//	@produce		json
+//	@param			id	path		string	true	"User ID"
+//	@success		200	{object}	DoctorProfileResponse
+//	@failure		400	{object}	error.Error
+//	@failure		403	{object}	error.Error
+//	@failure		404
+//	@failure		500	{object}	error.Error
+//	@router			/users/{id}/doctor-profile [get]
+func (a *API) ReadDoctor(w http.ResponseWriter, r *http.Request) {
+	id, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		a.logger.Error().Err(err).Msg("Read doctor profile failed")
+		e.BadRequest(w, e.RespInvalidURLParamID)
+		return
+	}
+
+	profile, err := a.repository.GetDoctor(id)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			e.NotFound(w)
+			return
+		}
+
+		a.logger.Error().Err(err).Msg("Read doctor profile failed")
+		e.ServerError(w, e.RespDBDataAccessFailure)
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(profile.ToResponse()); err != nil {
+		a.logger.Error().Err(err).Msg("Read doctor profile failed")
+		e.ServerError(w, e.RespJSONEncodeFailure)
+		return
+	}
+}
+
+// UpdateDoctor godoc
+//
+//	@summary		Update doctor profile
+//	@description	Create or replace the profile of a doctor
+//	@tags			doctors
+//	@accept			json
+//	@produce		json
+//	@param			id		path	string				true	"User ID"
+//	@param			body	body	DoctorProfileForm	true	"Doctor profile form"
+//	@success		200	{object}	DoctorProfileResponse
+//	@failure		400	{object}	error.Error
+//	@failure		403	{object}	error.Error
+//	@failure		404
+//	@failure		409
+//	@failure		422	{object}	error.Errors
+//	@failure		500	{object}	error.Error
+//	@router			/users/{id}/doctor-profile [put]
+func (a *API) UpdateDoctor(w http.ResponseWriter, r *http.Request) {
+	id, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		a.logger.Error().Err(err).Msg("Update doctor profile failed")
+		e.BadRequest(w, e.RespInvalidURLParamID)
+		return
+	}
+
+	form := &DoctorProfileForm{}
+	if err := json.NewDecoder(r.Body).Decode(form); err != nil {
+		a.logger.Error().Err(err).Msg("Update doctor profile failed")
+		e.ServerError(w, e.RespJSONDecodeFailure)
+		return
+	}
+
+	if err := a.validator.Struct(form); err != nil {
+		a.logger.Error().Err(err).Msg("Update doctor profile failed")
+		respBody, err := json.Marshal(validatorUtil.ToErrResponse(err))
+		if err != nil {
+			e.ServerError(w, e.RespJSONEncodeFailure)
+			return
+		}
+
+		e.ValidationErrors(w, respBody)
+		return
+	}
+
+	if !a.hasRole(w, id, users.Doctor) {
+		return
+	}
+
+	specialties, err := a.repository.SpecialtiesBySlugs(form.Specialties)
+	if err != nil {
+		a.logger.Error().Err(err).Msg("Update doctor profile failed")
+		e.ServerError(w, e.RespDBDataAccessFailure)
+		return
+	}
+	if unknown := unknownSlugs(form.Specialties, specialties); len(unknown) > 0 {
+		errs := make([]string, 0, len(unknown))
+		for _, slug := range unknown {
+			errs = append(errs, fmt.Sprintf("specialties contains the unknown specialty %s", slug))
+		}
+		respBody, err := json.Marshal(&validatorUtil.ErrResponse{Errors: errs})
+		if err != nil {
+			e.ServerError(w, e.RespJSONEncodeFailure)
+			return
+		}
+
+		e.ValidationErrors(w, respBody)
+		return
+	}
+
+	taken, err := a.repository.LicenseTaken(form.LicenseNumber, id)
+	if err != nil {
+		a.logger.Error().Err(err).Msg("Update doctor profile failed")
+		e.ServerError(w, e.RespDBDataAccessFailure)
+		return
+	}
+	if taken {
+		http.Error(w, "License number already belongs to another doctor!", http.StatusConflict)
+		return
+	}
+
+	profile, err := a.repository.SaveDoctor(form.ToModel(id, specialties))
+	if err != nil {
+		a.logger.Error().Err(err).Msg("Update doctor profile failed")
+		e.ServerError(w, e.RespDBDataUpdateFailure)
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(profile.ToResponse()); err != nil {
+		a.logger.Error().Err(err).Msg("Update doctor profile failed")
+		e.ServerError(w, e.RespJSONEncodeFailure)
+		return
+	}
+}
+
+// DeleteDoctor godoc
+//
+//	@summary		Delete doctor profile
+//	@description	Delete the profile of a doctor, which removes them from the directory
+//	@tags			doctors
+//	@accept			json
+//	@produce		json
+//	@param			id	path	string	true	"User ID"
+//	@success		200
+//	@failure		400	{object}	error.Error
+//	@failure		403	{object}	error.Error
+//	@failure		404
+//	@failure		500	{object}	error.Error
+//	@router			/users/{id}/doctor-profile [delete]
+func (a *API) DeleteDoctor(w http.ResponseWriter, r *http.Request) {
+	id, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		a.logger.Error().Err(err).Msg("Delete doctor profile failed")
+		e.BadRequest(w, e.RespInvalidURLParamID)
+		return
+	}
+
+	rows, err := a.repository.DeleteDoctor(id)
+	if err != nil {
+		a.logger.Error().Err(err).Msg("Delete doctor profile failed")
+		e.ServerError(w, e.RespDBDataRemoveFailure)
+		return
+	}
+	if rows == 0 {
+		e.NotFound(w)
+		return
+	}
+}
+
+// ListSpecialties godoc
+//
+//	@summary		List specialties
+//	@description	List the dictionary of specialties doctors can have
+//	@tags			doctors
+//	@accept			json
+//	@produce		json
+//	@success		200	{array}		SpecialtyResponse
+//	@failure		500	{object}	error.Error
+//	@router			/specialties [get]
+func (a *API) ListSpecialties(w http.ResponseWriter, _ *http.Request) {
+	specialties, err := a.repository.ListSpecialties()
+	if err != nil {
+		a.logger.Error().Err(err).Msg("List specialties failed")
+		e.ServerError(w, e.RespDBDataAccessFailure)
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(specialties.ToResponse()); err != nil {
+		a.logger.Error().Err(err).Msg("List specialties failed")
+		e.ServerError(w, e.RespJSONEncodeFailure)
+		return
+	}
+}
+
+// CreateSpecialty godoc
+//
+//	@summary		Create specialty
+//	@description	Add a specialty to the dictionary
+//	@tags			doctors
+//	@accept			json
+//	@produce		json
+//	@param			body	body	SpecialtyForm	true	"Specialty form"
+//	@success		201	{object}	SpecialtyResponse
+//	@failure		403	{object}	error.Error
+//	@failure		409
+//	@failure		422	{object}	error.Errors
+//	@failure		500	{object}	error.Error
+//	@router			/specialties [post]
+func (a *API) CreateSpecialty(w http.ResponseWriter, r *http.Request) {
+	form := &SpecialtyForm{}
+	if err := json.NewDecoder(r.Body).Decode(form); err != nil {
+		a.logger.Error().Err(err).Msg("Create specialty failed")
+		e.ServerError(w, e.RespJSONDecodeFailure)
+		return
+	}
+
+	if err := a.validator.Struct(form); err != nil {
+		a.logger.Error().Err(err).Msg("Create specialty failed")
+		respBody, err := json.Marshal(validatorUtil.ToErrResponse(err))
+		if err != nil {
+			e.ServerError(w, e.RespJSONEncodeFailure)
+			return
+		}
+
+		e.ValidationErrors(w, respBody)
+		return
+	}
+
+	existing, err := a.repository.GetSpecialtyBySlug(form.Slug)
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		a.logger.Error().Err(err).Msg("Create specialty failed")
+		e.ServerError(w, e.RespDBDataAccessFailure)
+		return
+	} else if existing != nil {
+		a.logger.Error().Msg("Specialty already exists")
+		http.Error(w, "Specialty already exists!", http.StatusConflict)
+		return
+	}
+
+	specialty, err := a.repository.CreateSpecialty(form.ToModel())
+	if err != nil {
+		a.logger.Error().Err(err).Msg("Create specialty failed")
+		e.ServerError(w, e.RespDBDataInsertFailure)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(specialty.ToResponse()); err != nil {
+		a.logger.Error().Err(err).Msg("Create specialty failed")
+		e.ServerError(w, e.RespJSONEncodeFailure)
+		return
+	}
+}
+
+// DeleteSpecialty godoc
+//
+//	@summary		Delete specialty
+//	@description	Remove a specialty from the dictionary and from every doctor having it
+//	@tags			doctors
+//	@accept			json
+//	@produce		json
+//	@param			id	path	string	true	"Specialty ID"
+//	@success		200
+//	@failure		400	{object}	error.Error
+//	@failure		403	{object}	error.Error
+//	@failure		404
+//	@failure		500	{object}	error.Error
+//	@router			/specialties/{id} [delete]
+func (a *API) DeleteSpecialty(w http.ResponseWriter, r *http.Request) {
+	id, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		a.logger.Error().Err(err).Msg("Delete specialty failed")
+		e.BadRequest(w, e.RespInvalidURLParamID)
+		return
+	}
+
+	rows, err := a.repository.DeleteSpecialty(id)
+	if err != nil {
+		a.logger.Error().Err(err).Msg("Delete specialty failed")
+		e.ServerError(w, e.RespDBDataRemoveFailure)
+		return
+	}
+	if rows == 0 {
+		e.NotFound(w)
+		return
+	}
+}
+
+// hasRole writes 404 unless the user exists and has the role, only patients
+// have a patient profile and only doctors a doctor profile.
+func (a *API) hasRole(w http.ResponseWriter, id uuid.UUID, role users.Role) bool {
+	user, err := a.users.Read(id)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			e.NotFound(w)
+			return false
+		}
+
+		a.logger.Error().Err(err).Msg("Read user failed")
+		e.ServerError(w, e.RespDBDataAccessFailure)
+		return false
+	}
+	if user.Role != role {
+		e.NotFound(w)
+		return false
+	}
+
+	return true
+}
+
+// unknownSlugs lists the slugs no specialty was found for.
+func unknownSlugs(slugs []string, specialties Specialties) []string {
+	var unknown []string
+	for _, slug := range slugs {
+		if !slices.ContainsFunc(specialties, func(s *Specialty) bool { return s.Slug == slug }) {
+			unknown = append(unknown, slug)
+		}
+	}
+	return unknown
+}
@@ -0,0 +1,327 @@
+package profiles
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+
+	"backend/api/resource/users"
+	validatorUtil "backend/utils/validator"
+)
+
+const (
+	SexFemale = "female"
+	SexMale   = "male"
+	SexOther  = "other"
+)
+
+type Address struct {
+	Line1      string `json:"line1" form:"max=255"`
+	Line2      string `json:"line2" form:"max=255"`
+	City       string `json:"city" form:"max=100"`
+	PostalCode string `json:"postalCode" form:"max=16"`
+	Country    string `json:"country" form:"omitempty,iso3166_1_alpha2"`
+}
+
+type EmergencyContact struct {
+	Name     string `json:"name" form:"required_with=Phone,max=255"`
+	Phone    string `json:"phone" form:"omitempty,e164"`
+	Relation string `json:"relation" form:"max=64"`
+}
+
+// PatientProfileForm replaces the whole profile, fields left out are cleared.
+type PatientProfileForm struct {
+	DateOfBirth      string           `json:"dateOfBirth" form:"omitempty,datetime=2006-01-02,past_date"`
+	Sex              string           `json:"sex" form:"omitempty,oneof=female male other"`
+	Phone            string           `json:"phone" form:"omitempty,e164"`
+	Address          Address          `json:"address"`
+	PESEL            string           `json:"pesel" form:"omitempty,pesel"`
+	InsuranceNumber  string           `json:"insuranceNumber" form:"max=64"`
+	EmergencyContact EmergencyContact `json:"emergencyContact"`
+}
+
+type PatientProfileResponse struct {
+	UserID           uuid.UUID        `json:"userId"`
+	DateOfBirth      *string          `json:"dateOfBirth"`
+	Sex              string           `json:"sex"`
+	Phone            string           `json:"phone"`
+	Address          Address          `json:"address"`
+	PESEL            string           `json:"pesel"`
+	InsuranceNumber  string           `json:"insuranceNumber"`
+	EmergencyContact EmergencyContact `json:"emergencyContact"`
+	UpdatedAt        time.Time        `json:"updatedAt"`
+}
+
+// PatientProfile holds the personal data of a patient needed by the
+// appointment and documentation systems.
+type PatientProfile struct {
+	UserID           uuid.UUID `gorm:"primarykey"`
+	DateOfBirth      *time.Time
+	Sex              string
+	Phone            string
+	Address          Address `gorm:"embedded;embeddedPrefix:address_"`
+	PESEL            *string `gorm:"column:pesel"`
+	InsuranceNumber  string
+	EmergencyContact EmergencyContact `gorm:"embedded;embeddedPrefix:emergency_contact_"`
+	UpdatedAt        time.Time
+}
+
+// Mismatches lists the fields that contradict the date of birth and sex
+// encoded in the PESEL.
+func (f *PatientProfileForm) Mismatches() []string {
+	if f.PESEL == "" {
+		return nil
+	}
+
+	birthDate, female, ok := validatorUtil.ParsePESEL(f.PESEL)
+	if !ok {
+		return nil
+	}
+
+	var mismatches []string
+	if f.DateOfBirth != "" && f.DateOfBirth != birthDate.Format(time.DateOnly) {
+		mismatches = append(mismatches, "dateOfBirth does not match the date of birth in pesel")
+	}
+	if (f.Sex == SexFemale && !female) || (f.Sex == SexMale && female) {
+		mismatches = append(mismatches, "sex does not match the sex in pesel")
+	}
+	return mismatches
+}
+
+// ToModel fills in the date of birth from the PESEL when it is not given.
+func (f *PatientProfileForm) ToModel(userID uuid.UUID) *PatientProfile {
+	profile := &PatientProfile{
+		UserID:           userID,
+		Sex:              f.Sex,
+		Phone:            f.Phone,
+		Address:          f.Address,
+		InsuranceNumber:  f.InsuranceNumber,
+		EmergencyContact: f.EmergencyContact,
+	}
+
+	if date, err := time.Parse(time.DateOnly, f.DateOfBirth); err == nil {
+		profile.DateOfBirth = &date
+	}
+	if f.PESEL != "" {
+		pesel := f.PESEL
+		profile.PESEL = &pesel
+		if birthDate, _, ok := validatorUtil.ParsePESEL(pesel); ok && profile.DateOfBirth == nil {
+			profile.DateOfBirth = &birthDate
+		}
+	}
+
+	return profile
+}
+
+func (p *PatientProfile) ToResponse() *PatientProfileResponse {
+	response := &PatientProfileResponse{
+		UserID:           p.UserID,
+		Sex:              p.Sex,
+		Phone:            p.Phone,
+		Address:          p.Address,
+		InsuranceNumber:  p.InsuranceNumber,
+		EmergencyContact: p.EmergencyContact,
+		UpdatedAt:        p.UpdatedAt,
+	}
+	if p.DateOfBirth != nil {
+		date := p.DateOfBirth.Format(time.DateOnly)
+		response.DateOfBirth = &date
+	}
+	if p.PESEL != nil {
+		response.PESEL = *p.PESEL
+	}
+
+	return response
+}
+
+// StringList is stored as a JSON array.
+type StringList []string
+
+func (l StringList) Value() (driver.Value, error) {
+	if l == nil {
+		return "[]", nil
+	}
+	b, err := json.Marshal(l)
+	return string(b), err
+}
+
+func (l *StringList) Scan(value any) error {
+	switch v := value.(type) {
+	case string:
+		return json.Unmarshal([]byte(v), l)
+	case []byte:
+		return json.Unmarshal(v, l)
+	case nil:
+		*l = nil
+		return nil
+	default:
+		return fmt.Errorf("cannot scan %T into StringList", value)
+	}
+}
+
+type SpecialtyForm struct {
+	Slug string `json:"slug" form:"required,max=64,slug"`
+	Name string `json:"name" form:"required,max=255"`
+}
+
+type SpecialtyResponse struct {
+	ID   uuid.UUID `json:"id"`
+	Slug string    `json:"slug"`
+	Name string    `json:"name"`
+}
+
+// Specialty is an entry of the dictionary of medical specialties.
+type Specialty struct {
+	ID        uuid.UUID `gorm:"primarykey"`
+	Slug      string
+	Name      string
+	CreatedAt time.Time
+}
+
+type Specialties []*Specialty
+
+// DoctorProfileForm replaces the whole profile. Specialties are given by slug.
+type DoctorProfileForm struct {
+	LicenseNumber string   `json:"licenseNumber" form:"required,max=32"`
+	Specialties   []string `json:"specialties" form:"unique,dive,required,max=64"`
+	Languages     []string `json:"languages" form:"unique,dive,bcp47_language_tag"`
+	Bio           string   `json:"bio" form:"max=5000"`
+	Clinics       []string `json:"clinics" form:"dive,required,max=255"`
+}
+
+type DoctorProfileResponse struct {
+	UserID        uuid.UUID            `json:"userId"`
+	LicenseNumber string               `json:"licenseNumber"`
+	Specialties   []*SpecialtyResponse `json:"specialties"`
+	Languages     []string             `json:"languages"`
+	Bio           string               `json:"bio"`
+	Clinics       []string             `json:"clinics"`
+	UpdatedAt     time.Time            `json:"updatedAt"`
+}
+
+// DoctorResponse is a doctor as listed in the public directory.
+type DoctorResponse struct {
+	ID            uuid.UUID            `json:"id"`
+	Name          string               `json:"name"`
+	LicenseNumber string               `json:"licenseNumber"`
+	Specialties   []*SpecialtyResponse `json:"specialties"`
+	Languages     []string             `json:"languages"`
+	Bio           string               `json:"bio"`
+	Clinics       []string             `json:"clinics"`
+}
+
+type DirectoryResponse struct {
+	Doctors       []*DoctorResponse `json:"doctors"`
+	TotalItems    int64             `json:"total"`
+	NumberOfPages int               `json:"pages"`
+	CurrentPage   int               `json:"currentPage"`
+}
+
+// DirectoryFilter narrows the directory down to doctors with the specialty
+// and speaking the language, when set.
+type DirectoryFilter struct {
+	Specialty string
+	Language  string
+}
+
+// DoctorProfile is what patients get to know about a doctor when booking.
+type DoctorProfile struct {
+	UserID        uuid.UUID `gorm:"primarykey"`
+	LicenseNumber string
+	Languages     StringList `gorm:"type:jsonb"`
+	Bio           string
+	Clinics       StringList `gorm:"type:jsonb"`
+	UpdatedAt     time.Time
+
+	User        *users.User `gorm:"foreignKey:UserID"`
+	Specialties Specialties `gorm:"many2many:doctor_specialties;joinForeignKey:UserID;joinReferences:SpecialtyID"`
+}
+
+type DoctorProfiles []*DoctorProfile
+
+// DoctorSpecialty is a row of the join table of doctors and specialties.
+type DoctorSpecialty struct {
+	UserID      uuid.UUID
+	SpecialtyID uuid.UUID
+}
+
+func (f *SpecialtyForm) ToModel() *Specialty {
+	return &Specialty{
+		ID:   uuid.New(),
+		Slug: f.Slug,
+		Name: f.Name,
+	}
+}
+
+func (s *Specialty) ToResponse() *SpecialtyResponse {
+	return &SpecialtyResponse{
+		ID:   s.ID,
+		Slug: s.Slug,
+		Name: s.Name,
+	}
+}
+
+func (specialties Specialties) ToResponse() []*SpecialtyResponse {
+	response := make([]*SpecialtyResponse, 0, len(specialties))
+	for _, s := range specialties {
+		response = append(response, s.ToResponse())
+	}
+	return response
+}
+
+func (f *DoctorProfileForm) ToModel(userID uuid.UUID, specialties Specialties) *DoctorProfile {
+	return &DoctorProfile{
+		UserID:        userID,
+		LicenseNumber: f.LicenseNumber,
+		Languages:     f.Languages,
+		Bio:           f.Bio,
+		Clinics:       f.Clinics,
+		Specialties:   specialties,
+	}
+}
+
+func (p *DoctorProfile) ToResponse() *DoctorProfileResponse {
+	return &DoctorProfileResponse{
+		UserID:        p.UserID,
+		LicenseNumber: p.LicenseNumber,
+		Specialties:   p.Specialties.ToResponse(),
+		Languages:     nonNil(p.Languages),
+		Bio:           p.Bio,
+		Clinics:       nonNil(p.Clinics),
+		UpdatedAt:     p.UpdatedAt,
+	}
+}
+
+func (p *DoctorProfile) ToDoctorResponse() *DoctorResponse {
+	response := &DoctorResponse{
+		ID:            p.UserID,
+		LicenseNumber: p.LicenseNumber,
+		Specialties:   p.Specialties.ToResponse(),
+		Languages:     nonNil(p.Languages),
+		Bio:           p.Bio,
+		Clinics:       nonNil(p.Clinics),
+	}
+	if p.User != nil {
+		response.Name = p.User.Name
+	}
+
+	return response
+}
+
+func (profiles DoctorProfiles) ToResponse() *DirectoryResponse {
+	response := make([]*DoctorResponse, 0, len(profiles))
+	for _, p := range profiles {
+		response = append(response, p.ToDoctorResponse())
+	}
+	return &DirectoryResponse{Doctors: response}
+}
+
+func nonNil(l StringList) []string {
+	if l == nil {
+		return []string{}
+	}
+	return l
+}
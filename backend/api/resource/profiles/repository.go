@@ -0,0 +1,198 @@
+package profiles
+
+import (
+	"encoding/json"
+	"math"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"backend/api/resource/users"
+	"backend/utils/pagination"
+)
+
+type Repository struct {
+	db *gorm.DB
+}
+
+func NewRepository(db *gorm.DB) *Repository {
+	return &Repository{
+		db: db,
+	}
+}
+
+func (r *Repository) GetPatient(userID uuid.UUID) (*PatientProfile, error) {
+	profile := &PatientProfile{}
+	if err := r.db.Where("user_id = ?", userID).First(profile).Error; err != nil {
+		return nil, err
+	}
+
+	return profile, nil
+}
+
+// SavePatient creates the profile or replaces the existing one.
+func (r *Repository) SavePatient(profile *PatientProfile) (*PatientProfile, error) {
+	if err := r.db.Clauses(clause.OnConflict{UpdateAll: true}).Create(profile).Error; err != nil {
+		return nil, err
+	}
+
+	return profile, nil
+}
+
+// PESELTaken reports whether another patient has the PESEL.
+func (r *Repository) PESELTaken(pesel string, userID uuid.UUID) (bool, error) {
+	var count int64
+	if err := r.db.Model(&PatientProfile{}).
+		Where("pesel = ? AND user_id <> ?", pesel, userID).
+		Count(&count).Error; err != nil {
+		return false, err
+	}
+
+	return count > 0, nil
+}
+
+func (r *Repository) ListSpecialties() (Specialties, error) {
+	var specialties Specialties
+	if err := r.db.Order("name").Find(&specialties).Error; err != nil {
+		return nil, err
+	}
+
+	return specialties, nil
+}
+
+func (r *Repository) CreateSpecialty(specialty *Specialty) (*Specialty, error) {
+	if err := r.db.Create(specialty).Error; err != nil {
+		return nil, err
+	}
+
+	return specialty, nil
+}
+
+func (r *Repository) GetSpecialtyBySlug(slug string) (*Specialty, error) {
+	specialty := &Specialty{}
+	if err := r.db.Where("slug = ?", slug).First(specialty).Error; err != nil {
+		return nil, err
+	}
+
+	return specialty, nil
+}
+
+// SpecialtiesBySlugs returns the specialties with the slugs, unknown slugs are
+// left out.
+func (r *Repository) SpecialtiesBySlugs(slugs []string) (Specialties, error) {
+	specialties := Specialties{}
+	if len(slugs) == 0 {
+		return specialties, nil
+	}
+	if err := r.db.Where("slug IN ?", slugs).Order("name").Find(&specialties).Error; err != nil {
+		return nil, err
+	}
+
+	return specialties, nil
+}
+
+// DeleteSpecialty removes the specialty from the dictionary and from every
+// doctor having it.
+func (r *Repository) DeleteSpecialty(id uuid.UUID) (int64, error) {
+	result := r.db.Where("id = ?", id).Delete(&Specialty{})
+
+	return result.RowsAffected, result.Error
+}
+
+func (r *Repository) GetDoctor(userID uuid.UUID) (*DoctorProfile, error) {
+	profile := &DoctorProfile{}
+	if err := r.db.Preload("Specialties", orderByName).Where("user_id = ?", userID).First(profile).Error; err != nil {
+		return nil, err
+	}
+
+	return profile, nil
+}
+
+// SaveDoctor creates the profile or replaces the existing one together with
+// its specialties.
+func (r *Repository) SaveDoctor(profile *DoctorProfile) (*DoctorProfile, error) {
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Omit(clause.Associations).Clauses(clause.OnConflict{UpdateAll: true}).Create(profile).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("user_id = ?", profile.UserID).Delete(&DoctorSpecialty{}).Error; err != nil {
+			return err
+		}
+		if len(profile.Specialties) == 0 {
+			return nil
+		}
+
+		rows := make([]*DoctorSpecialty, 0, len(profile.Specialties))
+		for _, s := range profile.Specialties {
+			rows = append(rows, &DoctorSpecialty{UserID: profile.UserID, SpecialtyID: s.ID})
+		}
+		return tx.Create(rows).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return profile, nil
+}
+
+func (r *Repository) DeleteDoctor(userID uuid.UUID) (int64, error) {
+	result := r.db.Where("user_id = ?", userID).Delete(&DoctorProfile{})
+
+	return result.RowsAffected, result.Error
+}
+
+// LicenseTaken reports whether another doctor has the license number.
+func (r *Repository) LicenseTaken(licenseNumber string, userID uuid.UUID) (bool, error) {
+	var count int64
+	if err := r.db.Model(&DoctorProfile{}).
+		Where("license_number = ? AND user_id <> ?", licenseNumber, userID).
+		Count(&count).Error; err != nil {
+		return false, err
+	}
+
+	return count > 0, nil
+}
+
+// Directory lists the profiles of active doctors by name.
+func (r *Repository) Directory(filter DirectoryFilter, p pagination.Pagination) (*pagination.Pagination, error) {
+	filtered := func(db *gorm.DB) *gorm.DB {
+		db = db.Joins("JOIN users ON users.id = doctor_profiles.user_id").
+			Where("users.role = ? AND users.status = ? AND users.deleted_at IS NULL", users.Doctor, users.StatusActive)
+		if filter.Specialty != "" {
+			db = db.Where("EXISTS (SELECT 1 FROM doctor_specialties JOIN specialties ON specialties.id = doctor_specialties.specialty_id "+
+				"WHERE doctor_specialties.user_id = doctor_profiles.user_id AND specialties.slug = ?)", filter.Specialty)
+		}
+		if filter.Language != "" {
+			language, _ := json.Marshal([]string{filter.Language})
+			db = db.Where("doctor_profiles.languages @> ?", string(language))
+		}
+		return db
+	}
+
+	var totalRows int64
+	if err := r.db.Model(&DoctorProfile{}).Scopes(filtered).Count(&totalRows).Error; err != nil {
+		return nil, err
+	}
+
+	var profiles DoctorProfiles
+	if err := r.db.Scopes(filtered).
+		Preload("User").
+		Preload("Specialties", orderByName).
+		Order("users.name, doctor_profiles.user_id").
+		Offset(p.GetOffset()).
+		Limit(p.GetLimit()).
+		Find(&profiles).Error; err != nil {
+		return nil, err
+	}
+
+	p.TotalRows = totalRows
+	p.TotalPages = int(math.Ceil(float64(totalRows) / float64(p.GetLimit())))
+	p.Rows = profiles
+
+	return &p, nil
+}
+
+func orderByName(db *gorm.DB) *gorm.DB {
+	return db.Order("name")
+}
@@ -4,39 +4,70 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"math"
+	"mime"
 	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 
 	"golang.org/x/crypto/bcrypt"
 
 	"github.com/go-chi/chi"
 	"github.com/go-playground/validator/v10"
 	"github.com/google/uuid"
+	"github.com/gorilla/sessions"
 	"github.com/rs/zerolog"
-	"github.com/wader/gormstore/v2"
 	"gorm.io/gorm"
 
+	"backend/api/resource/audit"
 	e "backend/api/resource/common/error"
+	"backend/api/resource/common/policy"
+	"backend/utils/clientip"
+	"backend/utils/etag"
+	"backend/utils/mailer"
 	"backend/utils/pagination"
+	"backend/utils/sessionstore"
+	"backend/utils/token"
+	"backend/utils/totp"
 	validatorUtil "backend/utils/validator"
 )
 
 var GetUUID = uuid.New
 
+// dummyHash is compared against when the email is unknown, so that a login
+// takes as long as for an existing account.
+var dummyHash = []byte("$2a$10$feOg3bgxQw6OtLaImIn8jejyPmhp9gdcDujEdFrmxtZVZnEgU1K2u")
+
 type API struct {
 	repository *Repository
 	validator  *validator.Validate
 	logger     *zerolog.Logger
-	store      *gormstore.Store
-	apiKey     string
+	store      sessionstore.Store
+	tokens     *token.Manager
+	mail       *mailer.Sender
+	config     *Config
 }
 
-func New(l *zerolog.Logger, db *gorm.DB, v *validator.Validate, s *gormstore.Store, apiKey string) *API {
+func New(l *zerolog.Logger, db *gorm.DB, v *validator.Validate, s sessionstore.Store, t *token.Manager, m *mailer.Sender, c *Config) *API {
+	if m == nil {
+		m = mailer.NewSender(mailer.NewLog(l), mailer.DefaultLocale)
+	}
+	if c == nil {
+		c = &DefaultConfig
+	}
+
 	return &API{
 		repository: NewRepository(db),
 		validator:  v,
 		logger:     l,
 		store:      s,
-		apiKey:     apiKey,
+		tokens:     t,
+		mail:       m,
+		config:     c,
 	}
 }
 
@@ -50,21 +81,43 @@ func New(l *zerolog.Logger, db *gorm.DB, v *validator.Validate, s *gormstore.Sto
 //	@param			page	query	int	false		"Page number"
 //	@param			limit	query	int	false		"Number of items per page"
 //	@param			role	query	string false	"Role to filter by"
+//	@param			includeDeleted	query	bool	false	"Include soft deleted users"
+//	@param			q				query	string	false	"Text to search for in names and emails"
+//	@param			sort			query	string	false	"Field to sort by: name, email, role, status or createdAt (default)"
+//	@param			order			query	string	false	"Sort direction: asc or desc, newest first by default"
+//	@param			status			query	string	false	"Status to filter by"
+//	@param			emailDomain		query	string	false	"Email domain to filter by"
+//	@param			createdFrom		query	string	false	"First registration date, YYYY-MM-DD"
+//	@param			createdTo		query	string	false	"Last registration date, YYYY-MM-DD"
+//	@param			cursor			query	string	false	"Lists the page after nextCursor or before prevCursor instead of a page number, empty for the first page"
+//	@param			count			query	bool	false	"Count the users in cursor mode too"
 //	@success		200	{object}	ListResponse
+//	@failure		400	{object}	error.Error
+//	@failure		403	{object}	error.Error
+//	@failure		422	{object}	error.Errors
 //	@failure		500	{object}	error.Error
 //	@router			/users [get]
 func (a *API) List(w http.ResponseWriter, r *http.Request) {
 	pagination := &pagination.Pagination{}
 	pagination.Parse(r.URL.Query())
-	if err := a.validator.Struct(pagination); err != nil {
-		a.logger.Error().Err(err).Msg("List users failed")
-		respBody, err := json.Marshal(validatorUtil.ToErrResponse(err))
-		if err != nil {
-			e.ServerError(w, e.RespJSONEncodeFailure)
+	query := ParseListQuery(r.URL.Query())
+	for _, form := range []any{pagination, query} {
+		if err := a.validator.Struct(form); err != nil {
+			a.logger.Error().Err(err).Msg("List users failed")
+			respBody, err := json.Marshal(validatorUtil.ToErrResponse(err))
+			if err != nil {
+				e.ServerError(w, e.RespJSONEncodeFailure)
+				return
+			}
+
+			e.ValidationErrors(w, respBody)
 			return
 		}
-
-		e.ValidationErrors(w, respBody)
+	}
+	query.Apply(pagination)
+	if err := pagination.DecodeCursor(); err != nil {
+		a.logger.Error().Err(err).Msg("List users failed")
+		e.BadRequest(w, e.RespInvalidURLParamCursor)
 		return
 	}
 
@@ -75,6 +128,8 @@ func (a *API) List(w http.ResponseWriter, r *http.Request) {
 		response.TotalItems = pagination.TotalRows
 		response.NumberOfPages = pagination.TotalPages
 		response.CurrentPage = pagination.Page
+		response.NextCursor = pagination.NextCursor
+		response.PrevCursor = pagination.PrevCursor
 
 		if err := json.NewEncoder(w).Encode(response); err != nil {
 			a.logger.Error().Err(err).Msg("List users failed")
@@ -90,13 +145,14 @@ func (a *API) List(w http.ResponseWriter, r *http.Request) {
 // Create godoc
 //
 //	@summary		Create user
-//	@description	Create user
+//	@description	Register a patient. Doctors and admins are invited with POST /invitations.
 //	@tags			users
 //	@accept			json
 //	@produce		json
 //	@param			body	body	Form	true	"User form"
 //	@success		201 {object}	UserResponse
 //	@failure		400	{object}	error.Error
+//	@failure		403
 //	@failure		422	{object}	error.Errors
 //	@failure		500	{object}	error.Error
 //	@router			/users [post]
@@ -120,24 +176,14 @@ func (a *API) Create(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if r.Header.Get("Authorization") != fmt.Sprintf("Bearer %s", a.apiKey) {
-		if form.Role == Admin {
-			a.logger.Error().Msg("Not allowed to create admin")
-			http.Error(w, "Cannot create admin from the level of API!", http.StatusUnauthorized)
-			return
-		}
-
-		if form.Role == Doctor {
-			session, err := a.store.Get(r, "session")
-			if value, ok := session.Values["role"].(string); !(ok && err == nil && value == Admin.ToString()) {
-				a.logger.Error().Err(err).Msg("Not admin tried to add doctor")
-				http.Error(w, "Doctor can only be added by admin!", http.StatusUnauthorized)
-				return
-			}
-		}
+	audit.Record(r.Context(), "user.create", "user", "", nil, nil)
+	if form.Role != Patient {
+		a.logger.Error().Str("role", form.Role.ToString()).Msg("Staff account registration attempted")
+		http.Error(w, "Staff accounts are created through invitations!", http.StatusForbidden)
+		return
 	}
 
-	user, err1 := a.repository.GetByEmail(form.Email)
+	user, err1 := a.repository.GetByEmailWithDeleted(form.Email)
 	if err1 != nil && !errors.Is(err1, gorm.ErrRecordNotFound) {
 		a.logger.Error().Err(err1).Msg("Create user failed")
 		e.ServerError(w, e.RespDBDataAccessFailure)
@@ -158,8 +204,11 @@ func (a *API) Create(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	a.sendVerification(r, newUser)
+
 	w.WriteHeader(http.StatusCreated)
 	response := newUser.ToResponse()
+	audit.Record(r.Context(), "user.create", "user", newUser.ID.String(), nil, response)
 	if err := json.NewEncoder(w).Encode(response); err != nil {
 		a.logger.Error().Err(err).Msg("Create user failed")
 		e.ServerError(w, e.RespJSONEncodeFailure)
@@ -180,20 +229,13 @@ func (a *API) Create(w http.ResponseWriter, r *http.Request) {
 //	@failure		500	{object}	error.Error
 //	@router			/users/current [get]
 func (a *API) Current(w http.ResponseWriter, r *http.Request) {
-	session, err := a.store.Get(r, "session")
+	idString, _, err := a.identity(r)
 	if err != nil {
 		a.logger.Error().Err(err).Msg("Getting current user failed")
 		e.ServerError(w, e.RespSessionAccessFailure)
 		return
 	}
 
-	idString, ok := session.Values["id"].(string)
-	if !ok {
-		a.logger.Error().Msg("Getting current user failed")
-		e.ServerError(w, e.RespSessionAccessFailure)
-		return
-	}
-
 	id, err := uuid.Parse(idString)
 	if err != nil {
 		a.logger.Error().Msg(fmt.Sprintf("Error parsing UUID: %v\n", err))
@@ -228,9 +270,13 @@ func (a *API) Current(w http.ResponseWriter, r *http.Request) {
 //	@tags			users
 //	@accept			json
 //	@produce		json
-//	@param			id	path		string	true	"User ID"
+//	@param			id				path		string	true	"User ID"
+//	@param			If-None-Match	header		string	false	"ETag of the cached user"
 //	@success		200	{object}	UserResponse
+//	@success		304
+//	@header			200,304	{string}	ETag	"Version of the user"
 //	@failure		400	{object}	error.Error
+//	@failure		403	{object}	error.Error
 //	@failure		404
 //	@failure		500	{object}	error.Error
 //	@router			/users/{id} [get]
@@ -255,6 +301,12 @@ func (a *API) Read(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	w.Header().Set("ETag", user.ETag())
+	if match := r.Header.Get("If-None-Match"); match != "" && etag.MatchWeak(match, user.ETag()) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
 	response := user.ToResponse()
 	if err := json.NewEncoder(w).Encode(response); err != nil {
 		a.logger.Error().Err(err).Msg("Read user failed")
@@ -270,11 +322,16 @@ func (a *API) Read(w http.ResponseWriter, r *http.Request) {
 //	@tags			users
 //	@accept			json
 //	@produce		json
-//	@param			id		path	string	true	"User ID"
-//	@param			body	body	Form	true	"User form"
+//	@param			id			path	string	true	"User ID"
+//	@param			If-Match	header	string	false	"ETag of the user being updated"
+//	@param			body		body	Form	true	"User form"
 //	@success		200 {object}	UserResponse
+//	@header			200	{string}	ETag	"Version of the updated user"
 //	@failure		400	{object}	error.Error
+//	@failure		403	{object}	error.Error
 //	@failure		404
+//	@failure		409	{string}	string	"User already exists!"
+//	@failure		412	{string}	string	"User was changed in the meantime!"
 //	@failure		422	{object}	error.Errors
 //	@failure		500	{object}	error.Error
 //	@router			/users/{id} [put]
@@ -285,6 +342,7 @@ func (a *API) Update(w http.ResponseWriter, r *http.Request) {
 		e.BadRequest(w, e.RespInvalidURLParamID)
 		return
 	}
+	audit.Record(r.Context(), "user.update", "user", id.String(), nil, nil)
 
 	form := &UpdateForm{}
 	if err := json.NewDecoder(r.Body).Decode(form); err != nil {
@@ -305,16 +363,52 @@ func (a *API) Update(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	current, err := a.repository.Read(id)
+	if err != nil {
+		a.logger.Error().Err(err).Msg("Update user failed")
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			e.NotFound(w)
+			return
+		}
+
+		e.ServerError(w, e.RespDBDataAccessFailure)
+		return
+	}
+
 	user := form.ToModel()
 	user.ID = id
 
-	rows, err := a.repository.Update(user)
+	// With If-Match only the version the client has seen is updated.
+	match := r.Header.Get("If-Match")
+	if match != "" {
+		if !etag.MatchStrong(match, current.ETag()) {
+			http.Error(w, "User was changed in the meantime!", http.StatusPreconditionFailed)
+			return
+		}
+		user.Version = current.Version
+	}
+
+	emailChanged := form.Email != "" && !strings.EqualFold(form.Email, current.Email)
+	if emailChanged && a.emailTaken(w, form.Email, id, "Update user failed") {
+		return
+	}
+
+	var rows int64
+	if emailChanged {
+		rows, err = a.repository.UpdateEmail(user)
+	} else {
+		rows, err = a.repository.Update(user)
+	}
 	if err != nil {
 		a.logger.Error().Err(err).Msg("Update user failed")
 		e.ServerError(w, e.RespDBDataUpdateFailure)
 		return
 	}
 	if rows == 0 {
+		if match != "" {
+			http.Error(w, "User was changed in the meantime!", http.StatusPreconditionFailed)
+			return
+		}
 		e.NotFound(w)
 		return
 	}
@@ -331,7 +425,13 @@ func (a *API) Update(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if emailChanged {
+		a.sendVerification(r, updatedUser)
+	}
+
+	w.Header().Set("ETag", updatedUser.ETag())
 	response := updatedUser.ToResponse()
+	audit.Record(r.Context(), "user.update", "user", id.String(), current.ToResponse(), response)
 	if err := json.NewEncoder(w).Encode(response); err != nil {
 		a.logger.Error().Err(err).Msg("Update user failed")
 		e.ServerError(w, e.RespJSONEncodeFailure)
@@ -339,17 +439,203 @@ func (a *API) Update(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// emailTaken responds with a conflict when the email belongs to an account,
+// deleted ones included, other than the user with id.
+func (a *API) emailTaken(w http.ResponseWriter, email string, id uuid.UUID, msg string) bool {
+	existing, err := a.repository.GetByEmailWithDeleted(email)
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		a.logger.Error().Err(err).Msg(msg)
+		e.ServerError(w, e.RespDBDataAccessFailure)
+		return true
+	} else if existing != nil && existing.ID != id {
+		a.logger.Error().Msg("User already exists")
+		http.Error(w, "User already exists!", http.StatusConflict)
+		return true
+	}
+
+	return false
+}
+
+// Patch godoc
+//
+//	@summary		Patch user
+//	@description	Change some fields of a user with an RFC 7396 merge patch (application/merge-patch+json), e.g. {"name": "..."}, or an RFC 6902 JSON patch (application/json-patch+json) of add, replace, remove and test operations, applied in order. Fields cannot be removed or set to null. Name and email can be changed by whoever may update the user, role and status only by admins. A changed email has to be verified again.
+//	@tags			users
+//	@accept			json
+//	@produce		json
+//	@param			id			path	string	true	"User ID"
+//	@param			If-Match	header	string	false	"ETag of the user being updated"
+//	@param			body		body	Patch	true	"Fields to change"
+//	@success		200 {object}	UserResponse
+//	@header			200	{string}	ETag	"Version of the updated user"
+//	@failure		400	{object}	error.Error
+//	@failure		403	{object}	error.Error
+//	@failure		404
+//	@failure		409	{string}	string	"User already exists, patch test failed or cannot demote, suspend or deactivate the last admin!"
+//	@failure		412	{string}	string	"User was changed in the meantime!"
+//	@failure		415
+//	@failure		422	{object}	error.Errors
+//	@failure		500	{object}	error.Error
+//	@router			/users/{id} [patch]
+func (a *API) Patch(w http.ResponseWriter, r *http.Request) {
+	id, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		a.logger.Error().Err(err).Msg("Patch user failed")
+		e.BadRequest(w, e.RespInvalidURLParamID)
+		return
+	}
+	audit.Record(r.Context(), "user.patch", "user", id.String(), nil, nil)
+
+	current, err := a.repository.Read(id)
+	if err != nil {
+		a.logger.Error().Err(err).Msg("Patch user failed")
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			e.NotFound(w)
+			return
+		}
+
+		e.ServerError(w, e.RespDBDataAccessFailure)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		a.logger.Error().Err(err).Msg("Patch user failed")
+		e.ServerError(w, e.RespJSONDecodeFailure)
+		return
+	}
+
+	var patch *Patch
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "application/merge-patch+json", "application/json", "":
+		patch, err = ParseMergePatch(body)
+	case "application/json-patch+json":
+		patch, err = ParseJSONPatch(body, current)
+	default:
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		return
+	}
+	if err != nil {
+		a.logger.Error().Err(err).Msg("Patch user failed")
+		switch {
+		case errors.Is(err, ErrPatchTestFailed):
+			http.Error(w, "Patch test failed!", http.StatusConflict)
+		case errors.Is(err, ErrInvalidPatch):
+			e.BadRequest(w, e.RespInvalidPatch)
+		default:
+			e.ServerError(w, e.RespJSONDecodeFailure)
+		}
+		return
+	}
+
+	if problems := patch.Problems(); len(problems) > 0 {
+		respBody, err := json.Marshal(&validatorUtil.ErrResponse{Errors: problems})
+		if err != nil {
+			e.ServerError(w, e.RespJSONEncodeFailure)
+			return
+		}
+
+		e.ValidationErrors(w, respBody)
+		return
+	}
+
+	if err := a.validator.Struct(patch); err != nil {
+		a.logger.Error().Err(err).Msg("Patch user failed")
+		respBody, err := json.Marshal(validatorUtil.ToErrResponse(err))
+		if err != nil {
+			e.ServerError(w, e.RespJSONEncodeFailure)
+			return
+		}
+
+		e.ValidationErrors(w, respBody)
+		return
+	}
+
+	// The route requires UsersUpdate, the other permissions are only held
+	// on every account.
+	for _, perm := range patch.Permissions() {
+		if perm != policy.UsersUpdate && !policy.Can(r.Context(), perm) {
+			e.Forbidden(w)
+			return
+		}
+	}
+
+	// With If-Match only the version the client has seen is updated.
+	match := r.Header.Get("If-Match")
+	if match != "" && !etag.MatchStrong(match, current.ETag()) {
+		http.Error(w, "User was changed in the meantime!", http.StatusPreconditionFailed)
+		return
+	}
+
+	user := *current
+	if match == "" {
+		user.Version = 0
+	}
+	columns := patch.Apply(&user)
+	if len(columns) == 0 {
+		w.Header().Set("ETag", current.ETag())
+		if err := json.NewEncoder(w).Encode(current.ToResponse()); err != nil {
+			a.logger.Error().Err(err).Msg("Patch user failed")
+			e.ServerError(w, e.RespJSONEncodeFailure)
+		}
+		return
+	}
+
+	emailChanged := slices.Contains(columns, "email")
+	if emailChanged && a.emailTaken(w, user.Email, id, "Patch user failed") {
+		return
+	}
+
+	patched, err := a.repository.Patch(&user, columns, a.identityID(r))
+	if err != nil {
+		a.logger.Error().Err(err).Msg("Patch user failed")
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			e.NotFound(w)
+		case errors.Is(err, ErrVersionMismatch):
+			http.Error(w, "User was changed in the meantime!", http.StatusPreconditionFailed)
+		case errors.Is(err, ErrLastAdmin):
+			http.Error(w, "Cannot demote, suspend or deactivate the last admin!", http.StatusConflict)
+		default:
+			e.ServerError(w, e.RespDBDataUpdateFailure)
+		}
+		return
+	}
+
+	a.logger.Info().Str("user", id.String()).Strs("fields", columns).Msg("User patched")
+
+	if slices.Contains(columns, "role") {
+		// Sessions and tokens carry the role, so the user has to log in again.
+		a.endRoleSessions(r, id)
+	}
+	if emailChanged {
+		a.sendVerification(r, patched)
+	}
+
+	w.Header().Set("ETag", patched.ETag())
+	response := patched.ToResponse()
+	audit.Record(r.Context(), "user.patch", "user", id.String(), current.ToResponse(), response)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		a.logger.Error().Err(err).Msg("Patch user failed")
+		e.ServerError(w, e.RespJSONEncodeFailure)
+		return
+	}
+}
+
 // Delete godoc
 //
 //	@summary		Delete user
-//	@description	Delete user
+//	@description	Soft delete user. The account disappears from the API but can be restored by an admin. The last active admin cannot be deleted.
 //	@tags			users
 //	@accept			json
 //	@produce		json
 //	@param			id	path	string	true	"User ID"
 //	@success		200
 //	@failure		400	{object}	error.Error
+//	@failure		403	{object}	error.Error
 //	@failure		404
+//	@failure		409
 //	@failure		500	{object}	error.Error
 //	@router			/users/{id} [delete]
 func (a *API) Delete(w http.ResponseWriter, r *http.Request) {
@@ -359,10 +645,29 @@ func (a *API) Delete(w http.ResponseWriter, r *http.Request) {
 		e.BadRequest(w, e.RespInvalidURLParamID)
 		return
 	}
+	audit.Record(r.Context(), "user.delete", "user", id.String(), nil, nil)
+
+	current, err := a.repository.Read(id)
+	if err != nil {
+		a.logger.Error().Err(err).Msg("Delete user failed")
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			e.NotFound(w)
+			return
+		}
+
+		e.ServerError(w, e.RespDBDataAccessFailure)
+		return
+	}
 
-	rows, err := a.repository.Delete(id)
+	now := time.Now()
+	rows, err := a.repository.Delete(id, now)
 	if err != nil {
 		a.logger.Error().Err(err).Msg("Delete user failed")
+		if errors.Is(err, ErrLastAdmin) {
+			http.Error(w, "Cannot delete the last admin!", http.StatusConflict)
+			return
+		}
+
 		e.BadRequest(w, e.RespDBDataRemoveFailure)
 		return
 	}
@@ -370,54 +675,40 @@ func (a *API) Delete(w http.ResponseWriter, r *http.Request) {
 		e.NotFound(w)
 		return
 	}
+
+	deleted := *current
+	deleted.DeletedAt = gorm.DeletedAt{Time: now, Valid: true}
+	audit.Record(r.Context(), "user.delete", "user", id.String(), current.ToResponse(), deleted.ToResponse())
 }
 
-// Login godoc
+// Restore godoc
 //
-//	@summary		Login user
-//	@description	Login user
+//	@summary		Restore user
+//	@description	Restore a soft deleted user
 //	@tags			users
 //	@accept			json
 //	@produce		json
-//	@param			body	body	Form	true	"Login form"
-//	@success		200
-//	@failure		401	{object}	error.Error
-//	@failure		422	{object}	error.Errors
+//	@param			id	path	string	true	"User ID"
+//	@success		200	{object}	UserResponse
+//	@failure		400	{object}	error.Error
+//	@failure		403	{object}	error.Error
+//	@failure		404
 //	@failure		500	{object}	error.Error
-//	@router			/users/login [post]
-func (a *API) Login(w http.ResponseWriter, r *http.Request) {
-	session, err := a.store.Get(r, "session")
-	if value, ok := session.Values["email"].(string); ok && err == nil {
-		if len(value) != 0 {
-			a.logger.Error().Err(err).Msg("User already logged in!")
-			return
-		}
-	}
-
-	form := &LoginForm{}
-	if err := json.NewDecoder(r.Body).Decode(form); err != nil {
-		a.logger.Error().Err(err).Msg("Login user failed")
-		e.ServerError(w, e.RespJSONDecodeFailure)
-		return
-	}
-
-	if err := a.validator.Struct(form); err != nil {
-		a.logger.Error().Err(err).Msg("Login user failed")
-		respBody, err := json.Marshal(validatorUtil.ToErrResponse(err))
-		if err != nil {
-			e.ServerError(w, e.RespJSONEncodeFailure)
-			return
-		}
-
-		e.ValidationErrors(w, respBody)
+//	@router			/users/{id}/restore [post]
+func (a *API) Restore(w http.ResponseWriter, r *http.Request) {
+	id, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		a.logger.Error().Err(err).Msg("Restore user failed")
+		e.BadRequest(w, e.RespInvalidURLParamID)
 		return
 	}
+	audit.Record(r.Context(), "user.restore", "user", id.String(), nil, nil)
 
-	user, err := a.repository.GetByEmail(form.Email)
-	if err != nil || user == nil {
-		a.logger.Error().Err(err).Msg("Login user failed")
+	current, err := a.repository.ReadWithDeleted(id)
+	if err != nil {
+		a.logger.Error().Err(err).Msg("Restore user failed")
 		if errors.Is(err, gorm.ErrRecordNotFound) {
-			w.WriteHeader(http.StatusNotFound)
+			e.NotFound(w)
 			return
 		}
 
@@ -425,57 +716,1741 @@ func (a *API) Login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = bcrypt.CompareHashAndPassword(user.Password, []byte(form.Password))
+	rows, err := a.repository.Restore(id)
 	if err != nil {
-		a.logger.Error().Err(err).Msg("Login user failed")
-		http.Error(w, err.Error(), http.StatusUnauthorized)
+		a.logger.Error().Err(err).Msg("Restore user failed")
+		e.ServerError(w, e.RespDBDataUpdateFailure)
+		return
+	}
+	if rows == 0 {
+		e.NotFound(w)
 		return
 	}
 
-	session.Values["id"] = user.ID.String()
-	session.Values["email"] = user.Email
-	session.Values["role"] = user.Role.ToString()
-
-	if err := session.Save(r, w); err != nil {
-		a.logger.Error().Err(err).Msg("Login user failed")
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	user, err := a.repository.Read(id)
+	if err != nil {
+		a.logger.Error().Err(err).Msg("Restore user failed")
+		e.ServerError(w, e.RespDBDataAccessFailure)
 		return
 	}
 
+	a.logger.Info().Str("user", id.String()).Msg("User restored")
+
 	response := user.ToResponse()
+	audit.Record(r.Context(), "user.restore", "user", id.String(), current.ToResponse(), response)
 	if err := json.NewEncoder(w).Encode(response); err != nil {
-		a.logger.Error().Err(err).Msg("Update user failed")
+		a.logger.Error().Err(err).Msg("Restore user failed")
 		e.ServerError(w, e.RespJSONEncodeFailure)
 		return
 	}
 }
 
-// Logout godoc
+// ChangeStatus godoc
 //
-//	@summary		Login user
-//	@description	Login user
+//	@summary		Change status
+//	@description	Suspend, deactivate or reactivate the user. Suspended and deactivated users cannot log in and their sessions stop working. The last active admin cannot be suspended or deactivated.
 //	@tags			users
 //	@accept			json
 //	@produce		json
-//	@param			body	body	Form	true	"Login form"
-//	@success		200
-//	@failure		401	{object}	error.Error
+//	@param			id		path	string		true	"User ID"
+//	@param			body	body	StatusForm	true	"Status form"
+//	@success		200	{object}	UserResponse
+//	@failure		400	{object}	error.Error
+//	@failure		403	{object}	error.Error
+//	@failure		404
+//	@failure		409
 //	@failure		422	{object}	error.Errors
 //	@failure		500	{object}	error.Error
-//	@router			/users/logout [post]
-func (a *API) Logout(w http.ResponseWriter, r *http.Request) {
-	session, err := a.store.Get(r, "session")
+//	@router			/users/{id}/status [patch]
+func (a *API) ChangeStatus(w http.ResponseWriter, r *http.Request) {
+	id, err := uuid.Parse(chi.URLParam(r, "id"))
 	if err != nil {
-		a.logger.Error().Err(err).Msg("Logout user failed")
+		a.logger.Error().Err(err).Msg("Change status failed")
+		e.BadRequest(w, e.RespInvalidURLParamID)
+		return
 	}
+	audit.Record(r.Context(), "user.status", "user", id.String(), nil, nil)
 
-	session.Values["id"] = nil
-	session.Values["email"] = nil
-	session.Values["role"] = nil
-	session.Options.MaxAge = -1
+	form := &StatusForm{}
+	if err := json.NewDecoder(r.Body).Decode(form); err != nil {
+		a.logger.Error().Err(err).Msg("Change status failed")
+		e.ServerError(w, e.RespJSONDecodeFailure)
+		return
+	}
 
-	err = session.Save(r, w)
-	if err != nil {
-		a.logger.Error().Err(err).Msg("Logout user failed")
+	if err := a.validator.Struct(form); err != nil {
+		a.logger.Error().Err(err).Msg("Change status failed")
+		respBody, err := json.Marshal(validatorUtil.ToErrResponse(err))
+		if err != nil {
+			e.ServerError(w, e.RespJSONEncodeFailure)
+			return
+		}
+
+		e.ValidationErrors(w, respBody)
+		return
+	}
+
+	current, err := a.repository.Read(id)
+	if err != nil {
+		a.logger.Error().Err(err).Msg("Change status failed")
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			e.NotFound(w)
+			return
+		}
+
+		e.ServerError(w, e.RespDBDataAccessFailure)
+		return
+	}
+
+	rows, err := a.repository.UpdateStatus(id, form.Status)
+	if err != nil {
+		a.logger.Error().Err(err).Msg("Change status failed")
+		if errors.Is(err, ErrLastAdmin) {
+			http.Error(w, "Cannot suspend or deactivate the last admin!", http.StatusConflict)
+			return
+		}
+
+		e.ServerError(w, e.RespDBDataUpdateFailure)
+		return
+	}
+	if rows == 0 {
+		e.NotFound(w)
+		return
+	}
+
+	user, err := a.repository.Read(id)
+	if err != nil {
+		a.logger.Error().Err(err).Msg("Change status failed")
+		e.ServerError(w, e.RespDBDataAccessFailure)
+		return
+	}
+
+	a.logger.Info().Str("user", id.String()).Str("status", form.Status.ToString()).Msg("Status changed")
+	audit.Record(r.Context(), "user.status", "user", id.String(), current.ToResponse(), user.ToResponse())
+
+	response := user.ToResponse()
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		a.logger.Error().Err(err).Msg("Change status failed")
+		e.ServerError(w, e.RespJSONEncodeFailure)
+		return
+	}
+}
+
+// Login godoc
+//
+//	@summary		Login user
+//	@description	Login user
+//	@tags			users
+//	@accept			json
+//	@produce		json
+//	@param			body	body	LoginForm	true	"Login form"
+//	@success		200	{object}	LoginResponse
+//	@success		202	{object}	TwoFactorChallengeResponse
+//	@failure		401
+//	@failure		403
+//	@failure		422	{object}	error.Errors
+//	@failure		429
+//	@failure		500	{object}	error.Error
+//	@router			/users/login [post]
+func (a *API) Login(w http.ResponseWriter, r *http.Request) {
+	session, err := a.store.Get(r, "session")
+	if value, ok := session.Values["email"].(string); ok && err == nil {
+		if len(value) != 0 {
+			a.logger.Error().Err(err).Msg("User already logged in!")
+			return
+		}
+	}
+
+	form := &LoginForm{}
+	if err := json.NewDecoder(r.Body).Decode(form); err != nil {
+		a.logger.Error().Err(err).Msg("Login user failed")
+		e.ServerError(w, e.RespJSONDecodeFailure)
+		return
+	}
+
+	if err := a.validator.Struct(form); err != nil {
+		a.logger.Error().Err(err).Msg("Login user failed")
+		respBody, err := json.Marshal(validatorUtil.ToErrResponse(err))
+		if err != nil {
+			e.ServerError(w, e.RespJSONEncodeFailure)
+			return
+		}
+
+		e.ValidationErrors(w, respBody)
+		return
+	}
+
+	audit.Record(r.Context(), "user.login", "user", form.Email, nil, nil)
+	if locked := a.checkLockout(w, []string{emailSubject(form.Email), ipSubject(r)}); locked {
+		return
+	}
+
+	user, err := a.repository.GetByEmail(form.Email)
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		a.logger.Error().Err(err).Msg("Login user failed")
+		e.ServerError(w, e.RespDBDataAccessFailure)
+		return
+	}
+
+	hash := dummyHash
+	if user != nil {
+		hash = user.Password
+		audit.Record(r.Context(), "user.login", "user", user.ID.String(), nil, nil)
+	}
+
+	if err := bcrypt.CompareHashAndPassword(hash, []byte(form.Password)); err != nil || user == nil {
+		a.logger.Error().Err(err).Msg("Login user failed")
+		a.loginFailed(w, r, form.Email, user)
+		return
+	}
+
+	if _, err := a.repository.ResetLoginFailures(emailSubject(form.Email)); err != nil {
+		a.logger.Error().Err(err).Msg("Resetting login failures failed")
+	}
+
+	if !user.Status.CanLogin() {
+		a.logger.Error().Str("user", user.ID.String()).Str("status", user.Status.ToString()).Msg("Login of inactive user")
+		accountInactive(w, user.Status)
+		return
+	}
+
+	if a.config.Verification.Required && user.Role == Patient && user.EmailVerifiedAt == nil {
+		a.logger.Error().Str("user", user.ID.String()).Msg("Login of unverified user")
+		http.Error(w, "Email address is not verified!", http.StatusForbidden)
+		return
+	}
+
+	challenge, err := a.twoFactorChallenge(session, user)
+	if err != nil {
+		a.logger.Error().Err(err).Msg("Login user failed")
+		e.ServerError(w, e.RespDBDataAccessFailure)
+		return
+	}
+
+	if challenge != nil {
+		if err := session.Save(r, w); err != nil {
+			a.logger.Error().Err(err).Msg("Login user failed")
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusAccepted)
+		if err := json.NewEncoder(w).Encode(challenge); err != nil {
+			a.logger.Error().Err(err).Msg("Login user failed")
+			e.ServerError(w, e.RespJSONEncodeFailure)
+		}
+		return
+	}
+
+	a.completeLogin(w, r, session, user)
+}
+
+// completeLogin stores the user in the session and responds with the user and,
+// when enabled, a token pair.
+func (a *API) completeLogin(w http.ResponseWriter, r *http.Request, session *sessions.Session, user *User) {
+	userSession, err := a.startSession(r, session, user)
+	if err != nil {
+		a.logger.Error().Err(err).Msg("Login user failed")
+		e.ServerError(w, e.RespDBDataInsertFailure)
+		return
+	}
+
+	if err := session.Save(r, w); err != nil {
+		a.logger.Error().Err(err).Msg("Login user failed")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	response := &LoginResponse{UserResponse: user.ToResponse()}
+	if a.tokens != nil {
+		pair, err := a.tokens.Issue(user.ID.String(), user.Email, user.Role.ToString(), userSession.ID.String())
+		if err != nil {
+			a.logger.Error().Err(err).Msg("Login user failed")
+			e.ServerError(w, e.RespTokenGenerateFailure)
+			return
+		}
+		response.Pair = pair
+	}
+
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		a.logger.Error().Err(err).Msg("Login user failed")
+		e.ServerError(w, e.RespJSONEncodeFailure)
+		return
+	}
+}
+
+// twoFactorChallenge returns the challenge of a user who has to pass a second
+// factor, and leaves the login pending in the session for LoginTwoFactor. It
+// returns nil when the user can be logged in right away.
+func (a *API) twoFactorChallenge(session *sessions.Session, user *User) (*TwoFactorChallengeResponse, error) {
+	credential, err := a.repository.GetTOTP(user.ID)
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+
+	required, err := a.repository.TwoFactorRequired(user.Role)
+	if err != nil {
+		return nil, err
+	}
+
+	if !credential.IsEnabled() && !required {
+		return nil, nil
+	}
+
+	session.Values["pendingId"] = user.ID.String()
+	session.Values["pendingAt"] = time.Now().Unix()
+	return &TwoFactorChallengeResponse{TwoFactorRequired: true, SetupRequired: !credential.IsEnabled()}, nil
+}
+
+// SignIn logs in a user who was authenticated by an external identity
+// provider. Users who have to pass a second factor get the same pending login
+// as after Login, and the challenge is returned instead of a session being
+// started. Unlike Login it writes no response besides the session cookie.
+func (a *API) SignIn(w http.ResponseWriter, r *http.Request, user *User) (*TwoFactorChallengeResponse, error) {
+	session, err := a.store.Get(r, "session")
+	if err != nil && session == nil {
+		return nil, err
+	}
+
+	challenge, err := a.twoFactorChallenge(session, user)
+	if err != nil {
+		return nil, err
+	}
+
+	if challenge == nil {
+		if _, err := a.startSession(r, session, user); err != nil {
+			return nil, err
+		}
+	}
+
+	return challenge, session.Save(r, w)
+}
+
+// startSession records a new login session of the user and stores it in the
+// session cookie, which the caller saves.
+func (a *API) startSession(r *http.Request, session *sessions.Session, user *User) (*UserSession, error) {
+	now := time.Now()
+	userSession := &UserSession{
+		ID:         GetUUID(),
+		UserID:     user.ID,
+		Device:     DeviceName(r.UserAgent()),
+		IP:         clientip.FromRequest(r),
+		UserAgent:  r.UserAgent(),
+		CreatedAt:  now,
+		LastSeenAt: now,
+	}
+	if err := a.repository.CreateSession(userSession); err != nil {
+		return nil, err
+	}
+
+	if err := a.repository.DeleteExpiredSessions(user.ID, now.Add(-a.store.MaxAge())); err != nil {
+		a.logger.Error().Err(err).Msg("Deleting expired sessions failed")
+	}
+
+	session.Values["sid"] = userSession.ID.String()
+	session.Values["id"] = user.ID.String()
+	session.Values["email"] = user.Email
+	session.Values["role"] = user.Role.ToString()
+	delete(session.Values, "pendingId")
+	delete(session.Values, "pendingAt")
+
+	return userSession, nil
+}
+
+// Logout godoc
+//
+//	@summary		Login user
+//	@description	Login user
+//	@tags			users
+//	@accept			json
+//	@produce		json
+//	@param			body	body	Form	true	"Login form"
+//	@success		200
+//	@failure		401	{object}	error.Error
+//	@failure		422	{object}	error.Errors
+//	@failure		500	{object}	error.Error
+//	@router			/users/logout [post]
+func (a *API) Logout(w http.ResponseWriter, r *http.Request) {
+	session, err := a.store.Get(r, "session")
+	if err != nil {
+		a.logger.Error().Err(err).Msg("Logout user failed")
+	}
+
+	sid, _ := session.Values["sid"].(string)
+	id, _ := session.Values["id"].(string)
+	if sid, err := uuid.Parse(sid); err == nil {
+		if id, err := uuid.Parse(id); err == nil {
+			if _, err := a.repository.DeleteSession(sid, id); err != nil {
+				a.logger.Error().Err(err).Msg("Logout user failed")
+			}
+		}
+	}
+
+	session.Values["sid"] = nil
+	session.Values["id"] = nil
+	session.Values["email"] = nil
+	session.Values["role"] = nil
+	session.Options.MaxAge = -1
+
+	err = session.Save(r, w)
+	if err != nil {
+		a.logger.Error().Err(err).Msg("Logout user failed")
+	}
+}
+
+// ListSessions godoc
+//
+//	@summary		List sessions
+//	@description	List the active sessions of the current user, most recently used first
+//	@tags			sessions
+//	@accept			json
+//	@produce		json
+//	@success		200	{array}		SessionResponse
+//	@failure		401
+//	@failure		500	{object}	error.Error
+//	@router			/users/current/sessions [get]
+func (a *API) ListSessions(w http.ResponseWriter, r *http.Request) {
+	id := a.identityID(r)
+	if id == nil {
+		http.Error(w, "You must log in!", http.StatusUnauthorized)
+		return
+	}
+
+	sessions, err := a.repository.ListSessions(*id, time.Now().Add(-a.store.MaxAge()))
+	if err != nil {
+		a.logger.Error().Err(err).Msg("List sessions failed")
+		e.ServerError(w, e.RespDBDataAccessFailure)
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(sessions.ToResponse(a.sessionID(r))); err != nil {
+		a.logger.Error().Err(err).Msg("List sessions failed")
+		e.ServerError(w, e.RespJSONEncodeFailure)
+		return
+	}
+}
+
+// RevokeSession godoc
+//
+//	@summary		Revoke session
+//	@description	End a session of the current user, e.g. on a lost device. Tokens issued with the session stop working as well.
+//	@tags			sessions
+//	@accept			json
+//	@produce		json
+//	@param			id	path	string	true	"Session ID"
+//	@success		200
+//	@failure		400	{object}	error.Error
+//	@failure		401
+//	@failure		404
+//	@failure		500	{object}	error.Error
+//	@router			/users/current/sessions/{id} [delete]
+func (a *API) RevokeSession(w http.ResponseWriter, r *http.Request) {
+	sid, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		a.logger.Error().Err(err).Msg("Revoke session failed")
+		e.BadRequest(w, e.RespInvalidURLParamID)
+		return
+	}
+
+	id := a.identityID(r)
+	if id == nil {
+		http.Error(w, "You must log in!", http.StatusUnauthorized)
+		return
+	}
+
+	rows, err := a.repository.DeleteSession(sid, *id)
+	if err != nil {
+		a.logger.Error().Err(err).Msg("Revoke session failed")
+		e.ServerError(w, e.RespDBDataRemoveFailure)
+		return
+	}
+	if rows == 0 {
+		e.NotFound(w)
+		return
+	}
+}
+
+// RevokeAllSessions godoc
+//
+//	@summary		Revoke all sessions
+//	@description	End every session of the user, e.g. when the account is compromised
+//	@tags			sessions
+//	@accept			json
+//	@produce		json
+//	@param			id	path	string	true	"User ID"
+//	@success		200
+//	@failure		400	{object}	error.Error
+//	@failure		403	{object}	error.Error
+//	@failure		500	{object}	error.Error
+//	@router			/users/{id}/sessions/revoke-all [post]
+func (a *API) RevokeAllSessions(w http.ResponseWriter, r *http.Request) {
+	id, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		a.logger.Error().Err(err).Msg("Revoke sessions failed")
+		e.BadRequest(w, e.RespInvalidURLParamID)
+		return
+	}
+
+	rows, err := a.repository.DeleteSessions(id, "")
+	if err != nil {
+		a.logger.Error().Err(err).Msg("Revoke sessions failed")
+		e.ServerError(w, e.RespDBDataRemoveFailure)
+		return
+	}
+
+	a.logger.Info().Str("user", id.String()).Int64("sessions", rows).Msg("Sessions revoked")
+}
+
+// endOtherSessions ends the sessions of the user except the one the request is
+// made with. A failure is only logged, the change itself has succeeded.
+func (a *API) endOtherSessions(r *http.Request, userID uuid.UUID) {
+	rows, err := a.repository.DeleteSessions(userID, a.sessionID(r))
+	if err != nil {
+		a.logger.Error().Err(err).Str("user", userID.String()).Msg("Ending sessions failed")
+		return
+	}
+
+	a.logger.Info().Str("user", userID.String()).Int64("sessions", rows).Msg("Sessions ended")
+}
+
+// endRoleSessions ends the sessions of the user whose role was changed, as
+// sessions and tokens carry the role. When callers changed their own role, the
+// session the request is made with is ended as well, so that it cannot keep
+// acting with the old role.
+func (a *API) endRoleSessions(r *http.Request, userID uuid.UUID) {
+	if caller := a.identityID(r); caller == nil || *caller != userID {
+		a.endOtherSessions(r, userID)
+		return
+	}
+
+	rows, err := a.repository.DeleteSessions(userID, "")
+	if err != nil {
+		a.logger.Error().Err(err).Str("user", userID.String()).Msg("Ending sessions failed")
+		return
+	}
+
+	a.logger.Info().Str("user", userID.String()).Int64("sessions", rows).Msg("Sessions ended")
+}
+
+// sessionLive reports whether the login session sid of the user was not ended.
+func (a *API) sessionLive(sid string, userID uuid.UUID) bool {
+	id, err := uuid.Parse(sid)
+	if err != nil {
+		return false
+	}
+
+	session, err := a.repository.GetSession(id)
+	if err != nil {
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			a.logger.Error().Err(err).Msg("Reading session failed")
+		}
+		return false
+	}
+
+	return session.UserID == userID
+}
+
+// sessionID returns the login session of the caller, as resolved by the
+// authentication middleware, or read from the session when the handler runs
+// without it.
+func (a *API) sessionID(r *http.Request) string {
+	if identity, ok := policy.IdentityFrom(r.Context()); ok {
+		return identity.SessionID
+	}
+
+	session, err := a.store.Get(r, "session")
+	if err != nil {
+		return ""
+	}
+
+	sid, _ := session.Values["sid"].(string)
+	return sid
+}
+
+// ChangePassword godoc
+//
+//	@summary		Change password
+//	@description	Change password of the user after checking the current one
+//	@tags			users
+//	@accept			json
+//	@produce		json
+//	@param			id		path	string			true	"User ID"
+//	@param			body	body	PasswordForm	true	"Password form"
+//	@success		200
+//	@failure		400	{object}	error.Error
+//	@failure		401
+//	@failure		403	{object}	error.Error
+//	@failure		404
+//	@failure		422	{object}	error.Errors
+//	@failure		500	{object}	error.Error
+//	@router			/users/{id}/password [put]
+func (a *API) ChangePassword(w http.ResponseWriter, r *http.Request) {
+	id, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		a.logger.Error().Err(err).Msg("Change password failed")
+		e.BadRequest(w, e.RespInvalidURLParamID)
+		return
+	}
+	audit.Record(r.Context(), "user.password", "user", id.String(), nil, nil)
+
+	form := &PasswordForm{}
+	if err := json.NewDecoder(r.Body).Decode(form); err != nil {
+		a.logger.Error().Err(err).Msg("Change password failed")
+		e.ServerError(w, e.RespJSONDecodeFailure)
+		return
+	}
+
+	if err := a.validator.Struct(form); err != nil {
+		a.logger.Error().Err(err).Msg("Change password failed")
+		respBody, err := json.Marshal(validatorUtil.ToErrResponse(err))
+		if err != nil {
+			e.ServerError(w, e.RespJSONEncodeFailure)
+			return
+		}
+
+		e.ValidationErrors(w, respBody)
+		return
+	}
+
+	user, err := a.repository.Read(id)
+	if err != nil {
+		a.logger.Error().Err(err).Msg("Change password failed")
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			e.NotFound(w)
+			return
+		}
+
+		e.ServerError(w, e.RespDBDataAccessFailure)
+		return
+	}
+
+	if err := bcrypt.CompareHashAndPassword(user.Password, []byte(form.CurrentPassword)); err != nil {
+		a.logger.Error().Err(err).Msg("Change password failed")
+		http.Error(w, "Invalid current password!", http.StatusUnauthorized)
+		return
+	}
+
+	password, err := GenerateHash([]byte(form.NewPassword))
+	if err != nil {
+		a.logger.Error().Err(err).Msg("Change password failed")
+		e.ServerError(w, e.RespDBDataUpdateFailure)
+		return
+	}
+
+	if _, err := a.repository.UpdatePassword(id, password); err != nil {
+		a.logger.Error().Err(err).Msg("Change password failed")
+		e.ServerError(w, e.RespDBDataUpdateFailure)
+		return
+	}
+
+	a.endOtherSessions(r, id)
+}
+
+// ForgotPassword godoc
+//
+//	@summary		Request password reset
+//	@description	Issue a single-use password reset token. Responds the same way whether or not the email exists.
+//	@tags			users
+//	@accept			json
+//	@produce		json
+//	@param			body	body	ForgotPasswordForm	true	"Forgot password form"
+//	@success		202
+//	@failure		422	{object}	error.Errors
+//	@failure		500	{object}	error.Error
+//	@router			/users/password/forgot [post]
+func (a *API) ForgotPassword(w http.ResponseWriter, r *http.Request) {
+	form := &ForgotPasswordForm{}
+	if err := json.NewDecoder(r.Body).Decode(form); err != nil {
+		a.logger.Error().Err(err).Msg("Forgot password failed")
+		e.ServerError(w, e.RespJSONDecodeFailure)
+		return
+	}
+
+	if err := a.validator.Struct(form); err != nil {
+		a.logger.Error().Err(err).Msg("Forgot password failed")
+		respBody, err := json.Marshal(validatorUtil.ToErrResponse(err))
+		if err != nil {
+			e.ServerError(w, e.RespJSONEncodeFailure)
+			return
+		}
+
+		e.ValidationErrors(w, respBody)
+		return
+	}
+
+	user, err := a.repository.GetByEmail(form.Email)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+
+		a.logger.Error().Err(err).Msg("Forgot password failed")
+		e.ServerError(w, e.RespDBDataAccessFailure)
+		return
+	}
+
+	token, err := GenerateToken()
+	if err != nil {
+		a.logger.Error().Err(err).Msg("Forgot password failed")
+		e.ServerError(w, e.RespTokenGenerateFailure)
+		return
+	}
+
+	resetToken := &PasswordResetToken{
+		ID:        GetUUID(),
+		UserID:    user.ID,
+		TokenHash: HashToken(token),
+		ExpiresAt: time.Now().Add(ResetTokenTTL),
+	}
+	if err := a.repository.CreatePasswordResetToken(resetToken); err != nil {
+		a.logger.Error().Err(err).Msg("Forgot password failed")
+		e.ServerError(w, e.RespDBDataInsertFailure)
+		return
+	}
+
+	a.sendMail(r, user, "password_reset", map[string]any{
+		"Name":    user.Name,
+		"Link":    a.config.PasswordResetURL + "?token=" + url.QueryEscape(token),
+		"Minutes": int(ResetTokenTTL.Minutes()),
+	})
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// ResetPassword godoc
+//
+//	@summary		Reset password
+//	@description	Set a new password using a password reset token
+//	@tags			users
+//	@accept			json
+//	@produce		json
+//	@param			body	body	ResetPasswordForm	true	"Reset password form"
+//	@success		200
+//	@failure		400	{object}	error.Error
+//	@failure		422	{object}	error.Errors
+//	@failure		500	{object}	error.Error
+//	@router			/users/password/reset [post]
+func (a *API) ResetPassword(w http.ResponseWriter, r *http.Request) {
+	form := &ResetPasswordForm{}
+	if err := json.NewDecoder(r.Body).Decode(form); err != nil {
+		a.logger.Error().Err(err).Msg("Reset password failed")
+		e.ServerError(w, e.RespJSONDecodeFailure)
+		return
+	}
+
+	if err := a.validator.Struct(form); err != nil {
+		a.logger.Error().Err(err).Msg("Reset password failed")
+		respBody, err := json.Marshal(validatorUtil.ToErrResponse(err))
+		if err != nil {
+			e.ServerError(w, e.RespJSONEncodeFailure)
+			return
+		}
+
+		e.ValidationErrors(w, respBody)
+		return
+	}
+
+	password, err := GenerateHash([]byte(form.Password))
+	if err != nil {
+		a.logger.Error().Err(err).Msg("Reset password failed")
+		e.ServerError(w, e.RespDBDataUpdateFailure)
+		return
+	}
+
+	if err := a.repository.ResetPassword(HashToken(form.Token), password, time.Now()); err != nil {
+		a.logger.Error().Err(err).Msg("Reset password failed")
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			e.BadRequest(w, e.RespInvalidToken)
+			return
+		}
+
+		e.ServerError(w, e.RespDBDataUpdateFailure)
+		return
+	}
+}
+
+// ChangeRole godoc
+//
+//	@summary		Change role
+//	@description	Change role of the user. The last remaining admin cannot be demoted.
+//	@tags			users
+//	@accept			json
+//	@produce		json
+//	@param			id		path	string		true	"User ID"
+//	@param			body	body	RoleForm	true	"Role form"
+//	@success		200	{object}	UserResponse
+//	@failure		400	{object}	error.Error
+//	@failure		403	{object}	error.Error
+//	@failure		404
+//	@failure		409
+//	@failure		422	{object}	error.Errors
+//	@failure		500	{object}	error.Error
+//	@router			/users/{id}/role [patch]
+func (a *API) ChangeRole(w http.ResponseWriter, r *http.Request) {
+	id, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		a.logger.Error().Err(err).Msg("Change role failed")
+		e.BadRequest(w, e.RespInvalidURLParamID)
+		return
+	}
+	audit.Record(r.Context(), "user.role", "user", id.String(), nil, nil)
+
+	form := &RoleForm{}
+	if err := json.NewDecoder(r.Body).Decode(form); err != nil {
+		a.logger.Error().Err(err).Msg("Change role failed")
+		e.ServerError(w, e.RespJSONDecodeFailure)
+		return
+	}
+
+	if err := a.validator.Struct(form); err != nil {
+		a.logger.Error().Err(err).Msg("Change role failed")
+		respBody, err := json.Marshal(validatorUtil.ToErrResponse(err))
+		if err != nil {
+			e.ServerError(w, e.RespJSONEncodeFailure)
+			return
+		}
+
+		e.ValidationErrors(w, respBody)
+		return
+	}
+
+	current, err := a.repository.Read(id)
+	if err != nil {
+		a.logger.Error().Err(err).Msg("Change role failed")
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			e.NotFound(w)
+			return
+		}
+
+		e.ServerError(w, e.RespDBDataAccessFailure)
+		return
+	}
+
+	user, err := a.repository.UpdateRole(id, form.Role, a.identityID(r))
+	if err != nil {
+		a.logger.Error().Err(err).Msg("Change role failed")
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			e.NotFound(w)
+		case errors.Is(err, ErrLastAdmin):
+			http.Error(w, "Cannot demote the last admin!", http.StatusConflict)
+		default:
+			e.ServerError(w, e.RespDBDataUpdateFailure)
+		}
+		return
+	}
+
+	a.logger.Info().Str("user", id.String()).Str("role", form.Role.ToString()).Msg("Role changed")
+	audit.Record(r.Context(), "user.role", "user", id.String(), current.ToResponse(), user.ToResponse())
+
+	// Sessions and tokens carry the role, so the user has to log in again.
+	a.endRoleSessions(r, id)
+
+	response := user.ToResponse()
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		a.logger.Error().Err(err).Msg("Change role failed")
+		e.ServerError(w, e.RespJSONEncodeFailure)
+		return
+	}
+}
+
+// RefreshToken godoc
+//
+//	@summary		Refresh tokens
+//	@description	Exchange a refresh token for a new access and refresh token pair
+//	@tags			users
+//	@accept			json
+//	@produce		json
+//	@param			body	body	RefreshForm	true	"Refresh form"
+//	@success		200	{object}	token.Pair
+//	@failure		401
+//	@failure		404
+//	@failure		422	{object}	error.Errors
+//	@failure		500	{object}	error.Error
+//	@router			/users/token/refresh [post]
+func (a *API) RefreshToken(w http.ResponseWriter, r *http.Request) {
+	if a.tokens == nil {
+		e.NotFound(w)
+		return
+	}
+
+	form := &RefreshForm{}
+	if err := json.NewDecoder(r.Body).Decode(form); err != nil {
+		a.logger.Error().Err(err).Msg("Refresh token failed")
+		e.ServerError(w, e.RespJSONDecodeFailure)
+		return
+	}
+
+	if err := a.validator.Struct(form); err != nil {
+		a.logger.Error().Err(err).Msg("Refresh token failed")
+		respBody, err := json.Marshal(validatorUtil.ToErrResponse(err))
+		if err != nil {
+			e.ServerError(w, e.RespJSONEncodeFailure)
+			return
+		}
+
+		e.ValidationErrors(w, respBody)
+		return
+	}
+
+	claims, err := a.tokens.Parse(form.RefreshToken, token.TypeRefresh)
+	if err != nil {
+		a.logger.Error().Err(err).Msg("Refresh token failed")
+		http.Error(w, "Invalid refresh token!", http.StatusUnauthorized)
+		return
+	}
+
+	id, err := uuid.Parse(claims.Subject)
+	if err != nil {
+		a.logger.Error().Err(err).Msg("Refresh token failed")
+		http.Error(w, "Invalid refresh token!", http.StatusUnauthorized)
+		return
+	}
+
+	// The user is read again so that a role change or removal since the
+	// previous token was issued takes effect.
+	user, err := a.repository.Read(id)
+	if err != nil {
+		a.logger.Error().Err(err).Msg("Refresh token failed")
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			http.Error(w, "Invalid refresh token!", http.StatusUnauthorized)
+			return
+		}
+
+		e.ServerError(w, e.RespDBDataAccessFailure)
+		return
+	}
+
+	if !user.Status.CanLogin() {
+		a.logger.Error().Str("user", user.ID.String()).Str("status", user.Status.ToString()).Msg("Refresh token of inactive user")
+		http.Error(w, "Invalid refresh token!", http.StatusUnauthorized)
+		return
+	}
+
+	if claims.SessionID != "" && !a.sessionLive(claims.SessionID, user.ID) {
+		a.logger.Error().Str("user", user.ID.String()).Msg("Refresh token of ended session")
+		http.Error(w, "Invalid refresh token!", http.StatusUnauthorized)
+		return
+	}
+
+	pair, err := a.tokens.Issue(user.ID.String(), user.Email, user.Role.ToString(), claims.SessionID)
+	if err != nil {
+		a.logger.Error().Err(err).Msg("Refresh token failed")
+		e.ServerError(w, e.RespTokenGenerateFailure)
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(pair); err != nil {
+		a.logger.Error().Err(err).Msg("Refresh token failed")
+		e.ServerError(w, e.RespJSONEncodeFailure)
+		return
+	}
+}
+
+// identity returns the id and role of the caller, as resolved by the
+// authentication middleware, or read from the session when the handler runs
+// without it.
+func (a *API) identity(r *http.Request) (string, string, error) {
+	if identity, ok := policy.IdentityFrom(r.Context()); ok {
+		return identity.ID, identity.Role, nil
+	}
+
+	session, err := a.store.Get(r, "session")
+	if err != nil {
+		return "", "", err
+	}
+
+	id, _ := session.Values["id"].(string)
+	role, _ := session.Values["role"].(string)
+
+	return id, role, nil
+}
+
+// identityID returns the id of the logged in caller, or nil when the request
+// is not made on behalf of a user (e.g. API key).
+func (a *API) identityID(r *http.Request) *uuid.UUID {
+	idString, _, err := a.identity(r)
+	if err != nil {
+		return nil
+	}
+
+	id, err := uuid.Parse(idString)
+	if err != nil {
+		return nil
+	}
+
+	return &id
+}
+
+// LoginTwoFactor godoc
+//
+//	@summary		Login second step
+//	@description	Complete a login that passed the password check with a TOTP or recovery code
+//	@tags			two-factor
+//	@accept			json
+//	@produce		json
+//	@param			body	body	TwoFactorLoginForm	true	"Code form"
+//	@success		200	{object}	LoginResponse
+//	@failure		401
+//	@failure		422	{object}	error.Errors
+//	@failure		429
+//	@failure		500	{object}	error.Error
+//	@router			/users/login/2fa [post]
+func (a *API) LoginTwoFactor(w http.ResponseWriter, r *http.Request) {
+	session, err := a.store.Get(r, "session")
+	if err != nil {
+		a.logger.Error().Err(err).Msg("Two-factor login failed")
+		e.ServerError(w, e.RespSessionAccessFailure)
+		return
+	}
+
+	id, ok := pendingUserID(session)
+	if !ok {
+		http.Error(w, "Log in with password first!", http.StatusUnauthorized)
+		return
+	}
+
+	form := &TwoFactorLoginForm{}
+	if err := json.NewDecoder(r.Body).Decode(form); err != nil {
+		a.logger.Error().Err(err).Msg("Two-factor login failed")
+		e.ServerError(w, e.RespJSONDecodeFailure)
+		return
+	}
+
+	if err := a.validator.Struct(form); err != nil {
+		a.logger.Error().Err(err).Msg("Two-factor login failed")
+		respBody, err := json.Marshal(validatorUtil.ToErrResponse(err))
+		if err != nil {
+			e.ServerError(w, e.RespJSONEncodeFailure)
+			return
+		}
+
+		e.ValidationErrors(w, respBody)
+		return
+	}
+
+	user, err := a.repository.Read(id)
+	if err != nil {
+		a.logger.Error().Err(err).Msg("Two-factor login failed")
+		e.ServerError(w, e.RespDBDataAccessFailure)
+		return
+	}
+
+	if locked := a.checkLockout(w, []string{emailSubject(user.Email), ipSubject(r)}); locked {
+		return
+	}
+
+	credential, err := a.repository.GetTOTP(id)
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		a.logger.Error().Err(err).Msg("Two-factor login failed")
+		e.ServerError(w, e.RespDBDataAccessFailure)
+		return
+	}
+	if !credential.IsEnabled() {
+		http.Error(w, "Two-factor authentication must be set up first!", http.StatusUnauthorized)
+		return
+	}
+
+	valid := false
+	if form.Code != "" {
+		valid, err = a.useCode(credential, form.Code)
+		if err != nil {
+			a.logger.Error().Err(err).Msg("Two-factor login failed")
+			e.ServerError(w, e.RespDBDataUpdateFailure)
+			return
+		}
+	} else {
+		valid, err = a.repository.UseRecoveryCode(id, HashToken(form.RecoveryCode), time.Now())
+		if err != nil {
+			a.logger.Error().Err(err).Msg("Two-factor login failed")
+			e.ServerError(w, e.RespDBDataUpdateFailure)
+			return
+		}
+	}
+
+	if !valid {
+		a.logger.Error().Str("user", id.String()).Msg("Two-factor login failed")
+		a.loginFailed(w, r, user.Email, user)
+		return
+	}
+
+	if !user.Status.CanLogin() {
+		a.logger.Error().Str("user", user.ID.String()).Str("status", user.Status.ToString()).Msg("Two-factor login of inactive user")
+		accountInactive(w, user.Status)
+		return
+	}
+
+	a.completeLogin(w, r, session, user)
+}
+
+// EnrollTwoFactor godoc
+//
+//	@summary		Start two-factor enrollment
+//	@description	Generate a TOTP secret for the logged in user, or for a user whose login waits for two-factor setup
+//	@tags			two-factor
+//	@accept			json
+//	@produce		json
+//	@success		200	{object}	EnrollResponse
+//	@failure		401
+//	@failure		409
+//	@failure		500	{object}	error.Error
+//	@router			/users/2fa/enroll [post]
+func (a *API) EnrollTwoFactor(w http.ResponseWriter, r *http.Request) {
+	user, ok := a.twoFactorUser(w, r)
+	if !ok {
+		return
+	}
+
+	credential, err := a.repository.GetTOTP(user.ID)
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		a.logger.Error().Err(err).Msg("Two-factor enrollment failed")
+		e.ServerError(w, e.RespDBDataAccessFailure)
+		return
+	}
+	if credential.IsEnabled() {
+		http.Error(w, "Two-factor authentication already enabled!", http.StatusConflict)
+		return
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		a.logger.Error().Err(err).Msg("Two-factor enrollment failed")
+		e.ServerError(w, e.RespTokenGenerateFailure)
+		return
+	}
+
+	if err := a.repository.SaveTOTP(&TOTPCredential{UserID: user.ID, Secret: secret, CreatedAt: time.Now()}); err != nil {
+		a.logger.Error().Err(err).Msg("Two-factor enrollment failed")
+		e.ServerError(w, e.RespDBDataInsertFailure)
+		return
+	}
+
+	response := &EnrollResponse{Secret: secret, URI: totp.URI(TOTPIssuer, user.Email, secret)}
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		a.logger.Error().Err(err).Msg("Two-factor enrollment failed")
+		e.ServerError(w, e.RespJSONEncodeFailure)
+		return
+	}
+}
+
+// ConfirmTwoFactor godoc
+//
+//	@summary		Confirm two-factor enrollment
+//	@description	Enable two-factor authentication with a code from the authenticator app. Returns one-time recovery codes.
+//	@tags			two-factor
+//	@accept			json
+//	@produce		json
+//	@param			body	body	TwoFactorCodeForm	true	"Code form"
+//	@success		200	{object}	RecoveryCodesResponse
+//	@failure		401
+//	@failure		409
+//	@failure		422	{object}	error.Errors
+//	@failure		429
+//	@failure		500	{object}	error.Error
+//	@router			/users/2fa/confirm [post]
+func (a *API) ConfirmTwoFactor(w http.ResponseWriter, r *http.Request) {
+	user, ok := a.twoFactorUser(w, r)
+	if !ok {
+		return
+	}
+
+	form := &TwoFactorCodeForm{}
+	if !a.decodeTwoFactorCode(w, r, form) {
+		return
+	}
+
+	credential, err := a.repository.GetTOTP(user.ID)
+	if err != nil {
+		a.logger.Error().Err(err).Msg("Two-factor confirmation failed")
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			http.Error(w, "Two-factor enrollment not started!", http.StatusConflict)
+			return
+		}
+
+		e.ServerError(w, e.RespDBDataAccessFailure)
+		return
+	}
+	if credential.IsEnabled() {
+		http.Error(w, "Two-factor authentication already enabled!", http.StatusConflict)
+		return
+	}
+
+	if locked := a.checkLockout(w, []string{emailSubject(user.Email), ipSubject(r)}); locked {
+		return
+	}
+
+	valid, err := a.useCode(credential, form.Code)
+	if err != nil {
+		a.logger.Error().Err(err).Msg("Two-factor confirmation failed")
+		e.ServerError(w, e.RespDBDataUpdateFailure)
+		return
+	}
+	if !valid {
+		a.logger.Error().Str("user", user.ID.String()).Msg("Two-factor confirmation failed")
+		a.codeFailed(w, r, user)
+		return
+	}
+
+	codes, err := GenerateRecoveryCodes()
+	if err != nil {
+		a.logger.Error().Err(err).Msg("Two-factor confirmation failed")
+		e.ServerError(w, e.RespTokenGenerateFailure)
+		return
+	}
+
+	hashes := make([][]byte, 0, len(codes))
+	for _, code := range codes {
+		hashes = append(hashes, HashToken(code))
+	}
+
+	if err := a.repository.EnableTOTP(user.ID, hashes, time.Now()); err != nil {
+		a.logger.Error().Err(err).Msg("Two-factor confirmation failed")
+		e.ServerError(w, e.RespDBDataUpdateFailure)
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(&RecoveryCodesResponse{RecoveryCodes: codes}); err != nil {
+		a.logger.Error().Err(err).Msg("Two-factor confirmation failed")
+		e.ServerError(w, e.RespJSONEncodeFailure)
+		return
+	}
+}
+
+// DisableTwoFactor godoc
+//
+//	@summary		Disable two-factor authentication
+//	@description	Disable two-factor authentication of the current user, unless it is mandatory for their role
+//	@tags			two-factor
+//	@accept			json
+//	@produce		json
+//	@param			body	body	TwoFactorCodeForm	true	"Code form"
+//	@success		200
+//	@failure		401
+//	@failure		404
+//	@failure		409
+//	@failure		422	{object}	error.Errors
+//	@failure		429
+//	@failure		500	{object}	error.Error
+//	@router			/users/current/2fa [delete]
+func (a *API) DisableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	id := a.identityID(r)
+	if id == nil {
+		http.Error(w, "You must log in!", http.StatusUnauthorized)
+		return
+	}
+
+	form := &TwoFactorCodeForm{}
+	if !a.decodeTwoFactorCode(w, r, form) {
+		return
+	}
+
+	user, err := a.repository.Read(*id)
+	if err != nil {
+		a.logger.Error().Err(err).Msg("Disable two-factor failed")
+		e.ServerError(w, e.RespDBDataAccessFailure)
+		return
+	}
+
+	required, err := a.repository.TwoFactorRequired(user.Role)
+	if err != nil {
+		a.logger.Error().Err(err).Msg("Disable two-factor failed")
+		e.ServerError(w, e.RespDBDataAccessFailure)
+		return
+	}
+	if required {
+		http.Error(w, "Two-factor authentication is mandatory for your role!", http.StatusConflict)
+		return
+	}
+
+	credential, err := a.repository.GetTOTP(user.ID)
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		a.logger.Error().Err(err).Msg("Disable two-factor failed")
+		e.ServerError(w, e.RespDBDataAccessFailure)
+		return
+	}
+	if !credential.IsEnabled() {
+		e.NotFound(w)
+		return
+	}
+
+	if locked := a.checkLockout(w, []string{emailSubject(user.Email), ipSubject(r)}); locked {
+		return
+	}
+
+	valid, err := a.useCode(credential, form.Code)
+	if err != nil {
+		a.logger.Error().Err(err).Msg("Disable two-factor failed")
+		e.ServerError(w, e.RespDBDataUpdateFailure)
+		return
+	}
+	if !valid {
+		a.logger.Error().Str("user", user.ID.String()).Msg("Disable two-factor failed")
+		a.codeFailed(w, r, user)
+		return
+	}
+
+	if err := a.repository.DeleteTOTP(user.ID); err != nil {
+		a.logger.Error().Err(err).Msg("Disable two-factor failed")
+		e.ServerError(w, e.RespDBDataRemoveFailure)
+		return
+	}
+}
+
+// ListTwoFactorPolicies godoc
+//
+//	@summary		List two-factor policies
+//	@description	List roles for which two-factor authentication is configured
+//	@tags			two-factor
+//	@accept			json
+//	@produce		json
+//	@success		200	{array}		TwoFactorPolicyResponse
+//	@failure		403	{object}	error.Error
+//	@failure		500	{object}	error.Error
+//	@router			/2fa/policies [get]
+func (a *API) ListTwoFactorPolicies(w http.ResponseWriter, _ *http.Request) {
+	policies, err := a.repository.ListTwoFactorPolicies()
+	if err != nil {
+		a.logger.Error().Err(err).Msg("List two-factor policies failed")
+		e.ServerError(w, e.RespDBDataAccessFailure)
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(policies.ToResponse()); err != nil {
+		a.logger.Error().Err(err).Msg("List two-factor policies failed")
+		e.ServerError(w, e.RespJSONEncodeFailure)
+		return
+	}
+}
+
+// SetTwoFactorPolicy godoc
+//
+//	@summary		Set two-factor policy
+//	@description	Make two-factor authentication mandatory or optional for a role
+//	@tags			two-factor
+//	@accept			json
+//	@produce		json
+//	@param			role	path	string				true	"Role"
+//	@param			body	body	TwoFactorPolicyForm	true	"Policy form"
+//	@success		200	{object}	TwoFactorPolicyResponse
+//	@failure		400	{object}	error.Error
+//	@failure		403	{object}	error.Error
+//	@failure		422	{object}	error.Errors
+//	@failure		500	{object}	error.Error
+//	@router			/2fa/policies/{role} [put]
+func (a *API) SetTwoFactorPolicy(w http.ResponseWriter, r *http.Request) {
+	role := ToRole(chi.URLParam(r, "role"))
+	if role == Unknown {
+		e.BadRequest(w, e.RespInvalidURLParamRole)
+		return
+	}
+
+	form := &TwoFactorPolicyForm{}
+	if err := json.NewDecoder(r.Body).Decode(form); err != nil {
+		a.logger.Error().Err(err).Msg("Set two-factor policy failed")
+		e.ServerError(w, e.RespJSONDecodeFailure)
+		return
+	}
+
+	if err := a.validator.Struct(form); err != nil {
+		a.logger.Error().Err(err).Msg("Set two-factor policy failed")
+		respBody, err := json.Marshal(validatorUtil.ToErrResponse(err))
+		if err != nil {
+			e.ServerError(w, e.RespJSONEncodeFailure)
+			return
+		}
+
+		e.ValidationErrors(w, respBody)
+		return
+	}
+
+	policy := &TwoFactorPolicy{Role: role, Required: *form.Required}
+	if err := a.repository.SetTwoFactorPolicy(policy); err != nil {
+		a.logger.Error().Err(err).Msg("Set two-factor policy failed")
+		e.ServerError(w, e.RespDBDataUpdateFailure)
+		return
+	}
+
+	response := TwoFactorPolicies{policy}.ToResponse()[0]
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		a.logger.Error().Err(err).Msg("Set two-factor policy failed")
+		e.ServerError(w, e.RespJSONEncodeFailure)
+		return
+	}
+}
+
+// twoFactorUser returns the user managing two-factor authentication: the
+// logged in user, or the user whose login waits for two-factor setup. It
+// writes the error response itself when there is none.
+func (a *API) twoFactorUser(w http.ResponseWriter, r *http.Request) (*User, bool) {
+	id := a.identityID(r)
+	if id == nil {
+		session, err := a.store.Get(r, "session")
+		if err != nil {
+			a.logger.Error().Err(err).Msg("Two-factor user lookup failed")
+			e.ServerError(w, e.RespSessionAccessFailure)
+			return nil, false
+		}
+
+		pending, ok := pendingUserID(session)
+		if !ok {
+			http.Error(w, "You must log in!", http.StatusUnauthorized)
+			return nil, false
+		}
+		id = &pending
+	}
+
+	user, err := a.repository.Read(*id)
+	if err != nil {
+		a.logger.Error().Err(err).Msg("Two-factor user lookup failed")
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			http.Error(w, "You must log in!", http.StatusUnauthorized)
+			return nil, false
+		}
+
+		e.ServerError(w, e.RespDBDataAccessFailure)
+		return nil, false
+	}
+
+	return user, true
+}
+
+// useCode reports whether code is a valid TOTP code of the credential which is
+// later than the last accepted one, and records it so it cannot be replayed.
+func (a *API) useCode(credential *TOTPCredential, code string) (bool, error) {
+	step, ok := totp.Step(credential.Secret, code, time.Now())
+	if !ok {
+		return false, nil
+	}
+
+	return a.repository.UseTOTPStep(credential.UserID, step)
+}
+
+func (a *API) decodeTwoFactorCode(w http.ResponseWriter, r *http.Request, form *TwoFactorCodeForm) bool {
+	if err := json.NewDecoder(r.Body).Decode(form); err != nil {
+		a.logger.Error().Err(err).Msg("Two-factor code decoding failed")
+		e.ServerError(w, e.RespJSONDecodeFailure)
+		return false
+	}
+
+	if err := a.validator.Struct(form); err != nil {
+		respBody, err := json.Marshal(validatorUtil.ToErrResponse(err))
+		if err != nil {
+			e.ServerError(w, e.RespJSONEncodeFailure)
+			return false
+		}
+
+		e.ValidationErrors(w, respBody)
+		return false
+	}
+
+	return true
+}
+
+// pendingUserID returns the user whose login passed the password check and
+// waits for the second factor.
+func pendingUserID(session *sessions.Session) (uuid.UUID, bool) {
+	idString, ok := session.Values["pendingId"].(string)
+	if !ok {
+		return uuid.Nil, false
+	}
+
+	pendingAt, ok := session.Values["pendingAt"].(int64)
+	if !ok || time.Since(time.Unix(pendingAt, 0)) > TwoFactorLoginTTL {
+		return uuid.Nil, false
+	}
+
+	id, err := uuid.Parse(idString)
+	if err != nil {
+		return uuid.Nil, false
+	}
+
+	return id, true
+}
+
+// Unlock godoc
+//
+//	@summary		Unlock user
+//	@description	Clear failed login attempts and the lockout of the user and of the client IPs the failures came from
+//	@tags			users
+//	@accept			json
+//	@produce		json
+//	@param			id	path	string	true	"User ID"
+//	@success		200
+//	@failure		400	{object}	error.Error
+//	@failure		403	{object}	error.Error
+//	@failure		404
+//	@failure		500	{object}	error.Error
+//	@router			/users/{id}/unlock [post]
+func (a *API) Unlock(w http.ResponseWriter, r *http.Request) {
+	id, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		a.logger.Error().Err(err).Msg("Unlock user failed")
+		e.BadRequest(w, e.RespInvalidURLParamID)
+		return
+	}
+
+	user, err := a.repository.Read(id)
+	if err != nil {
+		a.logger.Error().Err(err).Msg("Unlock user failed")
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			e.NotFound(w)
+			return
+		}
+
+		e.ServerError(w, e.RespDBDataAccessFailure)
+		return
+	}
+
+	if _, err := a.repository.Unlock(emailSubject(user.Email)); err != nil {
+		a.logger.Error().Err(err).Msg("Unlock user failed")
+		e.ServerError(w, e.RespDBDataRemoveFailure)
+		return
+	}
+
+	a.logger.Info().Str("user", id.String()).Msg("User unlocked")
+}
+
+// checkLockout responds with 429 when any of the subjects is locked.
+func (a *API) checkLockout(w http.ResponseWriter, subjects []string) bool {
+	now := time.Now()
+	until, err := a.repository.LockedUntil(subjects, now)
+	if err != nil {
+		a.logger.Error().Err(err).Msg("Checking lockout failed")
+		e.ServerError(w, e.RespDBDataAccessFailure)
+		return true
+	}
+
+	if until != nil {
+		tooManyAttempts(w, until.Sub(now))
+		return true
+	}
+
+	return false
+}
+
+// loginFailed counts a failed attempt for the account and the client and locks
+// them when a threshold is reached. The response is the same whether or not
+// the email belongs to an account; user is nil when it does not.
+func (a *API) loginFailed(w http.ResponseWriter, r *http.Request, email string, user *User) {
+	if lock := a.recordFailure(r, email, user); lock > 0 {
+		tooManyAttempts(w, lock)
+		return
+	}
+
+	http.Error(w, "Invalid email or password!", http.StatusUnauthorized)
+}
+
+// codeFailed counts a wrong two-factor code of a logged in user like a failed
+// login, so that codes cannot be guessed.
+func (a *API) codeFailed(w http.ResponseWriter, r *http.Request, user *User) {
+	if lock := a.recordFailure(r, user.Email, user); lock > 0 {
+		tooManyAttempts(w, lock)
+		return
+	}
+
+	http.Error(w, "Invalid code!", http.StatusUnauthorized)
+}
+
+// recordFailure counts a failed attempt of the account and the client IP and
+// locks the ones over their threshold, returning the longest lock.
+func (a *API) recordFailure(r *http.Request, email string, user *User) time.Duration {
+	now := time.Now()
+	account, client := emailSubject(email), ipSubject(r)
+	var lock time.Duration
+
+	for _, subject := range []struct {
+		name      string
+		source    string
+		threshold int
+	}{
+		{name: account, source: client, threshold: a.config.Lockout.MaxAttempts},
+		{name: client, threshold: a.config.Lockout.MaxAttemptsPerIP},
+	} {
+		failures, err := a.repository.RecordLoginFailure(subject.name, subject.source, now, a.config.Lockout.Window)
+		if err != nil {
+			a.logger.Error().Err(err).Msg("Recording login failure failed")
+			continue
+		}
+
+		d := a.config.Lockout.duration(failures, subject.threshold)
+		if d == 0 {
+			continue
+		}
+
+		if err := a.repository.Lock(subject.name, now.Add(d)); err != nil {
+			a.logger.Error().Err(err).Msg("Locking login failed")
+			continue
+		}
+
+		a.logger.Warn().Str("subject", subject.name).Int("failures", failures).Dur("duration", d).Msg("Login locked")
+		lock = max(lock, d)
+
+		if subject.name == account && user != nil {
+			a.sendMail(r, user, "lockout", map[string]any{
+				"Name":    user.Name,
+				"Minutes": int(math.Ceil(d.Minutes())),
+			})
+		}
+	}
+
+	return lock
+}
+
+func accountInactive(w http.ResponseWriter, status Status) {
+	http.Error(w, fmt.Sprintf("Account is %s!", status), http.StatusForbidden)
+}
+
+func tooManyAttempts(w http.ResponseWriter, retryAfter time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	http.Error(w, "Too many login attempts, try again later!", http.StatusTooManyRequests)
+}
+
+func emailSubject(email string) string {
+	return "email:" + strings.ToLower(strings.TrimSpace(email))
+}
+
+func ipSubject(r *http.Request) string {
+	return "ip:" + clientip.FromRequest(r)
+}
+
+// VerifyEmail godoc
+//
+//	@summary		Verify email
+//	@description	Confirm the email address with the token from the verification link
+//	@tags			users
+//	@accept			json
+//	@produce		json
+//	@param			body	body	VerifyEmailForm	true	"Verification form"
+//	@success		200	{object}	UserResponse
+//	@failure		400
+//	@failure		422	{object}	error.Errors
+//	@failure		500	{object}	error.Error
+//	@router			/users/email/verify [post]
+func (a *API) VerifyEmail(w http.ResponseWriter, r *http.Request) {
+	form := &VerifyEmailForm{}
+	if err := json.NewDecoder(r.Body).Decode(form); err != nil {
+		a.logger.Error().Err(err).Msg("Verify email failed")
+		e.ServerError(w, e.RespJSONDecodeFailure)
+		return
+	}
+
+	if err := a.validator.Struct(form); err != nil {
+		a.logger.Error().Err(err).Msg("Verify email failed")
+		respBody, err := json.Marshal(validatorUtil.ToErrResponse(err))
+		if err != nil {
+			e.ServerError(w, e.RespJSONEncodeFailure)
+			return
+		}
+
+		e.ValidationErrors(w, respBody)
+		return
+	}
+
+	now := time.Now()
+	id, email, err := ParseVerificationToken(a.config.Verification.Secret, form.Token, now)
+	if err != nil {
+		a.logger.Error().Err(err).Msg("Verify email failed")
+		http.Error(w, "Invalid or expired token!", http.StatusBadRequest)
+		return
+	}
+
+	user, err := a.repository.Read(id)
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		a.logger.Error().Err(err).Msg("Verify email failed")
+		e.ServerError(w, e.RespDBDataAccessFailure)
+		return
+	}
+	if user == nil || user.Email != email {
+		a.logger.Error().Str("user", id.String()).Msg("Verify email failed")
+		http.Error(w, "Invalid or expired token!", http.StatusBadRequest)
+		return
+	}
+
+	if user.EmailVerifiedAt == nil {
+		if _, err := a.repository.VerifyEmail(id, email, now); err != nil {
+			a.logger.Error().Err(err).Msg("Verify email failed")
+			e.ServerError(w, e.RespDBDataUpdateFailure)
+			return
+		}
+		user.Status = StatusActive
+		user.EmailVerifiedAt = &now
+	}
+
+	response := user.ToResponse()
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		a.logger.Error().Err(err).Msg("Verify email failed")
+		e.ServerError(w, e.RespJSONEncodeFailure)
+		return
+	}
+}
+
+// ResendVerification godoc
+//
+//	@summary		Resend verification
+//	@description	Send the verification link again. The response does not reveal whether the email is registered.
+//	@tags			users
+//	@accept			json
+//	@produce		json
+//	@param			body	body	ResendVerificationForm	true	"Resend form"
+//	@success		202
+//	@failure		422	{object}	error.Errors
+//	@failure		500	{object}	error.Error
+//	@router			/users/email/verify/resend [post]
+func (a *API) ResendVerification(w http.ResponseWriter, r *http.Request) {
+	form := &ResendVerificationForm{}
+	if err := json.NewDecoder(r.Body).Decode(form); err != nil {
+		a.logger.Error().Err(err).Msg("Resend verification failed")
+		e.ServerError(w, e.RespJSONDecodeFailure)
+		return
+	}
+
+	if err := a.validator.Struct(form); err != nil {
+		a.logger.Error().Err(err).Msg("Resend verification failed")
+		respBody, err := json.Marshal(validatorUtil.ToErrResponse(err))
+		if err != nil {
+			e.ServerError(w, e.RespJSONEncodeFailure)
+			return
+		}
+
+		e.ValidationErrors(w, respBody)
+		return
+	}
+
+	user, err := a.repository.GetByEmail(form.Email)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+
+		a.logger.Error().Err(err).Msg("Resend verification failed")
+		e.ServerError(w, e.RespDBDataAccessFailure)
+		return
+	}
+
+	if user.EmailVerifiedAt == nil {
+		a.sendVerification(r, user)
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// sendVerification mails the verification link to the user.
+func (a *API) sendVerification(r *http.Request, user *User) {
+	t := SignVerificationToken(a.config.Verification.Secret, user.ID, user.Email, time.Now().Add(a.config.Verification.TTL))
+
+	a.sendMail(r, user, "verification", map[string]any{
+		"Name":  user.Name,
+		"Link":  a.config.Verification.URL + "?token=" + url.QueryEscape(t),
+		"Hours": int(math.Ceil(a.config.Verification.TTL.Hours())),
+	})
+}
+
+// sendMail queues a templated message to the user in the language of the
+// request. A failure is only logged, none of the messages is critical.
+func (a *API) sendMail(r *http.Request, user *User, template string, data map[string]any) {
+	if err := a.mail.Send(r.Context(), user.Email, r.Header.Get("Accept-Language"), template, data); err != nil {
+		a.logger.Error().Err(err).Str("user", user.ID.String()).Str("template", template).Msg("Sending mail failed")
 	}
 }
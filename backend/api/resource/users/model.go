@@ -1,17 +1,195 @@
 package users
 
 import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"reflect"
 	"slices"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/google/uuid"
 	"golang.org/x/crypto/bcrypt"
-	_ "gorm.io/gorm" // nolint
+	"gorm.io/gorm"
+
+	"backend/api/resource/common/policy"
+	"backend/utils/etag"
+	"backend/utils/pagination"
+	"backend/utils/token"
+)
+
+var ErrInvalidVerificationToken = errors.New("verification token is invalid or expired")
+
+var (
+	ErrInvalidPatch    = errors.New("patch is invalid")
+	ErrPatchTestFailed = errors.New("patch test failed")
 )
 
 var GenerateHash = func(password []byte) ([]byte, error) {
 	return bcrypt.GenerateFromPassword(password, bcrypt.DefaultCost)
 }
 
+var GenerateToken = func() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// HashToken returns the digest under which a token is stored, so that a leaked
+// table does not expose usable tokens.
+func HashToken(token string) []byte {
+	sum := sha256.Sum256([]byte(token))
+	return sum[:]
+}
+
+var ResetTokenTTL = time.Hour
+
+// TwoFactorLoginTTL is how long a login that passed the password check waits
+// for the second factor.
+var TwoFactorLoginTTL = 5 * time.Minute
+
+const (
+	TOTPIssuer         = "HealthHub"
+	recoveryCodesCount = 10
+)
+
+// GenerateRecoveryCodes returns one-time codes in the form xxxxx-xxxxx.
+func GenerateRecoveryCodes() ([]string, error) {
+	codes := make([]string, recoveryCodesCount)
+	for i := range codes {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		code := hex.EncodeToString(b)
+		codes[i] = code[:5] + "-" + code[5:]
+	}
+	return codes, nil
+}
+
+// Lockout configures how failed logins are throttled. Failures are counted per
+// email and per client IP; once a counter reaches its threshold the subject is
+// locked, for twice as long with every further failure.
+type Lockout struct {
+	MaxAttempts      int
+	MaxAttemptsPerIP int
+	Window           time.Duration
+	BaseDuration     time.Duration
+	MaxDuration      time.Duration
+}
+
+var DefaultLockout = Lockout{
+	MaxAttempts:      5,
+	MaxAttemptsPerIP: 20,
+	Window:           15 * time.Minute,
+	BaseDuration:     time.Minute,
+	MaxDuration:      time.Hour,
+}
+
+// duration returns how long to lock a subject after its n-th failure, or zero
+// when it stays below the threshold.
+func (l *Lockout) duration(failures, threshold int) time.Duration {
+	if failures < threshold {
+		return 0
+	}
+
+	d := l.BaseDuration
+	for i := threshold; i < failures && d < l.MaxDuration; i++ {
+		d *= 2
+	}
+	return min(d, l.MaxDuration)
+}
+
+// Config holds the settings of the account flows.
+type Config struct {
+	Lockout      Lockout
+	Verification Verification
+	// PasswordResetURL of the frontend page the reset link points to; the
+	// token is appended as the token query parameter.
+	PasswordResetURL string
+}
+
+var DefaultConfig = Config{
+	Lockout:      DefaultLockout,
+	Verification: Verification{TTL: DefaultVerificationTTL},
+}
+
+// Verification configures the email verification sent on registration and
+// email changes.
+type Verification struct {
+	Secret []byte
+	// URL of the frontend page the link points to; the token is appended as
+	// the token query parameter.
+	URL string
+	TTL time.Duration
+	// Required blocks patients with an unverified email from logging in.
+	Required bool
+}
+
+var DefaultVerificationTTL = 48 * time.Hour
+
+// SignVerificationToken returns a token binding the user to the email being
+// verified, so that a link sent to a previous address stops working once the
+// email is changed again.
+func SignVerificationToken(secret []byte, id uuid.UUID, email string, expiresAt time.Time) string {
+	payload := id.String() + "|" + email + "|" + strconv.FormatInt(expiresAt.Unix(), 10)
+	encoded := base64.RawURLEncoding.EncodeToString([]byte(payload))
+
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(verificationMAC(secret, encoded))
+}
+
+// ParseVerificationToken checks the signature and expiry of a token and returns
+// the user and email it was issued for.
+func ParseVerificationToken(secret []byte, t string, now time.Time) (uuid.UUID, string, error) {
+	encoded, signature, ok := strings.Cut(t, ".")
+	if !ok {
+		return uuid.Nil, "", ErrInvalidVerificationToken
+	}
+
+	mac, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil || !hmac.Equal(mac, verificationMAC(secret, encoded)) {
+		return uuid.Nil, "", ErrInvalidVerificationToken
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return uuid.Nil, "", ErrInvalidVerificationToken
+	}
+
+	parts := strings.Split(string(payload), "|")
+	if len(parts) != 3 {
+		return uuid.Nil, "", ErrInvalidVerificationToken
+	}
+
+	id, err := uuid.Parse(parts[0])
+	if err != nil {
+		return uuid.Nil, "", ErrInvalidVerificationToken
+	}
+
+	expiresAt, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil || now.Unix() >= expiresAt {
+		return uuid.Nil, "", ErrInvalidVerificationToken
+	}
+
+	return id, parts[1], nil
+}
+
+func verificationMAC(secret []byte, payload string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte("email-verification." + payload))
+	return mac.Sum(nil)
+}
+
 type Role string
 
 const (
@@ -33,18 +211,71 @@ func ToRole(s string) Role {
 	return Unknown
 }
 
+type Status string
+
+const (
+	StatusPending     Status = "pending"
+	StatusActive      Status = "active"
+	StatusSuspended   Status = "suspended"
+	StatusDeactivated Status = "deactivated"
+)
+
+func (s Status) ToString() string {
+	return string(s)
+}
+
+// CanLogin reports whether an account in the status may log in and keep using
+// its sessions and tokens.
+func (s Status) CanLogin() bool {
+	return s == StatusActive || s == StatusPending
+}
+
 type ListResponse struct {
 	Users         []*UserResponse `json:"users"`
 	TotalItems    int64           `json:"total"`
 	NumberOfPages int             `json:"pages"`
 	CurrentPage   int             `json:"currentPage"`
+	NextCursor    string          `json:"nextCursor,omitempty"`
+	PrevCursor    string          `json:"prevCursor,omitempty"`
+}
+
+// ListQuery holds the search, sort and filter parameters of the users list.
+type ListQuery struct {
+	Q           string `json:"q" form:"max=255"`
+	Sort        string `json:"sort" form:"omitempty,oneof=name email role status createdAt"`
+	Order       string `json:"order" form:"omitempty,oneof=asc desc"`
+	Status      string `json:"status" form:"omitempty,oneof=pending active suspended deactivated"`
+	EmailDomain string `json:"emailDomain" form:"omitempty,fqdn,max=255"`
+	CreatedFrom string `json:"createdFrom" form:"omitempty,datetime=2006-01-02"`
+	CreatedTo   string `json:"createdTo" form:"omitempty,datetime=2006-01-02"`
+}
+
+// sortColumns maps the sort parameter to columns, it is the allow-list of
+// what users can be ordered by.
+var sortColumns = map[string]string{
+	"name":      "name",
+	"email":     "email",
+	"role":      "role",
+	"status":    "status",
+	"createdAt": "created_at",
 }
 
 type UserResponse struct {
-	ID    uuid.UUID `json:"id"`
-	Name  string    `json:"name"`
-	Email string    `json:"email"`
-	Role  string    `json:"role"`
+	ID            uuid.UUID  `json:"id"`
+	Name          string     `json:"name"`
+	Email         string     `json:"email"`
+	Role          string     `json:"role"`
+	Status        string     `json:"status"`
+	EmailVerified bool       `json:"emailVerified"`
+	CreatedAt     time.Time  `json:"createdAt"`
+	UpdatedAt     time.Time  `json:"updatedAt"`
+	DeletedAt     *time.Time `json:"deletedAt,omitempty"`
+	ETag          string     `json:"etag"`
+}
+
+type LoginResponse struct {
+	*UserResponse
+	*token.Pair
 }
 
 type Form struct {
@@ -59,28 +290,519 @@ type UpdateForm struct {
 	Email string `json:"email" form:"required_without=Name,email,max=255"`
 }
 
+// Patch is a partial update of a user. Only the members present in it are
+// changed. Every patchable field is required, so a member cannot be cleared
+// and null is rejected.
+type Patch struct {
+	Name   *string `json:"name" form:"omitnil,alpha_space,max=255"`
+	Email  *string `json:"email" form:"omitnil,email,max=255"`
+	Role   *Role   `json:"role" form:"omitnil,role"`
+	Status *Status `json:"status" form:"omitnil,oneof=pending active suspended deactivated"`
+
+	// members of the patch, null ones included.
+	members []string
+}
+
+// patchFields maps the members of a patch to the permission needed to change
+// them. The route itself requires UsersUpdate.
+var patchFields = map[string]policy.Permission{
+	"name":   policy.UsersUpdate,
+	"email":  policy.UsersUpdate,
+	"role":   policy.UsersRole,
+	"status": policy.UsersStatus,
+}
+
+// JSONPatchOperation is an operation of an RFC 6902 JSON patch.
+type JSONPatchOperation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	Value json.RawMessage `json:"value"`
+}
+
 type LoginForm struct {
 	Email    string `json:"email" form:"email,max=255"`
 	Password string `json:"password" form:"required,password,max=255"`
 }
 
+type PasswordForm struct {
+	CurrentPassword string `json:"currentPassword" form:"required,max=255"`
+	NewPassword     string `json:"newPassword" form:"required,password,max=255"`
+}
+
+type ForgotPasswordForm struct {
+	Email string `json:"email" form:"required,email,max=255"`
+}
+
+type VerifyEmailForm struct {
+	Token string `json:"token" form:"required,max=512"`
+}
+
+type StatusForm struct {
+	Status Status `json:"status" form:"required,oneof=active suspended deactivated"`
+}
+
+type ResendVerificationForm struct {
+	Email string `json:"email" form:"required,email,max=255"`
+}
+
+type ResetPasswordForm struct {
+	Token    string `json:"token" form:"required,max=255"`
+	Password string `json:"password" form:"required,password,max=255"`
+}
+
+type TwoFactorChallengeResponse struct {
+	TwoFactorRequired bool `json:"twoFactorRequired"`
+	SetupRequired     bool `json:"setupRequired"`
+}
+
+type EnrollResponse struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+type RecoveryCodesResponse struct {
+	RecoveryCodes []string `json:"recoveryCodes"`
+}
+
+type TwoFactorCodeForm struct {
+	Code string `json:"code" form:"required,numeric,len=6"`
+}
+
+type TwoFactorLoginForm struct {
+	Code         string `json:"code" form:"required_without=RecoveryCode,max=6"`
+	RecoveryCode string `json:"recoveryCode" form:"required_without=Code,max=64"`
+}
+
+type TwoFactorPolicyForm struct {
+	Required *bool `json:"required" form:"required"`
+}
+
+type TwoFactorPolicyResponse struct {
+	Role     string `json:"role"`
+	Required bool   `json:"required"`
+}
+
+type RefreshForm struct {
+	RefreshToken string `json:"refreshToken" form:"required"`
+}
+
+type SessionResponse struct {
+	ID         uuid.UUID `json:"id"`
+	Device     string    `json:"device"`
+	IP         string    `json:"ip"`
+	UserAgent  string    `json:"userAgent"`
+	CreatedAt  time.Time `json:"createdAt"`
+	LastSeenAt time.Time `json:"lastSeenAt"`
+	Current    bool      `json:"current"`
+}
+
+type RoleForm struct {
+	Role Role `json:"role" form:"required,role"`
+}
+
 type User struct {
 	ID       uuid.UUID `gorm:"primarykey"`
 	Name     string
 	Email    string
 	Password []byte
-	Role     Role `gorm:"type:Role, default:unknown"`
+	Role     Role   `gorm:"type:Role, default:unknown"`
+	Status   Status `gorm:"type:Status"`
+
+	EmailVerifiedAt *time.Time
+	CreatedAt       time.Time
+	// UpdatedAt and Version are maintained by a trigger on every change.
+	UpdatedAt time.Time `gorm:"<-:false"`
+	Version   int       `gorm:"<-:false"`
+	DeletedAt gorm.DeletedAt
 }
 
 type Users []*User
 
+// RoleChange records who changed the role of a user. ActorID is nil when the
+// change was made with the API key instead of an admin session.
+type RoleChange struct {
+	ID        uuid.UUID `gorm:"primarykey"`
+	UserID    uuid.UUID
+	ActorID   *uuid.UUID
+	OldRole   Role `gorm:"type:Role"`
+	NewRole   Role `gorm:"type:Role"`
+	CreatedAt time.Time
+}
+
+type TOTPCredential struct {
+	UserID    uuid.UUID `gorm:"primarykey"`
+	Secret    string
+	EnabledAt *time.Time
+	CreatedAt time.Time
+	// LastStep is the time step of the last accepted code, codes of this or
+	// an earlier step are refused so that a code cannot be replayed.
+	LastStep int64
+}
+
+func (c *TOTPCredential) IsEnabled() bool {
+	return c != nil && c.EnabledAt != nil
+}
+
+type RecoveryCode struct {
+	ID       uuid.UUID `gorm:"primarykey"`
+	UserID   uuid.UUID
+	CodeHash []byte
+	UsedAt   *time.Time
+}
+
+type TwoFactorPolicy struct {
+	Role     Role `gorm:"primarykey;type:Role"`
+	Required bool
+}
+
+type TwoFactorPolicies []*TwoFactorPolicy
+
+func (p TwoFactorPolicies) ToResponse() []*TwoFactorPolicyResponse {
+	response := make([]*TwoFactorPolicyResponse, 0, len(p))
+	for _, policy := range p {
+		response = append(response, &TwoFactorPolicyResponse{Role: policy.Role.ToString(), Required: policy.Required})
+	}
+	return response
+}
+
+type LoginThrottle struct {
+	Subject       string `gorm:"primarykey"`
+	Failures      int
+	LastFailureAt time.Time
+	LockedUntil   *time.Time
+}
+
+// UserSession is a login of a user, kept next to the session store so that the
+// logins can be listed and ended. The session and the tokens issued with it
+// carry its ID and stop working once the row is deleted.
+type UserSession struct {
+	ID         uuid.UUID `gorm:"primarykey"`
+	UserID     uuid.UUID
+	Device     string
+	IP         string
+	UserAgent  string
+	CreatedAt  time.Time
+	LastSeenAt time.Time
+}
+
+type UserSessions []*UserSession
+
+func (s *UserSession) ToResponse(current string) *SessionResponse {
+	return &SessionResponse{
+		ID:         s.ID,
+		Device:     s.Device,
+		IP:         s.IP,
+		UserAgent:  s.UserAgent,
+		CreatedAt:  s.CreatedAt,
+		LastSeenAt: s.LastSeenAt,
+		Current:    s.ID.String() == current,
+	}
+}
+
+func (sessions UserSessions) ToResponse(current string) []*SessionResponse {
+	response := make([]*SessionResponse, 0, len(sessions))
+	for _, s := range sessions {
+		response = append(response, s.ToResponse(current))
+	}
+	return response
+}
+
+// DeviceName describes the browser and operating system of a user agent,
+// e.g. "Firefox on Windows".
+func DeviceName(userAgent string) string {
+	var browser, os string
+	switch {
+	case strings.Contains(userAgent, "Edg/"):
+		browser = "Edge"
+	case strings.Contains(userAgent, "OPR/"):
+		browser = "Opera"
+	case strings.Contains(userAgent, "Firefox/"):
+		browser = "Firefox"
+	case strings.Contains(userAgent, "Chrome/"):
+		browser = "Chrome"
+	case strings.Contains(userAgent, "Safari/"):
+		browser = "Safari"
+	}
+
+	switch {
+	case strings.Contains(userAgent, "iPhone"), strings.Contains(userAgent, "iPad"):
+		os = "iOS"
+	case strings.Contains(userAgent, "Android"):
+		os = "Android"
+	case strings.Contains(userAgent, "Windows"):
+		os = "Windows"
+	case strings.Contains(userAgent, "Mac OS X"):
+		os = "macOS"
+	case strings.Contains(userAgent, "Linux"):
+		os = "Linux"
+	}
+
+	switch {
+	case browser != "" && os != "":
+		return browser + " on " + os
+	case browser != "":
+		return browser
+	case os != "":
+		return os
+	default:
+		return "Unknown device"
+	}
+}
+
+type PasswordResetToken struct {
+	ID        uuid.UUID `gorm:"primarykey"`
+	UserID    uuid.UUID
+	TokenHash []byte
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+	CreatedAt time.Time
+}
+
 func (u *User) ToResponse() *UserResponse {
 	return &UserResponse{
 		ID:    u.ID,
 		Name:  u.Name,
 		Email: u.Email,
 		Role:  u.Role.ToString(),
+
+		Status:        u.Status.ToString(),
+		EmailVerified: u.EmailVerifiedAt != nil,
+		CreatedAt:     u.CreatedAt,
+		UpdatedAt:     u.UpdatedAt,
+		DeletedAt:     deletedAt(u.DeletedAt),
+		ETag:          u.ETag(),
+	}
+}
+
+// ETag identifies the version of the user for conditional requests.
+func (u *User) ETag() string {
+	return etag.FromVersion(u.Version)
+}
+
+func deletedAt(d gorm.DeletedAt) *time.Time {
+	if !d.Valid {
+		return nil
+	}
+	return &d.Time
+}
+
+func ParseListQuery(query url.Values) *ListQuery {
+	return &ListQuery{
+		Q:           strings.TrimSpace(query.Get("q")),
+		Sort:        query.Get("sort"),
+		Order:       query.Get("order"),
+		Status:      query.Get("status"),
+		EmailDomain: query.Get("emailDomain"),
+		CreatedFrom: query.Get("createdFrom"),
+		CreatedTo:   query.Get("createdTo"),
+	}
+}
+
+// Apply sets the order and filters of the validated query on p. The newest
+// accounts come first unless another order is asked for.
+func (q *ListQuery) Apply(p *pagination.Pagination) {
+	p.Sort = sortColumns["createdAt"]
+	p.Desc = q.Order != "asc"
+	if q.Sort != "" {
+		p.Sort = sortColumns[q.Sort]
+		p.Desc = q.Order == "desc"
+	}
+
+	if q.Q != "" {
+		// Matches anywhere in the name or email, which the trigram indexes
+		// serve for searches of three or more characters.
+		pattern := "%" + escapeLike(strings.ToLower(q.Q)) + "%"
+		p.Filters = append(p.Filters, func(db *gorm.DB) *gorm.DB {
+			return db.Where("lower(name) LIKE ? OR lower(email) LIKE ?", pattern, pattern)
+		})
+	}
+	if q.Status != "" {
+		p.Filters = append(p.Filters, func(db *gorm.DB) *gorm.DB {
+			return db.Where("status = ?", q.Status)
+		})
+	}
+	if q.EmailDomain != "" {
+		domain := strings.ToLower(q.EmailDomain)
+		p.Filters = append(p.Filters, func(db *gorm.DB) *gorm.DB {
+			return db.Where("lower(split_part(email, '@', 2)) = ?", domain)
+		})
+	}
+	if from, err := time.Parse(time.DateOnly, q.CreatedFrom); err == nil {
+		p.Filters = append(p.Filters, func(db *gorm.DB) *gorm.DB {
+			return db.Where("created_at >= ?", from)
+		})
+	}
+	// The end date is inclusive.
+	if to, err := time.Parse(time.DateOnly, q.CreatedTo); err == nil {
+		p.Filters = append(p.Filters, func(db *gorm.DB) *gorm.DB {
+			return db.Where("created_at < ?", to.AddDate(0, 0, 1))
+		})
+	}
+}
+
+// sortKey returns the value of one of the sortColumns and the id, which
+// locate the user in the list for cursors.
+func (u *User) sortKey(column string) (any, any) {
+	switch column {
+	case "name":
+		return u.Name, u.ID
+	case "email":
+		return u.Email, u.ID
+	case "role":
+		return u.Role, u.ID
+	case "status":
+		return u.Status, u.ID
+	case "created_at":
+		return u.CreatedAt, u.ID
+	}
+	return nil, u.ID
+}
+
+// escapeLike escapes the wildcards of a LIKE pattern.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
+
+// ParseMergePatch reads an RFC 7396 merge patch, which has to be an object.
+func ParseMergePatch(body []byte) (*Patch, error) {
+	var members map[string]json.RawMessage
+	if err := json.Unmarshal(body, &members); err != nil {
+		return nil, err
+	}
+	if members == nil {
+		return nil, ErrInvalidPatch
+	}
+
+	patch := &Patch{}
+	if err := json.Unmarshal(body, patch); err != nil {
+		return nil, err
+	}
+	for member := range members {
+		patch.members = append(patch.members, member)
+	}
+	slices.Sort(patch.members)
+
+	return patch, nil
+}
+
+// ParseJSONPatch reads an RFC 6902 JSON patch as the merge patch it amounts
+// to. Operations apply in order to the members of the user: add, replace and
+// remove change them and test compares them with the user as changed by the
+// operations before it.
+func ParseJSONPatch(body []byte, current *User) (*Patch, error) {
+	var operations []*JSONPatchOperation
+	if err := json.Unmarshal(body, &operations); err != nil {
+		return nil, err
+	}
+
+	var values map[string]any
+	b, _ := json.Marshal(current.ToResponse())
+	if err := json.Unmarshal(b, &values); err != nil {
+		return nil, err
+	}
+
+	members := map[string]json.RawMessage{}
+	for _, op := range operations {
+		member, ok := strings.CutPrefix(op.Path, "/")
+		if !ok || strings.Contains(member, "/") {
+			return nil, ErrInvalidPatch
+		}
+		member = strings.NewReplacer("~1", "/", "~0", "~").Replace(member)
+
+		switch op.Op {
+		case "add", "replace":
+			var value any
+			if op.Value == nil || json.Unmarshal(op.Value, &value) != nil {
+				return nil, ErrInvalidPatch
+			}
+			members[member] = op.Value
+			values[member] = value
+		case "remove":
+			members[member] = json.RawMessage("null")
+			delete(values, member)
+		case "test":
+			var value any
+			if err := json.Unmarshal(op.Value, &value); err != nil {
+				return nil, ErrInvalidPatch
+			}
+			if !reflect.DeepEqual(values[member], value) {
+				return nil, ErrPatchTestFailed
+			}
+		default:
+			return nil, ErrInvalidPatch
+		}
+	}
+
+	b, _ = json.Marshal(members)
+	return ParseMergePatch(b)
+}
+
+// Problems lists the members which cannot be changed, being unknown or not
+// removable.
+func (p *Patch) Problems() []string {
+	var problems []string
+	for _, member := range p.members {
+		if _, ok := patchFields[member]; !ok {
+			problems = append(problems, fmt.Sprintf("%s cannot be changed", member))
+		} else if p.isNull(member) {
+			problems = append(problems, fmt.Sprintf("%s cannot be removed", member))
+		}
+	}
+	return problems
+}
+
+func (p *Patch) isNull(member string) bool {
+	switch member {
+	case "name":
+		return p.Name == nil
+	case "email":
+		return p.Email == nil
+	case "role":
+		return p.Role == nil
+	case "status":
+		return p.Status == nil
+	}
+	return false
+}
+
+// Permissions returns the permissions needed to apply the patch.
+func (p *Patch) Permissions() []policy.Permission {
+	var permissions []policy.Permission
+	for _, member := range p.members {
+		if perm, ok := patchFields[member]; ok && !slices.Contains(permissions, perm) {
+			permissions = append(permissions, perm)
+		}
+	}
+	return permissions
+}
+
+// Apply changes the user and returns the columns whose values changed. A
+// changed email has to be verified again, which makes an active user pending
+// unless the patch sets the status as well.
+func (p *Patch) Apply(user *User) []string {
+	var columns []string
+	if p.Name != nil && *p.Name != user.Name {
+		user.Name = *p.Name
+		columns = append(columns, "name")
+	}
+	if p.Email != nil && !strings.EqualFold(*p.Email, user.Email) {
+		user.Email = *p.Email
+		user.EmailVerifiedAt = nil
+		columns = append(columns, "email", "email_verified_at")
+		if p.Status == nil && user.Status == StatusActive {
+			user.Status = StatusPending
+			columns = append(columns, "status")
+		}
+	}
+	if p.Role != nil && *p.Role != user.Role {
+		user.Role = *p.Role
+		columns = append(columns, "role")
+	}
+	if p.Status != nil && *p.Status != user.Status {
+		user.Status = *p.Status
+		columns = append(columns, "status")
 	}
+	return columns
 }
 
 func (users Users) ToResponse() *ListResponse {
@@ -100,6 +822,7 @@ func (f *Form) ToModel() *User {
 		Email:    f.Email,
 		Password: password,
 		Role:     f.Role,
+		Status:   StatusPending,
 	}
 }
 
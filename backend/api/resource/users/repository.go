@@ -1,12 +1,22 @@
 package users
 
 import (
+	"errors"
+	"slices"
+	"time"
+
 	"github.com/google/uuid"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 
 	"backend/utils/pagination"
 )
 
+var (
+	ErrLastAdmin       = errors.New("cannot demote, suspend or delete the last admin")
+	ErrVersionMismatch = errors.New("user was changed in the meantime")
+)
+
 type Repository struct {
 	db *gorm.DB
 }
@@ -20,9 +30,10 @@ func NewRepository(db *gorm.DB) *Repository {
 func (r *Repository) List(p pagination.Pagination) *pagination.Pagination {
 	var users Users
 
-	r.db.Scopes(pagination.Paginate(users, &p, r.db)).Find(&users)
+	p.Count(r.db.Model(&User{}))
+	r.db.Scopes(pagination.Paginate(&p)).Find(&users)
 
-	p.Rows = users
+	p.Rows = pagination.Cursors(&p, users, (*User).sortKey)
 
 	return &p
 }
@@ -31,6 +42,9 @@ func (r *Repository) Create(user *User) (*User, error) {
 	if err := r.db.Create(user).Error; err != nil {
 		return nil, err
 	}
+	// The defaults of the columns the database maintains.
+	user.UpdatedAt = user.CreatedAt
+	user.Version = 1
 
 	return user, nil
 }
@@ -44,6 +58,16 @@ func (r *Repository) Read(id uuid.UUID) (*User, error) {
 	return user, nil
 }
 
+// ReadWithDeleted also finds soft deleted users.
+func (r *Repository) ReadWithDeleted(id uuid.UUID) (*User, error) {
+	user := &User{}
+	if err := r.db.Unscoped().Where("id = ?", id).First(&user).Error; err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
 func (r *Repository) GetByEmail(email string) (*User, error) {
 	user := &User{}
 	if err := r.db.Where("email = ?", email).First(&user).Error; err != nil {
@@ -53,17 +77,511 @@ func (r *Repository) GetByEmail(email string) (*User, error) {
 	return user, nil
 }
 
+// GetByEmailWithDeleted also finds soft deleted users, whose addresses stay
+// reserved so that the account can be restored.
+func (r *Repository) GetByEmailWithDeleted(email string) (*User, error) {
+	user := &User{}
+	if err := r.db.Unscoped().Where("email = ?", email).First(&user).Error; err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+// Update updates the name and email of a user. When the user has a version
+// only that version is updated, so that a concurrent change is not lost.
 func (r *Repository) Update(user *User) (int64, error) {
 	result := r.db.Model(&User{}).
 		Select("name", "email").
-		Where("id = ?", user.ID).
+		Scopes(ofVersion(user)).
 		Updates(user)
 
 	return result.RowsAffected, result.Error
 }
 
-func (r *Repository) Delete(id uuid.UUID) (int64, error) {
-	result := r.db.Where("id = ?", id).Delete(&User{})
+// UpdateEmail updates the name and a changed email of a user. The new address
+// has to be verified again, an active user is pending until then while a
+// suspended or deactivated one keeps the status.
+func (r *Repository) UpdateEmail(user *User) (int64, error) {
+	result := r.db.Model(&User{}).
+		Scopes(ofVersion(user)).
+		Updates(map[string]any{
+			"name":              user.Name,
+			"email":             user.Email,
+			"status":            gorm.Expr("CASE WHEN status = ? THEN ? ELSE status END", StatusActive, StatusPending),
+			"email_verified_at": nil,
+		})
+
+	return result.RowsAffected, result.Error
+}
+
+func ofVersion(user *User) func(db *gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		db = db.Where("id = ?", user.ID)
+		if user.Version != 0 {
+			db = db.Where("version = ?", user.Version)
+		}
+		return db
+	}
+}
+
+// VerifyEmail marks the email of a user as verified, provided it is still the
+// address the verification was sent to.
+func (r *Repository) VerifyEmail(id uuid.UUID, email string, now time.Time) (int64, error) {
+	result := r.db.Model(&User{}).
+		Where("id = ? AND email = ? AND status = ?", id, email, StatusPending).
+		Updates(map[string]any{
+			"status":            StatusActive,
+			"email_verified_at": now,
+		})
+
+	return result.RowsAffected, result.Error
+}
+
+// Delete soft deletes the user at the given time. The last active admin cannot
+// be deleted.
+func (r *Repository) Delete(id uuid.UUID, now time.Time) (int64, error) {
+	var rows int64
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		admins, err := lockAdmins(tx)
+		if err != nil {
+			return err
+		}
+
+		if isLastAdmin(admins, id) {
+			return ErrLastAdmin
+		}
+
+		result := tx.Model(&User{}).
+			Where("id = ?", id).
+			Update("deleted_at", now)
+		rows = result.RowsAffected
+
+		return result.Error
+	})
+
+	return rows, err
+}
+
+func (r *Repository) Restore(id uuid.UUID) (int64, error) {
+	result := r.db.Unscoped().Model(&User{}).
+		Where("id = ? AND deleted_at IS NOT NULL", id).
+		Update("deleted_at", nil)
+
+	return result.RowsAffected, result.Error
+}
+
+// UpdateStatus sets the status of the user. The last active admin cannot be
+// suspended or deactivated.
+func (r *Repository) UpdateStatus(id uuid.UUID, status Status) (int64, error) {
+	var rows int64
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		admins, err := lockAdmins(tx)
+		if err != nil {
+			return err
+		}
+
+		if !status.CanLogin() && isLastAdmin(admins, id) {
+			return ErrLastAdmin
+		}
+
+		result := tx.Model(&User{}).
+			Where("id = ?", id).
+			Update("status", status)
+		rows = result.RowsAffected
+
+		return result.Error
+	})
+
+	return rows, err
+}
+
+// IsActive reports whether the user exists, is not deleted and may log in.
+func (r *Repository) IsActive(id uuid.UUID) (bool, error) {
+	user := &User{}
+	err := r.db.Select("status").Where("id = ?", id).First(user).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return user.Status.CanLogin(), nil
+}
+
+func (r *Repository) UpdatePassword(id uuid.UUID, password []byte) (int64, error) {
+	result := r.db.Model(&User{}).
+		Where("id = ?", id).
+		Update("password", password)
+
+	return result.RowsAffected, result.Error
+}
+
+func (r *Repository) CreatePasswordResetToken(token *PasswordResetToken) error {
+	return r.db.Create(token).Error
+}
+
+// ResetPassword stores a new password for the owner of a valid reset token and
+// marks the token as used, so that it cannot be redeemed twice. Every session
+// of the owner is ended, as the password may have leaked.
+func (r *Repository) ResetPassword(tokenHash []byte, password []byte, now time.Time) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		token := &PasswordResetToken{}
+		if err := tx.Where("token_hash = ? AND used_at IS NULL AND expires_at > ?", tokenHash, now).
+			First(token).Error; err != nil {
+			return err
+		}
+
+		if err := tx.Model(&User{}).
+			Where("id = ?", token.UserID).
+			Update("password", password).Error; err != nil {
+			return err
+		}
+
+		if err := tx.Where("user_id = ?", token.UserID).Delete(&UserSession{}).Error; err != nil {
+			return err
+		}
+
+		return tx.Model(&PasswordResetToken{}).
+			Where("id = ?", token.ID).
+			Update("used_at", now).Error
+	})
+}
+
+// UpdateRole changes the role of a user and records the change. Admin rows are
+// locked for the duration of the transaction so that two concurrent demotions
+// cannot leave the system without an admin.
+func (r *Repository) UpdateRole(id uuid.UUID, role Role, actorID *uuid.UUID) (*User, error) {
+	user := &User{}
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		admins, err := lockAdmins(tx)
+		if err != nil {
+			return err
+		}
+
+		if err := tx.Where("id = ?", id).First(user).Error; err != nil {
+			return err
+		}
+
+		if user.Role == role {
+			return nil
+		}
+
+		if isLastAdmin(admins, id) {
+			return ErrLastAdmin
+		}
+
+		if err := tx.Model(&User{}).
+			Where("id = ?", id).
+			Update("role", role).Error; err != nil {
+			return err
+		}
+
+		change := &RoleChange{
+			ID:      GetUUID(),
+			UserID:  id,
+			ActorID: actorID,
+			OldRole: user.Role,
+			NewRole: role,
+		}
+		user.Role = role
+
+		return tx.Create(change).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+// Patch saves the given columns of a patched user in one transaction. A role
+// change is checked and recorded as by UpdateRole, and a status change is
+// checked as by UpdateStatus. When the user has a version only that version is
+// changed.
+func (r *Repository) Patch(user *User, columns []string, actorID *uuid.UUID) (*User, error) {
+	patched := &User{}
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		var admins []uuid.UUID
+		if slices.Contains(columns, "role") || slices.Contains(columns, "status") {
+			var err error
+			if admins, err = lockAdmins(tx); err != nil {
+				return err
+			}
+		}
+
+		current := &User{}
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("id = ?", user.ID).
+			First(current).Error; err != nil {
+			return err
+		}
+
+		if user.Version != 0 && user.Version != current.Version {
+			return ErrVersionMismatch
+		}
+
+		roleChanged := slices.Contains(columns, "role") && user.Role != current.Role
+		suspended := slices.Contains(columns, "status") && !user.Status.CanLogin()
+		if (roleChanged || suspended) && isLastAdmin(admins, user.ID) {
+			return ErrLastAdmin
+		}
+
+		if err := tx.Model(&User{}).
+			Select(columns).
+			Where("id = ?", user.ID).
+			Updates(user).Error; err != nil {
+			return err
+		}
+
+		if roleChanged {
+			change := &RoleChange{
+				ID:      GetUUID(),
+				UserID:  user.ID,
+				ActorID: actorID,
+				OldRole: current.Role,
+				NewRole: user.Role,
+			}
+			if err := tx.Create(change).Error; err != nil {
+				return err
+			}
+		}
+
+		return tx.Where("id = ?", user.ID).First(patched).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return patched, nil
+}
+
+// lockAdmins locks the rows of the active admins until the end of the
+// transaction and returns their ids. Pending, suspended, deactivated and
+// deleted admins do not count, as they cannot act.
+func lockAdmins(tx *gorm.DB) ([]uuid.UUID, error) {
+	var admins []uuid.UUID
+	err := tx.Model(&User{}).
+		Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("role = ? AND status = ?", Admin, StatusActive).
+		Pluck("id", &admins).Error
+
+	return admins, err
+}
+
+// isLastAdmin reports whether the user is the only active admin.
+func isLastAdmin(admins []uuid.UUID, id uuid.UUID) bool {
+	return len(admins) == 1 && admins[0] == id
+}
+
+func (r *Repository) GetTOTP(userID uuid.UUID) (*TOTPCredential, error) {
+	credential := &TOTPCredential{}
+	if err := r.db.Where("user_id = ?", userID).First(credential).Error; err != nil {
+		return nil, err
+	}
+
+	return credential, nil
+}
+
+// SaveTOTP stores a new, not yet confirmed, secret replacing any previous one.
+func (r *Repository) SaveTOTP(credential *TOTPCredential) error {
+	return r.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "user_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"secret", "enabled_at", "created_at"}),
+	}).Create(credential).Error
+}
+
+// EnableTOTP confirms the secret of a user and replaces the recovery codes.
+func (r *Repository) EnableTOTP(userID uuid.UUID, codeHashes [][]byte, now time.Time) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&TOTPCredential{}).
+			Where("user_id = ?", userID).
+			Update("enabled_at", now).Error; err != nil {
+			return err
+		}
+
+		if err := tx.Where("user_id = ?", userID).Delete(&RecoveryCode{}).Error; err != nil {
+			return err
+		}
+
+		codes := make([]*RecoveryCode, 0, len(codeHashes))
+		for _, hash := range codeHashes {
+			codes = append(codes, &RecoveryCode{ID: GetUUID(), UserID: userID, CodeHash: hash})
+		}
+
+		return tx.Create(codes).Error
+	})
+}
+
+// UseTOTPStep records the time step of an accepted code and reports whether it
+// is later than the step of the last accepted one.
+func (r *Repository) UseTOTPStep(userID uuid.UUID, step int64) (bool, error) {
+	result := r.db.Model(&TOTPCredential{}).
+		Where("user_id = ? AND last_step < ?", userID, step).
+		Update("last_step", step)
+
+	return result.RowsAffected == 1, result.Error
+}
+
+func (r *Repository) DeleteTOTP(userID uuid.UUID) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_id = ?", userID).Delete(&RecoveryCode{}).Error; err != nil {
+			return err
+		}
+
+		return tx.Where("user_id = ?", userID).Delete(&TOTPCredential{}).Error
+	})
+}
+
+// UseRecoveryCode marks an unused recovery code as used and reports whether
+// there was one.
+func (r *Repository) UseRecoveryCode(userID uuid.UUID, codeHash []byte, now time.Time) (bool, error) {
+	result := r.db.Model(&RecoveryCode{}).
+		Where("user_id = ? AND code_hash = ? AND used_at IS NULL", userID, codeHash).
+		Update("used_at", now)
+
+	return result.RowsAffected > 0, result.Error
+}
+
+func (r *Repository) TwoFactorRequired(role Role) (bool, error) {
+	var policies TwoFactorPolicies
+	if err := r.db.Where("role = ?", role).Limit(1).Find(&policies).Error; err != nil {
+		return false, err
+	}
+
+	return len(policies) > 0 && policies[0].Required, nil
+}
+
+func (r *Repository) ListTwoFactorPolicies() (TwoFactorPolicies, error) {
+	var policies TwoFactorPolicies
+	if err := r.db.Order("role").Find(&policies).Error; err != nil {
+		return nil, err
+	}
+
+	return policies, nil
+}
+
+func (r *Repository) SetTwoFactorPolicy(policy *TwoFactorPolicy) error {
+	return r.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "role"}},
+		DoUpdates: clause.AssignmentColumns([]string{"required"}),
+	}).Create(policy).Error
+}
+
+// LockedUntil returns the latest time until which any of the subjects is
+// locked, or nil when none of them is.
+func (r *Repository) LockedUntil(subjects []string, now time.Time) (*time.Time, error) {
+	var throttles []*LoginThrottle
+	if err := r.db.Where("subject IN ? AND locked_until > ?", subjects, now).
+		Find(&throttles).Error; err != nil {
+		return nil, err
+	}
+
+	var until *time.Time
+	for _, t := range throttles {
+		if until == nil || t.LockedUntil.After(*until) {
+			until = t.LockedUntil
+		}
+	}
+
+	return until, nil
+}
+
+// RecordLoginFailure counts a failed login of subject and returns the number
+// of failures within the window. Failures older than the window are forgotten.
+// A non-empty source, the subject of the client the failure came from, is
+// remembered so that Unlock can clear it too.
+func (r *Repository) RecordLoginFailure(subject, source string, now time.Time, window time.Duration) (int, error) {
+	since := now.Add(-window)
+	var failures int
+	err := r.db.Raw(`INSERT INTO login_throttles (subject, failures, last_failure_at, sources)
+		VALUES (?, 1, ?, array_remove(ARRAY[?]::text[], ''))
+		ON CONFLICT (subject) DO UPDATE SET
+			failures = CASE WHEN login_throttles.last_failure_at < ? THEN 1 ELSE login_throttles.failures + 1 END,
+			sources = CASE WHEN login_throttles.last_failure_at < ? THEN EXCLUDED.sources
+				ELSE array_remove(login_throttles.sources, ?) || EXCLUDED.sources END,
+			last_failure_at = EXCLUDED.last_failure_at
+		RETURNING failures`, subject, now, source, since, since, source).
+		Scan(&failures).Error
+
+	return failures, err
+}
+
+func (r *Repository) Lock(subject string, until time.Time) error {
+	return r.db.Model(&LoginThrottle{}).
+		Where("subject = ?", subject).
+		Update("locked_until", until).Error
+}
+
+func (r *Repository) ResetLoginFailures(subject string) (int64, error) {
+	result := r.db.Where("subject = ?", subject).Delete(&LoginThrottle{})
+
+	return result.RowsAffected, result.Error
+}
+
+// Unlock clears the failures and lockout of subject and of the clients its
+// failures came from.
+func (r *Repository) Unlock(subject string) (int64, error) {
+	result := r.db.Where("subject = ? OR subject = ANY (?)", subject,
+		r.db.Model(&LoginThrottle{}).Select("unnest(sources)").Where("subject = ?", subject)).
+		Delete(&LoginThrottle{})
 
 	return result.RowsAffected, result.Error
 }
+
+func (r *Repository) CreateSession(session *UserSession) error {
+	return r.db.Create(session).Error
+}
+
+func (r *Repository) GetSession(id uuid.UUID) (*UserSession, error) {
+	session := &UserSession{}
+	if err := r.db.Where("id = ?", id).First(session).Error; err != nil {
+		return nil, err
+	}
+
+	return session, nil
+}
+
+// ListSessions returns the sessions of the user created after since, most
+// recently used first.
+func (r *Repository) ListSessions(userID uuid.UUID, since time.Time) (UserSessions, error) {
+	var sessions UserSessions
+	if err := r.db.Where("user_id = ? AND created_at > ?", userID, since).
+		Order("last_seen_at desc").
+		Find(&sessions).Error; err != nil {
+		return nil, err
+	}
+
+	return sessions, nil
+}
+
+func (r *Repository) TouchSession(id uuid.UUID, now time.Time) error {
+	return r.db.Model(&UserSession{}).
+		Where("id = ?", id).
+		Update("last_seen_at", now).Error
+}
+
+func (r *Repository) DeleteSession(id, userID uuid.UUID) (int64, error) {
+	result := r.db.Where("id = ? AND user_id = ?", id, userID).Delete(&UserSession{})
+
+	return result.RowsAffected, result.Error
+}
+
+// DeleteSessions ends every session of the user except the one with id
+// except, which may be empty.
+func (r *Repository) DeleteSessions(userID uuid.UUID, except string) (int64, error) {
+	tx := r.db.Where("user_id = ?", userID)
+	if id, err := uuid.Parse(except); err == nil {
+		tx = tx.Where("id <> ?", id)
+	}
+	result := tx.Delete(&UserSession{})
+
+	return result.RowsAffected, result.Error
+}
+
+// DeleteExpiredSessions removes sessions of the user created before the given
+// time, which the session store no longer accepts.
+func (r *Repository) DeleteExpiredSessions(userID uuid.UUID, before time.Time) error {
+	return r.db.Where("user_id = ? AND created_at <= ?", userID, before).Delete(&UserSession{}).Error
+}
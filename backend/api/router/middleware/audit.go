@@ -0,0 +1,77 @@
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/go-chi/chi"
+	"github.com/rs/zerolog"
+
+	"backend/api/resource/audit"
+	"backend/utils/clientip"
+)
+
+// Recorder appends events to the audit log.
+type Recorder interface {
+	Append(event *audit.Event) error
+}
+
+// Audit records every request changing something, and every request that was
+// not authenticated or authorized, in the audit log. Handlers describe their
+// events with audit.Record, the others are recorded by method and route. An
+// event that cannot be recorded is logged, the response is already sent.
+func Audit(logger *zerolog.Logger, recorder Recorder) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			event := &audit.Event{
+				OccurredAt: audit.Now(),
+				ActorType:  audit.ActorAnonymous,
+				IP:         clientip.FromRequest(r),
+				UserAgent:  truncate(r.UserAgent(), 512),
+			}
+			wrapped := wrapResponseWriter(w)
+			next.ServeHTTP(wrapped, r.WithContext(audit.WithEvent(r.Context(), event)))
+
+			status := wrapped.Status()
+			if status == 0 {
+				status = http.StatusOK
+			}
+			// The handler may have told the outcome already.
+			switch {
+			case event.Outcome != "":
+			case status == http.StatusUnauthorized || status == http.StatusForbidden:
+				event.Outcome = audit.OutcomeDenied
+			case status >= http.StatusBadRequest:
+				event.Outcome = audit.OutcomeFailure
+			default:
+				event.Outcome = audit.OutcomeSuccess
+			}
+
+			if event.Action == "" {
+				safe := r.Method == http.MethodGet || r.Method == http.MethodHead || r.Method == http.MethodOptions
+				if safe && event.Outcome != audit.OutcomeDenied {
+					return
+				}
+				event.Action = r.Method + " " + r.URL.Path
+				if rctx := chi.RouteContext(r.Context()); rctx != nil {
+					if pattern := rctx.RoutePattern(); pattern != "" {
+						event.Action = r.Method + " " + pattern
+					}
+					event.TargetID = rctx.URLParam("id")
+				}
+			}
+			event.Action = truncate(event.Action, 255)
+			event.TargetID = truncate(event.TargetID, 255)
+
+			if err := recorder.Append(event); err != nil {
+				logger.Error().Err(err).Str("action", event.Action).Msg("Recording audit event failed")
+			}
+		})
+	}
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n]
+}
@@ -1,43 +1,142 @@
 package middleware
 
 import (
+	"backend/api/resource/apikeys"
+	"backend/api/resource/audit"
+	"backend/api/resource/common/policy"
 	"backend/api/resource/users"
-	"fmt"
+	"backend/utils/sessionstore"
+	"backend/utils/token"
 	"net/http"
+	"strings"
+	"time"
 
-	"github.com/wader/gormstore/v2"
+	"github.com/google/uuid"
 )
 
-func checkAPIkey(r *http.Request, apiKey string) bool {
-	return r.Header.Get("Authorization") == fmt.Sprintf("Bearer %s", apiKey)
+// touchInterval limits how often the last-used timestamp of an API key or a
+// session is written, so that a busy client does not cause a write per request.
+const touchInterval = time.Minute
+
+// Accounts tells whether a user may still act, i.e. the account was neither
+// suspended, deactivated nor deleted and the login session was not ended since
+// the session or token was issued.
+type Accounts interface {
+	IsActive(id uuid.UUID) (bool, error)
+	GetSession(id uuid.UUID) (*users.UserSession, error)
+	TouchSession(id uuid.UUID, now time.Time) error
+}
+
+func bearerToken(r *http.Request) (string, bool) {
+	return strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
 }
 
-func AdminOnly(store *gormstore.Store, apiKey string) func(http.Handler) http.Handler {
+// Authenticate resolves who a request is made by. A bearer JWT access token is
+// verified and any other bearer value is looked up as an API key; without a
+// bearer token the session is used. Requests that cannot be resolved are passed
+// on unchanged and rejected later by LoggedOnly or the route policy, and so are
+// requests of users whose account is no longer active.
+func Authenticate(store sessionstore.Store, tokens *token.Manager, keys *apikeys.Repository, accounts Accounts) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			if !checkAPIkey(r, apiKey) {
+			raw, ok := bearerToken(r)
+			switch {
+			case !ok:
 				session, err := store.Get(r, "session")
-				if value, ok := session.Values["role"].(string); !(ok && err == nil && value == users.Admin.ToString()) {
-					http.Error(w, "Admin needed!", http.StatusUnauthorized)
-					return
+				if err != nil {
+					break
+				}
+				id, ok := session.Values["id"].(string)
+				if !ok {
+					break
+				}
+				sid, _ := session.Values["sid"].(string)
+				if !isActive(accounts, id) || !isLive(accounts, sid, id) {
+					break
+				}
+				email, _ := session.Values["email"].(string)
+				role, _ := session.Values["role"].(string)
+				r = r.WithContext(policy.WithIdentity(r.Context(), &policy.Identity{ID: id, Email: email, Role: role, SessionID: sid}))
+				setActor(r, id, role)
+			case strings.Count(raw, ".") == 2:
+				if tokens == nil {
+					break
+				}
+				claims, err := tokens.Parse(raw, token.TypeAccess)
+				if err != nil || !isActive(accounts, claims.Subject) {
+					break
+				}
+				if claims.SessionID != "" && !isLive(accounts, claims.SessionID, claims.Subject) {
+					break
 				}
+				identity := &policy.Identity{ID: claims.Subject, Email: claims.Email, Role: claims.Role, SessionID: claims.SessionID}
+				r = r.WithContext(policy.WithIdentity(r.Context(), identity))
+				setActor(r, claims.Subject, claims.Role)
+			default:
+				key, err := keys.GetByHash(apikeys.HashKey(raw))
+				now := time.Now()
+				if err != nil || !key.IsActive(now) {
+					break
+				}
+				if key.LastUsedAt == nil || now.Sub(*key.LastUsedAt) > touchInterval {
+					_ = keys.Touch(key.ID, now)
+				}
+				r = r.WithContext(apikeys.WithKey(r.Context(), key))
+				audit.SetActor(r.Context(), audit.ActorAPIKey, key.ID, "")
 			}
 			next.ServeHTTP(w, r)
 		})
 	}
 }
 
-func LoggedOnly(store *gormstore.Store, apiKey string) func(http.Handler) http.Handler {
-	return func(next http.Handler) http.Handler {
-		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			if !checkAPIkey(r, apiKey) {
-				session, err := store.Get(r, "session")
-				if _, ok := session.Values["email"].(string); !ok || err != nil {
-					http.Error(w, "You must log in!", http.StatusUnauthorized)
-					return
-				}
-			}
-			next.ServeHTTP(w, r)
-		})
+// setActor records the logged in user as the actor of the audited request.
+func setActor(r *http.Request, id, role string) {
+	if uid, err := uuid.Parse(id); err == nil {
+		audit.SetActor(r.Context(), audit.ActorUser, uid, role)
+	}
+}
+
+func isActive(accounts Accounts, id string) bool {
+	uid, err := uuid.Parse(id)
+	if err != nil {
+		return false
+	}
+
+	active, err := accounts.IsActive(uid)
+	return err == nil && active
+}
+
+// isLive reports whether the login session sid of the user was not ended, and
+// records that it was seen.
+func isLive(accounts Accounts, sid, userID string) bool {
+	id, err := uuid.Parse(sid)
+	if err != nil {
+		return false
 	}
+
+	session, err := accounts.GetSession(id)
+	if err != nil || session.UserID.String() != userID {
+		return false
+	}
+
+	now := time.Now()
+	if now.Sub(session.LastSeenAt) > touchInterval {
+		_ = accounts.TouchSession(id, now)
+	}
+
+	return true
+}
+
+// LoggedOnly rejects requests that are neither made by a logged in user nor
+// with an active API key. What the caller may do is decided by the route policy.
+func LoggedOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, isUser := policy.IdentityFrom(r.Context())
+		_, isKey := apikeys.FromContext(r.Context())
+		if !isUser && !isKey {
+			http.Error(w, "You must log in!", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
 }
@@ -3,29 +3,60 @@ package router
 import (
 	"github.com/go-chi/chi"
 	"github.com/go-chi/cors"
-	"github.com/wader/gormstore/v2"
 	"gorm.io/gorm"
 
 	"github.com/go-playground/validator/v10"
 	"github.com/rs/zerolog"
 
+	"backend/api/resource/apikeys"
+	"backend/api/resource/audit"
+	"backend/api/resource/auth"
+	"backend/api/resource/availability"
+	"backend/api/resource/careteam"
+	"backend/api/resource/common/policy"
+	"backend/api/resource/federation"
 	"backend/api/resource/health"
+	"backend/api/resource/invitations"
+	"backend/api/resource/oidc"
+	"backend/api/resource/profiles"
 	"backend/api/resource/users"
 	"backend/api/router/middleware"
+	"backend/utils/mailer"
+	"backend/utils/sessionstore"
+	"backend/utils/token"
 
 	_ "backend/docs" // Swagger API documentation
 
 	httpSwagger "github.com/swaggo/http-swagger"
 )
 
-func New(l *zerolog.Logger, db *gorm.DB, v *validator.Validate, s *gormstore.Store, apiKey string) *chi.Mux {
+func New(l *zerolog.Logger, db *gorm.DB, v *validator.Validate, s sessionstore.Store, t *token.Manager, m *mailer.Sender, uc *users.Config, ic *invitations.Config, oc *oidc.Config, fc *federation.Config) *chi.Mux {
 	r := chi.NewRouter()
 
 	loggerMiddleware := middleware.NewLogger(l)
+	auditMiddleware := middleware.Audit(l, audit.NewRepository(db))
 
 	// Health check
 	r.Get("/livez", health.Read)
 
+	// Public signing keys
+	authAPI := auth.New(l, db, t)
+	r.Get("/.well-known/jwks.json", authAPI.JWKS)
+
+	// OpenID Connect provider. The token and userinfo endpoints are called by
+	// relying parties without cookies, so any origin may use them.
+	oidcAPI := oidc.New(l, db, v, s, t, oc)
+	r.Get("/.well-known/openid-configuration", oidcAPI.Discovery)
+	r.With(loggerMiddleware, auditMiddleware).Get("/oauth/authorize", oidcAPI.Authorize)
+	r.Group(func(r chi.Router) {
+		r.Use(cors.AllowAll().Handler)
+		r.Use(loggerMiddleware)
+		r.Use(auditMiddleware)
+		r.Post("/oauth/token", oidcAPI.Token)
+		r.Get("/userinfo", oidcAPI.UserInfo)
+		r.Post("/userinfo", oidcAPI.UserInfo)
+	})
+
 	// Swagger API documentation
 	r.Get("/swagger/*", httpSwagger.WrapHandler)
 
@@ -33,33 +64,150 @@ func New(l *zerolog.Logger, db *gorm.DB, v *validator.Validate, s *gormstore.Sto
 	r.Route("/api/v1", func(r chi.Router) {
 		r.Use(cors.Handler(cors.Options{
 			AllowedOrigins:   []string{"https://*", "http://*"},
-			AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE"},
-			AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token"},
-			ExposedHeaders:   []string{"Link"},
+			AllowedMethods:   []string{"GET", "POST", "PUT", "PATCH", "DELETE"},
+			AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token", "If-Match", "If-None-Match"},
+			ExposedHeaders:   []string{"Link", "ETag"},
 			AllowCredentials: true,
 			MaxAge:           300,
 			Debug:            true,
 		}))
 		r.Use(middleware.ContentTypeJSON)
 		r.Use(loggerMiddleware)
+		r.Use(auditMiddleware)
+		r.Use(middleware.Authenticate(s, t, apikeys.NewRepository(db), users.NewRepository(db)))
 
-		usersAPI := users.New(l, db, v, s, apiKey)
+		usersAPI := users.New(l, db, v, s, t, m, uc)
+		p := policy.New(careteam.NewRepository(db))
 		r.Group(func(r chi.Router) {
-			r.Use(middleware.AdminOnly(s, apiKey))
-			r.Get("/users", usersAPI.List)
-			r.Delete("/users/{id}", usersAPI.Delete)
+			r.Use(middleware.LoggedOnly)
+			r.With(p.Require(policy.UsersList)).Get("/users", usersAPI.List)
+			r.Get("/users/current", usersAPI.Current)
+			r.With(p.Require(policy.UsersRead)).Get("/users/{id}", usersAPI.Read)
+			r.With(p.Require(policy.UsersUpdate)).Put("/users/{id}", usersAPI.Update)
+			r.With(p.Require(policy.UsersUpdate)).Patch("/users/{id}", usersAPI.Patch)
+			r.With(p.Require(policy.UsersDelete)).Delete("/users/{id}", usersAPI.Delete)
+			r.With(p.Require(policy.UsersDelete)).Post("/users/{id}/restore", usersAPI.Restore)
+			r.With(p.Require(policy.UsersPassword)).Put("/users/{id}/password", usersAPI.ChangePassword)
+			r.With(p.Require(policy.UsersRole)).Patch("/users/{id}/role", usersAPI.ChangeRole)
+			r.With(p.Require(policy.UsersStatus)).Patch("/users/{id}/status", usersAPI.ChangeStatus)
+			r.With(p.Require(policy.UsersUnlock)).Post("/users/{id}/unlock", usersAPI.Unlock)
+			r.Post("/users/logout", usersAPI.Logout)
+			r.Get("/users/current/sessions", usersAPI.ListSessions)
+			r.Delete("/users/current/sessions/{id}", usersAPI.RevokeSession)
+			r.With(p.Require(policy.UsersSessions)).Post("/users/{id}/sessions/revoke-all", usersAPI.RevokeAllSessions)
+			r.Delete("/users/current/2fa", usersAPI.DisableTwoFactor)
+			r.With(p.Require(policy.TwoFactorManage)).Get("/2fa/policies", usersAPI.ListTwoFactorPolicies)
+			r.With(p.Require(policy.TwoFactorManage)).Put("/2fa/policies/{role}", usersAPI.SetTwoFactorPolicy)
+			r.With(p.Require(policy.AuthIntrospect)).Post("/auth/introspect", authAPI.Introspect)
 		})
 
+		// Profiles API
+		profilesAPI := profiles.New(l, db, v)
 		r.Group(func(r chi.Router) {
-			r.Use(middleware.LoggedOnly(s, apiKey))
-			r.Get("/users/current", usersAPI.Current)
-			r.Get("/users/{id}", usersAPI.Read)
-			r.Put("/users/{id}", usersAPI.Update)
-			r.Post("/users/logout", usersAPI.Logout)
+			r.Use(middleware.LoggedOnly)
+			r.With(p.Require(policy.ProfileRead)).Get("/users/{id}/patient-profile", profilesAPI.ReadPatient)
+			r.With(p.Require(policy.ProfileUpdate)).Put("/users/{id}/patient-profile", profilesAPI.UpdatePatient)
+		})
+		r.Group(func(r chi.Router) {
+			r.Use(middleware.LoggedOnly)
+			r.Use(p.Require(policy.DoctorsManage))
+			r.Get("/users/{id}/doctor-profile", profilesAPI.ReadDoctor)
+			r.Put("/users/{id}/doctor-profile", profilesAPI.UpdateDoctor)
+			r.Delete("/users/{id}/doctor-profile", profilesAPI.DeleteDoctor)
+			r.Post("/specialties", profilesAPI.CreateSpecialty)
+			r.Delete("/specialties/{id}", profilesAPI.DeleteSpecialty)
+		})
+		r.Get("/doctors", profilesAPI.Directory)
+		r.Get("/specialties", profilesAPI.ListSpecialties)
+
+		// Availability API
+		availabilityAPI := availability.New(l, db, v)
+		r.Group(func(r chi.Router) {
+			r.Use(middleware.LoggedOnly)
+			r.Use(p.Require(policy.ScheduleManage))
+			r.Put("/doctors/{id}/working-hours", availabilityAPI.UpdateWorkingHours)
+			r.Get("/doctors/{id}/exceptions", availabilityAPI.ListExceptions)
+			r.Post("/doctors/{id}/exceptions", availabilityAPI.CreateException)
+			r.Delete("/doctors/{id}/exceptions/{exceptionId}", availabilityAPI.DeleteException)
+		})
+		r.Get("/doctors/{id}/working-hours", availabilityAPI.ReadWorkingHours)
+		r.Get("/doctors/{id}/availability", availabilityAPI.Read)
+
+		// Care team API
+		careTeamAPI := careteam.New(l, db, v)
+		r.Group(func(r chi.Router) {
+			r.Use(middleware.LoggedOnly)
+			r.With(p.Require(policy.CareTeamRead)).Get("/users/{id}/doctors", careTeamAPI.ListDoctors)
+			r.With(p.Require(policy.CareTeamManage)).Post("/users/{id}/doctors", careTeamAPI.AddDoctor)
+			r.With(p.Require(policy.CareTeamManage)).Patch("/users/{id}/doctors/{doctorId}", careTeamAPI.UpdateDoctor)
+			r.With(p.Require(policy.CareTeamManage)).Delete("/users/{id}/doctors/{doctorId}", careTeamAPI.RemoveDoctor)
+			r.With(p.Require(policy.PatientsList)).Get("/users/{id}/patients", careTeamAPI.ListPatients)
+		})
+
+		// Invitations API
+		invitationsAPI := invitations.New(l, db, v, m, ic)
+		r.Group(func(r chi.Router) {
+			r.Use(middleware.LoggedOnly)
+			r.Use(p.Require(policy.UsersInvite))
+			r.Get("/invitations", invitationsAPI.List)
+			r.Post("/invitations", invitationsAPI.Create)
+			r.Post("/invitations/{id}/resend", invitationsAPI.Resend)
+			r.Delete("/invitations/{id}", invitationsAPI.Revoke)
+		})
+		r.Post("/invitations/accept", invitationsAPI.Accept)
+
+		// API keys API
+		apiKeysAPI := apikeys.New(l, db, v)
+		r.Group(func(r chi.Router) {
+			r.Use(middleware.LoggedOnly)
+			r.Use(p.Require(policy.APIKeysManage))
+			r.Get("/api-keys", apiKeysAPI.List)
+			r.Post("/api-keys", apiKeysAPI.Create)
+			r.Delete("/api-keys/{id}", apiKeysAPI.Revoke)
+		})
+
+		// OAuth clients API
+		r.Group(func(r chi.Router) {
+			r.Use(middleware.LoggedOnly)
+			r.Use(p.Require(policy.ClientsManage))
+			r.Get("/clients", oidcAPI.ListClients)
+			r.Post("/clients", oidcAPI.CreateClient)
+			r.Delete("/clients/{id}", oidcAPI.RevokeClient)
+		})
+
+		// Audit log API
+		auditAPI := audit.New(l, db, v)
+		r.Group(func(r chi.Router) {
+			r.Use(middleware.LoggedOnly)
+			r.Use(p.Require(policy.AuditRead))
+			r.Get("/audit", auditAPI.List)
+			r.Get("/audit/export", auditAPI.Export)
+			r.Get("/audit/verify", auditAPI.Verify)
+		})
+
+		// Identity providers API
+		federationAPI := federation.New(l, db, v, s, usersAPI, nil, fc)
+		r.Group(func(r chi.Router) {
+			r.Use(middleware.LoggedOnly)
+			r.Use(p.Require(policy.ProvidersManage))
+			r.Get("/identity-providers", federationAPI.List)
+			r.Post("/identity-providers", federationAPI.Create)
+			r.Delete("/identity-providers/{id}", federationAPI.Delete)
 		})
+		r.Get("/auth/providers", federationAPI.LoginOptions)
+		r.Get("/auth/providers/{slug}/login", federationAPI.Login)
+		r.Get("/auth/providers/{slug}/callback", federationAPI.Callback)
 
 		r.Post("/users", usersAPI.Create)
 		r.Post("/users/login", usersAPI.Login)
+		r.Post("/users/login/2fa", usersAPI.LoginTwoFactor)
+		r.Post("/users/2fa/enroll", usersAPI.EnrollTwoFactor)
+		r.Post("/users/2fa/confirm", usersAPI.ConfirmTwoFactor)
+		r.Post("/users/email/verify", usersAPI.VerifyEmail)
+		r.Post("/users/email/verify/resend", usersAPI.ResendVerification)
+		r.Post("/users/password/forgot", usersAPI.ForgotPassword)
+		r.Post("/users/password/reset", usersAPI.ResetPassword)
+		r.Post("/users/token/refresh", usersAPI.RefreshToken)
 	})
 
 	return r
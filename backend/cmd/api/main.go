@@ -2,23 +2,31 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
-	"time"
 
-	"github.com/wader/gormstore/v2" // Add this import
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog"
 
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
 	gormlogger "gorm.io/gorm/logger"
 
+	"backend/api/resource/federation"
+	"backend/api/resource/invitations"
+	"backend/api/resource/oidc"
+	"backend/api/resource/users"
 	"backend/api/router"
 	"backend/config"
 	"backend/utils/logger"
+	"backend/utils/mailer"
+	"backend/utils/sessionstore"
+	"backend/utils/token"
 	validatorUtil "backend/utils/validator"
 )
 
@@ -52,11 +60,71 @@ func main() {
 		return
 	}
 
-	store := gormstore.New(db, []byte(c.Server.Secret))
-	store.SessionOpts.SameSite = http.SameSiteNoneMode
-	store.SessionOpts.Secure = true
+	store, err := newSessionStore(&c.Session, db, c.Server.Secret)
+	if err != nil {
+		log.Fatalf("Session store configuration failure: %s", err)
+		return
+	}
+
+	var tokens *token.Manager
+	if c.JWT.Enabled {
+		tokens, err = newTokenManager(&c.JWT)
+		if err != nil {
+			log.Fatalf("JWT configuration failure: %s", err)
+			return
+		}
+	}
 
-	r := router.New(l, db, v, store, c.Server.APIKey)
+	mailQueue, err := newMailer(&c.Mail, l)
+	if err != nil {
+		log.Fatalf("Mail configuration failure: %s", err)
+		return
+	}
+	mail := mailer.NewSender(mailQueue, c.Mail.Locale)
+
+	usersConfig := &users.Config{
+		Lockout: users.Lockout{
+			MaxAttempts:      c.Login.MaxAttempts,
+			MaxAttemptsPerIP: c.Login.MaxAttemptsPerIP,
+			Window:           c.Login.Window,
+			BaseDuration:     c.Login.LockoutDuration,
+			MaxDuration:      c.Login.LockoutMax,
+		},
+		Verification: users.Verification{
+			Secret:   []byte(c.Server.Secret),
+			URL:      c.Account.VerificationURL,
+			TTL:      c.Account.VerificationTTL,
+			Required: c.Account.VerificationRequired,
+		},
+		PasswordResetURL: c.Account.PasswordResetURL,
+	}
+
+	invitationsConfig := &invitations.Config{
+		URL: c.Account.InvitationURL,
+		TTL: c.Account.InvitationTTL,
+	}
+
+	// Relying parties verify ID tokens with the keys of the JWKS, which only
+	// publishes RS256 keys.
+	if c.OIDC.Enabled && (tokens == nil || tokens.Algorithm() != token.RS256) {
+		log.Fatal("OIDC configuration failure: OIDC_ENABLED requires JWT_ENABLED with JWT_ALGORITHM=RS256")
+		return
+	}
+
+	oidcConfig := &oidc.Config{
+		Enabled:  c.OIDC.Enabled,
+		Issuer:   c.OIDC.Issuer,
+		LoginURL: c.OIDC.LoginURL,
+		CodeTTL:  c.OIDC.CodeTTL,
+	}
+
+	federationConfig := &federation.Config{
+		BaseURL:    c.Federation.BaseURL,
+		ReturnURLs: c.Federation.ReturnURLs,
+		StateTTL:   c.Federation.StateTTL,
+	}
+
+	r := router.New(l, db, v, store, tokens, mail, usersConfig, invitationsConfig, oidcConfig, federationConfig)
 
 	s := &http.Server{
 		Addr:         fmt.Sprintf(":%d", c.Server.Port),
@@ -67,7 +135,6 @@ func main() {
 	}
 
 	closed := make(chan struct{})
-	go store.PeriodicCleanup(1*time.Hour, closed)
 	go func() {
 		sigint := make(chan os.Signal, 1)
 		signal.Notify(sigint, os.Interrupt, syscall.SIGTERM)
@@ -82,6 +149,12 @@ func main() {
 			l.Error().Err(err).Msg("Server shutdown failure")
 		}
 
+		mailQueue.Close()
+
+		if err := store.Close(); err != nil {
+			l.Error().Err(err).Msg("Session store closing failure")
+		}
+
 		sqlDB, err := db.DB()
 		if err == nil {
 			if err = sqlDB.Close(); err != nil {
@@ -100,3 +173,90 @@ func main() {
 	<-closed
 	l.Info().Msgf("Server shutdown successfully")
 }
+
+func newMailer(c *config.ConfMail, l *zerolog.Logger) (*mailer.Queue, error) {
+	var m mailer.Mailer
+	switch c.Driver {
+	case "smtp":
+		m = mailer.NewSMTP(c.Host, c.Port, c.Username, c.Password, c.From)
+	case "file":
+		f, err := mailer.NewFile(c.Dir, c.From)
+		if err != nil {
+			return nil, err
+		}
+		m = f
+	case "log":
+		m = mailer.NewLog(l)
+	default:
+		return nil, fmt.Errorf("unsupported mail driver %s", c.Driver)
+	}
+
+	return mailer.NewQueue(m, l, c.QueueSize, c.Workers, c.Retries, c.RetryBackoff), nil
+}
+
+func newSessionStore(c *config.ConfSession, db *gorm.DB, secret string) (sessionstore.Store, error) {
+	opts := sessionstore.DefaultOptions
+	opts.MaxAge = int(c.MaxAge.Seconds())
+	opts.SameSite = http.SameSiteNoneMode
+	opts.Secure = true
+
+	switch c.Store {
+	case "gorm":
+		return sessionstore.NewGorm(db, opts, []byte(secret)), nil
+	case "memory":
+		return sessionstore.NewMemory(opts, []byte(secret)), nil
+	case "redis":
+		client := redis.NewClient(&redis.Options{
+			Addr:     c.RedisAddr,
+			Username: c.RedisUsername,
+			Password: c.RedisPassword,
+			DB:       c.RedisDB,
+		})
+		return sessionstore.NewRedis(client, c.RedisPrefix, opts, []byte(secret)), nil
+	default:
+		return nil, fmt.Errorf("unsupported session store %s", c.Store)
+	}
+}
+
+// newTokenManager signs tokens with the key of the configured algorithm. RS256
+// requires JWT_PRIVATE_KEY_FILE and HS256 its own JWT_SECRET, as tokens signed
+// with the session secret could be forged by everyone who verifies them.
+func newTokenManager(c *config.ConfJWT) (*token.Manager, error) {
+	var active *token.Key
+	var previous []*token.Key
+
+	switch c.Algorithm {
+	case token.HS256:
+		if c.Secret == "" {
+			return nil, errors.New("JWT_ALGORITHM=HS256 requires JWT_SECRET")
+		}
+		active = token.NewHS256Key([]byte(c.Secret))
+	case token.RS256:
+		if c.PrivateKeyFile == "" {
+			return nil, errors.New("JWT_ALGORITHM=RS256 requires JWT_PRIVATE_KEY_FILE")
+		}
+		key, err := token.LoadRSAPrivateKey(c.PrivateKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		active = token.NewRS256Key(key)
+	case "":
+		return nil, errors.New("JWT_ALGORITHM is required, RS256 or HS256")
+	default:
+		return nil, fmt.Errorf("unsupported algorithm %s", c.Algorithm)
+	}
+
+	for _, secret := range c.PreviousSecrets {
+		previous = append(previous, token.NewHS256Key([]byte(secret)))
+	}
+
+	for _, path := range c.PreviousPrivateKeyFiles {
+		key, err := token.LoadRSAPrivateKey(path)
+		if err != nil {
+			return nil, err
+		}
+		previous = append(previous, token.NewRS256Key(key))
+	}
+
+	return token.New(active, previous, c.Issuer, c.AccessTTL, c.RefreshTTL), nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+
+	"backend/api/resource/apikeys"
+	"backend/config"
+)
+
+const fmtDBString = "host=%s user=%s password=%s dbname=%s port=%d sslmode=disable"
+
+var (
+	flags  = flag.NewFlagSet("apikey", flag.ExitOnError)
+	name   = flags.String("name", "", "name of the client the key is issued for")
+	scopes = flags.String("scopes", apikeys.ScopeUsersRead, "comma separated scopes (users:read, users:write, users:admin)")
+	ttl    = flags.Duration("ttl", 0, "time until the key expires, 0 for no expiry")
+)
+
+// The command creates API keys directly in the database. It is meant for
+// issuing the first admin key, further keys can be managed through the API.
+func main() {
+	if err := flags.Parse(os.Args[1:]); err != nil {
+		log.Fatalf("Parsing failed: %s", err)
+	}
+
+	if *name == "" {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	form := &apikeys.Form{Name: *name, Scopes: strings.Split(*scopes, ",")}
+	for _, s := range form.Scopes {
+		if !apikeys.IsScope(s) {
+			log.Fatalf("Unknown scope: %s", s)
+		}
+	}
+
+	if *ttl > 0 {
+		expiresAt := time.Now().Add(*ttl)
+		form.ExpiresAt = &expiresAt
+	}
+
+	c := config.NewDatabase()
+	dbString := fmt.Sprintf(fmtDBString, c.Host, c.Username, c.Password, c.Name, c.Port)
+	db, err := gorm.Open(postgres.Open(dbString), &gorm.Config{})
+	if err != nil {
+		log.Fatalf("DB connection start failure: %s", err)
+	}
+
+	newKey, key, err := form.ToModel()
+	if err != nil {
+		log.Fatalf("Key generation failed: %s", err)
+	}
+
+	if _, err := apikeys.NewRepository(db).Create(newKey); err != nil {
+		log.Fatalf("Key creation failed: %s", err)
+	}
+
+	fmt.Println(key)
+}
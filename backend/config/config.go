@@ -9,8 +9,15 @@ import (
 )
 
 type Conf struct {
-	Server   ConfServer
-	Database ConfDatabase
+	Server     ConfServer
+	Database   ConfDatabase
+	Session    ConfSession
+	JWT        ConfJWT
+	Login      ConfLogin
+	Mail       ConfMail
+	Account    ConfAccount
+	OIDC       ConfOIDC
+	Federation ConfFederation
 }
 
 type ConfServer struct {
@@ -19,7 +26,6 @@ type ConfServer struct {
 	TimeoutWrite time.Duration `env:"SERVER_TIMEOUT_WRITE,required"`
 	TimeoutIdle  time.Duration `env:"SERVER_TIMEOUT_IDLE,required"`
 	Debug        bool          `env:"SERVER_DEBUG,required"`
-	APIKey       string        `env:"SERVER_API_KEY,required"`
 	Secret       string        `env:"SERVER_SECRET,required"`
 }
 
@@ -32,6 +38,87 @@ type ConfDatabase struct {
 	Debug    bool   `env:"POSTGRES_DEBUG,required"`
 }
 
+// ConfSession selects where sessions are kept: gorm (the database), memory or
+// redis, which works with any server speaking the Redis protocol.
+type ConfSession struct {
+	Store         string        `env:"SESSION_STORE,default=gorm"`
+	MaxAge        time.Duration `env:"SESSION_MAX_AGE,default=720h"`
+	RedisAddr     string        `env:"REDIS_ADDR,default=127.0.0.1:6379"`
+	RedisUsername string        `env:"REDIS_USERNAME"`
+	RedisPassword string        `env:"REDIS_PASSWORD"`
+	RedisDB       int           `env:"REDIS_DB,default=0"`
+	RedisPrefix   string        `env:"REDIS_PREFIX,default=session:"`
+}
+
+type ConfJWT struct {
+	Enabled        bool          `env:"JWT_ENABLED,default=false"`
+	Algorithm      string        `env:"JWT_ALGORITHM"`
+	Secret         string        `env:"JWT_SECRET"`
+	PrivateKeyFile string        `env:"JWT_PRIVATE_KEY_FILE"`
+	Issuer         string        `env:"JWT_ISSUER,default=users-service"`
+	AccessTTL      time.Duration `env:"JWT_ACCESS_TTL,default=15m"`
+	RefreshTTL     time.Duration `env:"JWT_REFRESH_TTL,default=168h"`
+
+	// Keys that were active before a rotation. They are only used to verify
+	// tokens that have not expired yet and can be dropped after JWT_REFRESH_TTL.
+	PreviousSecrets         []string `env:"JWT_PREVIOUS_SECRETS"`
+	PreviousPrivateKeyFiles []string `env:"JWT_PREVIOUS_PRIVATE_KEY_FILES"`
+}
+
+type ConfLogin struct {
+	MaxAttempts      int           `env:"LOGIN_MAX_ATTEMPTS,default=5"`
+	MaxAttemptsPerIP int           `env:"LOGIN_MAX_ATTEMPTS_PER_IP,default=20"`
+	Window           time.Duration `env:"LOGIN_FAILURE_WINDOW,default=15m"`
+	LockoutDuration  time.Duration `env:"LOGIN_LOCKOUT_DURATION,default=1m"`
+	LockoutMax       time.Duration `env:"LOGIN_LOCKOUT_MAX,default=1h"`
+}
+
+type ConfMail struct {
+	Driver   string `env:"MAIL_DRIVER,default=log"`
+	From     string `env:"MAIL_FROM,default=no-reply@healthhub.local"`
+	Locale   string `env:"MAIL_LOCALE,default=en"`
+	Dir      string `env:"MAIL_DIR,default=./mail"`
+	Host     string `env:"SMTP_HOST"`
+	Port     int    `env:"SMTP_PORT,default=587"`
+	Username string `env:"SMTP_USERNAME"`
+	Password string `env:"SMTP_PASSWORD"`
+
+	// Messages are sent in the background and retried with an exponential
+	// backoff when the mail server is unavailable.
+	QueueSize    int           `env:"MAIL_QUEUE_SIZE,default=100"`
+	Workers      int           `env:"MAIL_WORKERS,default=2"`
+	Retries      int           `env:"MAIL_RETRIES,default=3"`
+	RetryBackoff time.Duration `env:"MAIL_RETRY_BACKOFF,default=2s"`
+}
+
+// ConfAccount holds the links mailed to users, which point to the frontend.
+type ConfAccount struct {
+	VerificationRequired bool          `env:"EMAIL_VERIFICATION_REQUIRED,default=false"`
+	VerificationURL      string        `env:"EMAIL_VERIFICATION_URL,default=http://127.0.0.1:3000/verify-email"`
+	VerificationTTL      time.Duration `env:"EMAIL_VERIFICATION_TTL,default=48h"`
+	PasswordResetURL     string        `env:"PASSWORD_RESET_URL,default=http://127.0.0.1:3000/reset-password"`
+	InvitationURL        string        `env:"INVITATION_URL,default=http://127.0.0.1:3000/accept-invitation"`
+	InvitationTTL        time.Duration `env:"INVITATION_TTL,default=72h"`
+}
+
+// ConfOIDC configures the OpenID Connect provider. It requires JWT_ENABLED
+// with JWT_ALGORITHM=RS256, as relying parties verify ID tokens with the
+// published keys.
+type ConfOIDC struct {
+	Enabled  bool          `env:"OIDC_ENABLED,default=false"`
+	Issuer   string        `env:"OIDC_ISSUER,default=http://127.0.0.1:8080"`
+	LoginURL string        `env:"OIDC_LOGIN_URL,default=http://127.0.0.1:3000/login"`
+	CodeTTL  time.Duration `env:"OIDC_CODE_TTL,default=1m"`
+}
+
+// ConfFederation configures signing in with upstream identity providers, which
+// are registered with the API.
+type ConfFederation struct {
+	BaseURL    string        `env:"FEDERATION_BASE_URL,default=http://127.0.0.1:8080"`
+	ReturnURLs []string      `env:"FEDERATION_RETURN_URLS,default=http://127.0.0.1:3000/;http://127.0.0.1:8080/oauth/authorize"`
+	StateTTL   time.Duration `env:"FEDERATION_STATE_TTL,default=10m"`
+}
+
 func New() *Conf {
 	if err := godotenv.Load(); err != nil {
 		log.Fatalf("Failed to load env: %s", err)
@@ -0,0 +1,12 @@
+-- +goose NO TRANSACTION
+-- +goose Up
+ALTER TYPE status ADD VALUE IF NOT EXISTS 'suspended';
+ALTER TYPE status ADD VALUE IF NOT EXISTS 'deactivated';
+ALTER TABLE users ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMPTZ;
+CREATE INDEX IF NOT EXISTS users_deleted_at_idx ON users (deleted_at);
+
+-- +goose Down
+-- Enum values cannot be dropped, the accounts are reactivated instead.
+UPDATE users SET status = 'active' WHERE status IN ('suspended', 'deactivated');
+DROP INDEX IF EXISTS users_deleted_at_idx;
+ALTER TABLE users DROP COLUMN IF EXISTS deleted_at;
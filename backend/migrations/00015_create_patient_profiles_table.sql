@@ -0,0 +1,25 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS patient_profiles (
+    user_id UUID PRIMARY KEY REFERENCES users (id) ON DELETE CASCADE,
+    date_of_birth DATE,
+    sex VARCHAR(16) NOT NULL DEFAULT '',
+    phone VARCHAR(32) NOT NULL DEFAULT '',
+    address_line1 VARCHAR(255) NOT NULL DEFAULT '',
+    address_line2 VARCHAR(255) NOT NULL DEFAULT '',
+    address_city VARCHAR(100) NOT NULL DEFAULT '',
+    address_postal_code VARCHAR(16) NOT NULL DEFAULT '',
+    address_country VARCHAR(2) NOT NULL DEFAULT '',
+    pesel CHAR(11) UNIQUE,
+    insurance_number VARCHAR(64) NOT NULL DEFAULT '',
+    emergency_contact_name VARCHAR(255) NOT NULL DEFAULT '',
+    emergency_contact_phone VARCHAR(32) NOT NULL DEFAULT '',
+    emergency_contact_relation VARCHAR(64) NOT NULL DEFAULT '',
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS patient_profiles;
+-- +goose StatementEnd
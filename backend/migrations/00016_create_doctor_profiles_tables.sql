@@ -0,0 +1,31 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS specialties (
+    id UUID PRIMARY KEY,
+    slug VARCHAR(64) NOT NULL UNIQUE,
+    name VARCHAR(255) NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+CREATE TABLE IF NOT EXISTS doctor_profiles (
+    user_id UUID PRIMARY KEY REFERENCES users (id) ON DELETE CASCADE,
+    license_number VARCHAR(32) NOT NULL UNIQUE,
+    languages JSONB NOT NULL DEFAULT '[]',
+    bio TEXT NOT NULL DEFAULT '',
+    clinics JSONB NOT NULL DEFAULT '[]',
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+CREATE INDEX IF NOT EXISTS idx_doctor_profiles_languages ON doctor_profiles USING GIN (languages);
+CREATE TABLE IF NOT EXISTS doctor_specialties (
+    user_id UUID NOT NULL REFERENCES doctor_profiles (user_id) ON DELETE CASCADE,
+    specialty_id UUID NOT NULL REFERENCES specialties (id) ON DELETE CASCADE,
+    PRIMARY KEY (user_id, specialty_id)
+);
+CREATE INDEX IF NOT EXISTS idx_doctor_specialties_specialty_id ON doctor_specialties(specialty_id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS doctor_specialties;
+DROP TABLE IF EXISTS doctor_profiles;
+DROP TABLE IF EXISTS specialties;
+-- +goose StatementEnd
@@ -0,0 +1,35 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS doctor_schedules (
+    user_id UUID PRIMARY KEY REFERENCES users (id) ON DELETE CASCADE,
+    time_zone VARCHAR(64) NOT NULL,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+CREATE TABLE IF NOT EXISTS working_hours (
+    id UUID PRIMARY KEY,
+    user_id UUID NOT NULL REFERENCES doctor_schedules (user_id) ON DELETE CASCADE,
+    weekday SMALLINT NOT NULL CHECK (weekday BETWEEN 0 AND 6),
+    start_minute SMALLINT NOT NULL CHECK (start_minute BETWEEN 0 AND 1439),
+    end_minute SMALLINT NOT NULL CHECK (end_minute BETWEEN 1 AND 1440),
+    clinic VARCHAR(255) NOT NULL DEFAULT '',
+    CHECK (end_minute > start_minute)
+);
+CREATE INDEX IF NOT EXISTS idx_working_hours_user_id ON working_hours(user_id);
+CREATE TABLE IF NOT EXISTS availability_exceptions (
+    id UUID PRIMARY KEY,
+    user_id UUID NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    starts_at TIMESTAMPTZ NOT NULL,
+    ends_at TIMESTAMPTZ NOT NULL,
+    reason VARCHAR(255) NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    CHECK (ends_at > starts_at)
+);
+CREATE INDEX IF NOT EXISTS idx_availability_exceptions_user_id ON availability_exceptions(user_id, starts_at);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS availability_exceptions;
+DROP TABLE IF EXISTS working_hours;
+DROP TABLE IF EXISTS doctor_schedules;
+-- +goose StatementEnd
@@ -0,0 +1,21 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS care_relationships (
+    id UUID PRIMARY KEY,
+    patient_id UUID NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    doctor_id UUID NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    primary_physician BOOLEAN NOT NULL DEFAULT FALSE,
+    consent_status VARCHAR(16) NOT NULL CHECK (consent_status IN ('pending', 'granted', 'withdrawn')),
+    started_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    ended_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    CHECK (ended_at IS NULL OR ended_at > started_at)
+);
+CREATE INDEX IF NOT EXISTS idx_care_relationships_patient_id ON care_relationships(patient_id, doctor_id);
+CREATE INDEX IF NOT EXISTS idx_care_relationships_doctor_id ON care_relationships(doctor_id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS care_relationships;
+-- +goose StatementEnd
@@ -0,0 +1,25 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+-- Existing accounts get the time of the migration as their creation time.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS created_at TIMESTAMPTZ NOT NULL DEFAULT NOW();
+CREATE INDEX IF NOT EXISTS idx_users_name_trgm ON users USING GIN (lower(name) gin_trgm_ops);
+CREATE INDEX IF NOT EXISTS idx_users_email_trgm ON users USING GIN (lower(email) gin_trgm_ops);
+CREATE INDEX IF NOT EXISTS idx_users_email_domain ON users(lower(split_part(email, '@', 2)));
+CREATE INDEX IF NOT EXISTS idx_users_created_at ON users(created_at, id);
+CREATE INDEX IF NOT EXISTS idx_users_name ON users(name, id);
+CREATE INDEX IF NOT EXISTS idx_users_email ON users(email, id);
+CREATE INDEX IF NOT EXISTS idx_users_role_status ON users(role, status);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX IF EXISTS idx_users_role_status;
+DROP INDEX IF EXISTS idx_users_email;
+DROP INDEX IF EXISTS idx_users_name;
+DROP INDEX IF EXISTS idx_users_created_at;
+DROP INDEX IF EXISTS idx_users_email_domain;
+DROP INDEX IF EXISTS idx_users_email_trgm;
+DROP INDEX IF EXISTS idx_users_name_trgm;
+ALTER TABLE users DROP COLUMN IF EXISTS created_at;
+-- +goose StatementEnd
@@ -0,0 +1,9 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE totp_credentials ADD COLUMN IF NOT EXISTS last_step BIGINT NOT NULL DEFAULT 0;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE totp_credentials DROP COLUMN IF EXISTS last_step;
+-- +goose StatementEnd
@@ -0,0 +1,11 @@
+-- +goose Up
+-- +goose StatementBegin
+-- The client subjects the failures of an account came from, cleared together
+-- with the account when an admin unlocks it.
+ALTER TABLE login_throttles ADD COLUMN IF NOT EXISTS sources TEXT[] NOT NULL DEFAULT '{}';
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE login_throttles DROP COLUMN IF EXISTS sources;
+-- +goose StatementEnd
@@ -1,19 +1,24 @@
 package tests
 
 import (
+	"backend/api/resource/common/policy"
 	"backend/api/resource/users"
 	"backend/utils/logger"
 	mockDB "backend/utils/mock"
+	"backend/utils/sessionstore"
 	testUtil "backend/utils/test"
+	"backend/utils/totp"
 	validatorUtil "backend/utils/validator"
 	"bytes"
 	"context"
+	"database/sql/driver"
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
-	"github.com/wader/gormstore/v2"
 	"golang.org/x/crypto/bcrypt"
 
 	"github.com/DATA-DOG/go-sqlmock"
@@ -21,12 +26,40 @@ import (
 	"github.com/google/uuid"
 )
 
-func mockGormStoreRequests(mock sqlmock.Sqlmock) {
-	mock.ExpectQuery("SELECT count\\(\\*\\) FROM (.*)").WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
-	mock.ExpectQuery("SELECT CURRENT_DATABASE\\(\\)").WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
-	expectedRows := sqlmock.NewRows([]string{"column_name", "is_nullable", "udt_name", "character_maximum_length", "numeric_precision", "numeric_precision_radix", "numeric_scale", "datetime_precision", "typlen", "column_default", "description", "identity_increment"}).
-		AddRow("value1", "value2", "value3", 10, 5, 2, 1, 6, 16, "default_value", "description_value", 1)
-	mock.ExpectQuery("SELECT (.*) FROM (.*)").WithArgs("1", "sessions").WillReturnRows(expectedRows)
+func mockNoTwoFactor(mock sqlmock.Sqlmock) {
+	mock.ExpectQuery("^SELECT (.+) FROM \"totp_credentials\"").WillReturnRows(&sqlmock.Rows{})
+	mock.ExpectQuery("^SELECT (.+) FROM \"two_factor_policies\"").WillReturnRows(&sqlmock.Rows{})
+}
+
+func mockCreateSession(mock sqlmock.Sqlmock) {
+	mock.ExpectBegin()
+	mock.ExpectExec("^INSERT INTO \"user_sessions\"").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+	mock.ExpectBegin()
+	mock.ExpectExec("^DELETE FROM \"user_sessions\"").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
+}
+
+func mockNotLocked(mock sqlmock.Sqlmock) {
+	mock.ExpectQuery("^SELECT (.+) FROM \"login_throttles\"").WillReturnRows(&sqlmock.Rows{})
+}
+
+func mockResetLoginFailures(mock sqlmock.Sqlmock) {
+	mock.ExpectBegin()
+	mock.ExpectExec("^DELETE FROM \"login_throttles\"").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+}
+
+// mockLockAdmins expects the active admins to be locked inside a transaction
+// that was already begun.
+func mockLockAdmins(mock sqlmock.Sqlmock, admins ...uuid.UUID) {
+	rows := sqlmock.NewRows([]string{"id"})
+	for _, id := range admins {
+		rows.AddRow(id)
+	}
+	mock.ExpectQuery("^SELECT \"id\" FROM \"users\" WHERE \\(role = (.+) FOR UPDATE").
+		WithArgs(users.Admin, users.StatusActive).
+		WillReturnRows(rows)
 }
 
 func TestGetUsers(t *testing.T) {
@@ -41,10 +74,9 @@ func TestGetUsers(t *testing.T) {
 	db, mock, err := mockDB.NewMockDB()
 	testUtil.NoError(t, err)
 
-	mockGormStoreRequests(mock)
-	s := gormstore.New(db, []byte("secret"))
+	s := sessionstore.NewMemory(sessionstore.DefaultOptions, []byte("secret"))
 
-	usersAPI := users.New(l, db, v, s, "APIKey")
+	usersAPI := users.New(l, db, v, s, nil, nil, nil)
 	id := uuid.New()
 	mockRows := sqlmock.NewRows([]string{"id", "name", "email", "role"}).
 		AddRow(id, "user1", "email@email.com", "patient").
@@ -72,16 +104,159 @@ func TestGetUsers(t *testing.T) {
 	testUtil.Equal(t, responseUsers[1].Role, "doctor")
 }
 
+func TestGetUsersFiltered(t *testing.T) {
+	req, err := http.NewRequest("GET", "/api/v1/users?q=Kow_&sort=name&status=active&emailDomain=Hospital.org&createdFrom=2024-01-01&createdTo=2024-01-31", nil)
+	testUtil.NoError(t, err)
+
+	l := logger.New(false)
+	v := validatorUtil.New()
+	db, mock, err := mockDB.NewMockDB()
+	testUtil.NoError(t, err)
+
+	s := sessionstore.NewMemory(sessionstore.DefaultOptions, []byte("secret"))
+
+	usersAPI := users.New(l, db, v, s, nil, nil, nil)
+	from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)
+	where := "WHERE \\(lower\\(name\\) LIKE \\$1 OR lower\\(email\\) LIKE \\$2\\) AND status = \\$3 AND lower\\(split_part\\(email, '@', 2\\)\\) = \\$4 AND created_at >= \\$5 AND created_at < \\$6"
+	args := []driver.Value{"%kow\\_%", "%kow\\_%", "active", "hospital.org", from, to}
+
+	mock.ExpectQuery("^SELECT count\\(\\*\\) FROM \"users\" " + where).
+		WithArgs(args...).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+	mock.ExpectQuery("^SELECT (.*) FROM \"users\" " + where + "(.*) ORDER BY \"name\",\"id\" LIMIT \\$7").
+		WithArgs(append(args, 10)...).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "email", "role", "status"}).
+			AddRow(uuid.New(), "Jan Kow_alski", "jan@hospital.org", "doctor", "active"))
+
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(usersAPI.List)
+
+	handler.ServeHTTP(rr, req)
+	testUtil.Equal(t, rr.Code, http.StatusOK)
+
+	var response users.ListResponse
+	err = json.NewDecoder(rr.Body).Decode(&response)
+	testUtil.NoError(t, err)
+	testUtil.Equal(t, len(response.Users), 1)
+	testUtil.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestGetUsersInvalidSort(t *testing.T) {
+	req, err := http.NewRequest("GET", "/api/v1/users?sort=password", nil)
+	testUtil.NoError(t, err)
+
+	l := logger.New(false)
+	v := validatorUtil.New()
+	db, _, err := mockDB.NewMockDB()
+	testUtil.NoError(t, err)
+
+	s := sessionstore.NewMemory(sessionstore.DefaultOptions, []byte("secret"))
+
+	usersAPI := users.New(l, db, v, s, nil, nil, nil)
+
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(usersAPI.List)
+
+	handler.ServeHTTP(rr, req)
+	testUtil.Equal(t, rr.Code, http.StatusUnprocessableEntity)
+	testUtil.Equal(t, strings.Contains(rr.Body.String(), "sort must be one of the following: name, email, role, status, createdAt"), true)
+}
+
+func TestGetUsersCursor(t *testing.T) {
+	l := logger.New(false)
+	v := validatorUtil.New()
+	db, mock, err := mockDB.NewMockDB()
+	testUtil.NoError(t, err)
+
+	s := sessionstore.NewMemory(sessionstore.DefaultOptions, []byte("secret"))
+
+	usersAPI := users.New(l, db, v, s, nil, nil, nil)
+	columns := []string{"id", "name", "email", "role", "status", "created_at"}
+	ids := []uuid.UUID{uuid.New(), uuid.New(), uuid.New(), uuid.New()}
+	created := time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)
+
+	// The first page has no count and fetches one row more than the limit.
+	mock.ExpectQuery("^SELECT (.*) FROM \"users\" WHERE (.*) ORDER BY \"created_at\" DESC,\"id\" DESC LIMIT \\$1").
+		WithArgs(3).
+		WillReturnRows(sqlmock.NewRows(columns).
+			AddRow(ids[0], "user1", "email1@email.com", "patient", "active", created).
+			AddRow(ids[1], "user2", "email2@email.com", "patient", "active", created.Add(-time.Hour)).
+			AddRow(ids[2], "user3", "email3@email.com", "patient", "active", created.Add(-2*time.Hour)))
+
+	req, err := http.NewRequest("GET", "/api/v1/users?cursor=&limit=2", nil)
+	testUtil.NoError(t, err)
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(usersAPI.List).ServeHTTP(rr, req)
+	testUtil.Equal(t, rr.Code, http.StatusOK)
+
+	var first users.ListResponse
+	err = json.NewDecoder(rr.Body).Decode(&first)
+	testUtil.NoError(t, err)
+	testUtil.Equal(t, len(first.Users), 2)
+	testUtil.Equal(t, first.Users[1].ID, ids[1])
+	testUtil.Equal(t, first.PrevCursor, "")
+	testUtil.Equal(t, first.NextCursor != "", true)
+
+	// The next page continues after the last user of the first one.
+	mock.ExpectQuery("^SELECT (.*) FROM \"users\" WHERE \\(\"created_at\", id\\) < \\(\\$1, \\$2\\) (.*) ORDER BY \"created_at\" DESC,\"id\" DESC LIMIT \\$3").
+		WithArgs(created.Add(-time.Hour).Format(time.RFC3339Nano), ids[1].String(), 3).
+		WillReturnRows(sqlmock.NewRows(columns).
+			AddRow(ids[2], "user3", "email3@email.com", "patient", "active", created.Add(-2*time.Hour)).
+			AddRow(ids[3], "user4", "email4@email.com", "patient", "active", created.Add(-3*time.Hour)))
+
+	req, err = http.NewRequest("GET", "/api/v1/users?limit=2&cursor="+first.NextCursor, nil)
+	testUtil.NoError(t, err)
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(usersAPI.List).ServeHTTP(rr, req)
+	testUtil.Equal(t, rr.Code, http.StatusOK)
+
+	var second users.ListResponse
+	err = json.NewDecoder(rr.Body).Decode(&second)
+	testUtil.NoError(t, err)
+	testUtil.Equal(t, len(second.Users), 2)
+	testUtil.Equal(t, second.NextCursor, "")
+	testUtil.Equal(t, second.PrevCursor != "", true)
+
+	// Going back reverses the order and the rows.
+	mock.ExpectQuery("^SELECT (.*) FROM \"users\" WHERE \\(\"created_at\", id\\) > \\(\\$1, \\$2\\) (.*) ORDER BY \"created_at\",\"id\" LIMIT \\$3").
+		WithArgs(created.Add(-2*time.Hour).Format(time.RFC3339Nano), ids[2].String(), 3).
+		WillReturnRows(sqlmock.NewRows(columns).
+			AddRow(ids[1], "user2", "email2@email.com", "patient", "active", created.Add(-time.Hour)).
+			AddRow(ids[0], "user1", "email1@email.com", "patient", "active", created))
+
+	req, err = http.NewRequest("GET", "/api/v1/users?limit=2&cursor="+second.PrevCursor, nil)
+	testUtil.NoError(t, err)
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(usersAPI.List).ServeHTTP(rr, req)
+	testUtil.Equal(t, rr.Code, http.StatusOK)
+
+	var back users.ListResponse
+	err = json.NewDecoder(rr.Body).Decode(&back)
+	testUtil.NoError(t, err)
+	testUtil.Equal(t, len(back.Users), 2)
+	testUtil.Equal(t, back.Users[0].ID, ids[0])
+	testUtil.Equal(t, back.PrevCursor, "")
+	testUtil.Equal(t, back.NextCursor != "", true)
+	testUtil.NoError(t, mock.ExpectationsWereMet())
+
+	// A cursor of another sort order is rejected.
+	req, err = http.NewRequest("GET", "/api/v1/users?sort=name&cursor="+first.NextCursor, nil)
+	testUtil.NoError(t, err)
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(usersAPI.List).ServeHTTP(rr, req)
+	testUtil.Equal(t, rr.Code, http.StatusBadRequest)
+}
+
 func TestAddUser(t *testing.T) {
 	l := logger.New(false)
 	v := validatorUtil.New()
 	db, mock, err := mockDB.NewMockDB()
 	testUtil.NoError(t, err)
 
-	mockGormStoreRequests(mock)
-	s := gormstore.New(db, []byte("secret"))
+	s := sessionstore.NewMemory(sessionstore.DefaultOptions, []byte("secret"))
 
-	usersAPI := users.New(l, db, v, s, "APIKey")
+	usersAPI := users.New(l, db, v, s, nil, nil, nil)
 	old := users.GetUUID
 	defer func() { users.GetUUID = old }()
 	users.GetUUID = func() uuid.UUID {
@@ -106,7 +281,7 @@ func TestAddUser(t *testing.T) {
 	password, _ := users.GenerateHash([]byte("password"))
 	mock.ExpectBegin()
 	mock.ExpectExec("^INSERT INTO \"users\" ").
-		WithArgs(users.GetUUID(), "name", "email@email.com", password, "patient").
+		WithArgs(users.GetUUID(), "name", "email@email.com", password, "patient", "pending", nil, sqlmock.AnyArg(), nil).
 		WillReturnResult(sqlmock.NewResult(1, 1))
 	mock.ExpectCommit()
 
@@ -138,14 +313,13 @@ func TestCurrentUser(t *testing.T) {
 	db, mock, err := mockDB.NewMockDB()
 	testUtil.NoError(t, err)
 
-	mockGormStoreRequests(mock)
-	s := gormstore.New(db, []byte("secret"))
+	s := sessionstore.NewMemory(sessionstore.DefaultOptions, []byte("secret"))
 	session, _ := s.Get(req, "session")
 	session.Values["id"] = idString
 
 	id, err := uuid.Parse(idString)
 	testUtil.NoError(t, err)
-	usersAPI := users.New(l, db, v, s, "APIKey")
+	usersAPI := users.New(l, db, v, s, nil, nil, nil)
 	mockRows := sqlmock.NewRows([]string{"id", "name", "email", "role"}).
 		AddRow(id, "user1", "email@email.com", "admin")
 
@@ -187,12 +361,11 @@ func TestGetUser(t *testing.T) {
 	db, mock, err := mockDB.NewMockDB()
 	testUtil.NoError(t, err)
 
-	mockGormStoreRequests(mock)
-	s := gormstore.New(db, []byte("secret"))
+	s := sessionstore.NewMemory(sessionstore.DefaultOptions, []byte("secret"))
 
 	id, err := uuid.Parse(idString)
 	testUtil.NoError(t, err)
-	usersAPI := users.New(l, db, v, s, "APIKey")
+	usersAPI := users.New(l, db, v, s, nil, nil, nil)
 	mockRows := sqlmock.NewRows([]string{"id", "name", "email", "role"}).
 		AddRow(id, "user1", "email@email.com", "admin")
 
@@ -225,18 +398,22 @@ func TestUpdateUser(t *testing.T) {
 	db, mock, err := mockDB.NewMockDB()
 	testUtil.NoError(t, err)
 
-	mockGormStoreRequests(mock)
-	s := gormstore.New(db, []byte("secret"))
+	s := sessionstore.NewMemory(sessionstore.DefaultOptions, []byte("secret"))
 
-	usersAPI := users.New(l, db, v, s, "APIKey")
+	usersAPI := users.New(l, db, v, s, nil, nil, nil)
 
 	id, err := uuid.Parse(idString)
-	_ = sqlmock.NewRows([]string{"id", "name", "email", "role"}).
-		AddRow(id, "user1", "email@email.com", "patient")
 	testUtil.NoError(t, err)
+	mock.ExpectQuery("^SELECT (.+) FROM \"users\" WHERE (.+)").
+		WithArgs(id, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "email", "role"}).
+			AddRow(id, "user1", "email@email.com", "patient"))
+	mock.ExpectQuery("^SELECT (.+) FROM \"users\" WHERE email = (.+)").
+		WithArgs("email2@email.com", 1).
+		WillReturnRows(&sqlmock.Rows{})
 	mock.ExpectBegin()
 	mock.ExpectExec("^UPDATE \"users\" SET").
-		WithArgs("name", "email2@email.com", id).
+		WithArgs("email2@email.com", nil, "name", "active", "pending", id).
 		WillReturnResult(sqlmock.NewResult(1, 1))
 	mock.ExpectCommit()
 
@@ -264,6 +441,172 @@ func TestUpdateUser(t *testing.T) {
 	handler.ServeHTTP(rr, req)
 	status := rr.Code
 	testUtil.Equal(t, status, http.StatusOK)
+	testUtil.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestUpdateUserEmail(t *testing.T) {
+	id := uuid.New()
+
+	testCases := []struct {
+		name     string
+		status   string
+		taken    bool
+		expected int
+	}{
+		{name: "suspended user", status: "suspended", expected: http.StatusOK},
+		{name: "email taken", status: "active", taken: true, expected: http.StatusConflict},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			l := logger.New(false)
+			v := validatorUtil.New()
+			db, mock, err := mockDB.NewMockDB()
+			testUtil.NoError(t, err)
+
+			s := sessionstore.NewMemory(sessionstore.DefaultOptions, []byte("secret"))
+
+			usersAPI := users.New(l, db, v, s, nil, nil, nil)
+			columns := []string{"id", "name", "email", "role", "status"}
+			mock.ExpectQuery("^SELECT (.+) FROM \"users\" WHERE (.+)").
+				WithArgs(id, 1).
+				WillReturnRows(sqlmock.NewRows(columns).AddRow(id, "user1", "email@email.com", "patient", tc.status))
+			existing := sqlmock.NewRows(columns)
+			if tc.taken {
+				existing.AddRow(uuid.New(), "user2", "email2@email.com", "patient", "active")
+			}
+			mock.ExpectQuery("^SELECT (.+) FROM \"users\" WHERE email = (.+)").
+				WithArgs("email2@email.com", 1).
+				WillReturnRows(existing)
+			if !tc.taken {
+				// Only an active user becomes pending, a suspended one
+				// must not be able to log in after verifying the address.
+				mock.ExpectBegin()
+				mock.ExpectExec("^UPDATE \"users\" SET \"email\"=\\$1,\"email_verified_at\"=\\$2,\"name\"=\\$3,\"status\"=CASE WHEN status = \\$4 THEN \\$5 ELSE status END WHERE id = \\$6").
+					WithArgs("email2@email.com", nil, "name", "active", "pending", id).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectCommit()
+				mock.ExpectQuery("^SELECT (.+) FROM \"users\" WHERE (.+)").
+					WithArgs(id, 1).
+					WillReturnRows(sqlmock.NewRows(columns).AddRow(id, "name", "email2@email.com", "patient", tc.status))
+			}
+
+			body, _ := json.Marshal(&users.UpdateForm{Name: "name", Email: "email2@email.com"})
+			req, err := http.NewRequest("PUT", "/api/v1/users/{id}", bytes.NewReader(body))
+			testUtil.NoError(t, err)
+			rctx := chi.NewRouteContext()
+			rctx.URLParams.Add("id", id.String())
+			req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+
+			rr := httptest.NewRecorder()
+			http.HandlerFunc(usersAPI.Update).ServeHTTP(rr, req)
+			testUtil.Equal(t, rr.Code, tc.expected)
+			if tc.expected == http.StatusOK {
+				var response users.UserResponse
+				err = json.NewDecoder(rr.Body).Decode(&response)
+				testUtil.NoError(t, err)
+				testUtil.Equal(t, response.Status, "suspended")
+			}
+			testUtil.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestGetUserNotModified(t *testing.T) {
+	id := uuid.New()
+	req, err := http.NewRequest("GET", "/api/v1/users/{id}", nil)
+	testUtil.NoError(t, err)
+	req.Header.Set("If-None-Match", `"1", W/"3"`)
+
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Add("id", id.String())
+	req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+
+	l := logger.New(false)
+	v := validatorUtil.New()
+	db, mock, err := mockDB.NewMockDB()
+	testUtil.NoError(t, err)
+
+	s := sessionstore.NewMemory(sessionstore.DefaultOptions, []byte("secret"))
+
+	usersAPI := users.New(l, db, v, s, nil, nil, nil)
+	mock.ExpectQuery("^SELECT (.+) FROM \"users\" WHERE (.+)").
+		WithArgs(id, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "email", "role", "version"}).
+			AddRow(id, "user1", "email@email.com", "admin", 3))
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(usersAPI.Read).ServeHTTP(rr, req)
+	testUtil.Equal(t, rr.Code, http.StatusNotModified)
+	testUtil.Equal(t, rr.Header().Get("ETag"), `"3"`)
+	testUtil.Equal(t, rr.Body.Len(), 0)
+}
+
+func TestUpdateUserIfMatch(t *testing.T) {
+	id := uuid.New()
+
+	testCases := []struct {
+		name     string
+		ifMatch  string
+		rows     int64
+		expected int
+	}{
+		{name: "current version", ifMatch: `"2"`, rows: 1, expected: http.StatusOK},
+		{name: "stale version", ifMatch: `"1"`, expected: http.StatusPreconditionFailed},
+		{name: "weak tag", ifMatch: `W/"2"`, expected: http.StatusPreconditionFailed},
+		{name: "changed concurrently", ifMatch: `"2"`, rows: 0, expected: http.StatusPreconditionFailed},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			l := logger.New(false)
+			v := validatorUtil.New()
+			db, mock, err := mockDB.NewMockDB()
+			testUtil.NoError(t, err)
+
+			s := sessionstore.NewMemory(sessionstore.DefaultOptions, []byte("secret"))
+
+			usersAPI := users.New(l, db, v, s, nil, nil, nil)
+			columns := []string{"id", "name", "email", "role", "version"}
+			mock.ExpectQuery("^SELECT (.+) FROM \"users\" WHERE (.+)").
+				WithArgs(id, 1).
+				WillReturnRows(sqlmock.NewRows(columns).AddRow(id, "user1", "email@email.com", "patient", 2))
+			if tc.ifMatch == `"2"` {
+				// Only the version the client has seen is updated.
+				mock.ExpectBegin()
+				mock.ExpectExec("^UPDATE \"users\" SET \"name\"=\\$1,\"email\"=\\$2 WHERE id = \\$3 AND version = \\$4").
+					WithArgs("name", "email@email.com", id, 2).
+					WillReturnResult(sqlmock.NewResult(0, tc.rows))
+				mock.ExpectCommit()
+			}
+			if tc.expected == http.StatusOK {
+				mock.ExpectQuery("^SELECT (.+) FROM \"users\" WHERE (.+)").
+					WithArgs(id, 1).
+					WillReturnRows(sqlmock.NewRows(columns).AddRow(id, "name", "email@email.com", "patient", 3))
+			}
+
+			body, _ := json.Marshal(&users.UpdateForm{Name: "name", Email: "email@email.com"})
+			req, err := http.NewRequest("PUT", "/api/v1/users/{id}", bytes.NewReader(body))
+			testUtil.NoError(t, err)
+			req.Header.Set("If-Match", tc.ifMatch)
+			rctx := chi.NewRouteContext()
+			rctx.URLParams.Add("id", id.String())
+			req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+
+			rr := httptest.NewRecorder()
+			http.HandlerFunc(usersAPI.Update).ServeHTTP(rr, req)
+			testUtil.Equal(t, rr.Code, tc.expected)
+			if tc.expected == http.StatusOK {
+				testUtil.Equal(t, rr.Header().Get("ETag"), `"3"`)
+
+				var response users.UserResponse
+				err = json.NewDecoder(rr.Body).Decode(&response)
+				testUtil.NoError(t, err)
+				testUtil.Equal(t, response.ETag, `"3"`)
+			}
+			testUtil.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
 }
 
 func TestDeleteUser(t *testing.T) {
@@ -274,18 +617,20 @@ func TestDeleteUser(t *testing.T) {
 	db, mock, err := mockDB.NewMockDB()
 	testUtil.NoError(t, err)
 
-	mockGormStoreRequests(mock)
-	s := gormstore.New(db, []byte("secret"))
+	s := sessionstore.NewMemory(sessionstore.DefaultOptions, []byte("secret"))
 
-	usersAPI := users.New(l, db, v, s, "APIKey")
+	usersAPI := users.New(l, db, v, s, nil, nil, nil)
 
 	id, err := uuid.Parse(idString)
 	testUtil.NoError(t, err)
-	_ = sqlmock.NewRows([]string{"id", "name", "email", "role"}).
-		AddRow(id, "user1", "email@email.com", "patient")
+	mock.ExpectQuery("^SELECT (.+) FROM \"users\" WHERE (.+)").
+		WithArgs(id, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "email", "role"}).
+			AddRow(id, "user1", "email@email.com", "patient"))
 	mock.ExpectBegin()
-	mock.ExpectExec("^DELETE FROM \"users\" WHERE").
-		WithArgs(id).
+	mockLockAdmins(mock, uuid.New())
+	mock.ExpectExec("^UPDATE \"users\" SET \"deleted_at\"").
+		WithArgs(mockDB.AnyTime{}, id).
 		WillReturnResult(sqlmock.NewResult(1, 1))
 	mock.ExpectCommit()
 
@@ -305,32 +650,63 @@ func TestDeleteUser(t *testing.T) {
 	testUtil.Equal(t, status, http.StatusOK)
 }
 
+func TestDeleteLastAdmin(t *testing.T) {
+	l := logger.New(false)
+	v := validatorUtil.New()
+	db, mock, err := mockDB.NewMockDB()
+	testUtil.NoError(t, err)
+
+	s := sessionstore.NewMemory(sessionstore.DefaultOptions, []byte("secret"))
+
+	usersAPI := users.New(l, db, v, s, nil, nil, nil)
+
+	id := uuid.New()
+	mock.ExpectQuery("^SELECT (.+) FROM \"users\" WHERE (.+)").
+		WithArgs(id, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "email", "role"}).
+			AddRow(id, "Anna", "anna@email.com", "admin"))
+	mock.ExpectBegin()
+	mockLockAdmins(mock, id)
+	mock.ExpectRollback()
+
+	req, err := http.NewRequest("DELETE", "/api/v1/users/{id}", nil)
+	testUtil.NoError(t, err)
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Add("id", id.String())
+	req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(usersAPI.Delete).ServeHTTP(rr, req)
+	testUtil.Equal(t, rr.Code, http.StatusConflict)
+	testUtil.Equal(t, strings.TrimSpace(rr.Body.String()), "Cannot delete the last admin!")
+	testUtil.NoError(t, mock.ExpectationsWereMet())
+}
+
 func TestLogin(t *testing.T) {
 	l := logger.New(false)
 	v := validatorUtil.New()
 	db, mock, err := mockDB.NewMockDB()
 	testUtil.NoError(t, err)
 
-	mockGormStoreRequests(mock)
-	s := gormstore.New(db, []byte("secret"))
+	s := sessionstore.NewMemory(sessionstore.DefaultOptions, []byte("secret"))
 
-	usersAPI := users.New(l, db, v, s, "APIKey")
+	usersAPI := users.New(l, db, v, s, nil, nil, nil)
 
 	password := "Password@123"
 	pass, _ := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 	email := "email@email.com"
 	id := uuid.New()
 
-	mockRows := sqlmock.NewRows([]string{"id", "name", "email", "password", "role"}).
-		AddRow(id, "user1", email, pass, "patient")
+	mockRows := sqlmock.NewRows([]string{"id", "name", "email", "password", "role", "status"}).
+		AddRow(id, "user1", email, pass, "patient", "active")
 
+	mockNotLocked(mock)
 	mock.ExpectQuery("^SELECT (.+) FROM \"users\" WHERE (.+)").
 		WithArgs(email, 1).
 		WillReturnRows(mockRows)
-
-	mock.ExpectBegin()
-	mock.ExpectExec("^INSERT INTO \"sessions\"").WillReturnResult(sqlmock.NewResult(1, 1))
-	mock.ExpectCommit()
+	mockResetLoginFailures(mock)
+	mockNoTwoFactor(mock)
+	mockCreateSession(mock)
 
 	rr := httptest.NewRecorder()
 	handler := http.HandlerFunc(usersAPI.Login)
@@ -360,25 +736,24 @@ func TestLogout(t *testing.T) {
 	db, mock, err := mockDB.NewMockDB()
 	testUtil.NoError(t, err)
 
-	mockGormStoreRequests(mock)
-	s := gormstore.New(db, []byte("secret"))
+	s := sessionstore.NewMemory(sessionstore.DefaultOptions, []byte("secret"))
 
-	usersAPI := users.New(l, db, v, s, "APIKey")
+	usersAPI := users.New(l, db, v, s, nil, nil, nil)
 
 	password := "Password@123"
 	pass, _ := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 	email := "email@email.com"
 
-	mockRows := sqlmock.NewRows([]string{"id", "name", "email", "password", "role"}).
-		AddRow(uuid.New(), "user1", email, pass, "patient")
+	mockRows := sqlmock.NewRows([]string{"id", "name", "email", "password", "role", "status"}).
+		AddRow(uuid.New(), "user1", email, pass, "patient", "active")
 
+	mockNotLocked(mock)
 	mock.ExpectQuery("^SELECT (.+) FROM \"users\" WHERE (.+)").
 		WithArgs(email, 1).
 		WillReturnRows(mockRows)
-
-	mock.ExpectBegin()
-	mock.ExpectExec("^INSERT INTO \"sessions\"").WillReturnResult(sqlmock.NewResult(1, 1))
-	mock.ExpectCommit()
+	mockResetLoginFailures(mock)
+	mockNoTwoFactor(mock)
+	mockCreateSession(mock)
 
 	rr := httptest.NewRecorder()
 	handler := http.HandlerFunc(usersAPI.Login)
@@ -394,3 +769,497 @@ func TestLogout(t *testing.T) {
 	status := rr.Code
 	testUtil.Equal(t, status, http.StatusOK)
 }
+
+func TestChangePassword(t *testing.T) {
+	idString := "c50abe98-7f20-4cb9-b4a8-fbef37988e7f"
+
+	l := logger.New(false)
+	v := validatorUtil.New()
+	db, mock, err := mockDB.NewMockDB()
+	testUtil.NoError(t, err)
+
+	s := sessionstore.NewMemory(sessionstore.DefaultOptions, []byte("secret"))
+
+	usersAPI := users.New(l, db, v, s, nil, nil, nil)
+
+	id, err := uuid.Parse(idString)
+	testUtil.NoError(t, err)
+	password := "Password@123"
+	pass, _ := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+
+	mockRows := sqlmock.NewRows([]string{"id", "name", "email", "password", "role", "status"}).
+		AddRow(id, "user1", "email@email.com", pass, "patient", "active")
+
+	mock.ExpectQuery("^SELECT (.+) FROM \"users\" WHERE (.+)").
+		WithArgs(id, 1).
+		WillReturnRows(mockRows)
+
+	mock.ExpectBegin()
+	mock.ExpectExec("^UPDATE \"users\" SET \"password\"").
+		WithArgs(sqlmock.AnyArg(), id).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+	mock.ExpectBegin()
+	mock.ExpectExec("^DELETE FROM \"user_sessions\" WHERE user_id = \\$1").
+		WithArgs(id).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectCommit()
+
+	form := &users.PasswordForm{CurrentPassword: password, NewPassword: "NewPassword@123"}
+
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(usersAPI.ChangePassword)
+
+	body, _ := json.Marshal(form)
+	req, err := http.NewRequest("PUT", "/api/v1/users/{id}/password", bytes.NewReader(body))
+	if err != nil {
+		t.Errorf("Error creating a new request: %v", err)
+	}
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Add("id", idString)
+	req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+
+	handler.ServeHTTP(rr, req)
+	status := rr.Code
+	testUtil.Equal(t, status, http.StatusOK)
+	testUtil.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestChangePasswordWrongCurrent(t *testing.T) {
+	idString := "c50abe98-7f20-4cb9-b4a8-fbef37988e7f"
+
+	l := logger.New(false)
+	v := validatorUtil.New()
+	db, mock, err := mockDB.NewMockDB()
+	testUtil.NoError(t, err)
+
+	s := sessionstore.NewMemory(sessionstore.DefaultOptions, []byte("secret"))
+
+	usersAPI := users.New(l, db, v, s, nil, nil, nil)
+
+	id, err := uuid.Parse(idString)
+	testUtil.NoError(t, err)
+	pass, _ := bcrypt.GenerateFromPassword([]byte("Password@123"), bcrypt.DefaultCost)
+
+	mockRows := sqlmock.NewRows([]string{"id", "name", "email", "password", "role", "status"}).
+		AddRow(id, "user1", "email@email.com", pass, "patient", "active")
+
+	mock.ExpectQuery("^SELECT (.+) FROM \"users\" WHERE (.+)").
+		WithArgs(id, 1).
+		WillReturnRows(mockRows)
+
+	form := &users.PasswordForm{CurrentPassword: "Wrong@1234", NewPassword: "NewPassword@123"}
+
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(usersAPI.ChangePassword)
+
+	body, _ := json.Marshal(form)
+	req, err := http.NewRequest("PUT", "/api/v1/users/{id}/password", bytes.NewReader(body))
+	if err != nil {
+		t.Errorf("Error creating a new request: %v", err)
+	}
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Add("id", idString)
+	req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+
+	handler.ServeHTTP(rr, req)
+	status := rr.Code
+	testUtil.Equal(t, status, http.StatusUnauthorized)
+}
+
+func TestLoginTwoFactorRequired(t *testing.T) {
+	l := logger.New(false)
+	v := validatorUtil.New()
+	db, mock, err := mockDB.NewMockDB()
+	testUtil.NoError(t, err)
+
+	s := sessionstore.NewMemory(sessionstore.DefaultOptions, []byte("secret"))
+
+	usersAPI := users.New(l, db, v, s, nil, nil, nil)
+
+	password := "Password@123"
+	pass, _ := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	email := "email@email.com"
+	id := uuid.New()
+
+	mockNotLocked(mock)
+	mock.ExpectQuery("^SELECT (.+) FROM \"users\" WHERE (.+)").
+		WithArgs(email, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "email", "password", "role", "status"}).
+			AddRow(id, "user1", email, pass, "doctor", "active"))
+	mockResetLoginFailures(mock)
+	mock.ExpectQuery("^SELECT (.+) FROM \"totp_credentials\"").
+		WithArgs(id, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "secret", "enabled_at"}).AddRow(id, "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ", time.Now()))
+	mock.ExpectQuery("^SELECT (.+) FROM \"two_factor_policies\"").
+		WithArgs(users.Doctor, 1).
+		WillReturnRows(&sqlmock.Rows{})
+
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(usersAPI.Login)
+
+	body, _ := json.Marshal(&users.LoginForm{Email: email, Password: password})
+	req, err := http.NewRequest("POST", "/api/v1/users/login", bytes.NewReader(body))
+	if err != nil {
+		t.Errorf("Error creating a new request: %v", err)
+	}
+
+	handler.ServeHTTP(rr, req)
+	testUtil.Equal(t, rr.Code, http.StatusAccepted)
+
+	response := &users.TwoFactorChallengeResponse{}
+	err = json.NewDecoder(rr.Body).Decode(response)
+	testUtil.NoError(t, err)
+	testUtil.Equal(t, response.TwoFactorRequired, true)
+	testUtil.Equal(t, response.SetupRequired, false)
+	testUtil.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestDisableTwoFactorReplayedCode(t *testing.T) {
+	secret := "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+	code, err := totp.Code(secret, time.Now())
+	testUtil.NoError(t, err)
+
+	testCases := []struct {
+		name     string
+		fresh    bool
+		expected int
+	}{
+		{name: "fresh code", fresh: true, expected: http.StatusOK},
+		{name: "replayed code", fresh: false, expected: http.StatusUnauthorized},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			l := logger.New(false)
+			v := validatorUtil.New()
+			db, mock, err := mockDB.NewMockDB()
+			testUtil.NoError(t, err)
+
+			s := sessionstore.NewMemory(sessionstore.DefaultOptions, []byte("secret"))
+			usersAPI := users.New(l, db, v, s, nil, nil, nil)
+
+			id := uuid.New()
+			email := "email@email.com"
+			mock.ExpectQuery("^SELECT (.+) FROM \"users\" WHERE (.+)").
+				WithArgs(id, 1).
+				WillReturnRows(sqlmock.NewRows([]string{"id", "name", "email", "role", "status"}).
+					AddRow(id, "user1", email, "patient", "active"))
+			mock.ExpectQuery("^SELECT (.+) FROM \"two_factor_policies\"").
+				WithArgs(users.Patient, 1).
+				WillReturnRows(&sqlmock.Rows{})
+			mock.ExpectQuery("^SELECT (.+) FROM \"totp_credentials\"").
+				WithArgs(id, 1).
+				WillReturnRows(sqlmock.NewRows([]string{"user_id", "secret", "enabled_at", "last_step"}).
+					AddRow(id, secret, time.Now(), 0))
+			mockNotLocked(mock)
+			// The step of the code is only stored when it is later than
+			// the last accepted one.
+			rows := int64(0)
+			if tc.fresh {
+				rows = 1
+			}
+			mock.ExpectBegin()
+			mock.ExpectExec("^UPDATE \"totp_credentials\" SET \"last_step\"=\\$1 WHERE user_id = \\$2 AND last_step < \\$3").
+				WithArgs(sqlmock.AnyArg(), id, sqlmock.AnyArg()).
+				WillReturnResult(sqlmock.NewResult(0, rows))
+			mock.ExpectCommit()
+			if tc.fresh {
+				mock.ExpectBegin()
+				mock.ExpectExec("^DELETE FROM \"recovery_codes\"").WillReturnResult(sqlmock.NewResult(0, 10))
+				mock.ExpectExec("^DELETE FROM \"totp_credentials\"").WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectCommit()
+			} else {
+				mock.ExpectQuery("^INSERT INTO login_throttles").
+					WithArgs("email:"+email, sqlmock.AnyArg(), "ip:192.0.2.1", sqlmock.AnyArg(), sqlmock.AnyArg(), "ip:192.0.2.1").
+					WillReturnRows(sqlmock.NewRows([]string{"failures"}).AddRow(1))
+				mock.ExpectQuery("^INSERT INTO login_throttles").
+					WithArgs("ip:192.0.2.1", sqlmock.AnyArg(), "", sqlmock.AnyArg(), sqlmock.AnyArg(), "").
+					WillReturnRows(sqlmock.NewRows([]string{"failures"}).AddRow(1))
+			}
+
+			body, _ := json.Marshal(&users.TwoFactorCodeForm{Code: code})
+			req, err := http.NewRequest("DELETE", "/api/v1/users/current/2fa", bytes.NewReader(body))
+			testUtil.NoError(t, err)
+			req.RemoteAddr = "192.0.2.1:1234"
+			req = req.WithContext(policy.WithIdentity(req.Context(), &policy.Identity{ID: id.String(), Role: "patient"}))
+
+			rr := httptest.NewRecorder()
+			http.HandlerFunc(usersAPI.DisableTwoFactor).ServeHTTP(rr, req)
+			testUtil.Equal(t, rr.Code, tc.expected)
+			testUtil.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestUnlockClearsClientLockouts(t *testing.T) {
+	l := logger.New(false)
+	v := validatorUtil.New()
+	db, mock, err := mockDB.NewMockDB()
+	testUtil.NoError(t, err)
+
+	s := sessionstore.NewMemory(sessionstore.DefaultOptions, []byte("secret"))
+	usersAPI := users.New(l, db, v, s, nil, nil, nil)
+
+	id := uuid.New()
+	email := "Email@email.com"
+	mock.ExpectQuery("^SELECT (.+) FROM \"users\" WHERE (.+)").
+		WithArgs(id, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "email", "role", "status"}).
+			AddRow(id, "user1", email, "patient", "active"))
+	// The IPs the failures of the account came from are unlocked with it.
+	mock.ExpectBegin()
+	mock.ExpectExec("^DELETE FROM \"login_throttles\" WHERE subject = \\$1 OR subject = ANY \\(SELECT unnest\\(sources\\) FROM \"login_throttles\" WHERE subject = \\$2\\)").
+		WithArgs("email:email@email.com", "email:email@email.com").
+		WillReturnResult(sqlmock.NewResult(0, 3))
+	mock.ExpectCommit()
+
+	req, err := http.NewRequest("POST", "/api/v1/users/{id}/unlock", nil)
+	testUtil.NoError(t, err)
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Add("id", id.String())
+	req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(usersAPI.Unlock).ServeHTTP(rr, req)
+	testUtil.Equal(t, rr.Code, http.StatusOK)
+	testUtil.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestLoginWrongPassword(t *testing.T) {
+	l := logger.New(false)
+	v := validatorUtil.New()
+	db, mock, err := mockDB.NewMockDB()
+	testUtil.NoError(t, err)
+
+	s := sessionstore.NewMemory(sessionstore.DefaultOptions, []byte("secret"))
+
+	usersAPI := users.New(l, db, v, s, nil, nil, nil)
+
+	pass, _ := bcrypt.GenerateFromPassword([]byte("Password@123"), bcrypt.DefaultCost)
+	email := "email@email.com"
+
+	mockNotLocked(mock)
+	mock.ExpectQuery("^SELECT (.+) FROM \"users\" WHERE (.+)").
+		WithArgs(email, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "email", "password", "role", "status"}).
+			AddRow(uuid.New(), "user1", email, pass, "patient", "active"))
+	mock.ExpectQuery("^INSERT INTO login_throttles").
+		WithArgs("email:"+email, sqlmock.AnyArg(), "ip:192.0.2.1", sqlmock.AnyArg(), sqlmock.AnyArg(), "ip:192.0.2.1").
+		WillReturnRows(sqlmock.NewRows([]string{"failures"}).AddRow(users.DefaultLockout.MaxAttempts))
+	mock.ExpectBegin()
+	mock.ExpectExec("^UPDATE \"login_throttles\" SET \"locked_until\"").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	mock.ExpectQuery("^INSERT INTO login_throttles").
+		WithArgs("ip:192.0.2.1", sqlmock.AnyArg(), "", sqlmock.AnyArg(), sqlmock.AnyArg(), "").
+		WillReturnRows(sqlmock.NewRows([]string{"failures"}).AddRow(1))
+
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(usersAPI.Login)
+
+	body, _ := json.Marshal(&users.LoginForm{Email: email, Password: "Wrong@1234"})
+	req, err := http.NewRequest("POST", "/api/v1/users/login", bytes.NewReader(body))
+	if err != nil {
+		t.Errorf("Error creating a new request: %v", err)
+	}
+	req.RemoteAddr = "192.0.2.1:1234"
+
+	handler.ServeHTTP(rr, req)
+	testUtil.Equal(t, rr.Code, http.StatusTooManyRequests)
+	testUtil.Equal(t, rr.Header().Get("Retry-After"), "60")
+	testUtil.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestLoginLocked(t *testing.T) {
+	l := logger.New(false)
+	v := validatorUtil.New()
+	db, mock, err := mockDB.NewMockDB()
+	testUtil.NoError(t, err)
+
+	s := sessionstore.NewMemory(sessionstore.DefaultOptions, []byte("secret"))
+
+	usersAPI := users.New(l, db, v, s, nil, nil, nil)
+
+	mock.ExpectQuery("^SELECT (.+) FROM \"login_throttles\"").
+		WillReturnRows(sqlmock.NewRows([]string{"subject", "failures", "last_failure_at", "locked_until"}).
+			AddRow("email:email@email.com", 5, time.Now(), time.Now().Add(time.Minute)))
+
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(usersAPI.Login)
+
+	body, _ := json.Marshal(&users.LoginForm{Email: "email@email.com", Password: "Password@123"})
+	req, err := http.NewRequest("POST", "/api/v1/users/login", bytes.NewReader(body))
+	if err != nil {
+		t.Errorf("Error creating a new request: %v", err)
+	}
+
+	handler.ServeHTTP(rr, req)
+	testUtil.Equal(t, rr.Code, http.StatusTooManyRequests)
+	testUtil.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestLoginSuspended(t *testing.T) {
+	l := logger.New(false)
+	v := validatorUtil.New()
+	db, mock, err := mockDB.NewMockDB()
+	testUtil.NoError(t, err)
+
+	s := sessionstore.NewMemory(sessionstore.DefaultOptions, []byte("secret"))
+
+	usersAPI := users.New(l, db, v, s, nil, nil, nil)
+
+	pass, _ := bcrypt.GenerateFromPassword([]byte("Password@123"), bcrypt.DefaultCost)
+	email := "email@email.com"
+
+	mockNotLocked(mock)
+	mock.ExpectQuery("^SELECT (.+) FROM \"users\" WHERE (.+)").
+		WithArgs(email, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "email", "password", "role", "status"}).
+			AddRow(uuid.New(), "user1", email, pass, "patient", "suspended"))
+	mockResetLoginFailures(mock)
+
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(usersAPI.Login)
+
+	body, _ := json.Marshal(&users.LoginForm{Email: email, Password: "Password@123"})
+	req, err := http.NewRequest("POST", "/api/v1/users/login", bytes.NewReader(body))
+	if err != nil {
+		t.Errorf("Error creating a new request: %v", err)
+	}
+
+	handler.ServeHTTP(rr, req)
+	testUtil.Equal(t, rr.Code, http.StatusForbidden)
+	testUtil.Equal(t, strings.TrimSpace(rr.Body.String()), "Account is suspended!")
+	testUtil.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRestoreUser(t *testing.T) {
+	idString := "c50abe98-7f20-4cb9-b4a8-fbef37988e7f"
+
+	l := logger.New(false)
+	v := validatorUtil.New()
+	db, mock, err := mockDB.NewMockDB()
+	testUtil.NoError(t, err)
+
+	s := sessionstore.NewMemory(sessionstore.DefaultOptions, []byte("secret"))
+
+	usersAPI := users.New(l, db, v, s, nil, nil, nil)
+
+	id, err := uuid.Parse(idString)
+	testUtil.NoError(t, err)
+	mock.ExpectQuery("^SELECT (.+) FROM \"users\" WHERE id = (.+)").
+		WithArgs(id, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "email", "role", "status", "deleted_at"}).
+			AddRow(id, "user1", "email@email.com", "patient", "active", time.Now()))
+	mock.ExpectBegin()
+	mock.ExpectExec("^UPDATE \"users\" SET \"deleted_at\"=\\$1 WHERE id = \\$2 AND deleted_at IS NOT NULL").
+		WithArgs(nil, id).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+	mock.ExpectQuery("^SELECT (.+) FROM \"users\" WHERE (.+)").
+		WithArgs(id, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "email", "role", "status"}).
+			AddRow(id, "user1", "email@email.com", "patient", "active"))
+
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(usersAPI.Restore)
+
+	req, err := http.NewRequest("POST", "/api/v1/users/{id}/restore", nil)
+	if err != nil {
+		t.Errorf("Error creating a new request: %v", err)
+	}
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Add("id", idString)
+	req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+
+	handler.ServeHTTP(rr, req)
+	testUtil.Equal(t, rr.Code, http.StatusOK)
+
+	response := &users.UserResponse{}
+	testUtil.NoError(t, json.NewDecoder(rr.Body).Decode(response))
+	testUtil.Equal(t, response.ID, id)
+	testUtil.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestChangeStatus(t *testing.T) {
+	idString := "c50abe98-7f20-4cb9-b4a8-fbef37988e7f"
+
+	l := logger.New(false)
+	v := validatorUtil.New()
+	db, mock, err := mockDB.NewMockDB()
+	testUtil.NoError(t, err)
+
+	s := sessionstore.NewMemory(sessionstore.DefaultOptions, []byte("secret"))
+
+	usersAPI := users.New(l, db, v, s, nil, nil, nil)
+
+	id, err := uuid.Parse(idString)
+	testUtil.NoError(t, err)
+	mock.ExpectQuery("^SELECT (.+) FROM \"users\" WHERE (.+)").
+		WithArgs(id, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "email", "role", "status"}).
+			AddRow(id, "user1", "email@email.com", "patient", "active"))
+	mock.ExpectBegin()
+	mockLockAdmins(mock, uuid.New())
+	mock.ExpectExec("^UPDATE \"users\" SET \"status\"").
+		WithArgs("suspended", id).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+	mock.ExpectQuery("^SELECT (.+) FROM \"users\" WHERE (.+)").
+		WithArgs(id, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "email", "role", "status"}).
+			AddRow(id, "user1", "email@email.com", "patient", "suspended"))
+
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(usersAPI.ChangeStatus)
+
+	body, _ := json.Marshal(&users.StatusForm{Status: users.StatusSuspended})
+	req, err := http.NewRequest("PATCH", "/api/v1/users/{id}/status", bytes.NewReader(body))
+	if err != nil {
+		t.Errorf("Error creating a new request: %v", err)
+	}
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Add("id", idString)
+	req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+
+	handler.ServeHTTP(rr, req)
+	testUtil.Equal(t, rr.Code, http.StatusOK)
+
+	response := &users.UserResponse{}
+	testUtil.NoError(t, json.NewDecoder(rr.Body).Decode(response))
+	testUtil.Equal(t, response.Status, "suspended")
+	testUtil.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestChangeStatusLastAdmin(t *testing.T) {
+	l := logger.New(false)
+	v := validatorUtil.New()
+	db, mock, err := mockDB.NewMockDB()
+	testUtil.NoError(t, err)
+
+	s := sessionstore.NewMemory(sessionstore.DefaultOptions, []byte("secret"))
+
+	usersAPI := users.New(l, db, v, s, nil, nil, nil)
+
+	id := uuid.New()
+	mock.ExpectQuery("^SELECT (.+) FROM \"users\" WHERE (.+)").
+		WithArgs(id, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "email", "role", "status"}).
+			AddRow(id, "Anna", "anna@email.com", "admin", "active"))
+	mock.ExpectBegin()
+	mockLockAdmins(mock, id)
+	mock.ExpectRollback()
+
+	body, _ := json.Marshal(&users.StatusForm{Status: users.StatusDeactivated})
+	req, err := http.NewRequest("PATCH", "/api/v1/users/{id}/status", bytes.NewReader(body))
+	testUtil.NoError(t, err)
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Add("id", id.String())
+	req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(usersAPI.ChangeStatus).ServeHTTP(rr, req)
+	testUtil.Equal(t, rr.Code, http.StatusConflict)
+	testUtil.Equal(t, strings.TrimSpace(rr.Body.String()), "Cannot suspend or deactivate the last admin!")
+	testUtil.NoError(t, mock.ExpectationsWereMet())
+}
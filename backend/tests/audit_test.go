@@ -0,0 +1,435 @@
+package tests
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/go-chi/chi"
+	"github.com/google/uuid"
+
+	"backend/api/resource/audit"
+	"backend/api/resource/invitations"
+	"backend/api/resource/users"
+	"backend/api/router/middleware"
+	"backend/utils/logger"
+	mockDB "backend/utils/mock"
+	"backend/utils/sessionstore"
+	testUtil "backend/utils/test"
+	validatorUtil "backend/utils/validator"
+)
+
+type recorderStub struct {
+	events []*audit.Event
+}
+
+func (r *recorderStub) Append(event *audit.Event) error {
+	r.events = append(r.events, event)
+	return nil
+}
+
+func TestAuditMiddleware(t *testing.T) {
+	actor := uuid.New()
+	target := uuid.New()
+
+	testCases := []struct {
+		name      string
+		method    string
+		handler   http.HandlerFunc
+		recorded  bool
+		action    string
+		outcome   audit.Outcome
+		changes   string
+		withActor bool
+	}{
+		{
+			name:     "read",
+			method:   "GET",
+			handler:  func(_ http.ResponseWriter, _ *http.Request) {},
+			recorded: false,
+		},
+		{
+			name:   "denied read",
+			method: "GET",
+			handler: func(w http.ResponseWriter, _ *http.Request) {
+				w.WriteHeader(http.StatusForbidden)
+			},
+			recorded: true,
+			action:   "GET /users/{id}",
+			outcome:  audit.OutcomeDenied,
+		},
+		{
+			name:   "failed change",
+			method: "DELETE",
+			handler: func(w http.ResponseWriter, _ *http.Request) {
+				w.WriteHeader(http.StatusInternalServerError)
+			},
+			recorded:  true,
+			action:    "DELETE /users/{id}",
+			outcome:   audit.OutcomeFailure,
+			withActor: true,
+		},
+		{
+			name:   "described change",
+			method: "PUT",
+			handler: func(_ http.ResponseWriter, r *http.Request) {
+				audit.Record(r.Context(), "user.update", "user", target.String(),
+					map[string]string{"name": "Anna", "email": "anna@email.com"},
+					map[string]string{"name": "Anna Nowak", "email": "anna@email.com"})
+			},
+			recorded:  true,
+			action:    "user.update",
+			outcome:   audit.OutcomeSuccess,
+			changes:   `{"after":{"name":"Anna Nowak"},"before":{"name":"Anna"}}`,
+			withActor: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			recorder := &recorderStub{}
+			r := chi.NewRouter()
+			r.Use(middleware.Audit(logger.New(false), recorder))
+			if tc.withActor {
+				r.Use(func(next http.Handler) http.Handler {
+					return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+						audit.SetActor(r.Context(), audit.ActorUser, actor, "admin")
+						next.ServeHTTP(w, r)
+					})
+				})
+			}
+			r.MethodFunc(tc.method, "/users/{id}", tc.handler)
+
+			req, err := http.NewRequest(tc.method, "/users/"+target.String(), nil)
+			testUtil.NoError(t, err)
+			req.RemoteAddr = "10.0.0.1:5123"
+			req.Header.Set("User-Agent", "test")
+
+			r.ServeHTTP(httptest.NewRecorder(), req)
+
+			if !tc.recorded {
+				testUtil.Equal(t, len(recorder.events), 0)
+				return
+			}
+			testUtil.Equal(t, len(recorder.events), 1)
+			event := recorder.events[0]
+			testUtil.Equal(t, event.Action, tc.action)
+			testUtil.Equal(t, event.Outcome, tc.outcome)
+			testUtil.Equal(t, event.TargetID, target.String())
+			testUtil.Equal(t, event.IP, "10.0.0.1")
+			testUtil.Equal(t, event.UserAgent, "test")
+			if tc.withActor {
+				testUtil.Equal(t, event.ActorType, audit.ActorUser)
+				testUtil.Equal(t, *event.ActorID, actor)
+				testUtil.Equal(t, event.ActorRole, "admin")
+			} else {
+				testUtil.Equal(t, event.ActorType, audit.ActorAnonymous)
+				testUtil.Equal(t, event.ActorID == nil, true)
+			}
+			if tc.changes != "" {
+				testUtil.Equal(t, *event.Changes, tc.changes)
+			} else {
+				testUtil.Equal(t, event.Changes == nil, true)
+			}
+		})
+	}
+}
+
+func auditRows(events ...*audit.Event) *sqlmock.Rows {
+	rows := sqlmock.NewRows([]string{"id", "occurred_at", "actor_type", "action", "target_type", "target_id", "ip", "user_agent", "outcome", "prev_hash", "hash"})
+	for _, e := range events {
+		rows.AddRow(e.ID, e.OccurredAt, e.ActorType, e.Action, e.TargetType, e.TargetID, e.IP, e.UserAgent, e.Outcome, e.PrevHash, e.Hash)
+	}
+	return rows
+}
+
+func chainedEvents() []*audit.Event {
+	occurredAt := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	events := []*audit.Event{
+		{ID: 1, OccurredAt: occurredAt, ActorType: audit.ActorAnonymous, Action: "user.login", TargetType: "user", TargetID: uuid.NewString(), IP: "10.0.0.1", UserAgent: "test", Outcome: audit.OutcomeDenied},
+		{ID: 2, OccurredAt: occurredAt.Add(time.Second), ActorType: audit.ActorAnonymous, Action: "user.create", TargetType: "user", TargetID: uuid.NewString(), IP: "10.0.0.1", UserAgent: "test", Outcome: audit.OutcomeSuccess},
+	}
+	var prevHash []byte
+	for _, e := range events {
+		e.PrevHash = prevHash
+		e.Hash = e.Digest(prevHash)
+		prevHash = e.Hash
+	}
+	return events
+}
+
+func TestAuditVerify(t *testing.T) {
+	tampered := chainedEvents()
+	tampered[1].Outcome = audit.OutcomeFailure
+	unlinked := chainedEvents()
+	unlinked[1].PrevHash = nil
+	unlinked[1].Hash = unlinked[1].Digest(nil)
+
+	testCases := []struct {
+		name     string
+		events   []*audit.Event
+		valid    bool
+		checked  int64
+		brokenAt int64
+	}{
+		{name: "intact", events: chainedEvents(), valid: true, checked: 2},
+		{name: "changed event", events: tampered, valid: false, checked: 1, brokenAt: 2},
+		{name: "removed event", events: unlinked, valid: false, checked: 1, brokenAt: 2},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			db, mock, err := mockDB.NewMockDB()
+			testUtil.NoError(t, err)
+
+			mock.ExpectQuery("^SELECT \\* FROM \"audit_events\" WHERE id > \\$1 ORDER BY id LIMIT \\$2").
+				WithArgs(0, 500).
+				WillReturnRows(auditRows(tc.events...))
+
+			auditAPI := audit.New(logger.New(false), db, validatorUtil.New())
+			req, err := http.NewRequest("GET", "/api/v1/audit/verify", nil)
+			testUtil.NoError(t, err)
+			rr := httptest.NewRecorder()
+			http.HandlerFunc(auditAPI.Verify).ServeHTTP(rr, req)
+			testUtil.Equal(t, rr.Code, http.StatusOK)
+
+			var response audit.VerifyResponse
+			testUtil.NoError(t, json.NewDecoder(rr.Body).Decode(&response))
+			testUtil.Equal(t, response.Valid, tc.valid)
+			testUtil.Equal(t, response.Checked, tc.checked)
+			if tc.valid {
+				testUtil.Equal(t, response.BrokenAt == nil, true)
+			} else {
+				testUtil.Equal(t, *response.BrokenAt, tc.brokenAt)
+			}
+			testUtil.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestAuditAppend(t *testing.T) {
+	db, mock, err := mockDB.NewMockDB()
+	testUtil.NoError(t, err)
+
+	events := chainedEvents()
+	event := &audit.Event{
+		OccurredAt: events[1].OccurredAt,
+		ActorType:  events[1].ActorType,
+		Action:     events[1].Action,
+		TargetType: events[1].TargetType,
+		TargetID:   events[1].TargetID,
+		IP:         events[1].IP,
+		UserAgent:  events[1].UserAgent,
+		Outcome:    events[1].Outcome,
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectExec("^SELECT pg_advisory_xact_lock\\(\\$1\\)").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("^SELECT \"hash\" FROM \"audit_events\" ORDER BY id desc LIMIT \\$1").
+		WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"hash"}).AddRow(events[0].Hash))
+	mock.ExpectQuery("^INSERT INTO \"audit_events\" (.+) RETURNING \"id\"").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(2))
+	mock.ExpectCommit()
+
+	testUtil.NoError(t, audit.NewRepository(db).Append(event))
+	testUtil.Equal(t, event.ID, int64(2))
+	testUtil.Equal(t, string(event.PrevHash), string(events[0].Hash))
+	testUtil.Equal(t, string(event.Hash), string(events[1].Hash))
+	testUtil.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestAuditList(t *testing.T) {
+	db, mock, err := mockDB.NewMockDB()
+	testUtil.NoError(t, err)
+
+	where := "WHERE action LIKE \\$1 AND outcome = \\$2 AND occurred_at >= \\$3 AND occurred_at < \\$4"
+	from := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2024, 3, 2, 0, 0, 0, 0, time.UTC)
+	mock.ExpectQuery("^SELECT count\\(\\*\\) FROM \"audit_events\" "+where).
+		WithArgs("user.%", "denied", from, to).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+	mock.ExpectQuery("^SELECT \\* FROM \"audit_events\" "+where+" ORDER BY (.+) LIMIT \\$5").
+		WithArgs("user.%", "denied", from, to, 10).
+		WillReturnRows(auditRows(chainedEvents()[0]))
+
+	auditAPI := audit.New(logger.New(false), db, validatorUtil.New())
+	req, err := http.NewRequest("GET", "/api/v1/audit?action=user.&outcome=denied&from=2024-03-01&to=2024-03-01", nil)
+	testUtil.NoError(t, err)
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(auditAPI.List).ServeHTTP(rr, req)
+	testUtil.Equal(t, rr.Code, http.StatusOK)
+
+	var response audit.ListResponse
+	testUtil.NoError(t, json.NewDecoder(rr.Body).Decode(&response))
+	testUtil.Equal(t, len(response.Events), 1)
+	testUtil.Equal(t, response.Events[0].Action, "user.login")
+	testUtil.Equal(t, response.TotalItems, int64(1))
+	testUtil.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestAuditExport(t *testing.T) {
+	testCases := []struct {
+		name     string
+		query    string
+		expected int
+		header   string
+	}{
+		{name: "csv", query: "format=csv", expected: http.StatusOK, header: "id,occurredAt,actorId,actorType"},
+		{name: "ndjson", query: "", expected: http.StatusOK, header: `{"id":1,`},
+		{name: "unknown format", query: "format=xml", expected: http.StatusUnprocessableEntity},
+		{name: "invalid actor", query: "actorId=123", expected: http.StatusUnprocessableEntity},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			db, mock, err := mockDB.NewMockDB()
+			testUtil.NoError(t, err)
+			if tc.expected == http.StatusOK {
+				mock.ExpectQuery("^SELECT \\* FROM \"audit_events\" WHERE id > \\$1 ORDER BY id LIMIT \\$2").
+					WithArgs(0, 500).
+					WillReturnRows(auditRows(chainedEvents()...))
+			}
+
+			auditAPI := audit.New(logger.New(false), db, validatorUtil.New())
+			req, err := http.NewRequest("GET", "/api/v1/audit/export?"+tc.query, nil)
+			testUtil.NoError(t, err)
+			rr := httptest.NewRecorder()
+			http.HandlerFunc(auditAPI.Export).ServeHTTP(rr, req)
+			testUtil.Equal(t, rr.Code, tc.expected)
+
+			if tc.expected == http.StatusOK {
+				lines := strings.Split(strings.TrimSpace(rr.Body.String()), "\n")
+				testUtil.Equal(t, strings.HasPrefix(lines[0], tc.header), true)
+				testUtil.Equal(t, strings.HasPrefix(rr.Header().Get("Content-Disposition"), "attachment; filename=\"audit-"), true)
+			}
+			testUtil.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+// auditedRouter serves the handler behind the audit middleware.
+func auditedRouter(recorder *recorderStub, method, pattern string, handler http.HandlerFunc) *chi.Mux {
+	r := chi.NewRouter()
+	r.Use(middleware.Audit(logger.New(false), recorder))
+	r.MethodFunc(method, pattern, handler)
+	return r
+}
+
+func TestAuditDeleteUser(t *testing.T) {
+	db, mock, err := mockDB.NewMockDB()
+	testUtil.NoError(t, err)
+
+	s := sessionstore.NewMemory(sessionstore.DefaultOptions, []byte("secret"))
+	usersAPI := users.New(logger.New(false), db, validatorUtil.New(), s, nil, nil, nil)
+
+	id := uuid.New()
+	mock.ExpectQuery("^SELECT (.+) FROM \"users\" WHERE (.+)").
+		WithArgs(id, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "email", "role", "status"}).
+			AddRow(id, "Anna", "anna@email.com", "patient", "active"))
+	mock.ExpectBegin()
+	mockLockAdmins(mock, uuid.New())
+	mock.ExpectExec("^UPDATE \"users\" SET \"deleted_at\"").
+		WithArgs(mockDB.AnyTime{}, id).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	recorder := &recorderStub{}
+	r := auditedRouter(recorder, "DELETE", "/users/{id}", usersAPI.Delete)
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest("DELETE", "/users/"+id.String(), nil))
+	testUtil.Equal(t, rr.Code, http.StatusOK)
+	testUtil.NoError(t, mock.ExpectationsWereMet())
+
+	testUtil.Equal(t, len(recorder.events), 1)
+	event := recorder.events[0]
+	testUtil.Equal(t, event.Action, "user.delete")
+	testUtil.Equal(t, event.TargetID, id.String())
+
+	var changes struct {
+		Before map[string]any `json:"before"`
+		After  map[string]any `json:"after"`
+	}
+	testUtil.NoError(t, json.Unmarshal([]byte(*event.Changes), &changes))
+	_, deletedBefore := changes.Before["deletedAt"]
+	testUtil.Equal(t, deletedBefore, false)
+	testUtil.Equal(t, changes.After["deletedAt"] != nil, true)
+}
+
+func TestAuditChangeStatus(t *testing.T) {
+	db, mock, err := mockDB.NewMockDB()
+	testUtil.NoError(t, err)
+
+	s := sessionstore.NewMemory(sessionstore.DefaultOptions, []byte("secret"))
+	usersAPI := users.New(logger.New(false), db, validatorUtil.New(), s, nil, nil, nil)
+
+	id := uuid.New()
+	mock.ExpectQuery("^SELECT (.+) FROM \"users\" WHERE (.+)").
+		WithArgs(id, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "email", "role", "status"}).
+			AddRow(id, "Anna", "anna@email.com", "patient", "active"))
+	mock.ExpectBegin()
+	mockLockAdmins(mock, uuid.New())
+	mock.ExpectExec("^UPDATE \"users\" SET \"status\"").
+		WithArgs("suspended", id).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	mock.ExpectQuery("^SELECT (.+) FROM \"users\" WHERE (.+)").
+		WithArgs(id, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "email", "role", "status"}).
+			AddRow(id, "Anna", "anna@email.com", "patient", "suspended"))
+
+	recorder := &recorderStub{}
+	r := auditedRouter(recorder, "PATCH", "/users/{id}/status", usersAPI.ChangeStatus)
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest("PATCH", "/users/"+id.String()+"/status", strings.NewReader(`{"status": "suspended"}`)))
+	testUtil.Equal(t, rr.Code, http.StatusOK)
+	testUtil.NoError(t, mock.ExpectationsWereMet())
+
+	testUtil.Equal(t, len(recorder.events), 1)
+	event := recorder.events[0]
+	testUtil.Equal(t, event.Action, "user.status")
+
+	var changes struct {
+		Before map[string]any `json:"before"`
+		After  map[string]any `json:"after"`
+	}
+	testUtil.NoError(t, json.Unmarshal([]byte(*event.Changes), &changes))
+	testUtil.Equal(t, changes.Before["status"], any("active"))
+	testUtil.Equal(t, changes.After["status"], any("suspended"))
+}
+
+func TestAuditRevokeInvitation(t *testing.T) {
+	db, mock, err := mockDB.NewMockDB()
+	testUtil.NoError(t, err)
+
+	invitationsAPI := invitations.New(logger.New(false), db, validatorUtil.New(), nil, nil)
+
+	id := uuid.New()
+	mock.ExpectQuery("^SELECT (.+) FROM \"invitations\" WHERE (.+)").
+		WithArgs(id, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "email", "role", "expires_at"}).
+			AddRow(id, "anna@email.com", "doctor", time.Now().Add(time.Hour)))
+	mock.ExpectBegin()
+	mock.ExpectExec("^UPDATE \"invitations\" SET \"revoked_at\"").
+		WithArgs(mockDB.AnyTime{}, id).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	recorder := &recorderStub{}
+	r := auditedRouter(recorder, "DELETE", "/invitations/{id}", invitationsAPI.Revoke)
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest("DELETE", "/invitations/"+id.String(), nil))
+	testUtil.Equal(t, rr.Code, http.StatusOK)
+	testUtil.NoError(t, mock.ExpectationsWereMet())
+
+	testUtil.Equal(t, len(recorder.events), 1)
+	testUtil.Equal(t, recorder.events[0].Action, "invitation.revoke")
+	testUtil.Equal(t, *recorder.events[0].Changes, `{"after":{"status":"revoked"},"before":{"status":"pending"}}`)
+}
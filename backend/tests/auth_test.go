@@ -0,0 +1,152 @@
+package tests
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/google/uuid"
+
+	"backend/api/resource/auth"
+	"backend/utils/logger"
+	mockDB "backend/utils/mock"
+	testUtil "backend/utils/test"
+	"backend/utils/token"
+)
+
+func TestIntrospect(t *testing.T) {
+	l := logger.New(false)
+	db, mock, err := mockDB.NewMockDB()
+	testUtil.NoError(t, err)
+
+	tokens := token.NewHS256([]byte("secret"), "users-service", time.Minute, time.Hour)
+	authAPI := auth.New(l, db, tokens)
+
+	id := uuid.New()
+	sid := uuid.New()
+	pair, err := tokens.Issue(id.String(), "email@email.com", "patient", sid.String())
+	testUtil.NoError(t, err)
+
+	// The role has changed since the token was issued.
+	mock.ExpectQuery("^SELECT (.+) FROM \"users\" WHERE (.+)").
+		WithArgs(id, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "email", "role", "status"}).AddRow(id, "user1", "email@email.com", "doctor", "active"))
+	mock.ExpectQuery("^SELECT (.+) FROM \"user_sessions\" WHERE (.+)").
+		WithArgs(sid, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "user_id"}).AddRow(sid, id))
+
+	form := url.Values{"token": {pair.AccessToken}}
+	req, err := http.NewRequest("POST", "/api/v1/auth/introspect", strings.NewReader(form.Encode()))
+	if err != nil {
+		t.Errorf("Error creating a new request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(authAPI.Introspect).ServeHTTP(rr, req)
+	testUtil.Equal(t, rr.Code, http.StatusOK)
+
+	var response auth.IntrospectionResponse
+	err = json.NewDecoder(rr.Body).Decode(&response)
+	testUtil.NoError(t, err)
+	testUtil.Equal(t, response.Active, true)
+	testUtil.Equal(t, response.Subject, id.String())
+	testUtil.Equal(t, response.Role, "doctor")
+	testUtil.Equal(t, response.TokenType, token.TypeAccess)
+}
+
+func TestIntrospectInvalidToken(t *testing.T) {
+	l := logger.New(false)
+	db, _, err := mockDB.NewMockDB()
+	testUtil.NoError(t, err)
+
+	authAPI := auth.New(l, db, token.NewHS256([]byte("secret"), "users-service", time.Minute, time.Hour))
+
+	form := url.Values{"token": {"invalid"}}
+	req, err := http.NewRequest("POST", "/api/v1/auth/introspect", strings.NewReader(form.Encode()))
+	if err != nil {
+		t.Errorf("Error creating a new request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(authAPI.Introspect).ServeHTTP(rr, req)
+	testUtil.Equal(t, rr.Code, http.StatusOK)
+	testUtil.Equal(t, strings.TrimSpace(rr.Body.String()), `{"active":false}`)
+}
+
+func TestIntrospectOAuthToken(t *testing.T) {
+	l := logger.New(false)
+	db, mock, err := mockDB.NewMockDB()
+	testUtil.NoError(t, err)
+
+	tokens := token.NewHS256([]byte("secret"), "users-service", time.Minute, time.Hour)
+	authAPI := auth.New(l, db, tokens)
+
+	id := uuid.New()
+	sid := uuid.New()
+	raw, err := tokens.IssueOAuth(id.String(), "client", "openid email", sid.String())
+	testUtil.NoError(t, err)
+
+	mock.ExpectQuery("^SELECT (.+) FROM \"users\" WHERE (.+)").
+		WithArgs(id, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "email", "role", "status"}).AddRow(id, "user1", "email@email.com", "patient", "active"))
+	mock.ExpectQuery("^SELECT (.+) FROM \"user_sessions\" WHERE (.+)").
+		WithArgs(sid, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "user_id"}).AddRow(sid, id))
+
+	form := url.Values{"token": {raw}}
+	req, err := http.NewRequest("POST", "/api/v1/auth/introspect", strings.NewReader(form.Encode()))
+	testUtil.NoError(t, err)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(authAPI.Introspect).ServeHTTP(rr, req)
+	testUtil.Equal(t, rr.Code, http.StatusOK)
+
+	var response auth.IntrospectionResponse
+	err = json.NewDecoder(rr.Body).Decode(&response)
+	testUtil.NoError(t, err)
+	testUtil.Equal(t, response.Active, true)
+	testUtil.Equal(t, response.TokenType, token.TypeOAuth)
+	testUtil.Equal(t, response.ClientID, "client")
+	testUtil.Equal(t, response.Scope, "openid email")
+	testUtil.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestIntrospectSessionOfOtherUser(t *testing.T) {
+	l := logger.New(false)
+	db, mock, err := mockDB.NewMockDB()
+	testUtil.NoError(t, err)
+
+	tokens := token.NewHS256([]byte("secret"), "users-service", time.Minute, time.Hour)
+	authAPI := auth.New(l, db, tokens)
+
+	id := uuid.New()
+	sid := uuid.New()
+	pair, err := tokens.Issue(id.String(), "email@email.com", "patient", sid.String())
+	testUtil.NoError(t, err)
+
+	mock.ExpectQuery("^SELECT (.+) FROM \"users\" WHERE (.+)").
+		WithArgs(id, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "email", "role", "status"}).AddRow(id, "user1", "email@email.com", "patient", "active"))
+	mock.ExpectQuery("^SELECT (.+) FROM \"user_sessions\" WHERE (.+)").
+		WithArgs(sid, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "user_id"}).AddRow(sid, uuid.New()))
+
+	form := url.Values{"token": {pair.AccessToken}}
+	req, err := http.NewRequest("POST", "/api/v1/auth/introspect", strings.NewReader(form.Encode()))
+	testUtil.NoError(t, err)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(authAPI.Introspect).ServeHTTP(rr, req)
+	testUtil.Equal(t, rr.Code, http.StatusOK)
+	testUtil.Equal(t, strings.TrimSpace(rr.Body.String()), `{"active":false}`)
+	testUtil.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,149 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/go-chi/chi"
+	"github.com/google/uuid"
+
+	"backend/api/resource/availability"
+	"backend/utils/logger"
+	mockDB "backend/utils/mock"
+	testUtil "backend/utils/test"
+	validatorUtil "backend/utils/validator"
+)
+
+func TestExpandWorkingHours(t *testing.T) {
+	form := &availability.WorkingHoursForm{
+		TimeZone: "Europe/Warsaw",
+		Hours: []*availability.HoursForm{
+			{Weekday: "monday", Start: "13:00", End: "16:00", Clinic: "B"},
+			{Weekday: "monday", Start: "08:00", End: "12:00", Clinic: "A"},
+			{Weekday: "wednesday", Start: "09:00", End: "17:00", Clinic: "A"},
+		},
+	}
+	schedule := form.ToModel(uuid.New())
+
+	warsaw, err := time.LoadLocation("Europe/Warsaw")
+	testUtil.NoError(t, err)
+	exceptions := availability.Exceptions{
+		{StartsAt: time.Date(2026, 3, 25, 12, 0, 0, 0, warsaw), EndsAt: time.Date(2026, 3, 25, 13, 0, 0, 0, warsaw)},
+	}
+
+	// Daylight saving time starts on Sunday, 29 March 2026.
+	from := time.Date(2026, 3, 23, 10, 0, 0, 0, warsaw)
+	to := time.Date(2026, 3, 30, 14, 0, 0, 0, warsaw)
+	windows, err := schedule.Expand(exceptions, from, to)
+	testUtil.NoError(t, err)
+
+	expected := []string{
+		"2026-03-23T10:00:00+01:00 2026-03-23T12:00:00+01:00 A",
+		"2026-03-23T13:00:00+01:00 2026-03-23T16:00:00+01:00 B",
+		"2026-03-25T09:00:00+01:00 2026-03-25T12:00:00+01:00 A",
+		"2026-03-25T13:00:00+01:00 2026-03-25T17:00:00+01:00 A",
+		"2026-03-30T08:00:00+02:00 2026-03-30T12:00:00+02:00 A",
+		"2026-03-30T13:00:00+02:00 2026-03-30T14:00:00+02:00 B",
+	}
+	testUtil.Equal(t, len(windows), len(expected))
+	for i, w := range windows {
+		testUtil.Equal(t, w.Start.Format(time.RFC3339)+" "+w.End.Format(time.RFC3339)+" "+w.Clinic, expected[i])
+	}
+}
+
+func TestWorkingHoursProblems(t *testing.T) {
+	form := &availability.WorkingHoursForm{
+		TimeZone: "Europe/Warsaw",
+		Hours: []*availability.HoursForm{
+			{Weekday: "monday", Start: "08:00", End: "12:00"},
+			{Weekday: "monday", Start: "11:00", End: "15:00"},
+			{Weekday: "tuesday", Start: "11:00", End: "15:00"},
+			{Weekday: "friday", Start: "15:00", End: "09:00"},
+		},
+	}
+
+	problems := form.Problems()
+	testUtil.Equal(t, len(problems), 2)
+	testUtil.Equal(t, problems[0], "hours[1] overlaps hours[0]")
+	testUtil.Equal(t, problems[1], "hours[3].end must be after start")
+}
+
+func availabilityRequest(t *testing.T, id uuid.UUID, query string) *http.Request {
+	req, err := http.NewRequest("GET", "/api/v1/doctors/{id}/availability?"+query, nil)
+	testUtil.NoError(t, err)
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Add("id", id.String())
+	return req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+}
+
+func mockActiveDoctor(mock sqlmock.Sqlmock, id uuid.UUID) {
+	mock.ExpectQuery("^SELECT (.+) FROM \"users\" WHERE (.+)").
+		WithArgs(id, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "email", "role", "status"}).
+			AddRow(id, "Dr House", "house@email.com", "doctor", "active"))
+}
+
+func TestReadAvailability(t *testing.T) {
+	db, mock, err := mockDB.NewMockDB()
+	testUtil.NoError(t, err)
+	availabilityAPI := availability.New(logger.New(false), db, validatorUtil.New())
+
+	id := uuid.New()
+	mockActiveDoctor(mock, id)
+	mock.ExpectQuery("^SELECT (.+) FROM \"doctor_schedules\" WHERE (.+)").
+		WithArgs(id, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "time_zone"}).AddRow(id, "Europe/Warsaw"))
+	mock.ExpectQuery("^SELECT (.+) FROM \"working_hours\" WHERE (.+)").
+		WithArgs(id).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "weekday", "start_minute", "end_minute", "clinic"}).
+			AddRow(uuid.New(), id, 1, 480, 960, "A").
+			AddRow(uuid.New(), id, 2, 480, 960, "A"))
+	mock.ExpectQuery("^SELECT (.+) FROM \"availability_exceptions\" WHERE (.+)").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "starts_at", "ends_at"}).
+			AddRow(uuid.New(), id, time.Date(2026, 6, 2, 0, 0, 0, 0, time.UTC), time.Date(2026, 6, 3, 0, 0, 0, 0, time.UTC)))
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(availabilityAPI.Read).ServeHTTP(rr, availabilityRequest(t, id, "from=2026-06-01&to=2026-06-08"))
+	testUtil.Equal(t, rr.Code, http.StatusOK)
+
+	var response availability.AvailabilityResponse
+	testUtil.NoError(t, json.NewDecoder(rr.Body).Decode(&response))
+	testUtil.Equal(t, response.TimeZone, "Europe/Warsaw")
+	testUtil.Equal(t, len(response.Windows), 1)
+	testUtil.Equal(t, response.Windows[0].Start.UTC(), time.Date(2026, 6, 1, 6, 0, 0, 0, time.UTC))
+	testUtil.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestReadAvailabilityInvalidRange(t *testing.T) {
+	testCases := []struct {
+		name  string
+		query string
+	}{
+		{name: "malformed", query: "from=tomorrow"},
+		{name: "reversed", query: "from=2026-06-08&to=2026-06-01"},
+		{name: "too long", query: "from=2026-01-01&to=2026-12-31"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			db, mock, err := mockDB.NewMockDB()
+			testUtil.NoError(t, err)
+			availabilityAPI := availability.New(logger.New(false), db, validatorUtil.New())
+
+			id := uuid.New()
+			mockActiveDoctor(mock, id)
+			mock.ExpectQuery("^SELECT (.+) FROM \"doctor_schedules\" WHERE (.+)").
+				WillReturnRows(&sqlmock.Rows{})
+
+			rr := httptest.NewRecorder()
+			http.HandlerFunc(availabilityAPI.Read).ServeHTTP(rr, availabilityRequest(t, id, tc.query))
+			testUtil.Equal(t, rr.Code, http.StatusBadRequest)
+			testUtil.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
@@ -0,0 +1,154 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/go-chi/chi"
+	"github.com/google/uuid"
+
+	"backend/api/resource/careteam"
+	"backend/api/resource/common/policy"
+	"backend/utils/logger"
+	mockDB "backend/utils/mock"
+	testUtil "backend/utils/test"
+	validatorUtil "backend/utils/validator"
+)
+
+func careTeamRequest(t *testing.T, method string, patientID, doctorID uuid.UUID, body any, identity *policy.Identity) *http.Request {
+	b, err := json.Marshal(body)
+	testUtil.NoError(t, err)
+
+	req, err := http.NewRequest(method, "/api/v1/users/{id}/doctors/{doctorId}", bytes.NewReader(b))
+	testUtil.NoError(t, err)
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Add("id", patientID.String())
+	rctx.URLParams.Add("doctorId", doctorID.String())
+	ctx := context.WithValue(req.Context(), chi.RouteCtxKey, rctx)
+	if identity != nil {
+		ctx = policy.WithIdentity(ctx, identity)
+	}
+	return req.WithContext(ctx)
+}
+
+func TestAddDoctorByPatient(t *testing.T) {
+	now := time.Date(2026, 6, 1, 12, 0, 0, 0, time.UTC)
+	careteam.Now = func() time.Time { return now }
+	defer func() { careteam.Now = time.Now }()
+
+	db, mock, err := mockDB.NewMockDB()
+	testUtil.NoError(t, err)
+	careTeamAPI := careteam.New(logger.New(false), db, validatorUtil.New())
+
+	patientID := uuid.New()
+	doctorID := uuid.New()
+	mockUserRole(mock, patientID, "patient")
+	mockActiveDoctor(mock, doctorID)
+	mock.ExpectQuery("^SELECT (.+) FROM \"care_relationships\" WHERE \\(patient_id = \\$1 AND doctor_id = \\$2\\) AND \\(ended_at IS NULL OR ended_at > \\$3\\)").
+		WithArgs(patientID, doctorID, now, 1).
+		WillReturnRows(&sqlmock.Rows{})
+	mock.ExpectBegin()
+	mock.ExpectExec("^UPDATE \"care_relationships\" SET \"primary_physician\"").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("^INSERT INTO \"care_relationships\"").
+		WithArgs(sqlmock.AnyArg(), patientID, doctorID, true, "granted", now, nil, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	form := &careteam.Form{DoctorID: doctorID, PrimaryPhysician: true}
+	rr := httptest.NewRecorder()
+	req := careTeamRequest(t, "POST", patientID, uuid.Nil, form, &policy.Identity{ID: patientID.String(), Role: "patient"})
+	http.HandlerFunc(careTeamAPI.AddDoctor).ServeHTTP(rr, req)
+	testUtil.Equal(t, rr.Code, http.StatusCreated)
+
+	var response careteam.RelationshipResponse
+	testUtil.NoError(t, json.NewDecoder(rr.Body).Decode(&response))
+	testUtil.Equal(t, response.ConsentStatus, careteam.ConsentGranted)
+	testUtil.Equal(t, response.Doctor.Name, "Dr House")
+	testUtil.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestAddDoctorNotADoctor(t *testing.T) {
+	db, mock, err := mockDB.NewMockDB()
+	testUtil.NoError(t, err)
+	careTeamAPI := careteam.New(logger.New(false), db, validatorUtil.New())
+
+	patientID := uuid.New()
+	otherPatientID := uuid.New()
+	mockUserRole(mock, patientID, "patient")
+	mockUserRole(mock, otherPatientID, "patient")
+
+	form := &careteam.Form{DoctorID: otherPatientID}
+	rr := httptest.NewRecorder()
+	req := careTeamRequest(t, "POST", patientID, uuid.Nil, form, &policy.Identity{ID: patientID.String(), Role: "patient"})
+	http.HandlerFunc(careTeamAPI.AddDoctor).ServeHTTP(rr, req)
+	testUtil.Equal(t, rr.Code, http.StatusUnprocessableEntity)
+	testUtil.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestGrantConsentOnlyByPatient(t *testing.T) {
+	db, mock, err := mockDB.NewMockDB()
+	testUtil.NoError(t, err)
+	careTeamAPI := careteam.New(logger.New(false), db, validatorUtil.New())
+
+	form := &careteam.UpdateForm{ConsentStatus: "granted"}
+	rr := httptest.NewRecorder()
+	req := careTeamRequest(t, "PATCH", uuid.New(), uuid.New(), form, &policy.Identity{ID: uuid.NewString(), Role: "admin"})
+	http.HandlerFunc(careTeamAPI.UpdateDoctor).ServeHTTP(rr, req)
+	testUtil.Equal(t, rr.Code, http.StatusForbidden)
+	testUtil.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRemoveDoctor(t *testing.T) {
+	now := time.Date(2026, 6, 1, 12, 0, 0, 0, time.UTC)
+	careteam.Now = func() time.Time { return now }
+	defer func() { careteam.Now = time.Now }()
+
+	db, mock, err := mockDB.NewMockDB()
+	testUtil.NoError(t, err)
+	careTeamAPI := careteam.New(logger.New(false), db, validatorUtil.New())
+
+	patientID := uuid.New()
+	doctorID := uuid.New()
+	relationshipID := uuid.New()
+	mock.ExpectQuery("^SELECT (.+) FROM \"care_relationships\"").
+		WithArgs(patientID, doctorID, now, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "patient_id", "doctor_id", "consent_status"}).
+			AddRow(relationshipID, patientID, doctorID, "granted"))
+	mock.ExpectQuery("^SELECT (.+) FROM \"users\"").WillReturnRows(&sqlmock.Rows{})
+	mock.ExpectQuery("^SELECT (.+) FROM \"users\"").WillReturnRows(&sqlmock.Rows{})
+	mock.ExpectBegin()
+	mock.ExpectExec("^UPDATE \"care_relationships\" SET \"ended_at\"=\\$1,\"primary_physician\"=\\$2 WHERE id = \\$3").
+		WithArgs(now, false, relationshipID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	rr := httptest.NewRecorder()
+	req := careTeamRequest(t, "DELETE", patientID, doctorID, nil, &policy.Identity{ID: patientID.String(), Role: "patient"})
+	http.HandlerFunc(careTeamAPI.RemoveDoctor).ServeHTTP(rr, req)
+	testUtil.Equal(t, rr.Code, http.StatusOK)
+	testUtil.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestIsPatientOf(t *testing.T) {
+	db, mock, err := mockDB.NewMockDB()
+	testUtil.NoError(t, err)
+	repository := careteam.NewRepository(db)
+
+	patientID := uuid.New()
+	doctorID := uuid.New()
+	mock.ExpectQuery("^SELECT count\\(\\*\\) FROM \"care_relationships\" WHERE \\(patient_id = \\$1 AND doctor_id = \\$2\\) AND \\(consent_status = \\$3 AND started_at <= \\$4\\) AND \\(ended_at IS NULL OR ended_at > \\$5\\)").
+		WithArgs(patientID, doctorID, "granted", sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+
+	treats, err := repository.IsPatientOf(patientID, doctorID)
+	testUtil.NoError(t, err)
+	testUtil.Equal(t, treats, true)
+	testUtil.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,401 @@
+package tests
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"database/sql/driver"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/go-chi/chi"
+	"github.com/google/uuid"
+
+	"backend/api/resource/audit"
+	"backend/api/resource/federation"
+	"backend/api/resource/users"
+	"backend/api/router/middleware"
+	"backend/utils/logger"
+	mockDB "backend/utils/mock"
+	"backend/utils/oidcclient"
+	"backend/utils/sessionstore"
+	testUtil "backend/utils/test"
+	"backend/utils/token"
+	validatorUtil "backend/utils/validator"
+)
+
+// mockIdP is a minimal OpenID Connect provider that signs in whoever asks
+// with the claims of the test.
+type mockIdP struct {
+	server     *httptest.Server
+	privateKey *rsa.PrivateKey
+	key        *token.Key
+	claims     map[string]any
+	nonce      string
+}
+
+func newMockIdP(t *testing.T) *mockIdP {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	testUtil.NoError(t, err)
+
+	idp := &mockIdP{privateKey: privateKey, key: token.NewRS256Key(privateKey)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, _ *http.Request) {
+		_ = json.NewEncoder(w).Encode(&oidcclient.Metadata{
+			Issuer:                idp.server.URL,
+			AuthorizationEndpoint: idp.server.URL + "/authorize",
+			TokenEndpoint:         idp.server.URL + "/token",
+			JWKSURI:               idp.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, _ *http.Request) {
+		_ = json.NewEncoder(w).Encode(token.New(idp.key, nil, "", time.Minute, time.Hour).JWKS())
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.PostFormValue("code") != "idp-code" || r.PostFormValue("code_verifier") == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"error": "invalid_grant"}`))
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]string{"id_token": idp.idToken(t)})
+	})
+	idp.server = httptest.NewServer(mux)
+	t.Cleanup(idp.server.Close)
+
+	return idp
+}
+
+func (idp *mockIdP) idToken(t *testing.T) string {
+	claims := map[string]any{
+		"iss":   idp.server.URL,
+		"aud":   "users-service",
+		"exp":   time.Now().Add(time.Minute).Unix(),
+		"iat":   time.Now().Unix(),
+		"nonce": idp.nonce,
+	}
+	for k, v := range idp.claims {
+		claims[k] = v
+	}
+
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": idp.key.ID})
+	payload, _ := json.Marshal(claims)
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signingInput))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, idp.privateKey, crypto.SHA256, digest[:])
+	testUtil.NoError(t, err)
+
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// nullArg matches a value the driver sends as NULL.
+type nullArg struct{}
+
+func (nullArg) Match(v driver.Value) bool {
+	b, ok := v.([]byte)
+	return v == nil || ok && b == nil
+}
+
+func providerRows(id uuid.UUID, issuer string) *sqlmock.Rows {
+	return sqlmock.NewRows([]string{"id", "slug", "name", "issuer", "client_id", "client_secret", "role_claim", "role_mapping", "default_role"}).
+		AddRow(id, "hospital", "Hospital", issuer, "users-service", "idp-secret", "groups", `{"physicians": "doctor"}`, "")
+}
+
+func federationRouter(api *federation.API) *chi.Mux {
+	r := chi.NewRouter()
+	r.Get("/api/v1/auth/providers/{slug}/login", api.Login)
+	r.Get("/api/v1/auth/providers/{slug}/callback", api.Callback)
+	return r
+}
+
+// startFederatedLogin follows the login redirect and returns the session
+// cookie and the query of the authorization request sent to the provider.
+func startFederatedLogin(t *testing.T, r http.Handler, mock sqlmock.Sqlmock, providerID uuid.UUID, idp *mockIdP) (*http.Cookie, url.Values) {
+	mock.ExpectQuery("^SELECT (.+) FROM \"identity_providers\" WHERE (.+)").
+		WithArgs("hospital", 1).
+		WillReturnRows(providerRows(providerID, idp.server.URL))
+
+	req := httptest.NewRequest("GET", "/api/v1/auth/providers/hospital/login?returnTo="+url.QueryEscape("http://127.0.0.1:3000/dashboard"), nil)
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	testUtil.Equal(t, rr.Code, http.StatusFound)
+
+	location, err := url.Parse(rr.Header().Get("Location"))
+	testUtil.NoError(t, err)
+	testUtil.Equal(t, location.Path, "/authorize")
+	testUtil.Equal(t, location.Query().Get("redirect_uri"), "http://127.0.0.1:8080/api/v1/auth/providers/hospital/callback")
+	testUtil.Equal(t, location.Query().Get("code_challenge_method"), "S256")
+
+	return rr.Result().Cookies()[0], location.Query()
+}
+
+func TestProviderRoleFor(t *testing.T) {
+	provider := &federation.Provider{
+		RoleClaim:   "realm_access.roles",
+		RoleMapping: federation.RoleMapping{"physicians": "doctor"},
+	}
+
+	role := provider.RoleFor(oidcclient.Claims{"realm_access": map[string]any{"roles": []any{"staff", "physicians"}}})
+	testUtil.Equal(t, *role, users.Doctor)
+
+	testUtil.Equal(t, provider.RoleFor(oidcclient.Claims{}) == nil, true)
+
+	provider.DefaultRole = "patient"
+	testUtil.Equal(t, *provider.RoleFor(oidcclient.Claims{}), users.Patient)
+}
+
+func TestFederatedLoginCreatesAccount(t *testing.T) {
+	l := logger.New(false)
+	v := validatorUtil.New()
+	db, mock, err := mockDB.NewMockDB()
+	testUtil.NoError(t, err)
+
+	s := sessionstore.NewMemory(sessionstore.DefaultOptions, []byte("secret"))
+	idp := newMockIdP(t)
+	api := federation.New(l, db, v, s, users.New(l, db, v, s, nil, nil, nil), nil, nil)
+	recorder := &recorderStub{}
+	r := chi.NewRouter()
+	r.Use(middleware.Audit(l, recorder))
+	r.Mount("/", federationRouter(api))
+
+	providerID := uuid.New()
+	cookie, authorization := startFederatedLogin(t, r, mock, providerID, idp)
+	idp.nonce = authorization.Get("nonce")
+	idp.claims = map[string]any{
+		"sub":            "idp-user-1",
+		"email":          "doctor@hospital.org",
+		"email_verified": true,
+		"name":           "Jan Kowalski",
+		"groups":         []string{"physicians"},
+	}
+
+	mock.ExpectQuery("^SELECT (.+) FROM \"identity_providers\" WHERE (.+)").
+		WithArgs("hospital", 1).
+		WillReturnRows(providerRows(providerID, idp.server.URL))
+	mock.ExpectBegin()
+	mock.ExpectQuery("^SELECT (.+) FROM \"external_identities\" WHERE (.+)").
+		WithArgs(providerID, "idp-user-1", 1).
+		WillReturnRows(&sqlmock.Rows{})
+	mock.ExpectQuery("^SELECT (.+) FROM \"users\" WHERE (.+)").
+		WithArgs("doctor@hospital.org", 1).
+		WillReturnRows(&sqlmock.Rows{})
+	// The account has no password.
+	mock.ExpectExec("^INSERT INTO \"users\"").
+		WithArgs(sqlmock.AnyArg(), "Jan Kowalski", "doctor@hospital.org", nullArg{}, "doctor", "active", sqlmock.AnyArg(), sqlmock.AnyArg(), nil).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("^INSERT INTO \"external_identities\"").
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), providerID, "idp-user-1", "doctor@hospital.org", sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+	mockNoTwoFactor(mock)
+	mockCreateSession(mock)
+
+	req := httptest.NewRequest("GET", "/api/v1/auth/providers/hospital/callback?code=idp-code&state="+url.QueryEscape(authorization.Get("state")), nil)
+	req.AddCookie(cookie)
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	testUtil.Equal(t, rr.Code, http.StatusFound)
+	testUtil.Equal(t, rr.Header().Get("Location"), "http://127.0.0.1:3000/dashboard")
+	testUtil.NoError(t, mock.ExpectationsWereMet())
+
+	// Only the callback is audited, as a login.
+	testUtil.Equal(t, len(recorder.events), 1)
+	testUtil.Equal(t, recorder.events[0].Action, "user.login")
+	testUtil.Equal(t, recorder.events[0].Outcome, audit.OutcomeSuccess)
+	testUtil.Equal(t, *recorder.events[0].Changes, `{"after":{"provider":"hospital"}}`)
+
+	req = httptest.NewRequest("GET", "/api/v1/users/current", nil)
+	req.AddCookie(rr.Result().Cookies()[0])
+	session, err := s.Get(req, "session")
+	testUtil.NoError(t, err)
+	testUtil.Equal(t, session.Values["email"], "doctor@hospital.org")
+	testUtil.Equal(t, session.Values["role"], "doctor")
+	testUtil.Equal(t, session.Values["fedState"], nil)
+}
+
+func TestFederatedLoginRequiresTwoFactor(t *testing.T) {
+	l := logger.New(false)
+	v := validatorUtil.New()
+	db, mock, err := mockDB.NewMockDB()
+	testUtil.NoError(t, err)
+
+	s := sessionstore.NewMemory(sessionstore.DefaultOptions, []byte("secret"))
+	idp := newMockIdP(t)
+	api := federation.New(l, db, v, s, users.New(l, db, v, s, nil, nil, nil), nil, nil)
+	r := federationRouter(api)
+
+	providerID := uuid.New()
+	userID := uuid.New()
+	cookie, authorization := startFederatedLogin(t, r, mock, providerID, idp)
+	idp.nonce = authorization.Get("nonce")
+	idp.claims = map[string]any{"sub": "idp-admin", "email": "admin@hospital.org", "email_verified": true}
+
+	mock.ExpectQuery("^SELECT (.+) FROM \"identity_providers\" WHERE (.+)").
+		WithArgs("hospital", 1).
+		WillReturnRows(providerRows(providerID, idp.server.URL))
+	mock.ExpectBegin()
+	mock.ExpectQuery("^SELECT (.+) FROM \"external_identities\" WHERE (.+)").
+		WithArgs(providerID, "idp-admin", 1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "provider_id", "subject"}).AddRow(uuid.New(), userID, providerID, "idp-admin"))
+	mock.ExpectQuery("^SELECT (.+) FROM \"users\" WHERE (.+)").
+		WithArgs(userID, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "email", "role", "status"}).AddRow(userID, "Anna", "admin@hospital.org", "admin", "active"))
+	mock.ExpectExec("^UPDATE \"external_identities\"").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	mock.ExpectQuery("^SELECT (.+) FROM \"totp_credentials\"").
+		WithArgs(userID, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "secret", "enabled_at"}).AddRow(userID, "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ", time.Now()))
+	mock.ExpectQuery("^SELECT (.+) FROM \"two_factor_policies\"").
+		WithArgs(users.Admin, 1).
+		WillReturnRows(&sqlmock.Rows{})
+
+	req := httptest.NewRequest("GET", "/api/v1/auth/providers/hospital/callback?code=idp-code&state="+url.QueryEscape(authorization.Get("state")), nil)
+	req.AddCookie(cookie)
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	testUtil.Equal(t, rr.Code, http.StatusFound)
+	testUtil.Equal(t, rr.Header().Get("Location"), "http://127.0.0.1:3000/?returnTo="+url.QueryEscape("http://127.0.0.1:3000/dashboard")+"&twoFactor=required")
+	// No session is started, the login waits for the code.
+	testUtil.NoError(t, mock.ExpectationsWereMet())
+
+	req = httptest.NewRequest("GET", "/api/v1/users/current", nil)
+	req.AddCookie(rr.Result().Cookies()[0])
+	session, err := s.Get(req, "session")
+	testUtil.NoError(t, err)
+	testUtil.Equal(t, session.Values["id"], nil)
+	testUtil.Equal(t, session.Values["pendingId"], any(userID.String()))
+}
+
+func TestFederatedLoginRequiresVerifiedEmail(t *testing.T) {
+	l := logger.New(false)
+	v := validatorUtil.New()
+	db, mock, err := mockDB.NewMockDB()
+	testUtil.NoError(t, err)
+
+	s := sessionstore.NewMemory(sessionstore.DefaultOptions, []byte("secret"))
+	idp := newMockIdP(t)
+	api := federation.New(l, db, v, s, users.New(l, db, v, s, nil, nil, nil), nil, nil)
+	recorder := &recorderStub{}
+	r := chi.NewRouter()
+	r.Use(middleware.Audit(l, recorder))
+	r.Mount("/", federationRouter(api))
+
+	providerID := uuid.New()
+	cookie, authorization := startFederatedLogin(t, r, mock, providerID, idp)
+	idp.nonce = authorization.Get("nonce")
+	idp.claims = map[string]any{"sub": "idp-user-1", "email": "admin@email.com", "email_verified": false}
+
+	mock.ExpectQuery("^SELECT (.+) FROM \"identity_providers\" WHERE (.+)").
+		WithArgs("hospital", 1).
+		WillReturnRows(providerRows(providerID, idp.server.URL))
+	mock.ExpectBegin()
+	mock.ExpectQuery("^SELECT (.+) FROM \"external_identities\" WHERE (.+)").
+		WillReturnRows(&sqlmock.Rows{})
+	mock.ExpectRollback()
+
+	req := httptest.NewRequest("GET", "/api/v1/auth/providers/hospital/callback?code=idp-code&state="+url.QueryEscape(authorization.Get("state")), nil)
+	req.AddCookie(cookie)
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	testUtil.Equal(t, rr.Code, http.StatusFound)
+	testUtil.Equal(t, rr.Header().Get("Location"), "http://127.0.0.1:3000/?error=email_not_verified")
+	testUtil.NoError(t, mock.ExpectationsWereMet())
+
+	// The failure is reported with a redirect but audited as a failure.
+	testUtil.Equal(t, len(recorder.events), 1)
+	testUtil.Equal(t, recorder.events[0].Action, "user.login")
+	testUtil.Equal(t, recorder.events[0].Outcome, audit.OutcomeFailure)
+}
+
+func TestFederatedLoginInvalidState(t *testing.T) {
+	l := logger.New(false)
+	v := validatorUtil.New()
+	db, mock, err := mockDB.NewMockDB()
+	testUtil.NoError(t, err)
+
+	s := sessionstore.NewMemory(sessionstore.DefaultOptions, []byte("secret"))
+	idp := newMockIdP(t)
+	api := federation.New(l, db, v, s, users.New(l, db, v, s, nil, nil, nil), nil, nil)
+	r := federationRouter(api)
+
+	providerID := uuid.New()
+	cookie, _ := startFederatedLogin(t, r, mock, providerID, idp)
+
+	mock.ExpectQuery("^SELECT (.+) FROM \"identity_providers\" WHERE (.+)").
+		WithArgs("hospital", 1).
+		WillReturnRows(providerRows(providerID, idp.server.URL))
+
+	req := httptest.NewRequest("GET", "/api/v1/auth/providers/hospital/callback?code=idp-code&state=forged", nil)
+	req.AddCookie(cookie)
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	testUtil.Equal(t, rr.Code, http.StatusFound)
+	testUtil.Equal(t, rr.Header().Get("Location"), "http://127.0.0.1:3000/?error=invalid_state")
+}
+
+func TestFederatedLoginRejectsForeignReturnURL(t *testing.T) {
+	config := federation.DefaultConfig
+	config.ReturnURLs = []string{"https://app.example.com", "https://portal.example.com/app/"}
+
+	testCases := []struct {
+		name     string
+		returnTo string
+	}{
+		{name: "other host", returnTo: "https://evil.example.com/"},
+		{name: "look-alike host", returnTo: "https://app.example.com.evil.io/"},
+		{name: "user info", returnTo: "https://app.example.com@evil.io/"},
+		{name: "other scheme", returnTo: "http://app.example.com/"},
+		{name: "relative", returnTo: "//evil.io/"},
+		{name: "path outside", returnTo: "https://portal.example.com/application"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			l := logger.New(false)
+			v := validatorUtil.New()
+			db, mock, err := mockDB.NewMockDB()
+			testUtil.NoError(t, err)
+
+			s := sessionstore.NewMemory(sessionstore.DefaultOptions, []byte("secret"))
+			api := federation.New(l, db, v, s, users.New(l, db, v, s, nil, nil, nil), nil, &config)
+
+			mock.ExpectQuery("^SELECT (.+) FROM \"identity_providers\" WHERE (.+)").
+				WithArgs("hospital", 1).
+				WillReturnRows(providerRows(uuid.New(), "https://idp.example.com"))
+
+			req := httptest.NewRequest("GET", "/api/v1/auth/providers/hospital/login?returnTo="+url.QueryEscape(tc.returnTo), nil)
+			rr := httptest.NewRecorder()
+			federationRouter(api).ServeHTTP(rr, req)
+			testUtil.Equal(t, rr.Code, http.StatusBadRequest)
+			testUtil.Equal(t, strings.TrimSpace(rr.Body.String()), "Return URL is not allowed!")
+		})
+	}
+}
+
+func TestVerifyIDTokenAudience(t *testing.T) {
+	idp := newMockIdP(t)
+	client := oidcclient.New(nil, time.Hour)
+	metadata, err := client.Discover(context.Background(), idp.server.URL)
+	testUtil.NoError(t, err)
+
+	idp.nonce = "n"
+	idp.claims = map[string]any{"sub": "idp-user-1"}
+	idToken := idp.idToken(t)
+
+	_, err = client.Verify(context.Background(), metadata, &oidcclient.Config{ClientID: "users-service"}, idToken, "n")
+	testUtil.NoError(t, err)
+
+	_, err = client.Verify(context.Background(), metadata, &oidcclient.Config{ClientID: "other-service"}, idToken, "n")
+	testUtil.Equal(t, err, oidcclient.ErrInvalidClaims)
+
+	_, err = client.Verify(context.Background(), metadata, &oidcclient.Config{ClientID: "users-service"}, idToken, "other")
+	testUtil.Equal(t, err, oidcclient.ErrInvalidClaims)
+}
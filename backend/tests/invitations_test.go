@@ -0,0 +1,147 @@
+package tests
+
+import (
+	"backend/api/resource/common/policy"
+	"backend/api/resource/invitations"
+	"backend/api/resource/users"
+	"backend/utils/logger"
+	"backend/utils/mailer"
+	mockDB "backend/utils/mock"
+	"backend/utils/sessionstore"
+	testUtil "backend/utils/test"
+	validatorUtil "backend/utils/validator"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/google/uuid"
+)
+
+func TestCreateInvitation(t *testing.T) {
+	l := logger.New(false)
+	v := validatorUtil.New()
+	db, mock, err := mockDB.NewMockDB()
+	testUtil.NoError(t, err)
+
+	mail := mailer.NewMemory()
+	config := &invitations.Config{URL: "https://healthhub/accept", TTL: time.Hour}
+	invitationsAPI := invitations.New(l, db, v, mailer.NewSender(mail, mailer.DefaultLocale), config)
+
+	adminID := uuid.New()
+	mock.ExpectQuery("^SELECT (.+) FROM \"users\" WHERE (.+)").
+		WithArgs("doctor@email.com", 1).
+		WillReturnRows(&sqlmock.Rows{})
+	mock.ExpectQuery("^SELECT (.+) FROM \"invitations\" WHERE (.+)").
+		WithArgs("doctor@email.com", 1).
+		WillReturnRows(&sqlmock.Rows{})
+	mock.ExpectBegin()
+	mock.ExpectExec("^INSERT INTO \"invitations\"").
+		WithArgs(sqlmock.AnyArg(), "doctor@email.com", "doctor", sqlmock.AnyArg(), &adminID, sqlmock.AnyArg(), nil, nil, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	body, _ := json.Marshal(&invitations.Form{Email: "doctor@email.com", Role: users.Doctor})
+	req, err := http.NewRequest("POST", "/api/v1/invitations", bytes.NewReader(body))
+	testUtil.NoError(t, err)
+	req = req.WithContext(policy.WithIdentity(req.Context(), &policy.Identity{ID: adminID.String(), Role: "admin"}))
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(invitationsAPI.Create).ServeHTTP(rr, req)
+	testUtil.Equal(t, rr.Code, http.StatusCreated)
+
+	response := &invitations.Response{}
+	testUtil.NoError(t, json.NewDecoder(rr.Body).Decode(response))
+	testUtil.Equal(t, response.Status, invitations.StatusPending)
+	testUtil.Equal(t, response.Role, "doctor")
+
+	sent := mail.Messages()
+	testUtil.Equal(t, len(sent), 1)
+	testUtil.Equal(t, sent[0].To, "doctor@email.com")
+	testUtil.Equal(t, strings.Contains(sent[0].Text, "https://healthhub/accept?token="), true)
+	testUtil.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestCreateInvitationAdminForbidden(t *testing.T) {
+	l := logger.New(false)
+	v := validatorUtil.New()
+	db, _, err := mockDB.NewMockDB()
+	testUtil.NoError(t, err)
+
+	invitationsAPI := invitations.New(l, db, v, nil, nil)
+
+	body, _ := json.Marshal(&invitations.Form{Email: "admin@email.com", Role: users.Admin})
+	req, err := http.NewRequest("POST", "/api/v1/invitations", bytes.NewReader(body))
+	testUtil.NoError(t, err)
+	req = req.WithContext(policy.WithIdentity(req.Context(), &policy.Identity{ID: uuid.New().String(), Role: "admin"}))
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(invitationsAPI.Create).ServeHTTP(rr, req)
+	testUtil.Equal(t, rr.Code, http.StatusForbidden)
+}
+
+func TestAcceptInvitation(t *testing.T) {
+	l := logger.New(false)
+	v := validatorUtil.New()
+	db, mock, err := mockDB.NewMockDB()
+	testUtil.NoError(t, err)
+
+	invitationsAPI := invitations.New(l, db, v, nil, nil)
+
+	token := "a1b2c3"
+	invitationID := uuid.New()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("^SELECT (.+) FROM \"invitations\" WHERE (.+) FOR UPDATE").
+		WithArgs(users.HashToken(token), sqlmock.AnyArg(), 1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "email", "role", "expires_at"}).
+			AddRow(invitationID, "doctor@email.com", "doctor", time.Now().Add(time.Hour)))
+	mock.ExpectQuery("^SELECT count\\(\\*\\) FROM \"users\"").
+		WithArgs("doctor@email.com").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+	mock.ExpectExec("^INSERT INTO \"users\"").
+		WithArgs(sqlmock.AnyArg(), "Jan Kowalski", "doctor@email.com", sqlmock.AnyArg(), "doctor", "active", sqlmock.AnyArg(), sqlmock.AnyArg(), nil).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("^UPDATE \"invitations\" SET \"accepted_at\"").
+		WithArgs(sqlmock.AnyArg(), invitationID).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	body, _ := json.Marshal(&invitations.AcceptForm{Token: token, Name: "Jan Kowalski", Password: "Password@123"})
+	req, err := http.NewRequest("POST", "/api/v1/invitations/accept", bytes.NewReader(body))
+	testUtil.NoError(t, err)
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(invitationsAPI.Accept).ServeHTTP(rr, req)
+	testUtil.Equal(t, rr.Code, http.StatusCreated)
+
+	response := &users.UserResponse{}
+	testUtil.NoError(t, json.NewDecoder(rr.Body).Decode(response))
+	testUtil.Equal(t, response.Role, "doctor")
+	testUtil.Equal(t, response.EmailVerified, true)
+	testUtil.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestAddDoctorRequiresInvitation(t *testing.T) {
+	l := logger.New(false)
+	v := validatorUtil.New()
+	db, _, err := mockDB.NewMockDB()
+	testUtil.NoError(t, err)
+
+	s := sessionstore.NewMemory(sessionstore.DefaultOptions, []byte("secret"))
+
+	usersAPI := users.New(l, db, v, s, nil, nil, nil)
+
+	body, _ := json.Marshal(&users.Form{Name: "name", Email: "doctor@email.com", Password: "Password@123", Role: users.Doctor})
+	req, err := http.NewRequest("POST", "/api/v1/users", bytes.NewReader(body))
+	testUtil.NoError(t, err)
+	req = req.WithContext(policy.WithIdentity(req.Context(), &policy.Identity{ID: uuid.New().String(), Role: "admin"}))
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(usersAPI.Create).ServeHTTP(rr, req)
+	testUtil.Equal(t, rr.Code, http.StatusForbidden)
+}
@@ -0,0 +1,104 @@
+package tests
+
+import (
+	"backend/utils/logger"
+	"backend/utils/mailer"
+	testUtil "backend/utils/test"
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type flakyMailer struct {
+	mu       sync.Mutex
+	failures int
+	attempts int
+	sent     []*mailer.Message
+}
+
+func (m *flakyMailer) Send(_ context.Context, msg *mailer.Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.attempts++
+	if m.attempts <= m.failures {
+		return errors.New("connection refused")
+	}
+	m.sent = append(m.sent, msg)
+	return nil
+}
+
+func TestRenderTemplate(t *testing.T) {
+	data := map[string]any{"Name": "Jan <b>", "Link": "https://healthhub/verify?token=a&b", "Hours": 48}
+
+	msg, err := mailer.Render("verification", "pl", data)
+	testUtil.NoError(t, err)
+	testUtil.Equal(t, msg.Subject, "Potwierdź swój adres e-mail")
+	testUtil.Equal(t, strings.HasPrefix(msg.Text, "Dzień dobry Jan <b>,"), true)
+	testUtil.Equal(t, strings.Contains(msg.HTML, "Jan &lt;b&gt;"), true)
+	testUtil.Equal(t, strings.Contains(msg.HTML, `href="https://healthhub/verify?token=a&amp;b"`), true)
+
+	msg, err = mailer.Render("verification", "de", data)
+	testUtil.NoError(t, err)
+	testUtil.Equal(t, msg.Subject, "Verify your email address")
+
+	_, err = mailer.Render("unknown", "en", data)
+	testUtil.Equal(t, err != nil, true)
+}
+
+func TestSenderLocale(t *testing.T) {
+	s := mailer.NewSender(mailer.NewMemory(), "en")
+
+	testUtil.Equal(t, s.Locale("verification", "pl-PL,pl;q=0.9,en;q=0.8"), "pl")
+	testUtil.Equal(t, s.Locale("verification", "de-DE, en-GB;q=0.5"), "en")
+	testUtil.Equal(t, s.Locale("verification", ""), "en")
+}
+
+func TestQueueRetries(t *testing.T) {
+	l := logger.New(false)
+	next := &flakyMailer{failures: 2}
+
+	q := mailer.NewQueue(next, l, 10, 1, 3, time.Millisecond)
+	testUtil.NoError(t, q.Send(context.Background(), &mailer.Message{To: "email@email.com", Subject: "Subject", Text: "Text"}))
+	q.Close()
+
+	testUtil.Equal(t, next.attempts, 3)
+	testUtil.Equal(t, len(next.sent), 1)
+}
+
+func TestQueueGivesUp(t *testing.T) {
+	l := logger.New(false)
+	next := &flakyMailer{failures: 10}
+
+	q := mailer.NewQueue(next, l, 10, 1, 2, time.Millisecond)
+	testUtil.NoError(t, q.Send(context.Background(), &mailer.Message{To: "email@email.com", Subject: "Subject", Text: "Text"}))
+	q.Close()
+
+	testUtil.Equal(t, next.attempts, 3)
+	testUtil.Equal(t, len(next.sent), 0)
+}
+
+func TestFileMailer(t *testing.T) {
+	dir := t.TempDir()
+	m, err := mailer.NewFile(dir, "HealthHub <no-reply@healthhub.local>")
+	testUtil.NoError(t, err)
+
+	msg := &mailer.Message{To: "email@email.com", Subject: "Zażółć", Text: "Text", HTML: "<p>HTML</p>"}
+	testUtil.NoError(t, m.Send(context.Background(), msg))
+
+	entries, err := os.ReadDir(dir)
+	testUtil.NoError(t, err)
+	testUtil.Equal(t, len(entries), 1)
+
+	data, err := os.ReadFile(dir + "/" + entries[0].Name())
+	testUtil.NoError(t, err)
+	content := string(data)
+	testUtil.Equal(t, strings.Contains(content, "To: email@email.com\r\n"), true)
+	testUtil.Equal(t, strings.Contains(content, "Subject: =?utf-8?q?Za=C5=BC=C3=B3=C5=82=C4=87?=\r\n"), true)
+	testUtil.Equal(t, strings.Contains(content, "multipart/alternative"), true)
+	testUtil.Equal(t, strings.Contains(content, "@healthhub.local>"), true)
+}
@@ -0,0 +1,177 @@
+package tests
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/go-chi/chi"
+	"github.com/google/uuid"
+
+	"backend/api/resource/apikeys"
+	"backend/api/resource/common/policy"
+	"backend/api/resource/users"
+	"backend/api/router/middleware"
+	mockDB "backend/utils/mock"
+	"backend/utils/sessionstore"
+	testUtil "backend/utils/test"
+	"backend/utils/token"
+)
+
+type careTeamStub map[uuid.UUID]uuid.UUID
+
+func (c careTeamStub) IsPatientOf(patientID, doctorID uuid.UUID) (bool, error) {
+	return c[patientID] == doctorID, nil
+}
+
+func TestAPIKeyScopes(t *testing.T) {
+	testCases := []struct {
+		name       string
+		scopes     string
+		revoked    bool
+		permission policy.Permission
+		expected   int
+	}{
+		{name: "exact scope", scopes: "users:read", permission: policy.UsersRead, expected: http.StatusOK},
+		{name: "implied scope", scopes: "users:admin", permission: policy.UsersUpdate, expected: http.StatusOK},
+		{name: "missing scope", scopes: "users:read", permission: policy.UsersDelete, expected: http.StatusForbidden},
+		{name: "revoked key", scopes: "users:admin", revoked: true, permission: policy.UsersRead, expected: http.StatusUnauthorized},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			db, mock, err := mockDB.NewMockDB()
+			testUtil.NoError(t, err)
+
+			s := sessionstore.NewMemory(sessionstore.DefaultOptions, []byte("secret"))
+
+			var revokedAt any
+			if tc.revoked {
+				revokedAt = time.Now()
+			}
+			key := "hh_key"
+			mock.ExpectQuery("^SELECT (.+) FROM \"api_keys\" WHERE (.+)").
+				WithArgs(apikeys.HashKey(key), 1).
+				WillReturnRows(sqlmock.NewRows([]string{"id", "name", "scopes", "revoked_at", "last_used_at"}).
+					AddRow(uuid.New(), "client", tc.scopes, revokedAt, time.Now()))
+
+			p := policy.New(careTeamStub{})
+			handler := middleware.Authenticate(s, nil, apikeys.NewRepository(db), users.NewRepository(db))(
+				middleware.LoggedOnly(p.Require(tc.permission)(http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {}))),
+			)
+
+			req, err := http.NewRequest("GET", "/api/v1/users/current", nil)
+			testUtil.NoError(t, err)
+			req.Header.Set("Authorization", "Bearer "+key)
+
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			testUtil.Equal(t, rr.Code, tc.expected)
+		})
+	}
+}
+
+func TestAccessTokenOfInactiveAccount(t *testing.T) {
+	testCases := []struct {
+		name     string
+		status   string
+		expected int
+	}{
+		{name: "active", status: "active", expected: http.StatusOK},
+		{name: "suspended", status: "suspended", expected: http.StatusUnauthorized},
+		{name: "deactivated", status: "deactivated", expected: http.StatusUnauthorized},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			db, mock, err := mockDB.NewMockDB()
+			testUtil.NoError(t, err)
+
+			s := sessionstore.NewMemory(sessionstore.DefaultOptions, []byte("secret"))
+
+			tokens := token.NewHS256([]byte("secret"), "users-service", time.Minute, time.Hour)
+			id := uuid.New()
+			pair, err := tokens.Issue(id.String(), "email@email.com", "patient", "")
+			testUtil.NoError(t, err)
+
+			mock.ExpectQuery("^SELECT \"status\" FROM \"users\" WHERE (.+)").
+				WithArgs(id, 1).
+				WillReturnRows(sqlmock.NewRows([]string{"status"}).AddRow(tc.status))
+
+			handler := middleware.Authenticate(s, tokens, apikeys.NewRepository(db), users.NewRepository(db))(
+				middleware.LoggedOnly(http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {})),
+			)
+
+			req, err := http.NewRequest("GET", "/api/v1/users/current", nil)
+			testUtil.NoError(t, err)
+			req.Header.Set("Authorization", "Bearer "+pair.AccessToken)
+
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			testUtil.Equal(t, rr.Code, tc.expected)
+			testUtil.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	patient := uuid.New()
+	otherPatient := uuid.New()
+	doctor := uuid.New()
+	p := policy.New(careTeamStub{patient: doctor})
+
+	testCases := []struct {
+		name       string
+		identity   *policy.Identity
+		permission policy.Permission
+		target     uuid.UUID
+		expected   int
+	}{
+		{name: "patient reads self", identity: &policy.Identity{ID: patient.String(), Role: "patient"}, permission: policy.UsersRead, target: patient, expected: http.StatusOK},
+		{name: "patient reads other", identity: &policy.Identity{ID: patient.String(), Role: "patient"}, permission: policy.UsersRead, target: otherPatient, expected: http.StatusForbidden},
+		{name: "patient updates other", identity: &policy.Identity{ID: patient.String(), Role: "patient"}, permission: policy.UsersUpdate, target: otherPatient, expected: http.StatusForbidden},
+		{name: "doctor reads own patient", identity: &policy.Identity{ID: doctor.String(), Role: "doctor"}, permission: policy.UsersRead, target: patient, expected: http.StatusOK},
+		{name: "doctor reads other patient", identity: &policy.Identity{ID: doctor.String(), Role: "doctor"}, permission: policy.UsersRead, target: otherPatient, expected: http.StatusForbidden},
+		{name: "doctor updates patient", identity: &policy.Identity{ID: doctor.String(), Role: "doctor"}, permission: policy.UsersUpdate, target: patient, expected: http.StatusForbidden},
+		{name: "admin deletes anyone", identity: &policy.Identity{ID: uuid.NewString(), Role: "admin"}, permission: policy.UsersDelete, target: patient, expected: http.StatusOK},
+		{name: "doctor deletes", identity: &policy.Identity{ID: doctor.String(), Role: "doctor"}, permission: policy.UsersDelete, target: doctor, expected: http.StatusForbidden},
+		{name: "patient updates own profile", identity: &policy.Identity{ID: patient.String(), Role: "patient"}, permission: policy.ProfileUpdate, target: patient, expected: http.StatusOK},
+		{name: "patient reads other profile", identity: &policy.Identity{ID: patient.String(), Role: "patient"}, permission: policy.ProfileRead, target: otherPatient, expected: http.StatusForbidden},
+		{name: "doctor updates own patient profile", identity: &policy.Identity{ID: doctor.String(), Role: "doctor"}, permission: policy.ProfileUpdate, target: patient, expected: http.StatusOK},
+		{name: "doctor reads other patient profile", identity: &policy.Identity{ID: doctor.String(), Role: "doctor"}, permission: policy.ProfileRead, target: otherPatient, expected: http.StatusForbidden},
+		{name: "doctor manages own doctor profile", identity: &policy.Identity{ID: doctor.String(), Role: "doctor"}, permission: policy.DoctorsManage, target: doctor, expected: http.StatusForbidden},
+		{name: "doctor manages own schedule", identity: &policy.Identity{ID: doctor.String(), Role: "doctor"}, permission: policy.ScheduleManage, target: doctor, expected: http.StatusOK},
+		{name: "patient manages schedule", identity: &policy.Identity{ID: patient.String(), Role: "patient"}, permission: policy.ScheduleManage, target: doctor, expected: http.StatusForbidden},
+		{name: "patient manages own care team", identity: &policy.Identity{ID: patient.String(), Role: "patient"}, permission: policy.CareTeamManage, target: patient, expected: http.StatusOK},
+		{name: "doctor manages care team", identity: &policy.Identity{ID: doctor.String(), Role: "doctor"}, permission: policy.CareTeamManage, target: patient, expected: http.StatusForbidden},
+		{name: "doctor lists own patients", identity: &policy.Identity{ID: doctor.String(), Role: "doctor"}, permission: policy.PatientsList, target: doctor, expected: http.StatusOK},
+		{name: "admin reads audit log", identity: &policy.Identity{ID: uuid.NewString(), Role: "admin"}, permission: policy.AuditRead, target: doctor, expected: http.StatusOK},
+		{name: "admin introspects", identity: &policy.Identity{ID: uuid.NewString(), Role: "admin"}, permission: policy.AuthIntrospect, target: patient, expected: http.StatusOK},
+		{name: "patient introspects", identity: &policy.Identity{ID: patient.String(), Role: "patient"}, permission: policy.AuthIntrospect, target: patient, expected: http.StatusForbidden},
+		{name: "doctor introspects", identity: &policy.Identity{ID: doctor.String(), Role: "doctor"}, permission: policy.AuthIntrospect, target: doctor, expected: http.StatusForbidden},
+		{name: "doctor reads audit log", identity: &policy.Identity{ID: doctor.String(), Role: "doctor"}, permission: policy.AuditRead, target: doctor, expected: http.StatusForbidden},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			handler := p.Require(tc.permission)(http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {}))
+
+			req, err := http.NewRequest("GET", "/api/v1/users/{id}", nil)
+			testUtil.NoError(t, err)
+			rctx := chi.NewRouteContext()
+			rctx.URLParams.Add("id", tc.target.String())
+			ctx := context.WithValue(req.Context(), chi.RouteCtxKey, rctx)
+			req = req.WithContext(policy.WithIdentity(ctx, tc.identity))
+
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			testUtil.Equal(t, rr.Code, tc.expected)
+			if tc.expected == http.StatusForbidden {
+				testUtil.Equal(t, rr.Body.String(), `{"error": "forbidden"}`)
+			}
+		})
+	}
+}
@@ -0,0 +1,399 @@
+package tests
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/google/uuid"
+
+	"backend/api/resource/auth"
+	"backend/api/resource/oidc"
+	"backend/api/resource/users"
+	"backend/api/router/middleware"
+	"backend/utils/logger"
+	mockDB "backend/utils/mock"
+	"backend/utils/sessionstore"
+	testUtil "backend/utils/test"
+	"backend/utils/token"
+	validatorUtil "backend/utils/validator"
+)
+
+const (
+	oidcRedirectURI = "https://app.example.com/callback"
+	oidcVerifier    = "dBjftJeZ4CVP-mJ92K8rYCJ9Nq7zVXmUNZ9k4TxVZLhW"
+)
+
+// oidcTokens returns a manager signing with an RS256 key, which the provider
+// requires.
+func oidcTokens(t *testing.T) *token.Manager {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	testUtil.NoError(t, err)
+	return token.NewRS256(privateKey, "users-service", time.Minute, time.Hour)
+}
+
+// verifyWithJWKS checks the signature of a token with the key of the JWKS
+// served by the service that its kid names.
+func verifyWithJWKS(t *testing.T, tokens *token.Manager, raw string) {
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(auth.New(logger.New(false), nil, tokens).JWKS).ServeHTTP(rr, httptest.NewRequest("GET", "/.well-known/jwks.json", nil))
+	testUtil.Equal(t, rr.Code, http.StatusOK)
+	var jwks token.JWKS
+	testUtil.NoError(t, json.NewDecoder(rr.Body).Decode(&jwks))
+
+	parts := strings.Split(raw, ".")
+	testUtil.Equal(t, len(parts), 3)
+	var header struct {
+		Algorithm string `json:"alg"`
+		KeyID     string `json:"kid"`
+	}
+	b, err := base64.RawURLEncoding.DecodeString(parts[0])
+	testUtil.NoError(t, err)
+	testUtil.NoError(t, json.Unmarshal(b, &header))
+	testUtil.Equal(t, header.Algorithm, token.RS256)
+
+	for _, key := range jwks.Keys {
+		if key.KeyID != header.KeyID {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(key.N)
+		testUtil.NoError(t, err)
+		e, err := base64.RawURLEncoding.DecodeString(key.E)
+		testUtil.NoError(t, err)
+		public := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+
+		signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+		testUtil.NoError(t, err)
+		digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+		testUtil.NoError(t, rsa.VerifyPKCS1v15(public, crypto.SHA256, digest[:], signature))
+		return
+	}
+	t.Fatalf("no key %q in the JWKS", header.KeyID)
+}
+
+func oidcChallenge() string {
+	sum := sha256.Sum256([]byte(oidcVerifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func clientRows(id uuid.UUID, secretHash []byte) *sqlmock.Rows {
+	return sqlmock.NewRows([]string{"id", "name", "secret_hash", "redirect_uris", "created_at"}).
+		AddRow(id, "app", secretHash, oidcRedirectURI, time.Now())
+}
+
+// loginCookie returns the cookie of a logged in session.
+func loginCookie(t *testing.T, store sessionstore.Store, userID, sid uuid.UUID) *http.Cookie {
+	req := httptest.NewRequest("POST", "/api/v1/users/login", nil)
+	rr := httptest.NewRecorder()
+
+	session, err := store.Get(req, "session")
+	testUtil.NoError(t, err)
+	session.Values["sid"] = sid.String()
+	session.Values["id"] = userID.String()
+	testUtil.NoError(t, session.Save(req, rr))
+
+	return rr.Result().Cookies()[0]
+}
+
+func authorizeURL(clientID uuid.UUID, redirectURI string) string {
+	q := url.Values{
+		"client_id":             {clientID.String()},
+		"redirect_uri":          {redirectURI},
+		"response_type":         {"code"},
+		"scope":                 {"openid email"},
+		"state":                 {"xyz"},
+		"nonce":                 {"n-0S6"},
+		"code_challenge":        {oidcChallenge()},
+		"code_challenge_method": {"S256"},
+	}
+	return "/oauth/authorize?" + q.Encode()
+}
+
+func TestVerifyPKCE(t *testing.T) {
+	testUtil.Equal(t, oidc.VerifyPKCE(oidcVerifier, oidcChallenge()), true)
+	testUtil.Equal(t, oidc.VerifyPKCE(oidcVerifier+"x", oidcChallenge()), false)
+	testUtil.Equal(t, oidc.VerifyPKCE("short", oidcChallenge()), false)
+}
+
+func TestParseScope(t *testing.T) {
+	scope, ok := oidc.ParseScope("openid offline_access email openid")
+	testUtil.Equal(t, scope, "openid email")
+	testUtil.Equal(t, ok, true)
+
+	_, ok = oidc.ParseScope("profile email")
+	testUtil.Equal(t, ok, false)
+}
+
+func TestDiscovery(t *testing.T) {
+	l := logger.New(false)
+	db, _, err := mockDB.NewMockDB()
+	testUtil.NoError(t, err)
+
+	tokens := oidcTokens(t)
+	s := sessionstore.NewMemory(sessionstore.DefaultOptions, []byte("secret"))
+	oidcAPI := oidc.New(l, db, validatorUtil.New(), s, tokens, &oidc.Config{Enabled: true, Issuer: "https://id.example.com/"})
+
+	req := httptest.NewRequest("GET", "/.well-known/openid-configuration", nil)
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(oidcAPI.Discovery).ServeHTTP(rr, req)
+	testUtil.Equal(t, rr.Code, http.StatusOK)
+
+	var discovery oidc.Discovery
+	testUtil.NoError(t, json.NewDecoder(rr.Body).Decode(&discovery))
+	testUtil.Equal(t, discovery.Issuer, "https://id.example.com")
+	testUtil.Equal(t, discovery.TokenEndpoint, "https://id.example.com/oauth/token")
+	testUtil.Equal(t, discovery.IDTokenSigningAlgValuesSupported[0], token.RS256)
+}
+
+func TestDiscoveryDisabled(t *testing.T) {
+	l := logger.New(false)
+	db, _, err := mockDB.NewMockDB()
+	testUtil.NoError(t, err)
+
+	s := sessionstore.NewMemory(sessionstore.DefaultOptions, []byte("secret"))
+	oidcAPI := oidc.New(l, db, validatorUtil.New(), s, oidcTokens(t), &oidc.Config{Issuer: "https://id.example.com/"})
+
+	req := httptest.NewRequest("GET", "/.well-known/openid-configuration", nil)
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(oidcAPI.Discovery).ServeHTTP(rr, req)
+	testUtil.Equal(t, rr.Code, http.StatusNotFound)
+}
+
+func TestAuthorizeUnregisteredRedirect(t *testing.T) {
+	l := logger.New(false)
+	db, mock, err := mockDB.NewMockDB()
+	testUtil.NoError(t, err)
+
+	tokens := oidcTokens(t)
+	s := sessionstore.NewMemory(sessionstore.DefaultOptions, []byte("secret"))
+	oidcAPI := oidc.New(l, db, validatorUtil.New(), s, tokens, nil)
+
+	clientID := uuid.New()
+	mock.ExpectQuery("^SELECT (.+) FROM \"clients\" WHERE (.+)").
+		WithArgs(clientID, 1).
+		WillReturnRows(clientRows(clientID, nil))
+
+	req := httptest.NewRequest("GET", authorizeURL(clientID, "https://evil.example.com/callback"), nil)
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(oidcAPI.Authorize).ServeHTTP(rr, req)
+	testUtil.Equal(t, rr.Code, http.StatusBadRequest)
+	testUtil.Equal(t, rr.Header().Get("Location"), "")
+}
+
+func TestAuthorizeWithoutSession(t *testing.T) {
+	l := logger.New(false)
+	db, mock, err := mockDB.NewMockDB()
+	testUtil.NoError(t, err)
+
+	tokens := oidcTokens(t)
+	s := sessionstore.NewMemory(sessionstore.DefaultOptions, []byte("secret"))
+	oidcAPI := oidc.New(l, db, validatorUtil.New(), s, tokens, nil)
+
+	clientID := uuid.New()
+	mock.ExpectQuery("^SELECT (.+) FROM \"clients\" WHERE (.+)").
+		WithArgs(clientID, 1).
+		WillReturnRows(clientRows(clientID, nil))
+
+	req := httptest.NewRequest("GET", authorizeURL(clientID, oidcRedirectURI), nil)
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(oidcAPI.Authorize).ServeHTTP(rr, req)
+	testUtil.Equal(t, rr.Code, http.StatusFound)
+
+	location, err := url.Parse(rr.Header().Get("Location"))
+	testUtil.NoError(t, err)
+	testUtil.Equal(t, location.Host, "127.0.0.1:3000")
+	testUtil.Equal(t, strings.HasPrefix(location.Query().Get("returnTo"), "http://127.0.0.1:8080/oauth/authorize?"), true)
+}
+
+func TestAuthorizeIssuesCode(t *testing.T) {
+	l := logger.New(false)
+	db, mock, err := mockDB.NewMockDB()
+	testUtil.NoError(t, err)
+
+	tokens := oidcTokens(t)
+	s := sessionstore.NewMemory(sessionstore.DefaultOptions, []byte("secret"))
+	oidcAPI := oidc.New(l, db, validatorUtil.New(), s, tokens, nil)
+
+	clientID := uuid.New()
+	userID := uuid.New()
+	sid := uuid.New()
+	mock.ExpectQuery("^SELECT (.+) FROM \"clients\" WHERE (.+)").
+		WithArgs(clientID, 1).
+		WillReturnRows(clientRows(clientID, nil))
+	mock.ExpectQuery("^SELECT (.+) FROM \"user_sessions\" WHERE (.+)").
+		WithArgs(sid, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "created_at"}).AddRow(sid, userID, time.Now()))
+	mock.ExpectQuery("^SELECT \"status\" FROM \"users\" WHERE (.+)").
+		WithArgs(userID, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"status"}).AddRow("active"))
+	mock.ExpectBegin()
+	mock.ExpectExec("^INSERT INTO \"authorization_codes\"").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+	mock.ExpectBegin()
+	mock.ExpectExec("^DELETE FROM \"authorization_codes\"").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
+
+	req := httptest.NewRequest("GET", authorizeURL(clientID, oidcRedirectURI), nil)
+	req.AddCookie(loginCookie(t, s, userID, sid))
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(oidcAPI.Authorize).ServeHTTP(rr, req)
+	testUtil.Equal(t, rr.Code, http.StatusFound)
+
+	location, err := url.Parse(rr.Header().Get("Location"))
+	testUtil.NoError(t, err)
+	testUtil.Equal(t, location.Host, "app.example.com")
+	testUtil.Equal(t, location.Query().Get("state"), "xyz")
+	testUtil.Equal(t, len(location.Query().Get("code")), 64)
+	testUtil.NoError(t, mock.ExpectationsWereMet())
+}
+
+func mockRedeemCode(mock sqlmock.Sqlmock, clientID, userID, sid uuid.UUID) {
+	mock.ExpectBegin()
+	mock.ExpectQuery("^SELECT (.+) FROM \"authorization_codes\" WHERE (.+) FOR UPDATE").
+		WillReturnRows(sqlmock.NewRows([]string{"code_hash", "client_id", "user_id", "session_id", "redirect_uri", "scope", "nonce", "code_challenge", "auth_time"}).
+			AddRow(users.HashToken("code"), clientID, userID, sid, oidcRedirectURI, "openid email", "n-0S6", oidcChallenge(), time.Now()))
+	mock.ExpectExec("^UPDATE \"authorization_codes\" SET \"used_at\"").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+}
+
+func TestTokenExchange(t *testing.T) {
+	l := logger.New(false)
+	db, mock, err := mockDB.NewMockDB()
+	testUtil.NoError(t, err)
+
+	tokens := oidcTokens(t)
+	s := sessionstore.NewMemory(sessionstore.DefaultOptions, []byte("secret"))
+	oidcAPI := oidc.New(l, db, validatorUtil.New(), s, tokens, nil)
+
+	clientID := uuid.New()
+	userID := uuid.New()
+	sid := uuid.New()
+	mock.ExpectQuery("^SELECT (.+) FROM \"clients\" WHERE (.+)").
+		WithArgs(clientID, 1).
+		WillReturnRows(clientRows(clientID, oidc.HashSecret("hhs_secret")))
+	mockRedeemCode(mock, clientID, userID, sid)
+	mock.ExpectQuery("^SELECT (.+) FROM \"users\" WHERE (.+)").
+		WithArgs(userID, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "email", "role", "status"}).AddRow(userID, "user1", "email@email.com", "patient", "active"))
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {"code"},
+		"redirect_uri":  {oidcRedirectURI},
+		"code_verifier": {oidcVerifier},
+	}
+	req := httptest.NewRequest("POST", "/oauth/token", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(clientID.String(), "hhs_secret")
+	rr := httptest.NewRecorder()
+	recorder := &recorderStub{}
+	middleware.Audit(l, recorder)(http.HandlerFunc(oidcAPI.Token)).ServeHTTP(rr, req)
+	testUtil.Equal(t, rr.Code, http.StatusOK)
+	testUtil.Equal(t, rr.Header().Get("Cache-Control"), "no-store")
+	testUtil.Equal(t, len(recorder.events), 1)
+	testUtil.Equal(t, recorder.events[0].Action, "oauth.token")
+	testUtil.Equal(t, recorder.events[0].TargetID, userID.String())
+	testUtil.Equal(t, *recorder.events[0].Changes, `{"after":{"clientId":"`+clientID.String()+`"}}`)
+
+	var response oidc.TokenResponse
+	testUtil.NoError(t, json.NewDecoder(rr.Body).Decode(&response))
+	testUtil.Equal(t, response.Scope, "openid email")
+
+	payload, err := base64.RawURLEncoding.DecodeString(strings.Split(response.IDToken, ".")[1])
+	testUtil.NoError(t, err)
+	var claims token.IDClaims
+	testUtil.NoError(t, json.Unmarshal(payload, &claims))
+	testUtil.Equal(t, claims.Audience, clientID.String())
+	testUtil.Equal(t, claims.Nonce, "n-0S6")
+	testUtil.Equal(t, claims.Email, "email@email.com")
+	testUtil.Equal(t, claims.Name, "")
+	verifyWithJWKS(t, tokens, response.IDToken)
+
+	// The access token is accepted by the userinfo endpoint only.
+	_, err = tokens.Parse(response.AccessToken, token.TypeAccess)
+	testUtil.Equal(t, err, token.ErrInvalidClaims)
+
+	mock.ExpectQuery("^SELECT (.+) FROM \"users\" WHERE (.+)").
+		WithArgs(userID, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "email", "role", "status"}).AddRow(userID, "user1", "email@email.com", "patient", "active"))
+	mock.ExpectQuery("^SELECT (.+) FROM \"user_sessions\" WHERE (.+)").
+		WithArgs(sid, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "user_id"}).AddRow(sid, userID))
+
+	req = httptest.NewRequest("GET", "/userinfo", nil)
+	req.Header.Set("Authorization", "Bearer "+response.AccessToken)
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(oidcAPI.UserInfo).ServeHTTP(rr, req)
+	testUtil.Equal(t, rr.Code, http.StatusOK)
+
+	var info oidc.UserInfo
+	testUtil.NoError(t, json.NewDecoder(rr.Body).Decode(&info))
+	testUtil.Equal(t, info.Subject, userID.String())
+	testUtil.Equal(t, info.Email, "email@email.com")
+	testUtil.Equal(t, *info.EmailVerified, false)
+	testUtil.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestTokenExchangeWrongVerifier(t *testing.T) {
+	l := logger.New(false)
+	db, mock, err := mockDB.NewMockDB()
+	testUtil.NoError(t, err)
+
+	tokens := oidcTokens(t)
+	s := sessionstore.NewMemory(sessionstore.DefaultOptions, []byte("secret"))
+	oidcAPI := oidc.New(l, db, validatorUtil.New(), s, tokens, nil)
+
+	clientID := uuid.New()
+	mock.ExpectQuery("^SELECT (.+) FROM \"clients\" WHERE (.+)").
+		WithArgs(clientID, 1).
+		WillReturnRows(clientRows(clientID, nil))
+	mockRedeemCode(mock, clientID, uuid.New(), uuid.New())
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"client_id":     {clientID.String()},
+		"code":          {"code"},
+		"redirect_uri":  {oidcRedirectURI},
+		"code_verifier": {strings.Repeat("a", 43)},
+	}
+	req := httptest.NewRequest("POST", "/oauth/token", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(oidcAPI.Token).ServeHTTP(rr, req)
+	testUtil.Equal(t, rr.Code, http.StatusBadRequest)
+
+	var response oidc.ErrorResponse
+	testUtil.NoError(t, json.NewDecoder(rr.Body).Decode(&response))
+	testUtil.Equal(t, response.Error, "invalid_grant")
+}
+
+func TestUserInfoRejectsAPIToken(t *testing.T) {
+	l := logger.New(false)
+	db, _, err := mockDB.NewMockDB()
+	testUtil.NoError(t, err)
+
+	tokens := oidcTokens(t)
+	s := sessionstore.NewMemory(sessionstore.DefaultOptions, []byte("secret"))
+	oidcAPI := oidc.New(l, db, validatorUtil.New(), s, tokens, nil)
+
+	pair, err := tokens.Issue(uuid.NewString(), "email@email.com", "patient", uuid.NewString())
+	testUtil.NoError(t, err)
+
+	req := httptest.NewRequest("GET", "/userinfo", nil)
+	req.Header.Set("Authorization", "Bearer "+pair.AccessToken)
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(oidcAPI.UserInfo).ServeHTTP(rr, req)
+	testUtil.Equal(t, rr.Code, http.StatusUnauthorized)
+	testUtil.Equal(t, rr.Header().Get("WWW-Authenticate"), `Bearer error="invalid_token"`)
+}
@@ -0,0 +1,259 @@
+package tests
+
+import (
+	"context"
+	"database/sql/driver"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/go-chi/chi"
+	"github.com/google/uuid"
+
+	"backend/api/resource/common/policy"
+	"backend/api/resource/users"
+	"backend/utils/logger"
+	mockDB "backend/utils/mock"
+	"backend/utils/sessionstore"
+	testUtil "backend/utils/test"
+	validatorUtil "backend/utils/validator"
+)
+
+func patchRequest(t *testing.T, id uuid.UUID, contentType, body string, identity *policy.Identity) *http.Request {
+	req, err := http.NewRequest("PATCH", "/api/v1/users/{id}", strings.NewReader(body))
+	testUtil.NoError(t, err)
+	req.Header.Set("Content-Type", contentType)
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Add("id", id.String())
+	ctx := policy.WithIdentity(context.WithValue(req.Context(), chi.RouteCtxKey, rctx), identity)
+	return req.WithContext(ctx)
+}
+
+func mockPatchedUser(mock sqlmock.Sqlmock, id uuid.UUID, name, email, role, status string, version int) {
+	mock.ExpectQuery("^SELECT (.+) FROM \"users\" WHERE (.+)").
+		WithArgs(id, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "email", "role", "status", "version"}).
+			AddRow(id, name, email, role, status, version))
+}
+
+func TestPatchUser(t *testing.T) {
+	id := uuid.New()
+	owner := &policy.Identity{ID: id.String(), Role: "patient"}
+
+	testCases := []struct {
+		name        string
+		contentType string
+		body        string
+		update      string
+		args        []driver.Value
+		patched     []string
+	}{
+		{
+			name:        "merge patch",
+			contentType: "application/merge-patch+json",
+			body:        `{"name": "Anna Nowak"}`,
+			update:      "^UPDATE \"users\" SET \"name\"=\\$1 WHERE id = \\$2",
+			args:        []driver.Value{"Anna Nowak", id},
+			patched:     []string{"Anna Nowak", "anna@email.com", "active"},
+		},
+		{
+			name:        "json patch",
+			contentType: "application/json-patch+json",
+			body:        `[{"op": "test", "path": "/name", "value": "Anna"}, {"op": "replace", "path": "/name", "value": "Anna Nowak"}]`,
+			update:      "^UPDATE \"users\" SET \"name\"=\\$1 WHERE id = \\$2",
+			args:        []driver.Value{"Anna Nowak", id},
+			patched:     []string{"Anna Nowak", "anna@email.com", "active"},
+		},
+		{
+			name:        "json patch testing its own change",
+			contentType: "application/json-patch+json",
+			body:        `[{"op": "replace", "path": "/name", "value": "Anna Nowak"}, {"op": "test", "path": "/name", "value": "Anna Nowak"}]`,
+			update:      "^UPDATE \"users\" SET \"name\"=\\$1 WHERE id = \\$2",
+			args:        []driver.Value{"Anna Nowak", id},
+			patched:     []string{"Anna Nowak", "anna@email.com", "active"},
+		},
+		{
+			name:        "changed email",
+			contentType: "application/merge-patch+json",
+			body:        `{"email": "anna.nowak@email.com"}`,
+			update:      "^UPDATE \"users\" SET \"email\"=\\$1,\"status\"=\\$2,\"email_verified_at\"=\\$3 WHERE id = \\$4",
+			args:        []driver.Value{"anna.nowak@email.com", "pending", nil, id},
+			patched:     []string{"Anna", "anna.nowak@email.com", "pending"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			l := logger.New(false)
+			v := validatorUtil.New()
+			db, mock, err := mockDB.NewMockDB()
+			testUtil.NoError(t, err)
+
+			s := sessionstore.NewMemory(sessionstore.DefaultOptions, []byte("secret"))
+
+			usersAPI := users.New(l, db, v, s, nil, nil, nil)
+			mockPatchedUser(mock, id, "Anna", "anna@email.com", "patient", "active", 4)
+			if strings.Contains(tc.body, "email") {
+				mock.ExpectQuery("^SELECT (.+) FROM \"users\" WHERE email = \\$1").
+					WithArgs("anna.nowak@email.com", 1).
+					WillReturnRows(&sqlmock.Rows{})
+			}
+			mock.ExpectBegin()
+			if strings.Contains(tc.body, "email") {
+				// The changed email resets the status.
+				mockLockAdmins(mock)
+			}
+			mock.ExpectQuery("^SELECT (.+) FROM \"users\" WHERE (.+) FOR UPDATE").
+				WithArgs(id, 1).
+				WillReturnRows(sqlmock.NewRows([]string{"id", "name", "email", "role", "status", "version"}).
+					AddRow(id, "Anna", "anna@email.com", "patient", "active", 4))
+			mock.ExpectExec(tc.update).
+				WithArgs(tc.args...).
+				WillReturnResult(sqlmock.NewResult(0, 1))
+			mockPatchedUser(mock, id, tc.patched[0], tc.patched[1], "patient", tc.patched[2], 5)
+			mock.ExpectCommit()
+
+			rr := httptest.NewRecorder()
+			http.HandlerFunc(usersAPI.Patch).ServeHTTP(rr, patchRequest(t, id, tc.contentType, tc.body, owner))
+			testUtil.Equal(t, rr.Code, http.StatusOK)
+			testUtil.Equal(t, rr.Header().Get("ETag"), `"5"`)
+			testUtil.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestPatchUserRejected(t *testing.T) {
+	id := uuid.New()
+	owner := &policy.Identity{ID: id.String(), Role: "patient"}
+
+	testCases := []struct {
+		name        string
+		contentType string
+		body        string
+		expected    int
+		message     string
+	}{
+		{
+			name:        "role by owner",
+			contentType: "application/merge-patch+json",
+			body:        `{"name": "Anna Nowak", "role": "admin"}`,
+			expected:    http.StatusForbidden,
+		},
+		{
+			name:        "unknown and removed members",
+			contentType: "application/merge-patch+json",
+			body:        `{"password": "secret", "name": null}`,
+			expected:    http.StatusUnprocessableEntity,
+			message:     `{"errors":["name cannot be removed","password cannot be changed"]}`,
+		},
+		{
+			name:        "invalid email",
+			contentType: "application/merge-patch+json",
+			body:        `{"email": ""}`,
+			expected:    http.StatusUnprocessableEntity,
+			message:     `{"errors":["email must be a valid email address"]}`,
+		},
+		{
+			name:        "not an object",
+			contentType: "application/merge-patch+json",
+			body:        `null`,
+			expected:    http.StatusBadRequest,
+		},
+		{
+			name:        "failed test",
+			contentType: "application/json-patch+json",
+			body:        `[{"op": "test", "path": "/name", "value": "Ewa"}, {"op": "replace", "path": "/name", "value": "Anna Nowak"}]`,
+			expected:    http.StatusConflict,
+		},
+		{
+			name:        "test of the value before the change",
+			contentType: "application/json-patch+json",
+			body:        `[{"op": "replace", "path": "/name", "value": "Anna Nowak"}, {"op": "test", "path": "/name", "value": "Anna"}]`,
+			expected:    http.StatusConflict,
+		},
+		{
+			name:        "removed member",
+			contentType: "application/json-patch+json",
+			body:        `[{"op": "remove", "path": "/name"}]`,
+			expected:    http.StatusUnprocessableEntity,
+			message:     `{"errors":["name cannot be removed"]}`,
+		},
+		{
+			name:        "nested path",
+			contentType: "application/json-patch+json",
+			body:        `[{"op": "replace", "path": "/address/city", "value": "Kraków"}]`,
+			expected:    http.StatusBadRequest,
+		},
+		{
+			name:        "unsupported media type",
+			contentType: "text/plain",
+			body:        `name=Anna`,
+			expected:    http.StatusUnsupportedMediaType,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			l := logger.New(false)
+			v := validatorUtil.New()
+			db, mock, err := mockDB.NewMockDB()
+			testUtil.NoError(t, err)
+
+			s := sessionstore.NewMemory(sessionstore.DefaultOptions, []byte("secret"))
+
+			usersAPI := users.New(l, db, v, s, nil, nil, nil)
+			mockPatchedUser(mock, id, "Anna", "anna@email.com", "patient", "active", 4)
+
+			rr := httptest.NewRecorder()
+			http.HandlerFunc(usersAPI.Patch).ServeHTTP(rr, patchRequest(t, id, tc.contentType, tc.body, owner))
+			testUtil.Equal(t, rr.Code, tc.expected)
+			if tc.message != "" {
+				testUtil.Equal(t, strings.TrimSpace(rr.Body.String()), tc.message)
+			}
+			testUtil.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestPatchUserRoleByAdmin(t *testing.T) {
+	id := uuid.New()
+	admin := &policy.Identity{ID: uuid.New().String(), Role: "admin"}
+
+	l := logger.New(false)
+	v := validatorUtil.New()
+	db, mock, err := mockDB.NewMockDB()
+	testUtil.NoError(t, err)
+
+	s := sessionstore.NewMemory(sessionstore.DefaultOptions, []byte("secret"))
+
+	usersAPI := users.New(l, db, v, s, nil, nil, nil)
+	mockPatchedUser(mock, id, "Anna", "anna@email.com", "patient", "active", 4)
+	mock.ExpectBegin()
+	mock.ExpectQuery("^SELECT \"id\" FROM \"users\" WHERE \\(role = \\$1 AND status = \\$2\\) (.+) FOR UPDATE").
+		WithArgs("admin", "active").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(admin.ID))
+	mock.ExpectQuery("^SELECT (.+) FROM \"users\" WHERE (.+) FOR UPDATE").
+		WithArgs(id, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "email", "role", "status", "version"}).
+			AddRow(id, "Anna", "anna@email.com", "patient", "active", 4))
+	mock.ExpectExec("^UPDATE \"users\" SET \"role\"=\\$1 WHERE id = \\$2").
+		WithArgs("doctor", id).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("^INSERT INTO \"role_changes\"").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mockPatchedUser(mock, id, "Anna", "anna@email.com", "doctor", "active", 5)
+	mock.ExpectCommit()
+	// The user has to log in again with the new role.
+	mock.ExpectBegin()
+	mock.ExpectExec("^DELETE FROM \"user_sessions\"").
+		WithArgs(id).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectCommit()
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(usersAPI.Patch).ServeHTTP(rr, patchRequest(t, id, "application/merge-patch+json", `{"role": "doctor"}`, admin))
+	testUtil.Equal(t, rr.Code, http.StatusOK)
+	testUtil.NoError(t, mock.ExpectationsWereMet())
+}
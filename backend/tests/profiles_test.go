@@ -0,0 +1,305 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/go-chi/chi"
+	"github.com/google/uuid"
+
+	"backend/api/resource/profiles"
+	"backend/utils/logger"
+	mockDB "backend/utils/mock"
+	testUtil "backend/utils/test"
+	validatorUtil "backend/utils/validator"
+)
+
+func profileRequest(t *testing.T, method string, id uuid.UUID, body any) *http.Request {
+	var reader *bytes.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		testUtil.NoError(t, err)
+		reader = bytes.NewReader(b)
+	} else {
+		reader = bytes.NewReader(nil)
+	}
+
+	req, err := http.NewRequest(method, "/api/v1/users/{id}/patient-profile", reader)
+	testUtil.NoError(t, err)
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Add("id", id.String())
+	return req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+}
+
+func mockUserRole(mock sqlmock.Sqlmock, id uuid.UUID, role string) {
+	mock.ExpectQuery("^SELECT (.+) FROM \"users\" WHERE (.+)").
+		WithArgs(id, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "email", "role"}).
+			AddRow(id, "user1", "email@email.com", role))
+}
+
+func TestReadPatientProfile(t *testing.T) {
+	db, mock, err := mockDB.NewMockDB()
+	testUtil.NoError(t, err)
+	profilesAPI := profiles.New(logger.New(false), db, validatorUtil.New())
+
+	id := uuid.New()
+	mockUserRole(mock, id, "patient")
+	mock.ExpectQuery("^SELECT (.+) FROM \"patient_profiles\" WHERE (.+)").
+		WithArgs(id, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "date_of_birth", "sex", "pesel", "address_city", "emergency_contact_name"}).
+			AddRow(id, time.Date(1990, 1, 1, 0, 0, 0, 0, time.UTC), "female", "90010112349", "Kraków", "Jan"))
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(profilesAPI.ReadPatient).ServeHTTP(rr, profileRequest(t, "GET", id, nil))
+	testUtil.Equal(t, rr.Code, http.StatusOK)
+
+	var response profiles.PatientProfileResponse
+	testUtil.NoError(t, json.NewDecoder(rr.Body).Decode(&response))
+	testUtil.Equal(t, response.UserID, id)
+	testUtil.Equal(t, *response.DateOfBirth, "1990-01-01")
+	testUtil.Equal(t, response.PESEL, "90010112349")
+	testUtil.Equal(t, response.Address.City, "Kraków")
+	testUtil.Equal(t, response.EmergencyContact.Name, "Jan")
+	testUtil.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestReadPatientProfileOfDoctor(t *testing.T) {
+	db, mock, err := mockDB.NewMockDB()
+	testUtil.NoError(t, err)
+	profilesAPI := profiles.New(logger.New(false), db, validatorUtil.New())
+
+	id := uuid.New()
+	mockUserRole(mock, id, "doctor")
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(profilesAPI.ReadPatient).ServeHTTP(rr, profileRequest(t, "GET", id, nil))
+	testUtil.Equal(t, rr.Code, http.StatusNotFound)
+	testUtil.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestUpdatePatientProfile(t *testing.T) {
+	db, mock, err := mockDB.NewMockDB()
+	testUtil.NoError(t, err)
+	profilesAPI := profiles.New(logger.New(false), db, validatorUtil.New())
+
+	id := uuid.New()
+	mockUserRole(mock, id, "patient")
+	mock.ExpectQuery("^SELECT count\\(\\*\\) FROM \"patient_profiles\"").
+		WithArgs("90010112349", id).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+	mock.ExpectBegin()
+	mock.ExpectExec("^INSERT INTO \"patient_profiles\" (.+) ON CONFLICT").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	form := &profiles.PatientProfileForm{
+		Sex:   "female",
+		Phone: "+48123456789",
+		PESEL: "90010112349",
+		Address: profiles.Address{
+			City:    "Kraków",
+			Country: "PL",
+		},
+	}
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(profilesAPI.UpdatePatient).ServeHTTP(rr, profileRequest(t, "PUT", id, form))
+	testUtil.Equal(t, rr.Code, http.StatusOK)
+
+	var response profiles.PatientProfileResponse
+	testUtil.NoError(t, json.NewDecoder(rr.Body).Decode(&response))
+	testUtil.Equal(t, *response.DateOfBirth, "1990-01-01")
+	testUtil.Equal(t, response.PESEL, "90010112349")
+	testUtil.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestUpdatePatientProfileInvalid(t *testing.T) {
+	testCases := []struct {
+		name     string
+		form     *profiles.PatientProfileForm
+		expected string
+	}{
+		{
+			name:     "checksum",
+			form:     &profiles.PatientProfileForm{PESEL: "90010112348"},
+			expected: "pesel must be a valid PESEL number",
+		},
+		{
+			name:     "date of birth",
+			form:     &profiles.PatientProfileForm{PESEL: "90010112349", DateOfBirth: "1990-01-02"},
+			expected: "dateOfBirth does not match the date of birth in pesel",
+		},
+		{
+			name:     "sex",
+			form:     &profiles.PatientProfileForm{PESEL: "90010112349", Sex: "male"},
+			expected: "sex does not match the sex in pesel",
+		},
+		{
+			name:     "emergency contact",
+			form:     &profiles.PatientProfileForm{EmergencyContact: profiles.EmergencyContact{Phone: "+48123456789"}},
+			expected: "name is required when another field is present",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			db, mock, err := mockDB.NewMockDB()
+			testUtil.NoError(t, err)
+			profilesAPI := profiles.New(logger.New(false), db, validatorUtil.New())
+
+			rr := httptest.NewRecorder()
+			http.HandlerFunc(profilesAPI.UpdatePatient).ServeHTTP(rr, profileRequest(t, "PUT", uuid.New(), tc.form))
+			testUtil.Equal(t, rr.Code, http.StatusUnprocessableEntity)
+			if !strings.Contains(rr.Body.String(), tc.expected) {
+				t.Fatalf(`Expected:"%v", Got:"%v"`, tc.expected, rr.Body.String())
+			}
+			testUtil.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestUpdatePatientProfilePESELTaken(t *testing.T) {
+	db, mock, err := mockDB.NewMockDB()
+	testUtil.NoError(t, err)
+	profilesAPI := profiles.New(logger.New(false), db, validatorUtil.New())
+
+	id := uuid.New()
+	mockUserRole(mock, id, "patient")
+	mock.ExpectQuery("^SELECT count\\(\\*\\) FROM \"patient_profiles\"").
+		WithArgs("90010112349", id).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+
+	rr := httptest.NewRecorder()
+	form := &profiles.PatientProfileForm{PESEL: "90010112349"}
+	http.HandlerFunc(profilesAPI.UpdatePatient).ServeHTTP(rr, profileRequest(t, "PUT", id, form))
+	testUtil.Equal(t, rr.Code, http.StatusConflict)
+	testUtil.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestDoctorDirectory(t *testing.T) {
+	db, mock, err := mockDB.NewMockDB()
+	testUtil.NoError(t, err)
+	profilesAPI := profiles.New(logger.New(false), db, validatorUtil.New())
+
+	doctorID := uuid.New()
+	specialtyID := uuid.New()
+	mock.ExpectQuery("^SELECT count\\(\\*\\) FROM \"doctor_profiles\" JOIN users (.+)EXISTS (.+) doctor_profiles.languages @> (.+)").
+		WithArgs("doctor", "active", "cardiology", `["pl"]`).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+	mock.ExpectQuery("^SELECT \"doctor_profiles\".\"user_id\"(.+) FROM \"doctor_profiles\" JOIN users (.+) ORDER BY users.name").
+		WithArgs("doctor", "active", "cardiology", `["pl"]`, 5).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "license_number", "languages", "bio", "clinics"}).
+			AddRow(doctorID, "1234567", `["pl","en"]`, "Bio", `["Clinic"]`))
+	mock.ExpectQuery("^SELECT (.+) FROM \"doctor_specialties\"").
+		WithArgs(doctorID).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "specialty_id"}).AddRow(doctorID, specialtyID))
+	mock.ExpectQuery("^SELECT (.+) FROM \"specialties\" WHERE (.+) ORDER BY name").
+		WithArgs(specialtyID).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "slug", "name"}).AddRow(specialtyID, "cardiology", "Cardiology"))
+	mock.ExpectQuery("^SELECT (.+) FROM \"users\" WHERE (.+)").
+		WithArgs(doctorID).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "email", "role"}).AddRow(doctorID, "Dr House", "house@email.com", "doctor"))
+
+	req, err := http.NewRequest("GET", "/api/v1/doctors?specialty=cardiology&language=pl&limit=5", nil)
+	testUtil.NoError(t, err)
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(profilesAPI.Directory).ServeHTTP(rr, req)
+	testUtil.Equal(t, rr.Code, http.StatusOK)
+
+	var response profiles.DirectoryResponse
+	testUtil.NoError(t, json.NewDecoder(rr.Body).Decode(&response))
+	testUtil.Equal(t, response.TotalItems, int64(1))
+	testUtil.Equal(t, len(response.Doctors), 1)
+	testUtil.Equal(t, response.Doctors[0].Name, "Dr House")
+	testUtil.Equal(t, response.Doctors[0].Specialties[0].Slug, "cardiology")
+	testUtil.Equal(t, response.Doctors[0].Languages[1], "en")
+	testUtil.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestUpdateDoctorProfile(t *testing.T) {
+	db, mock, err := mockDB.NewMockDB()
+	testUtil.NoError(t, err)
+	profilesAPI := profiles.New(logger.New(false), db, validatorUtil.New())
+
+	id := uuid.New()
+	specialtyID := uuid.New()
+	mockUserRole(mock, id, "doctor")
+	mock.ExpectQuery("^SELECT (.+) FROM \"specialties\" WHERE slug IN").
+		WithArgs("cardiology").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "slug", "name"}).AddRow(specialtyID, "cardiology", "Cardiology"))
+	mock.ExpectQuery("^SELECT count\\(\\*\\) FROM \"doctor_profiles\"").
+		WithArgs("1234567", id).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+	mock.ExpectBegin()
+	mock.ExpectExec("^INSERT INTO \"doctor_profiles\" (.+) ON CONFLICT").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("^DELETE FROM \"doctor_specialties\"").
+		WithArgs(id).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("^INSERT INTO \"doctor_specialties\"").
+		WithArgs(id, specialtyID).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	form := &profiles.DoctorProfileForm{
+		LicenseNumber: "1234567",
+		Specialties:   []string{"cardiology"},
+		Languages:     []string{"pl", "en-GB"},
+	}
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(profilesAPI.UpdateDoctor).ServeHTTP(rr, profileRequest(t, "PUT", id, form))
+	testUtil.Equal(t, rr.Code, http.StatusOK)
+
+	var response profiles.DoctorProfileResponse
+	testUtil.NoError(t, json.NewDecoder(rr.Body).Decode(&response))
+	testUtil.Equal(t, response.Specialties[0].ID, specialtyID)
+	testUtil.Equal(t, len(response.Clinics), 0)
+	testUtil.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestUpdateDoctorProfileUnknownSpecialty(t *testing.T) {
+	db, mock, err := mockDB.NewMockDB()
+	testUtil.NoError(t, err)
+	profilesAPI := profiles.New(logger.New(false), db, validatorUtil.New())
+
+	id := uuid.New()
+	mockUserRole(mock, id, "doctor")
+	mock.ExpectQuery("^SELECT (.+) FROM \"specialties\" WHERE slug IN").
+		WithArgs("cardiology", "astrology").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "slug", "name"}).AddRow(uuid.New(), "cardiology", "Cardiology"))
+
+	form := &profiles.DoctorProfileForm{
+		LicenseNumber: "1234567",
+		Specialties:   []string{"cardiology", "astrology"},
+	}
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(profilesAPI.UpdateDoctor).ServeHTTP(rr, profileRequest(t, "PUT", id, form))
+	testUtil.Equal(t, rr.Code, http.StatusUnprocessableEntity)
+	testUtil.Equal(t, strings.Contains(rr.Body.String(), "unknown specialty astrology"), true)
+	testUtil.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestUpdateDoctorProfileOfPatient(t *testing.T) {
+	db, mock, err := mockDB.NewMockDB()
+	testUtil.NoError(t, err)
+	profilesAPI := profiles.New(logger.New(false), db, validatorUtil.New())
+
+	id := uuid.New()
+	mockUserRole(mock, id, "patient")
+
+	rr := httptest.NewRecorder()
+	form := &profiles.DoctorProfileForm{LicenseNumber: "1234567"}
+	http.HandlerFunc(profilesAPI.UpdateDoctor).ServeHTTP(rr, profileRequest(t, "PUT", id, form))
+	testUtil.Equal(t, rr.Code, http.StatusNotFound)
+	testUtil.NoError(t, mock.ExpectationsWereMet())
+}
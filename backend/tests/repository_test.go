@@ -2,11 +2,13 @@ package tests_test
 
 import (
 	"testing"
+	"time"
 
 	"golang.org/x/crypto/bcrypt"
 
 	"github.com/DATA-DOG/go-sqlmock"
 	"github.com/google/uuid"
+	"gorm.io/gorm"
 
 	"backend/api/resource/users"
 	mockDB "backend/utils/mock"
@@ -44,6 +46,51 @@ func TestRepository_List(t *testing.T) {
 	testUtil.Equal(t, result.TotalRows, 2)
 }
 
+func TestRepository_ListCountsFilteredRows(t *testing.T) {
+	t.Parallel()
+
+	db, mock, err := mockDB.NewMockDB()
+	testUtil.NoError(t, err)
+
+	repo := users.NewRepository(db)
+
+	mock.ExpectQuery("^SELECT count\\(\\*\\) FROM \"users\" WHERE role = \\$1 AND email LIKE \\$2").
+		WithArgs("doctor", "%@clinic.com").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+	mock.ExpectQuery("^SELECT (.+) FROM \"users\" WHERE role = \\$1 AND email LIKE \\$2").
+		WithArgs("doctor", "%@clinic.com", 10).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "email", "role"}).
+			AddRow(uuid.New(), "user1", "user1@clinic.com", "doctor"))
+
+	result := repo.List(pagination.Pagination{
+		Page:  1,
+		Limit: 10,
+		Role:  "doctor",
+		Filters: []func(*gorm.DB) *gorm.DB{func(db *gorm.DB) *gorm.DB {
+			return db.Where("email LIKE ?", "%@clinic.com")
+		}},
+	})
+	testUtil.Equal(t, result.TotalRows, 1)
+	testUtil.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRepository_ListKeysetSkipsCount(t *testing.T) {
+	t.Parallel()
+
+	db, mock, err := mockDB.NewMockDB()
+	testUtil.NoError(t, err)
+
+	repo := users.NewRepository(db)
+
+	mock.ExpectQuery("^SELECT (.+) FROM \"users\"").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "email", "role"}).
+			AddRow(uuid.New(), "user1", "email1@email.com", "patient"))
+
+	result := repo.List(pagination.Pagination{Limit: 10, Keyset: true})
+	testUtil.Equal(t, result.TotalRows, 0)
+	testUtil.NoError(t, mock.ExpectationsWereMet())
+}
+
 func TestRepository_Create(t *testing.T) {
 	t.Parallel()
 
@@ -56,11 +103,11 @@ func TestRepository_Create(t *testing.T) {
 	id := uuid.New()
 	mock.ExpectBegin()
 	mock.ExpectExec("^INSERT INTO \"users\" ").
-		WithArgs(id, "name", "email", password, "patient").
+		WithArgs(id, "name", "email", password, "patient", "active", nil, sqlmock.AnyArg(), nil).
 		WillReturnResult(sqlmock.NewResult(1, 1))
 	mock.ExpectCommit()
 
-	user := &users.User{ID: id, Name: "name", Email: "email", Password: password, Role: users.Patient}
+	user := &users.User{ID: id, Name: "name", Email: "email", Password: password, Role: users.Patient, Status: users.StatusActive}
 	_, err = repo.Create(user)
 	testUtil.NoError(t, err)
 }
@@ -124,12 +171,15 @@ func TestRepository_Delete(t *testing.T) {
 		AddRow(id, "user1", "email@email.com", "patient")
 
 	mock.ExpectBegin()
-	mock.ExpectExec("^DELETE FROM \"users\" WHERE").
-		WithArgs(id).
+	mock.ExpectQuery("^SELECT \"id\" FROM \"users\" WHERE \\(role = (.+) FOR UPDATE").
+		WithArgs(users.Admin, users.StatusActive).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	mock.ExpectExec("^UPDATE \"users\" SET \"deleted_at\"").
+		WithArgs(sqlmock.AnyArg(), id).
 		WillReturnResult(sqlmock.NewResult(1, 1))
 	mock.ExpectCommit()
 
-	rows, err := repo.Delete(id)
+	rows, err := repo.Delete(id, time.Now())
 	testUtil.NoError(t, err)
 	testUtil.Equal(t, 1, rows)
 }
@@ -154,3 +204,92 @@ func TestRepository_GetByEmail(t *testing.T) {
 	testUtil.NoError(t, err)
 	testUtil.Equal(t, "user1", user.Name)
 }
+
+func TestRepository_ResetPassword(t *testing.T) {
+	t.Parallel()
+
+	db, mock, err := mockDB.NewMockDB()
+	testUtil.NoError(t, err)
+
+	repo := users.NewRepository(db)
+
+	tokenID := uuid.New()
+	userID := uuid.New()
+	tokenHash := users.HashToken("token")
+	password, _ := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.DefaultCost)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("^SELECT (.+) FROM \"password_reset_tokens\" WHERE (.+)").
+		WithArgs(tokenHash, mockDB.AnyTime{}, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "user_id"}).AddRow(tokenID, userID))
+	mock.ExpectExec("^UPDATE \"users\" SET \"password\"").
+		WithArgs(password, userID).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("^DELETE FROM \"user_sessions\"").
+		WithArgs(userID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("^UPDATE \"password_reset_tokens\" SET \"used_at\"").
+		WithArgs(mockDB.AnyTime{}, tokenID).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	err = repo.ResetPassword(tokenHash, password, time.Now())
+	testUtil.NoError(t, err)
+	testUtil.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRepository_UpdateRole(t *testing.T) {
+	t.Parallel()
+
+	db, mock, err := mockDB.NewMockDB()
+	testUtil.NoError(t, err)
+
+	repo := users.NewRepository(db)
+
+	id := uuid.New()
+	actorID := uuid.New()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("^SELECT \"id\" FROM \"users\" WHERE \\(role = (.+) FOR UPDATE").
+		WithArgs(users.Admin, users.StatusActive).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(actorID))
+	mock.ExpectQuery("^SELECT (.+) FROM \"users\" WHERE (.+)").
+		WithArgs(id, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "email", "role"}).AddRow(id, "user1", "email@email.com", "patient"))
+	mock.ExpectExec("^UPDATE \"users\" SET \"role\"").
+		WithArgs(users.Doctor, id).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("^INSERT INTO \"role_changes\"").
+		WithArgs(sqlmock.AnyArg(), id, &actorID, users.Patient, users.Doctor, mockDB.AnyTime{}).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	user, err := repo.UpdateRole(id, users.Doctor, &actorID)
+	testUtil.NoError(t, err)
+	testUtil.Equal(t, user.Role, users.Doctor)
+	testUtil.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRepository_UpdateRoleLastAdmin(t *testing.T) {
+	t.Parallel()
+
+	db, mock, err := mockDB.NewMockDB()
+	testUtil.NoError(t, err)
+
+	repo := users.NewRepository(db)
+
+	id := uuid.New()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("^SELECT \"id\" FROM \"users\" WHERE \\(role = (.+) FOR UPDATE").
+		WithArgs(users.Admin, users.StatusActive).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(id))
+	mock.ExpectQuery("^SELECT (.+) FROM \"users\" WHERE (.+)").
+		WithArgs(id, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "email", "role"}).AddRow(id, "user1", "email@email.com", "admin"))
+	mock.ExpectRollback()
+
+	_, err = repo.UpdateRole(id, users.Patient, nil)
+	testUtil.Equal(t, err, users.ErrLastAdmin)
+	testUtil.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,156 @@
+package tests
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/go-chi/chi"
+	"github.com/google/uuid"
+
+	"backend/api/resource/common/policy"
+	"backend/api/resource/users"
+	"backend/utils/logger"
+	mockDB "backend/utils/mock"
+	"backend/utils/sessionstore"
+	testUtil "backend/utils/test"
+	validatorUtil "backend/utils/validator"
+)
+
+func roleRequest(t *testing.T, id uuid.UUID, body string, identity *policy.Identity) *http.Request {
+	req, err := http.NewRequest("PATCH", "/api/v1/users/"+id.String()+"/role", strings.NewReader(body))
+	testUtil.NoError(t, err)
+	return req.WithContext(policy.WithIdentity(context.Background(), identity))
+}
+
+func roleRouter(t *testing.T) (http.Handler, sqlmock.Sqlmock) {
+	l := logger.New(false)
+	v := validatorUtil.New()
+	db, mock, err := mockDB.NewMockDB()
+	testUtil.NoError(t, err)
+
+	s := sessionstore.NewMemory(sessionstore.DefaultOptions, []byte("secret"))
+	usersAPI := users.New(l, db, v, s, nil, nil, nil)
+	p := policy.New(careTeamStub{})
+
+	r := chi.NewRouter()
+	r.With(p.Require(policy.UsersRole)).Patch("/api/v1/users/{id}/role", usersAPI.ChangeRole)
+	return r, mock
+}
+
+func TestChangeRoleForbidden(t *testing.T) {
+	id := uuid.New()
+	doctor := &policy.Identity{ID: uuid.NewString(), Role: "doctor"}
+
+	r, mock := roleRouter(t)
+
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, roleRequest(t, id, `{"role": "admin"}`, doctor))
+	testUtil.Equal(t, rr.Code, http.StatusForbidden)
+	testUtil.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestChangeRoleLastAdmin(t *testing.T) {
+	id := uuid.New()
+	admin := &policy.Identity{ID: id.String(), Role: "admin"}
+
+	r, mock := roleRouter(t)
+	mock.ExpectQuery("^SELECT (.+) FROM \"users\" WHERE (.+)").
+		WithArgs(id, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "email", "role", "status"}).
+			AddRow(id, "Anna", "anna@email.com", "admin", "active"))
+	mock.ExpectBegin()
+	mock.ExpectQuery("^SELECT \"id\" FROM \"users\" WHERE \\(role = (.+) FOR UPDATE").
+		WithArgs(users.Admin, users.StatusActive).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(id))
+	mock.ExpectQuery("^SELECT (.+) FROM \"users\" WHERE (.+)").
+		WithArgs(id, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "email", "role"}).AddRow(id, "Anna", "anna@email.com", "admin"))
+	mock.ExpectRollback()
+
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, roleRequest(t, id, `{"role": "patient"}`, admin))
+	testUtil.Equal(t, rr.Code, http.StatusConflict)
+	testUtil.Equal(t, strings.TrimSpace(rr.Body.String()), "Cannot demote the last admin!")
+	testUtil.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestChangeRoleEndsOtherSessions(t *testing.T) {
+	id := uuid.New()
+	actorID := uuid.New()
+	sessionID := uuid.New()
+	admin := &policy.Identity{ID: actorID.String(), Role: "admin", SessionID: sessionID.String()}
+
+	r, mock := roleRouter(t)
+	mock.ExpectQuery("^SELECT (.+) FROM \"users\" WHERE (.+)").
+		WithArgs(id, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "email", "role", "status"}).
+			AddRow(id, "Anna", "anna@email.com", "patient", "active"))
+	mock.ExpectBegin()
+	mock.ExpectQuery("^SELECT \"id\" FROM \"users\" WHERE \\(role = (.+) FOR UPDATE").
+		WithArgs(users.Admin, users.StatusActive).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(actorID))
+	mock.ExpectQuery("^SELECT (.+) FROM \"users\" WHERE (.+)").
+		WithArgs(id, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "email", "role"}).AddRow(id, "Anna", "anna@email.com", "patient"))
+	mock.ExpectExec("^UPDATE \"users\" SET \"role\"").
+		WithArgs(users.Doctor, id).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("^INSERT INTO \"role_changes\"").
+		WithArgs(sqlmock.AnyArg(), id, &actorID, users.Patient, users.Doctor, mockDB.AnyTime{}).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+	// Every session of the user but the one of the request is ended.
+	mock.ExpectBegin()
+	mock.ExpectExec("^DELETE FROM \"user_sessions\" WHERE user_id = \\$1 AND id <> \\$2").
+		WithArgs(id, sessionID).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectCommit()
+
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, roleRequest(t, id, `{"role": "doctor"}`, admin))
+	testUtil.Equal(t, rr.Code, http.StatusOK)
+	testUtil.Equal(t, strings.Contains(rr.Body.String(), `"role":"doctor"`), true)
+	testUtil.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestChangeRoleEndsOwnSession(t *testing.T) {
+	id := uuid.New()
+	otherAdminID := uuid.New()
+	sessionID := uuid.New()
+	admin := &policy.Identity{ID: id.String(), Role: "admin", SessionID: sessionID.String()}
+
+	r, mock := roleRouter(t)
+	mock.ExpectQuery("^SELECT (.+) FROM \"users\" WHERE (.+)").
+		WithArgs(id, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "email", "role", "status"}).
+			AddRow(id, "Anna", "anna@email.com", "admin", "active"))
+	mock.ExpectBegin()
+	mock.ExpectQuery("^SELECT \"id\" FROM \"users\" WHERE \\(role = (.+) FOR UPDATE").
+		WithArgs(users.Admin, users.StatusActive).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(id).AddRow(otherAdminID))
+	mock.ExpectQuery("^SELECT (.+) FROM \"users\" WHERE (.+)").
+		WithArgs(id, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "email", "role"}).AddRow(id, "Anna", "anna@email.com", "admin"))
+	mock.ExpectExec("^UPDATE \"users\" SET \"role\"").
+		WithArgs(users.Doctor, id).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("^INSERT INTO \"role_changes\"").
+		WithArgs(sqlmock.AnyArg(), id, &id, users.Admin, users.Doctor, mockDB.AnyTime{}).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+	// An admin demoting themselves loses the session of the request as well.
+	mock.ExpectBegin()
+	mock.ExpectExec("^DELETE FROM \"user_sessions\" WHERE user_id = \\$1$").
+		WithArgs(id).
+		WillReturnResult(sqlmock.NewResult(0, 3))
+	mock.ExpectCommit()
+
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, roleRequest(t, id, `{"role": "doctor"}`, admin))
+	testUtil.Equal(t, rr.Code, http.StatusOK)
+	testUtil.NoError(t, mock.ExpectationsWereMet())
+}
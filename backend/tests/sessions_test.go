@@ -0,0 +1,161 @@
+package tests
+
+import (
+	"backend/api/resource/apikeys"
+	"backend/api/resource/common/policy"
+	"backend/api/resource/users"
+	"backend/api/router/middleware"
+	"backend/utils/logger"
+	mockDB "backend/utils/mock"
+	"backend/utils/sessionstore"
+	testUtil "backend/utils/test"
+	"backend/utils/token"
+	validatorUtil "backend/utils/validator"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/go-chi/chi"
+	"github.com/google/uuid"
+)
+
+func TestDeviceName(t *testing.T) {
+	testUtil.Equal(t, users.DeviceName("Mozilla/5.0 (Windows NT 10.0; Win64; x64; rv:128.0) Gecko/20100101 Firefox/128.0"), "Firefox on Windows")
+	testUtil.Equal(t, users.DeviceName("Mozilla/5.0 (iPhone; CPU iPhone OS 17_5 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.5 Mobile/15E148 Safari/604.1"), "Safari on iOS")
+	testUtil.Equal(t, users.DeviceName("Mozilla/5.0 (Linux; Android 14) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/126.0 Mobile Safari/537.36"), "Chrome on Android")
+	testUtil.Equal(t, users.DeviceName("curl/8.5.0"), "Unknown device")
+}
+
+func TestListSessions(t *testing.T) {
+	l := logger.New(false)
+	v := validatorUtil.New()
+	db, mock, err := mockDB.NewMockDB()
+	testUtil.NoError(t, err)
+
+	s := sessionstore.NewMemory(sessionstore.DefaultOptions, []byte("secret"))
+
+	usersAPI := users.New(l, db, v, s, nil, nil, nil)
+
+	id := uuid.New()
+	current := uuid.New()
+	other := uuid.New()
+	mock.ExpectQuery("^SELECT (.+) FROM \"user_sessions\" WHERE (.+) ORDER BY last_seen_at desc").
+		WithArgs(id, mockDB.AnyTime{}).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "device", "ip", "user_agent", "created_at", "last_seen_at"}).
+			AddRow(current, id, "Firefox on Linux", "192.0.2.1", "Firefox/128.0", time.Now(), time.Now()).
+			AddRow(other, id, "Safari on iOS", "198.51.100.7", "Safari/604.1", time.Now(), time.Now().Add(-time.Hour)))
+
+	req, err := http.NewRequest("GET", "/api/v1/users/current/sessions", nil)
+	testUtil.NoError(t, err)
+	req = req.WithContext(policy.WithIdentity(req.Context(), &policy.Identity{ID: id.String(), Role: "patient", SessionID: current.String()}))
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(usersAPI.ListSessions).ServeHTTP(rr, req)
+	testUtil.Equal(t, rr.Code, http.StatusOK)
+
+	var response []*users.SessionResponse
+	testUtil.NoError(t, json.NewDecoder(rr.Body).Decode(&response))
+	testUtil.Equal(t, len(response), 2)
+	testUtil.Equal(t, response[0].Current, true)
+	testUtil.Equal(t, response[1].Current, false)
+	testUtil.Equal(t, response[1].Device, "Safari on iOS")
+	testUtil.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRevokeSessionOfOtherUser(t *testing.T) {
+	l := logger.New(false)
+	v := validatorUtil.New()
+	db, mock, err := mockDB.NewMockDB()
+	testUtil.NoError(t, err)
+
+	s := sessionstore.NewMemory(sessionstore.DefaultOptions, []byte("secret"))
+
+	usersAPI := users.New(l, db, v, s, nil, nil, nil)
+
+	id := uuid.New()
+	sid := uuid.New()
+	mock.ExpectBegin()
+	mock.ExpectExec("^DELETE FROM \"user_sessions\" WHERE id = \\$1 AND user_id = \\$2").
+		WithArgs(sid, id).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
+
+	req, err := http.NewRequest("DELETE", "/api/v1/users/current/sessions/{id}", nil)
+	testUtil.NoError(t, err)
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Add("id", sid.String())
+	ctx := context.WithValue(req.Context(), chi.RouteCtxKey, rctx)
+	req = req.WithContext(policy.WithIdentity(ctx, &policy.Identity{ID: id.String(), Role: "patient"}))
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(usersAPI.RevokeSession).ServeHTTP(rr, req)
+	testUtil.Equal(t, rr.Code, http.StatusNotFound)
+	testUtil.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRevokeAllSessions(t *testing.T) {
+	l := logger.New(false)
+	v := validatorUtil.New()
+	db, mock, err := mockDB.NewMockDB()
+	testUtil.NoError(t, err)
+
+	s := sessionstore.NewMemory(sessionstore.DefaultOptions, []byte("secret"))
+
+	usersAPI := users.New(l, db, v, s, nil, nil, nil)
+
+	id := uuid.New()
+	mock.ExpectBegin()
+	mock.ExpectExec("^DELETE FROM \"user_sessions\" WHERE user_id = \\$1$").
+		WithArgs(id).
+		WillReturnResult(sqlmock.NewResult(0, 3))
+	mock.ExpectCommit()
+
+	req, err := http.NewRequest("POST", "/api/v1/users/{id}/sessions/revoke-all", nil)
+	testUtil.NoError(t, err)
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Add("id", id.String())
+	ctx := context.WithValue(req.Context(), chi.RouteCtxKey, rctx)
+	req = req.WithContext(policy.WithIdentity(ctx, &policy.Identity{ID: uuid.NewString(), Role: "admin", SessionID: uuid.NewString()}))
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(usersAPI.RevokeAllSessions).ServeHTTP(rr, req)
+	testUtil.Equal(t, rr.Code, http.StatusOK)
+	testUtil.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestAccessTokenOfRevokedSession(t *testing.T) {
+	db, mock, err := mockDB.NewMockDB()
+	testUtil.NoError(t, err)
+
+	s := sessionstore.NewMemory(sessionstore.DefaultOptions, []byte("secret"))
+
+	tokens := token.NewHS256([]byte("secret"), "users-service", time.Minute, time.Hour)
+	id := uuid.New()
+	sid := uuid.New()
+	pair, err := tokens.Issue(id.String(), "email@email.com", "patient", sid.String())
+	testUtil.NoError(t, err)
+
+	mock.ExpectQuery("^SELECT \"status\" FROM \"users\" WHERE (.+)").
+		WithArgs(id, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"status"}).AddRow("active"))
+	mock.ExpectQuery("^SELECT (.+) FROM \"user_sessions\" WHERE (.+)").
+		WithArgs(sid, 1).
+		WillReturnRows(&sqlmock.Rows{})
+
+	handler := middleware.Authenticate(s, tokens, apikeys.NewRepository(db), users.NewRepository(db))(
+		middleware.LoggedOnly(http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {})),
+	)
+
+	req, err := http.NewRequest("GET", "/api/v1/users/current", nil)
+	testUtil.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer "+pair.AccessToken)
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	testUtil.Equal(t, rr.Code, http.StatusUnauthorized)
+	testUtil.NoError(t, mock.ExpectationsWereMet())
+}
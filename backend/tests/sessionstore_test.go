@@ -0,0 +1,106 @@
+package tests
+
+import (
+	"backend/utils/sessionstore"
+	testUtil "backend/utils/test"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// saveSession saves a value in a new session and returns the cookie.
+func saveSession(t *testing.T, store sessionstore.Store, value string) *http.Cookie {
+	req := httptest.NewRequest("POST", "/api/v1/users/login", nil)
+	rr := httptest.NewRecorder()
+
+	session, err := store.Get(req, "session")
+	testUtil.NoError(t, err)
+	testUtil.Equal(t, session.IsNew, true)
+	session.Values["id"] = value
+	testUtil.NoError(t, session.Save(req, rr))
+
+	cookies := rr.Result().Cookies()
+	testUtil.Equal(t, len(cookies), 1)
+	return cookies[0]
+}
+
+func loadSession(t *testing.T, store sessionstore.Store, cookie *http.Cookie) (string, bool) {
+	req := httptest.NewRequest("GET", "/api/v1/users/current", nil)
+	req.AddCookie(cookie)
+
+	session, err := store.Get(req, "session")
+	testUtil.NoError(t, err)
+	value, ok := session.Values["id"].(string)
+	return value, ok && !session.IsNew
+}
+
+func deleteSession(t *testing.T, store sessionstore.Store, cookie *http.Cookie) {
+	req := httptest.NewRequest("POST", "/api/v1/users/logout", nil)
+	req.AddCookie(cookie)
+	rr := httptest.NewRecorder()
+
+	session, err := store.Get(req, "session")
+	testUtil.NoError(t, err)
+	session.Options.MaxAge = -1
+	testUtil.NoError(t, session.Save(req, rr))
+}
+
+func TestMemorySessionStore(t *testing.T) {
+	store := sessionstore.NewMemory(sessionstore.DefaultOptions, []byte("secret"))
+	defer store.Close()
+
+	cookie := saveSession(t, store, "c50abe98-7f20-4cb9-b4a8-fbef37988e7f")
+	testUtil.Equal(t, store.Len(), 1)
+
+	value, ok := loadSession(t, store, cookie)
+	testUtil.Equal(t, ok, true)
+	testUtil.Equal(t, value, "c50abe98-7f20-4cb9-b4a8-fbef37988e7f")
+
+	deleteSession(t, store, cookie)
+	testUtil.Equal(t, store.Len(), 0)
+	_, ok = loadSession(t, store, cookie)
+	testUtil.Equal(t, ok, false)
+}
+
+func TestMemorySessionStoreForgedCookie(t *testing.T) {
+	store := sessionstore.NewMemory(sessionstore.DefaultOptions, []byte("secret"))
+	other := sessionstore.NewMemory(sessionstore.DefaultOptions, []byte("other"))
+
+	cookie := saveSession(t, other, "c50abe98-7f20-4cb9-b4a8-fbef37988e7f")
+
+	_, ok := loadSession(t, store, cookie)
+	testUtil.Equal(t, ok, false)
+}
+
+func TestRedisSessionStore(t *testing.T) {
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+
+	opts := sessionstore.DefaultOptions
+	opts.MaxAge = 60
+	store := sessionstore.NewRedis(client, sessionstore.DefaultRedisPrefix, opts, []byte("secret"))
+	defer store.Close()
+	testUtil.Equal(t, store.MaxAge(), time.Minute)
+
+	cookie := saveSession(t, store, "c50abe98-7f20-4cb9-b4a8-fbef37988e7f")
+	keys := server.Keys()
+	testUtil.Equal(t, len(keys), 1)
+	testUtil.Equal(t, server.TTL(keys[0]), time.Minute)
+
+	value, ok := loadSession(t, store, cookie)
+	testUtil.Equal(t, ok, true)
+	testUtil.Equal(t, value, "c50abe98-7f20-4cb9-b4a8-fbef37988e7f")
+
+	deleteSession(t, store, cookie)
+	testUtil.Equal(t, len(server.Keys()), 0)
+
+	// The server expires sessions.
+	cookie = saveSession(t, store, "c50abe98-7f20-4cb9-b4a8-fbef37988e7f")
+	server.FastForward(2 * time.Minute)
+	_, ok = loadSession(t, store, cookie)
+	testUtil.Equal(t, ok, false)
+}
@@ -0,0 +1,101 @@
+package tests_test
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"testing"
+	"time"
+
+	testUtil "backend/utils/test"
+	"backend/utils/token"
+)
+
+func TestTokenHS256(t *testing.T) {
+	m := token.NewHS256([]byte("secret"), "users-service", time.Minute, time.Hour)
+
+	pair, err := m.Issue("c50abe98-7f20-4cb9-b4a8-fbef37988e7f", "email@email.com", "doctor", "")
+	testUtil.NoError(t, err)
+
+	claims, err := m.Parse(pair.AccessToken, token.TypeAccess)
+	testUtil.NoError(t, err)
+	testUtil.Equal(t, claims.Subject, "c50abe98-7f20-4cb9-b4a8-fbef37988e7f")
+	testUtil.Equal(t, claims.Role, "doctor")
+
+	claims, err = m.Parse(pair.RefreshToken, token.TypeRefresh)
+	testUtil.NoError(t, err)
+	testUtil.Equal(t, claims.Email, "email@email.com")
+
+	_, err = m.Parse(pair.RefreshToken, token.TypeAccess)
+	testUtil.Equal(t, err, token.ErrInvalidClaims)
+
+	other := token.NewHS256([]byte("other"), "users-service", time.Minute, time.Hour)
+	_, err = other.Parse(pair.AccessToken, token.TypeAccess)
+	testUtil.Equal(t, err, token.ErrInvalidSignature)
+
+	// ID tokens are verified with the JWKS, which has no shared secrets.
+	_, err = m.SignIDToken(&token.IDClaims{})
+	testUtil.Equal(t, err, token.ErrNoPublicKey)
+}
+
+func TestTokenRS256(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	testUtil.NoError(t, err)
+	m := token.NewRS256(key, "users-service", time.Minute, time.Hour)
+
+	pair, err := m.Issue("c50abe98-7f20-4cb9-b4a8-fbef37988e7f", "email@email.com", "admin", "")
+	testUtil.NoError(t, err)
+
+	claims, err := m.Parse(pair.AccessToken, token.TypeAccess)
+	testUtil.NoError(t, err)
+	testUtil.Equal(t, claims.Role, "admin")
+
+	// A token signed with HS256 must not be accepted by an RS256 manager.
+	hs := token.NewHS256([]byte("secret"), "users-service", time.Minute, time.Hour)
+	hsPair, err := hs.Issue("c50abe98-7f20-4cb9-b4a8-fbef37988e7f", "email@email.com", "admin", "")
+	testUtil.NoError(t, err)
+	_, err = m.Parse(hsPair.AccessToken, token.TypeAccess)
+	testUtil.Equal(t, err, token.ErrInvalidSignature)
+}
+
+func TestTokenExpired(t *testing.T) {
+	m := token.NewHS256([]byte("secret"), "users-service", time.Minute, time.Hour)
+
+	pair, err := m.Issue("c50abe98-7f20-4cb9-b4a8-fbef37988e7f", "email@email.com", "patient", "")
+	testUtil.NoError(t, err)
+
+	old := token.Now
+	defer func() { token.Now = old }()
+	token.Now = func() time.Time { return time.Now().Add(2 * time.Minute) }
+
+	_, err = m.Parse(pair.AccessToken, token.TypeAccess)
+	testUtil.Equal(t, err, token.ErrExpired)
+
+	_, err = m.Parse("not.a.token", token.TypeAccess)
+	testUtil.Equal(t, err, token.ErrMalformed)
+}
+
+func TestTokenKeyRotation(t *testing.T) {
+	oldKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	testUtil.NoError(t, err)
+	newKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	testUtil.NoError(t, err)
+
+	before := token.NewRS256(oldKey, "users-service", time.Minute, time.Hour)
+	pair, err := before.Issue("c50abe98-7f20-4cb9-b4a8-fbef37988e7f", "email@email.com", "patient", "")
+	testUtil.NoError(t, err)
+
+	after := token.New(token.NewRS256Key(newKey), []*token.Key{token.NewRS256Key(oldKey)}, "users-service", time.Minute, time.Hour)
+	_, err = after.Parse(pair.AccessToken, token.TypeAccess)
+	testUtil.NoError(t, err)
+
+	jwks := after.JWKS()
+	testUtil.Equal(t, len(jwks.Keys), 2)
+	testUtil.Equal(t, jwks.Keys[0].KeyID, token.NewRS256Key(newKey).ID)
+	testUtil.Equal(t, jwks.Keys[0].E, "AQAB")
+
+	retired := token.NewRS256(newKey, "users-service", time.Minute, time.Hour)
+	_, err = retired.Parse(pair.AccessToken, token.TypeAccess)
+	testUtil.Equal(t, err, token.ErrInvalidSignature)
+
+	testUtil.Equal(t, len(token.NewHS256([]byte("secret"), "users-service", time.Minute, time.Hour).JWKS().Keys), 0)
+}
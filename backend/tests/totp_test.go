@@ -0,0 +1,64 @@
+package tests_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	testUtil "backend/utils/test"
+	"backend/utils/totp"
+)
+
+// RFC 6238 test secret "12345678901234567890".
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestTOTPCode(t *testing.T) {
+	testCases := []struct {
+		unix     int64
+		expected string
+	}{
+		{unix: 59, expected: "287082"},
+		{unix: 1111111109, expected: "081804"},
+		{unix: 1234567890, expected: "005924"},
+		{unix: 2000000000, expected: "279037"},
+	}
+
+	for _, tc := range testCases {
+		code, err := totp.Code(rfcSecret, time.Unix(tc.unix, 0))
+		testUtil.NoError(t, err)
+		testUtil.Equal(t, code, tc.expected)
+	}
+}
+
+func TestTOTPValidate(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+
+	testUtil.Equal(t, totp.Validate(rfcSecret, "005924", now), true)
+	testUtil.Equal(t, totp.Validate(rfcSecret, "005924", now.Add(30*time.Second)), true)
+	testUtil.Equal(t, totp.Validate(rfcSecret, "005924", now.Add(90*time.Second)), false)
+	testUtil.Equal(t, totp.Validate(rfcSecret, "000000", now), false)
+	testUtil.Equal(t, totp.Validate(rfcSecret, "5924", now), false)
+
+	secret, err := totp.GenerateSecret()
+	testUtil.NoError(t, err)
+	testUtil.Equal(t, len(secret), 32)
+
+	uri := totp.URI("HealthHub", "email@email.com", secret)
+	testUtil.Equal(t, strings.HasPrefix(uri, "otpauth://totp/HealthHub:email@email.com?"), true)
+}
+
+func TestTOTPStep(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+
+	step, ok := totp.Step(rfcSecret, "005924", now)
+	testUtil.Equal(t, ok, true)
+	testUtil.Equal(t, step, int64(1234567890/30))
+
+	// A code of the previous period is still accepted, with its own step.
+	step, ok = totp.Step(rfcSecret, "005924", now.Add(30*time.Second))
+	testUtil.Equal(t, ok, true)
+	testUtil.Equal(t, step, int64(1234567890/30))
+
+	_, ok = totp.Step(rfcSecret, "000000", now)
+	testUtil.Equal(t, ok, false)
+}
@@ -2,6 +2,7 @@ package tests_test
 
 import (
 	"testing"
+	"time"
 
 	"backend/utils/validator"
 )
@@ -41,6 +42,27 @@ var tests = []*testCase{
 		}{Password: "password"},
 		expected: "password must contain at least one uppercase letter, one lowercase letter, one digit, and one special character",
 	},
+	{
+		name: `pesel`,
+		input: struct {
+			PESEL string `json:"pesel" form:"pesel"`
+		}{PESEL: "90010112348"},
+		expected: "pesel must be a valid PESEL number",
+	},
+	{
+		name: `past_date`,
+		input: struct {
+			DateOfBirth string `json:"dateOfBirth" form:"past_date"`
+		}{DateOfBirth: "2999-01-01"},
+		expected: "dateOfBirth must be a date in the past",
+	},
+	{
+		name: `fqdn`,
+		input: struct {
+			EmailDomain string `json:"emailDomain" form:"fqdn"`
+		}{EmailDomain: "@example.com"},
+		expected: "emailDomain must be a domain name, e.g. example.com",
+	},
 	{
 		name: `required_without`,
 		input: struct {
@@ -67,3 +89,38 @@ func TestToErrResponse(t *testing.T) {
 		})
 	}
 }
+
+func TestParsePESEL(t *testing.T) {
+	testCases := []struct {
+		pesel     string
+		birthDate string
+		female    bool
+		ok        bool
+	}{
+		{pesel: "90010112349", birthDate: "1990-01-01", female: true, ok: true},
+		{pesel: "90010112356", birthDate: "1990-01-01", female: false, ok: true},
+		{pesel: "02270803624", birthDate: "2002-07-08", female: true, ok: true},
+		{pesel: "90010112348"},
+		{pesel: "9001011234"},
+		{pesel: "9001011234a"},
+		{pesel: "90023112347"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.pesel, func(t *testing.T) {
+			birthDate, female, ok := validator.ParsePESEL(tc.pesel)
+			if ok != tc.ok {
+				t.Fatalf(`Expected ok:"%v", Got:"%v"`, tc.ok, ok)
+			}
+			if !ok {
+				return
+			}
+			if got := birthDate.Format(time.DateOnly); got != tc.birthDate {
+				t.Fatalf(`Expected:"%v", Got:"%v"`, tc.birthDate, got)
+			}
+			if female != tc.female {
+				t.Fatalf(`Expected female:"%v", Got:"%v"`, tc.female, female)
+			}
+		})
+	}
+}
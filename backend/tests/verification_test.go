@@ -0,0 +1,154 @@
+package tests
+
+import (
+	"backend/api/resource/users"
+	"backend/utils/logger"
+	"backend/utils/mailer"
+	mockDB "backend/utils/mock"
+	"backend/utils/sessionstore"
+	testUtil "backend/utils/test"
+	validatorUtil "backend/utils/validator"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/google/uuid"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestVerificationToken(t *testing.T) {
+	secret := []byte("secret")
+	id := uuid.New()
+	now := time.Now()
+
+	signed := users.SignVerificationToken(secret, id, "email@email.com", now.Add(time.Hour))
+
+	parsedID, email, err := users.ParseVerificationToken(secret, signed, now)
+	testUtil.NoError(t, err)
+	testUtil.Equal(t, parsedID, id)
+	testUtil.Equal(t, email, "email@email.com")
+
+	_, _, err = users.ParseVerificationToken(secret, signed, now.Add(2*time.Hour))
+	testUtil.Equal(t, err, users.ErrInvalidVerificationToken)
+
+	_, _, err = users.ParseVerificationToken([]byte("other"), signed, now)
+	testUtil.Equal(t, err, users.ErrInvalidVerificationToken)
+
+	forged := users.SignVerificationToken(secret, id, "other@email.com", now.Add(time.Hour))
+	payload, _, _ := strings.Cut(forged, ".")
+	_, signature, _ := strings.Cut(signed, ".")
+	_, _, err = users.ParseVerificationToken(secret, payload+"."+signature, now)
+	testUtil.Equal(t, err, users.ErrInvalidVerificationToken)
+}
+
+func TestVerifyEmail(t *testing.T) {
+	l := logger.New(false)
+	v := validatorUtil.New()
+	db, mock, err := mockDB.NewMockDB()
+	testUtil.NoError(t, err)
+
+	s := sessionstore.NewMemory(sessionstore.DefaultOptions, []byte("secret"))
+
+	secret := []byte("secret")
+	usersAPI := users.New(l, db, v, s, nil, nil, &users.Config{Verification: users.Verification{Secret: secret, TTL: time.Hour}})
+
+	id := uuid.New()
+	email := "email@email.com"
+
+	mock.ExpectQuery("^SELECT (.+) FROM \"users\" WHERE (.+)").
+		WithArgs(id, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "email", "role", "status"}).
+			AddRow(id, "user1", email, "patient", "pending"))
+	mock.ExpectBegin()
+	mock.ExpectExec("^UPDATE \"users\" SET").
+		WithArgs(sqlmock.AnyArg(), "active", id, email, "pending").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	form := &users.VerifyEmailForm{Token: users.SignVerificationToken(secret, id, email, time.Now().Add(time.Hour))}
+	body, _ := json.Marshal(form)
+	req, err := http.NewRequest("POST", "/api/v1/users/email/verify", bytes.NewReader(body))
+	testUtil.NoError(t, err)
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(usersAPI.VerifyEmail).ServeHTTP(rr, req)
+	testUtil.Equal(t, rr.Code, http.StatusOK)
+
+	response := &users.UserResponse{}
+	testUtil.NoError(t, json.NewDecoder(rr.Body).Decode(response))
+	testUtil.Equal(t, response.EmailVerified, true)
+	testUtil.Equal(t, response.Status, "active")
+	testUtil.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestAddUserSendsVerification(t *testing.T) {
+	l := logger.New(false)
+	v := validatorUtil.New()
+	db, mock, err := mockDB.NewMockDB()
+	testUtil.NoError(t, err)
+
+	s := sessionstore.NewMemory(sessionstore.DefaultOptions, []byte("secret"))
+
+	mail := mailer.NewMemory()
+	config := &users.Config{Verification: users.Verification{Secret: []byte("secret"), URL: "https://healthhub/verify", TTL: time.Hour}}
+	usersAPI := users.New(l, db, v, s, nil, mailer.NewSender(mail, mailer.DefaultLocale), config)
+
+	mock.ExpectQuery("^SELECT (.+) FROM \"users\" WHERE (.+)").
+		WithArgs("email@email.com", 1).
+		WillReturnRows(&sqlmock.Rows{})
+	mock.ExpectBegin()
+	mock.ExpectExec("^INSERT INTO \"users\" ").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	body, _ := json.Marshal(&users.Form{Name: "name", Email: "email@email.com", Password: "Password@123", Role: "patient"})
+	req, err := http.NewRequest("POST", "/api/v1/users", bytes.NewReader(body))
+	testUtil.NoError(t, err)
+	req.Header.Set("Accept-Language", "pl-PL,pl;q=0.9,en;q=0.8")
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(usersAPI.Create).ServeHTTP(rr, req)
+	testUtil.Equal(t, rr.Code, http.StatusCreated)
+
+	sent := mail.Messages()
+	testUtil.Equal(t, len(sent), 1)
+	testUtil.Equal(t, sent[0].To, "email@email.com")
+	testUtil.Equal(t, sent[0].Subject, "Potwierdź swój adres e-mail")
+	testUtil.Equal(t, strings.Contains(sent[0].Text, "https://healthhub/verify?token="), true)
+	testUtil.Equal(t, strings.Contains(sent[0].HTML, "https://healthhub/verify?token="), true)
+}
+
+func TestLoginUnverified(t *testing.T) {
+	l := logger.New(false)
+	v := validatorUtil.New()
+	db, mock, err := mockDB.NewMockDB()
+	testUtil.NoError(t, err)
+
+	s := sessionstore.NewMemory(sessionstore.DefaultOptions, []byte("secret"))
+
+	usersAPI := users.New(l, db, v, s, nil, nil, &users.Config{Verification: users.Verification{TTL: time.Hour, Required: true}})
+
+	password := "Password@123"
+	pass, _ := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	email := "email@email.com"
+
+	mockNotLocked(mock)
+	mock.ExpectQuery("^SELECT (.+) FROM \"users\" WHERE (.+)").
+		WithArgs(email, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "email", "password", "role", "status", "email_verified_at"}).
+			AddRow(uuid.New(), "user1", email, pass, "patient", "pending", nil))
+	mockResetLoginFailures(mock)
+
+	body, _ := json.Marshal(&users.LoginForm{Email: email, Password: password})
+	req, err := http.NewRequest("POST", "/api/v1/users/login", bytes.NewReader(body))
+	testUtil.NoError(t, err)
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(usersAPI.Login).ServeHTTP(rr, req)
+	testUtil.Equal(t, rr.Code, http.StatusForbidden)
+	testUtil.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,43 @@
+package etag
+
+import (
+	"strconv"
+	"strings"
+)
+
+// FromVersion returns the strong entity tag of a resource version.
+func FromVersion(version int) string {
+	return `"` + strconv.Itoa(version) + `"`
+}
+
+// MatchStrong reports whether an If-Match header lists the tag, using the
+// strong comparison of RFC 9110: weak tags never match.
+func MatchStrong(header, tag string) bool {
+	for _, t := range split(header) {
+		if t == "*" || (!strings.HasPrefix(t, "W/") && t == tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchWeak reports whether an If-None-Match header lists the tag, using the
+// weak comparison of RFC 9110 that ignores the W/ prefix.
+func MatchWeak(header, tag string) bool {
+	for _, t := range split(header) {
+		if t == "*" || strings.TrimPrefix(t, "W/") == strings.TrimPrefix(tag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+func split(header string) []string {
+	var tags []string
+	for _, t := range strings.Split(header, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			tags = append(tags, t)
+		}
+	}
+	return tags
+}
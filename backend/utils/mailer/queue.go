@@ -0,0 +1,85 @@
+package mailer
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+var ErrQueueFull = errors.New("mail queue is full")
+
+// Queue sends messages in the background so that a slow or unavailable mail
+// server does not hold up requests. Failed deliveries are retried with an
+// exponential backoff and dropped, with an error logged, after the last retry.
+type Queue struct {
+	next    Mailer
+	logger  *zerolog.Logger
+	jobs    chan *Message
+	retries int
+	backoff time.Duration
+	wg      sync.WaitGroup
+}
+
+func NewQueue(next Mailer, l *zerolog.Logger, size, workers, retries int, backoff time.Duration) *Queue {
+	q := &Queue{
+		next:    next,
+		logger:  l,
+		jobs:    make(chan *Message, size),
+		retries: retries,
+		backoff: backoff,
+	}
+
+	for range max(workers, 1) {
+		q.wg.Add(1)
+		go q.work()
+	}
+
+	return q
+}
+
+// Send enqueues the message. It only fails when the queue is full.
+func (q *Queue) Send(_ context.Context, msg *Message) error {
+	select {
+	case q.jobs <- msg:
+		return nil
+	default:
+		return ErrQueueFull
+	}
+}
+
+// Close waits until the queued messages are delivered. No message may be sent
+// after Close was called.
+func (q *Queue) Close() {
+	close(q.jobs)
+	q.wg.Wait()
+}
+
+func (q *Queue) work() {
+	defer q.wg.Done()
+
+	for msg := range q.jobs {
+		q.deliver(msg)
+	}
+}
+
+func (q *Queue) deliver(msg *Message) {
+	delay := q.backoff
+	for attempt := 0; ; attempt++ {
+		err := q.next.Send(context.Background(), msg)
+		if err == nil {
+			return
+		}
+
+		if attempt >= q.retries {
+			q.logger.Error().Err(err).Str("to", msg.To).Str("subject", msg.Subject).Msg("Sending mail failed")
+			return
+		}
+
+		q.logger.Warn().Err(err).Int("attempt", attempt+1).Dur("retryIn", delay).Msg("Sending mail failed, retrying")
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
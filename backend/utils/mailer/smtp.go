@@ -0,0 +1,45 @@
+package mailer
+
+import (
+	"context"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strconv"
+	"time"
+)
+
+// SMTP sends messages through an SMTP relay, using STARTTLS when the server
+// offers it.
+type SMTP struct {
+	addr string
+	auth smtp.Auth
+	from string
+}
+
+func NewSMTP(host string, port int, username, password, from string) *SMTP {
+	var auth smtp.Auth
+	if username != "" {
+		auth = smtp.PlainAuth("", username, password, host)
+	}
+
+	return &SMTP{
+		addr: net.JoinHostPort(host, strconv.Itoa(port)),
+		auth: auth,
+		from: from,
+	}
+}
+
+func (m *SMTP) Send(_ context.Context, msg *Message) error {
+	data, err := Format(m.from, msg, time.Now())
+	if err != nil {
+		return err
+	}
+
+	sender := m.from
+	if address, err := mail.ParseAddress(m.from); err == nil {
+		sender = address.Address
+	}
+
+	return smtp.SendMail(m.addr, m.auth, sender, []string{msg.To}, data)
+}
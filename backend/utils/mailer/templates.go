@@ -0,0 +1,147 @@
+package mailer
+
+import (
+	"bytes"
+	"context"
+	"embed"
+	"fmt"
+	htmltemplate "html/template"
+	"io/fs"
+	"path"
+	"strings"
+	texttemplate "text/template"
+)
+
+// Templates live in templates/<locale>/<name>.txt with an optional
+// <name>.html next to them. The text template defines the subject in a
+// "subject" block.
+//
+//go:embed templates
+var files embed.FS
+
+const DefaultLocale = "en"
+
+type localized struct {
+	text *texttemplate.Template
+	html *htmltemplate.Template
+}
+
+var templates = mustParse(files)
+
+func mustParse(fsys fs.FS) map[string]*localized {
+	parsed := map[string]*localized{}
+
+	paths, err := fs.Glob(fsys, "templates/*/*.txt")
+	if err != nil {
+		panic(err)
+	}
+
+	for _, p := range paths {
+		locale := path.Base(path.Dir(p))
+		name := strings.TrimSuffix(path.Base(p), ".txt")
+
+		t := &localized{text: texttemplate.Must(texttemplate.ParseFS(fsys, p))}
+		if h := strings.TrimSuffix(p, ".txt") + ".html"; exists(fsys, h) {
+			t.html = htmltemplate.Must(htmltemplate.ParseFS(fsys, h))
+		}
+
+		parsed[locale+"/"+name] = t
+	}
+
+	return parsed
+}
+
+func exists(fsys fs.FS, name string) bool {
+	_, err := fs.Stat(fsys, name)
+	return err == nil
+}
+
+// Locales returns the locales a template is available in.
+func Locales(name string) []string {
+	var locales []string
+	for key := range templates {
+		if locale, n, _ := strings.Cut(key, "/"); n == name {
+			locales = append(locales, locale)
+		}
+	}
+	return locales
+}
+
+// Render executes the template in the given locale, falling back to the
+// default locale when it is not translated.
+func Render(name, locale string, data any) (*Message, error) {
+	t, ok := templates[locale+"/"+name]
+	if !ok {
+		t, ok = templates[DefaultLocale+"/"+name]
+	}
+	if !ok {
+		return nil, fmt.Errorf("mail template %s not found", name)
+	}
+
+	var subject, text bytes.Buffer
+	if err := t.text.ExecuteTemplate(&subject, "subject", data); err != nil {
+		return nil, err
+	}
+	if err := t.text.Execute(&text, data); err != nil {
+		return nil, err
+	}
+
+	msg := &Message{
+		Subject: strings.TrimSpace(subject.String()),
+		Text:    strings.TrimLeft(text.String(), "\n"),
+	}
+
+	if t.html != nil {
+		var html bytes.Buffer
+		if err := t.html.Execute(&html, data); err != nil {
+			return nil, err
+		}
+		msg.HTML = html.String()
+	}
+
+	return msg, nil
+}
+
+// Sender renders templated messages and hands them to a Mailer.
+type Sender struct {
+	mailer Mailer
+	locale string
+}
+
+func NewSender(m Mailer, defaultLocale string) *Sender {
+	if defaultLocale == "" {
+		defaultLocale = DefaultLocale
+	}
+
+	return &Sender{mailer: m, locale: defaultLocale}
+}
+
+// Send renders the template in the preferred language of an Accept-Language
+// header and sends it to the recipient.
+func (s *Sender) Send(ctx context.Context, to, acceptLanguage, name string, data any) error {
+	msg, err := Render(name, s.Locale(name, acceptLanguage), data)
+	if err != nil {
+		return err
+	}
+	msg.To = to
+
+	return s.mailer.Send(ctx, msg)
+}
+
+// Locale picks the first language of an Accept-Language header the template
+// is translated to. Quality values are ignored, clients list languages in the
+// order of preference anyway.
+func (s *Sender) Locale(name, acceptLanguage string) string {
+	available := Locales(name)
+	for _, tag := range strings.Split(acceptLanguage, ",") {
+		language, _, _ := strings.Cut(strings.TrimSpace(tag), ";")
+		language, _, _ = strings.Cut(strings.ToLower(language), "-")
+		for _, locale := range available {
+			if locale == language {
+				return locale
+			}
+		}
+	}
+
+	return s.locale
+}
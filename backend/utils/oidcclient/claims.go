@@ -0,0 +1,63 @@
+package oidcclient
+
+import "strings"
+
+// Claims of an ID token. Names may be dotted paths into nested objects, e.g.
+// realm_access.roles.
+type Claims map[string]any
+
+func (c Claims) lookup(name string) any {
+	var v any = map[string]any(c)
+	for _, part := range strings.Split(name, ".") {
+		m, ok := v.(map[string]any)
+		if !ok {
+			return nil
+		}
+		v = m[part]
+	}
+	return v
+}
+
+func (c Claims) String(name string) string {
+	s, _ := c.lookup(name).(string)
+	return s
+}
+
+// Bool also accepts "true", which some providers send for email_verified.
+func (c Claims) Bool(name string) bool {
+	switch v := c.lookup(name).(type) {
+	case bool:
+		return v
+	case string:
+		return v == "true"
+	}
+	return false
+}
+
+// Strings returns a claim that is a string or a list of strings.
+func (c Claims) Strings(name string) []string {
+	switch v := c.lookup(name).(type) {
+	case string:
+		return []string{v}
+	case []any:
+		values := make([]string, 0, len(v))
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+// HasAudience reports whether the aud claim, a string or a list, names the
+// client.
+func (c Claims) HasAudience(clientID string) bool {
+	for _, aud := range c.Strings("aud") {
+		if aud == clientID {
+			return true
+		}
+	}
+	return false
+}
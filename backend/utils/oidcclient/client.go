@@ -0,0 +1,340 @@
+// Package oidcclient signs users in with an upstream OpenID Connect provider
+// using the authorization code flow with PKCE.
+package oidcclient
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"backend/utils/token"
+)
+
+var (
+	ErrIssuerMismatch   = errors.New("provider metadata names another issuer")
+	ErrMalformed        = errors.New("id token is malformed")
+	ErrUnknownKey       = errors.New("id token is signed with an unknown key")
+	ErrInvalidSignature = errors.New("id token signature is invalid")
+	ErrInvalidClaims    = errors.New("id token claims are invalid")
+)
+
+var Now = time.Now
+
+// leeway tolerates clocks of the provider running slightly ahead or behind.
+const leeway = time.Minute
+
+// Metadata is the part of the OpenID Provider Metadata a relying party needs.
+type Metadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// Config identifies this service as a client of the provider.
+type Config struct {
+	ClientID     string
+	ClientSecret string
+	RedirectURI  string
+}
+
+// Request holds the values of an authorization request that have to be kept
+// until the user returns with the code.
+type Request struct {
+	State    string
+	Nonce    string
+	Verifier string
+}
+
+type provider struct {
+	metadata  *Metadata
+	keys      map[string]*rsa.PublicKey
+	fetchedAt time.Time
+}
+
+// Client fetches and caches the metadata and signing keys of providers.
+type Client struct {
+	http *http.Client
+	ttl  time.Duration
+
+	mu        sync.Mutex
+	providers map[string]*provider
+}
+
+func New(httpClient *http.Client, ttl time.Duration) *Client {
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: 10 * time.Second}
+	}
+
+	return &Client{
+		http:      httpClient,
+		ttl:       ttl,
+		providers: map[string]*provider{},
+	}
+}
+
+// NewRequest generates the state, nonce and PKCE verifier of an authorization
+// request.
+func NewRequest() (*Request, error) {
+	values := make([]string, 3)
+	for i := range values {
+		b := make([]byte, 32)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		values[i] = base64.RawURLEncoding.EncodeToString(b)
+	}
+
+	return &Request{State: values[0], Nonce: values[1], Verifier: values[2]}, nil
+}
+
+// Discover returns the metadata of the provider at issuer.
+func (c *Client) Discover(ctx context.Context, issuer string) (*Metadata, error) {
+	p, err := c.provider(ctx, issuer, false)
+	if err != nil {
+		return nil, err
+	}
+
+	return p.metadata, nil
+}
+
+// AuthCodeURL is where the user agent is sent to sign in with the provider.
+func (c *Client) AuthCodeURL(metadata *Metadata, config *Config, request *Request, scope string) string {
+	sum := sha256.Sum256([]byte(request.Verifier))
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {config.ClientID},
+		"redirect_uri":          {config.RedirectURI},
+		"scope":                 {scope},
+		"state":                 {request.State},
+		"nonce":                 {request.Nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(sum[:])},
+		"code_challenge_method": {"S256"},
+	}
+
+	separator := "?"
+	if strings.Contains(metadata.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return metadata.AuthorizationEndpoint + separator + q.Encode()
+}
+
+// Exchange redeems the code at the token endpoint and returns the ID token.
+func (c *Client) Exchange(ctx context.Context, metadata *Metadata, config *Config, code, verifier string) (string, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {config.RedirectURI},
+		"code_verifier": {verifier},
+		"client_id":     {config.ClientID},
+	}
+	if config.ClientSecret != "" {
+		form.Set("client_secret", config.ClientSecret)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", metadata.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	var response struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := c.do(req, &response); err != nil {
+		if response.Error != "" {
+			return "", fmt.Errorf("token endpoint: %s: %s", response.Error, response.ErrorDescription)
+		}
+		return "", err
+	}
+	if response.IDToken == "" {
+		return "", errors.New("token endpoint returned no id token")
+	}
+
+	return response.IDToken, nil
+}
+
+// Verify checks the signature, issuer, audience, expiry and nonce of an ID
+// token and returns its claims. Only RS256, which every provider has to
+// support, is accepted.
+func (c *Client) Verify(ctx context.Context, metadata *Metadata, config *Config, idToken, nonce string) (Claims, error) {
+	parts := strings.Split(idToken, ".")
+	if len(parts) != 3 {
+		return nil, ErrMalformed
+	}
+
+	var header struct {
+		Algorithm string `json:"alg"`
+		KeyID     string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, ErrMalformed
+	}
+	if header.Algorithm != token.RS256 {
+		return nil, ErrInvalidSignature
+	}
+
+	key, err := c.key(ctx, metadata.Issuer, header.KeyID)
+	if err != nil {
+		return nil, err
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrMalformed
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature); err != nil {
+		return nil, ErrInvalidSignature
+	}
+
+	claims := Claims{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, ErrMalformed
+	}
+
+	now := Now()
+	exp, ok := claims["exp"].(float64)
+	if claims.String("iss") != metadata.Issuer ||
+		!claims.HasAudience(config.ClientID) ||
+		!ok || now.After(time.Unix(int64(exp), 0).Add(leeway)) ||
+		claims.String("sub") == "" ||
+		subtle.ConstantTimeCompare([]byte(claims.String("nonce")), []byte(nonce)) != 1 {
+		return nil, ErrInvalidClaims
+	}
+
+	return claims, nil
+}
+
+// provider returns the cached metadata and keys of the issuer, fetching them
+// when they are missing, stale or refresh is set.
+func (c *Client) provider(ctx context.Context, issuer string, refresh bool) (*provider, error) {
+	c.mu.Lock()
+	p, ok := c.providers[issuer]
+	c.mu.Unlock()
+	if ok && !refresh && Now().Sub(p.fetchedAt) < c.ttl {
+		return p, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", strings.TrimSuffix(issuer, "/")+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return nil, err
+	}
+	metadata := &Metadata{}
+	if err := c.do(req, metadata); err != nil {
+		return nil, err
+	}
+	if metadata.Issuer != issuer {
+		return nil, ErrIssuerMismatch
+	}
+
+	req, err = http.NewRequestWithContext(ctx, "GET", metadata.JWKSURI, nil)
+	if err != nil {
+		return nil, err
+	}
+	set := &token.JWKS{}
+	if err := c.do(req, set); err != nil {
+		return nil, err
+	}
+
+	p = &provider{metadata: metadata, keys: map[string]*rsa.PublicKey{}, fetchedAt: Now()}
+	for _, jwk := range set.Keys {
+		if key, err := publicKey(&jwk); err == nil {
+			p.keys[jwk.KeyID] = key
+		}
+	}
+
+	c.mu.Lock()
+	c.providers[issuer] = p
+	c.mu.Unlock()
+
+	return p, nil
+}
+
+// key looks up a signing key, refetching the key set once for an unknown key
+// id as the provider may have rotated its keys.
+func (c *Client) key(ctx context.Context, issuer, keyID string) (*rsa.PublicKey, error) {
+	p, err := c.provider(ctx, issuer, false)
+	if err != nil {
+		return nil, err
+	}
+	if key, ok := p.keys[keyID]; ok {
+		return key, nil
+	}
+
+	p, err = c.provider(ctx, issuer, true)
+	if err != nil {
+		return nil, err
+	}
+	if key, ok := p.keys[keyID]; ok {
+		return key, nil
+	}
+
+	return nil, ErrUnknownKey
+}
+
+// do sends the request and decodes the JSON response into v, also when the
+// status is an error so that OAuth error responses can be read.
+func (c *Client) do(req *http.Request, v any) error {
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	decodeErr := json.Unmarshal(body, v)
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s %s: %s", req.Method, req.URL.Redacted(), resp.Status)
+	}
+	return decodeErr
+}
+
+func publicKey(jwk *token.JWK) (*rsa.PublicKey, error) {
+	if jwk.KeyType != "RSA" {
+		return nil, errors.New("not an RSA key")
+	}
+
+	n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+	if err != nil {
+		return nil, err
+	}
+	e, err := base64.RawURLEncoding.DecodeString(jwk.E)
+	if err != nil {
+		return nil, err
+	}
+
+	return &rsa.PublicKey{
+		N: new(big.Int).SetBytes(n),
+		E: int(new(big.Int).SetBytes(e).Int64()),
+	}, nil
+}
+
+func decodeSegment(segment string, v any) error {
+	b, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
@@ -0,0 +1,127 @@
+package pagination
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"slices"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// cursor is the position of a row in the sort order. Clients get it
+// base64 encoded and must not rely on its contents.
+type cursor struct {
+	Sort   string `json:"s,omitempty"`
+	Desc   bool   `json:"d,omitempty"`
+	Value  any    `json:"v,omitempty"`
+	ID     any    `json:"id"`
+	Before bool   `json:"b,omitempty"`
+}
+
+func (c *cursor) encode() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// DecodeCursor reads the cursor given in the query. It has to be called
+// once the sort order is set, a cursor made for another order is invalid.
+func (p *Pagination) DecodeCursor() error {
+	p.after = nil
+	if !p.Keyset || p.Cursor == "" {
+		return nil
+	}
+
+	b, err := base64.RawURLEncoding.DecodeString(p.Cursor)
+	if err != nil {
+		return ErrInvalidCursor
+	}
+	c := &cursor{}
+	if err := json.Unmarshal(b, c); err != nil {
+		return ErrInvalidCursor
+	}
+	if c.ID == nil || c.Sort != p.Sort || c.Desc != p.desc() || (p.Sort != "" && c.Value == nil) {
+		return ErrInvalidCursor
+	}
+
+	p.after = c
+	return nil
+}
+
+// desc reports the direction rows are listed in, the newest ids come first
+// without a sort column.
+func (p *Pagination) desc() bool {
+	return p.Sort == "" || p.Desc
+}
+
+// keyset selects the rows following the cursor, or preceding it when paging
+// backwards, and one more to tell whether there is another page.
+func (p *Pagination) keyset(db *gorm.DB) *gorm.DB {
+	desc := p.desc()
+	if p.after != nil && p.after.Before {
+		desc = !desc
+	}
+
+	if p.after != nil {
+		op := ">"
+		if desc {
+			op = "<"
+		}
+		if p.Sort == "" {
+			db = db.Where("id "+op+" ?", p.after.ID)
+		} else {
+			db = db.Where("(?, id) "+op+" (?, ?)", clause.Column{Name: p.Sort}, p.after.Value, p.after.ID)
+		}
+	}
+
+	if p.Sort != "" {
+		db = db.Order(clause.OrderByColumn{Column: clause.Column{Name: p.Sort}, Desc: desc})
+	}
+	return db.Order(clause.OrderByColumn{Column: clause.Column{Name: "id"}, Desc: desc}).
+		Limit(p.GetLimit() + 1)
+}
+
+// Cursors trims the rows fetched in keyset mode to the page and sets
+// NextCursor and PrevCursor from its first and last rows. key returns the
+// value of the sort column and the id of a row. In page mode rows are
+// returned unchanged.
+func Cursors[S ~[]T, T any](p *Pagination, rows S, key func(row T, column string) (any, any)) S {
+	if !p.Keyset {
+		return rows
+	}
+
+	before := p.after != nil && p.after.Before
+	more := len(rows) > p.GetLimit()
+	if more {
+		rows = rows[:p.GetLimit()]
+	}
+	if before {
+		slices.Reverse(rows)
+	}
+	if len(rows) == 0 {
+		return rows
+	}
+
+	position := func(row T, before bool) string {
+		value, id := key(row, p.Sort)
+		c := &cursor{Sort: p.Sort, Desc: p.desc(), ID: id, Before: before}
+		if p.Sort != "" {
+			c.Value = value
+		}
+		return c.encode()
+	}
+
+	// Paging backwards there always is a next page, paging forwards there
+	// is a previous one unless this is the first page.
+	if before || more {
+		p.NextCursor = position(rows[len(rows)-1], false)
+	}
+	if (before && more) || (!before && p.after != nil) {
+		p.PrevCursor = position(rows[0], true)
+	}
+
+	return rows
+}
@@ -6,15 +6,33 @@ import (
 	"strconv"
 
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 type Pagination struct {
-	Limit      int `form:"limit"`
-	Page       int `form:"page"`
-	Role       any
+	Limit int `form:"limit"`
+	Page  int `form:"page"`
+	Role  any
+	// WithDeleted includes soft deleted rows.
+	WithDeleted bool
+	// Sort is the column rows are ordered by, with the id breaking ties.
+	// Without it the newest ids come first.
+	Sort string
+	Desc bool
+	// Filters narrow down the rows, the total counts only matching ones.
+	Filters []func(*gorm.DB) *gorm.DB
+	// Keyset lists the rows following Cursor instead of a page, and counts
+	// them only WithCount.
+	Keyset     bool
+	Cursor     string `json:"cursor" form:"omitempty,base64rawurl,max=1024"`
+	WithCount  bool
+	NextCursor string
+	PrevCursor string
 	TotalRows  int64
 	TotalPages int
 	Rows       any
+
+	after *cursor
 }
 
 func (p *Pagination) Parse(query url.Values) {
@@ -39,6 +57,12 @@ func (p *Pagination) Parse(query url.Values) {
 	} else {
 		p.Role = nil
 	}
+
+	p.WithDeleted, _ = strconv.ParseBool(query.Get("includeDeleted"))
+
+	p.Keyset = query.Has("cursor")
+	p.Cursor = query.Get("cursor")
+	p.WithCount, _ = strconv.ParseBool(query.Get("count"))
 }
 
 func (p *Pagination) GetOffset() int {
@@ -59,22 +83,50 @@ func (p *Pagination) GetPage() int {
 	return p.Page
 }
 
-func Paginate(value any, pagination *Pagination, db *gorm.DB) func(db *gorm.DB) *gorm.DB {
-	var totalRows int64
-	if pagination.Role == nil {
-		db.Model(value).Count(&totalRows)
-	} else {
-		db.Model(value).Where("role = ?", pagination.Role).Count(&totalRows)
+// Count sets the total of rows and pages. The rows are counted on db, which
+// names the model, with the same filters as Paginate lists them. Keyset pages
+// are counted only WithCount.
+func (p *Pagination) Count(db *gorm.DB) {
+	if p.Keyset && !p.WithCount {
+		return
 	}
 
-	pagination.TotalRows = totalRows
-	totalPages := int(math.Ceil(float64(totalRows) / float64(pagination.Limit)))
-	pagination.TotalPages = totalPages
+	var totalRows int64
+	db.Scopes(p.filter).Count(&totalRows)
+
+	p.TotalRows = totalRows
+	p.TotalPages = int(math.Ceil(float64(totalRows) / float64(p.GetLimit())))
+}
 
+// Paginate lists the page, or with Keyset the rows following the cursor, of
+// the rows matching the filters.
+func Paginate(pagination *Pagination) func(db *gorm.DB) *gorm.DB {
 	return func(db *gorm.DB) *gorm.DB {
-		if pagination.Role == nil {
-			return db.Offset(pagination.GetOffset()).Limit(pagination.GetLimit()).Order("id desc")
+		db = db.Scopes(pagination.filter)
+		if pagination.Keyset {
+			return db.Scopes(pagination.keyset)
 		}
-		return db.Where("role = ?", pagination.Role).Offset(pagination.GetOffset()).Limit(pagination.GetLimit()).Order("id desc")
+		return db.Scopes(pagination.order).Offset(pagination.GetOffset()).Limit(pagination.GetLimit())
 	}
 }
+
+// filter narrows the rows down to the ones both listed and counted.
+func (p *Pagination) filter(db *gorm.DB) *gorm.DB {
+	if p.WithDeleted {
+		db = db.Unscoped()
+	}
+	db = db.Scopes(p.Filters...)
+	if p.Role != nil {
+		db = db.Where("role = ?", p.Role)
+	}
+	return db
+}
+
+func (p *Pagination) order(db *gorm.DB) *gorm.DB {
+	if p.Sort == "" {
+		return db.Order("id desc")
+	}
+
+	return db.Order(clause.OrderByColumn{Column: clause.Column{Name: p.Sort}, Desc: p.Desc}).
+		Order(clause.OrderByColumn{Column: clause.Column{Name: "id"}, Desc: p.Desc})
+}
@@ -0,0 +1,51 @@
+package sessionstore
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gorilla/sessions"
+	"github.com/wader/gormstore/v2"
+	"gorm.io/gorm"
+)
+
+// cleanupInterval is how often expired sessions are deleted from the table.
+const cleanupInterval = time.Hour
+
+// Gorm keeps sessions in the sessions table of the database.
+type Gorm struct {
+	store *gormstore.Store
+	quit  chan struct{}
+}
+
+func NewGorm(db *gorm.DB, opts sessions.Options, keyPairs ...[]byte) *Gorm {
+	store := gormstore.New(db, keyPairs...)
+	*store.SessionOpts = opts
+	store.MaxAge(opts.MaxAge)
+
+	g := &Gorm{store: store, quit: make(chan struct{})}
+	go store.PeriodicCleanup(cleanupInterval, g.quit)
+
+	return g
+}
+
+func (g *Gorm) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(g, name)
+}
+
+func (g *Gorm) New(r *http.Request, name string) (*sessions.Session, error) {
+	return g.store.New(r, name)
+}
+
+func (g *Gorm) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	return g.store.Save(r, w, session)
+}
+
+func (g *Gorm) MaxAge() time.Duration {
+	return time.Duration(g.store.SessionOpts.MaxAge) * time.Second
+}
+
+func (g *Gorm) Close() error {
+	close(g.quit)
+	return nil
+}
@@ -0,0 +1,101 @@
+package sessionstore
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/gorilla/sessions"
+)
+
+// sweepInterval limits how often expired sessions are removed from memory.
+const sweepInterval = time.Minute
+
+// Memory keeps sessions in the process. They are lost on restart and not
+// shared between instances, so it suits tests and single instance setups.
+type Memory struct {
+	*kvStore
+	sessions *memoryBackend
+}
+
+type memoryEntry struct {
+	data      []byte
+	expiresAt time.Time
+}
+
+type memoryBackend struct {
+	mu        sync.Mutex
+	entries   map[string]memoryEntry
+	lastSweep time.Time
+}
+
+func NewMemory(opts sessions.Options, keyPairs ...[]byte) *Memory {
+	b := &memoryBackend{entries: map[string]memoryEntry{}}
+
+	return &Memory{
+		kvStore:  newKVStore(b, opts, keyPairs...),
+		sessions: b,
+	}
+}
+
+// Len returns the number of sessions that have not expired.
+func (m *Memory) Len() int {
+	m.sessions.mu.Lock()
+	defer m.sessions.mu.Unlock()
+
+	now := time.Now()
+	n := 0
+	for _, e := range m.sessions.entries {
+		if now.Before(e.expiresAt) {
+			n++
+		}
+	}
+	return n
+}
+
+func (m *Memory) Close() error {
+	return nil
+}
+
+func (b *memoryBackend) load(_ context.Context, id string) ([]byte, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	e, ok := b.entries[id]
+	if !ok {
+		return nil, nil
+	}
+	if !time.Now().Before(e.expiresAt) {
+		delete(b.entries, id)
+		return nil, nil
+	}
+
+	return e.data, nil
+}
+
+func (b *memoryBackend) save(_ context.Context, id string, data []byte, ttl time.Duration) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.entries[id] = memoryEntry{data: data, expiresAt: now.Add(ttl)}
+
+	if now.Sub(b.lastSweep) > sweepInterval {
+		for key, e := range b.entries {
+			if !now.Before(e.expiresAt) {
+				delete(b.entries, key)
+			}
+		}
+		b.lastSweep = now
+	}
+
+	return nil
+}
+
+func (b *memoryBackend) delete(_ context.Context, id string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	delete(b.entries, id)
+	return nil
+}
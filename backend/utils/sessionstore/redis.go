@@ -0,0 +1,55 @@
+package sessionstore
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/gorilla/sessions"
+	"github.com/redis/go-redis/v9"
+)
+
+// DefaultRedisPrefix is put in front of the session IDs to form the keys.
+const DefaultRedisPrefix = "session:"
+
+// Redis keeps sessions in Redis or a server speaking its protocol, such as
+// Valkey or KeyDB. Expiry is left to the server.
+type Redis struct {
+	*kvStore
+	client redis.UniversalClient
+}
+
+type redisBackend struct {
+	client redis.UniversalClient
+	prefix string
+}
+
+func NewRedis(client redis.UniversalClient, prefix string, opts sessions.Options, keyPairs ...[]byte) *Redis {
+	b := &redisBackend{client: client, prefix: prefix}
+
+	return &Redis{
+		kvStore: newKVStore(b, opts, keyPairs...),
+		client:  client,
+	}
+}
+
+func (s *Redis) Close() error {
+	return s.client.Close()
+}
+
+func (b *redisBackend) load(ctx context.Context, id string) ([]byte, error) {
+	data, err := b.client.Get(ctx, b.prefix+id).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+
+	return data, err
+}
+
+func (b *redisBackend) save(ctx context.Context, id string, data []byte, ttl time.Duration) error {
+	return b.client.Set(ctx, b.prefix+id, data, ttl).Err()
+}
+
+func (b *redisBackend) delete(ctx context.Context, id string) error {
+	return b.client.Del(ctx, b.prefix+id).Err()
+}
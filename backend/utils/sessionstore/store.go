@@ -0,0 +1,154 @@
+// Package sessionstore keeps the server side of the cookie sessions. The
+// cookie only carries a signed session ID; the values are kept in Postgres, in
+// memory or in Redis.
+package sessionstore
+
+import (
+	"context"
+	"encoding/base32"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+)
+
+const idLength = 32
+
+// Store is what the handlers and middlewares depend on.
+type Store interface {
+	sessions.Store
+	// MaxAge is how long a session lives after it was last saved.
+	MaxAge() time.Duration
+	// Close stops the background work of the store and releases its
+	// connections.
+	Close() error
+}
+
+// DefaultOptions are the cookie options of a new store, sessions live 30 days.
+var DefaultOptions = sessions.Options{
+	Path:     "/",
+	MaxAge:   60 * 60 * 24 * 30,
+	HttpOnly: true,
+}
+
+// backend keeps the encoded session values under the session ID.
+type backend interface {
+	// load returns nil when there is no such session or it has expired.
+	load(ctx context.Context, id string) ([]byte, error)
+	save(ctx context.Context, id string, data []byte, ttl time.Duration) error
+	delete(ctx context.Context, id string) error
+}
+
+// kvStore implements the session handling on top of a key-value backend, in
+// the same way as gormstore does on top of a table.
+type kvStore struct {
+	backend backend
+	codecs  []securecookie.Codec
+	options sessions.Options
+}
+
+func newKVStore(b backend, opts sessions.Options, keyPairs ...[]byte) *kvStore {
+	codecs := securecookie.CodecsFromPairs(keyPairs...)
+	for _, codec := range codecs {
+		if sc, ok := codec.(*securecookie.SecureCookie); ok {
+			sc.MaxAge(opts.MaxAge)
+		}
+	}
+
+	return &kvStore{
+		backend: b,
+		codecs:  codecs,
+		options: opts,
+	}
+}
+
+// Get returns a session for the given name after adding it to the registry.
+func (s *kvStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(s, name)
+}
+
+// New creates a session with name without adding it to the registry. A
+// missing, forged or expired session results in a new empty one.
+func (s *kvStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(s, name)
+	opts := s.options
+	session.Options = &opts
+	session.IsNew = true
+
+	id, ok := s.cookieID(r, name)
+	if !ok {
+		return session, nil
+	}
+
+	data, err := s.backend.load(r.Context(), id)
+	if err != nil {
+		return session, err
+	}
+	if data == nil {
+		return session, nil
+	}
+
+	if err := securecookie.DecodeMulti(name, string(data), &session.Values, s.codecs...); err != nil {
+		return session, nil
+	}
+	session.ID = id
+	session.IsNew = false
+
+	return session, nil
+}
+
+// Save stores the session and sets the cookie. A session with a negative
+// MaxAge is deleted.
+func (s *kvStore) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	if session.Options.MaxAge < 0 {
+		if session.ID != "" {
+			if err := s.backend.delete(r.Context(), session.ID); err != nil {
+				return err
+			}
+		}
+		http.SetCookie(w, sessions.NewCookie(session.Name(), "", session.Options))
+		return nil
+	}
+
+	if session.ID == "" {
+		session.ID = strings.TrimRight(base32.StdEncoding.EncodeToString(securecookie.GenerateRandomKey(idLength)), "=")
+	}
+
+	data, err := securecookie.EncodeMulti(session.Name(), session.Values, s.codecs...)
+	if err != nil {
+		return err
+	}
+
+	ttl := time.Duration(session.Options.MaxAge) * time.Second
+	if err := s.backend.save(r.Context(), session.ID, []byte(data), ttl); err != nil {
+		return err
+	}
+
+	id, err := securecookie.EncodeMulti(session.Name(), session.ID, s.codecs...)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, sessions.NewCookie(session.Name(), id, session.Options))
+
+	return nil
+}
+
+func (s *kvStore) MaxAge() time.Duration {
+	return time.Duration(s.options.MaxAge) * time.Second
+}
+
+func (s *kvStore) cookieID(r *http.Request, name string) (string, bool) {
+	cookie, err := r.Cookie(name)
+	if err != nil {
+		return "", false
+	}
+
+	id := ""
+	if err := securecookie.DecodeMulti(name, cookie.Value, &id, s.codecs...); err != nil {
+		return "", false
+	}
+
+	return id, id != ""
+}
@@ -0,0 +1,442 @@
+package token
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	HS256 = "HS256"
+	RS256 = "RS256"
+
+	TypeAccess  = "access"
+	TypeRefresh = "refresh"
+	// TypeOAuth is an access token handed to a relying party. It is only
+	// accepted by the OpenID Connect endpoints, not by the API.
+	TypeOAuth = "oauth"
+)
+
+var (
+	ErrMalformed        = errors.New("token is malformed")
+	ErrInvalidSignature = errors.New("token signature is invalid")
+	ErrExpired          = errors.New("token is expired")
+	ErrInvalidClaims    = errors.New("token claims are invalid")
+	ErrNoPublicKey      = errors.New("active key has no public key")
+)
+
+var Now = time.Now
+
+type header struct {
+	Algorithm string `json:"alg"`
+	Type      string `json:"typ"`
+	KeyID     string `json:"kid,omitempty"`
+}
+
+type Claims struct {
+	ID        string `json:"jti"`
+	Issuer    string `json:"iss"`
+	Subject   string `json:"sub"`
+	Email     string `json:"email"`
+	Role      string `json:"role"`
+	SessionID string `json:"sid,omitempty"`
+	ClientID  string `json:"client_id,omitempty"`
+	Scope     string `json:"scope,omitempty"`
+	Type      string `json:"typ"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// IDClaims are the claims of an OpenID Connect ID token.
+type IDClaims struct {
+	Issuer        string `json:"iss"`
+	Subject       string `json:"sub"`
+	Audience      string `json:"aud"`
+	IssuedAt      int64  `json:"iat"`
+	ExpiresAt     int64  `json:"exp"`
+	AuthTime      int64  `json:"auth_time"`
+	Nonce         string `json:"nonce,omitempty"`
+	SessionID     string `json:"sid,omitempty"`
+	Name          string `json:"name,omitempty"`
+	Email         string `json:"email,omitempty"`
+	EmailVerified *bool  `json:"email_verified,omitempty"`
+	Role          string `json:"role,omitempty"`
+}
+
+type JWK struct {
+	KeyType   string `json:"kty"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid"`
+	N         string `json:"n"`
+	E         string `json:"e"`
+}
+
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+type Pair struct {
+	AccessToken  string `json:"accessToken"`
+	RefreshToken string `json:"refreshToken"`
+	TokenType    string `json:"tokenType"`
+	ExpiresIn    int64  `json:"expiresIn"`
+}
+
+// Key is a single signing key identified by its key id.
+type Key struct {
+	ID         string
+	Algorithm  string
+	secret     []byte
+	privateKey *rsa.PrivateKey
+}
+
+func NewHS256Key(secret []byte) *Key {
+	sum := sha256.Sum256(secret)
+
+	return &Key{
+		ID:        hex.EncodeToString(sum[:8]),
+		Algorithm: HS256,
+		secret:    secret,
+	}
+}
+
+func NewRS256Key(privateKey *rsa.PrivateKey) *Key {
+	der := x509.MarshalPKCS1PublicKey(&privateKey.PublicKey)
+	sum := sha256.Sum256(der)
+
+	return &Key{
+		ID:         hex.EncodeToString(sum[:8]),
+		Algorithm:  RS256,
+		privateKey: privateKey,
+	}
+}
+
+// PublicKey returns the public half of an RS256 key, or nil for a shared
+// secret which must never be published.
+func (k *Key) PublicKey() *rsa.PublicKey {
+	if k.privateKey == nil {
+		return nil
+	}
+	return &k.privateKey.PublicKey
+}
+
+// Manager issues and verifies signed access and refresh tokens. New tokens are
+// signed with the active key, while tokens signed with any of the previous keys
+// are still accepted until those keys are removed from the configuration.
+type Manager struct {
+	active     *Key
+	keys       map[string]*Key
+	issuer     string
+	accessTTL  time.Duration
+	refreshTTL time.Duration
+}
+
+func New(active *Key, previous []*Key, issuer string, accessTTL, refreshTTL time.Duration) *Manager {
+	keys := map[string]*Key{active.ID: active}
+	for _, k := range previous {
+		keys[k.ID] = k
+	}
+
+	return &Manager{
+		active:     active,
+		keys:       keys,
+		issuer:     issuer,
+		accessTTL:  accessTTL,
+		refreshTTL: refreshTTL,
+	}
+}
+
+func NewHS256(secret []byte, issuer string, accessTTL, refreshTTL time.Duration) *Manager {
+	return New(NewHS256Key(secret), nil, issuer, accessTTL, refreshTTL)
+}
+
+func NewRS256(privateKey *rsa.PrivateKey, issuer string, accessTTL, refreshTTL time.Duration) *Manager {
+	return New(NewRS256Key(privateKey), nil, issuer, accessTTL, refreshTTL)
+}
+
+// Keys returns all keys accepted for verification, the active one first.
+func (m *Manager) Keys() []*Key {
+	keys := []*Key{m.active}
+	for id, k := range m.keys {
+		if id != m.active.ID {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+// JWKS returns the public keys accepted for verification. Shared HS256 secrets
+// are left out, so the set is empty unless RS256 is used.
+func (m *Manager) JWKS() *JWKS {
+	set := &JWKS{Keys: []JWK{}}
+	for _, k := range m.Keys() {
+		public := k.PublicKey()
+		if public == nil {
+			continue
+		}
+
+		set.Keys = append(set.Keys, JWK{
+			KeyType:   "RSA",
+			Use:       "sig",
+			Algorithm: k.Algorithm,
+			KeyID:     k.ID,
+			N:         base64.RawURLEncoding.EncodeToString(public.N.Bytes()),
+			E:         base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes()),
+		})
+	}
+	return set
+}
+
+// LoadRSAPrivateKey reads a PEM encoded PKCS#1 or PKCS#8 RSA private key.
+func LoadRSAPrivateKey(path string) (*rsa.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data in %s", path)
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s does not contain an RSA private key", path)
+	}
+
+	return key, nil
+}
+
+// Issue creates an access and refresh token pair for the given user. The pair
+// is bound to the login session sessionID, if any, and stops working when the
+// session is ended.
+func (m *Manager) Issue(subject, email, role, sessionID string) (*Pair, error) {
+	access, err := m.sign(subject, email, role, sessionID, TypeAccess, m.accessTTL)
+	if err != nil {
+		return nil, err
+	}
+
+	refresh, err := m.sign(subject, email, role, sessionID, TypeRefresh, m.refreshTTL)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Pair{
+		AccessToken:  access,
+		RefreshToken: refresh,
+		TokenType:    "Bearer",
+		ExpiresIn:    int64(m.accessTTL.Seconds()),
+	}, nil
+}
+
+// Parse verifies the signature, issuer, expiry and type of a token and
+// returns its claims.
+func (m *Manager) Parse(token, tokenType string) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrMalformed
+	}
+
+	h := &header{}
+	if err := decodeSegment(parts[0], h); err != nil {
+		return nil, ErrMalformed
+	}
+
+	key := m.active
+	if h.KeyID != "" {
+		k, ok := m.keys[h.KeyID]
+		if !ok {
+			return nil, ErrInvalidSignature
+		}
+		key = k
+	}
+
+	// The algorithm is never taken from the token itself, otherwise an RS256
+	// public key could be used as an HS256 secret.
+	if h.Algorithm != key.Algorithm {
+		return nil, ErrInvalidSignature
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrMalformed
+	}
+
+	if err := key.verify(parts[0]+"."+parts[1], signature); err != nil {
+		return nil, ErrInvalidSignature
+	}
+
+	claims := &Claims{}
+	if err := decodeSegment(parts[1], claims); err != nil {
+		return nil, ErrMalformed
+	}
+
+	if claims.Issuer != m.issuer || claims.Type != tokenType || claims.Subject == "" {
+		return nil, ErrInvalidClaims
+	}
+
+	if Now().Unix() >= claims.ExpiresAt {
+		return nil, ErrExpired
+	}
+
+	return claims, nil
+}
+
+// IssueOAuth creates an access token granting the relying party clientID the
+// scope on behalf of the user.
+func (m *Manager) IssueOAuth(subject, clientID, scope, sessionID string) (string, error) {
+	claims, err := m.newClaims(subject, "", "", sessionID, TypeOAuth, m.accessTTL)
+	if err != nil {
+		return "", err
+	}
+	claims.ClientID = clientID
+	claims.Scope = scope
+
+	return m.encode(claims)
+}
+
+// SignIDToken signs an ID token, which expires together with the access token
+// issued with it. Relying parties verify it with the JWKS, so the active key
+// has to be an RS256 key.
+func (m *Manager) SignIDToken(claims *IDClaims) (string, error) {
+	if m.active.PublicKey() == nil {
+		return "", ErrNoPublicKey
+	}
+
+	now := Now()
+	claims.IssuedAt = now.Unix()
+	claims.ExpiresAt = now.Add(m.accessTTL).Unix()
+
+	return m.encode(claims)
+}
+
+// AccessTTL is the lifetime of access and ID tokens.
+func (m *Manager) AccessTTL() time.Duration {
+	return m.accessTTL
+}
+
+// Algorithm is the algorithm tokens are signed with.
+func (m *Manager) Algorithm() string {
+	return m.active.Algorithm
+}
+
+func (m *Manager) sign(subject, email, role, sessionID, tokenType string, ttl time.Duration) (string, error) {
+	claims, err := m.newClaims(subject, email, role, sessionID, tokenType, ttl)
+	if err != nil {
+		return "", err
+	}
+
+	return m.encode(claims)
+}
+
+func (m *Manager) newClaims(subject, email, role, sessionID, tokenType string, ttl time.Duration) (*Claims, error) {
+	jti := make([]byte, 16)
+	if _, err := rand.Read(jti); err != nil {
+		return nil, err
+	}
+
+	now := Now()
+	return &Claims{
+		ID:        hex.EncodeToString(jti),
+		Issuer:    m.issuer,
+		Subject:   subject,
+		Email:     email,
+		Role:      role,
+		SessionID: sessionID,
+		Type:      tokenType,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(ttl).Unix(),
+	}, nil
+}
+
+// encode signs the claims with the active key.
+func (m *Manager) encode(claims any) (string, error) {
+	h, err := encodeSegment(&header{Algorithm: m.active.Algorithm, Type: "JWT", KeyID: m.active.ID})
+	if err != nil {
+		return "", err
+	}
+
+	c, err := encodeSegment(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := h + "." + c
+	signature, err := m.active.signature(signingInput)
+	if err != nil {
+		return "", err
+	}
+
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+func (k *Key) signature(signingInput string) ([]byte, error) {
+	switch k.Algorithm {
+	case HS256:
+		mac := hmac.New(sha256.New, k.secret)
+		mac.Write([]byte(signingInput))
+		return mac.Sum(nil), nil
+	case RS256:
+		digest := sha256.Sum256([]byte(signingInput))
+		return rsa.SignPKCS1v15(rand.Reader, k.privateKey, crypto.SHA256, digest[:])
+	default:
+		return nil, fmt.Errorf("unsupported algorithm %s", k.Algorithm)
+	}
+}
+
+func (k *Key) verify(signingInput string, signature []byte) error {
+	switch k.Algorithm {
+	case HS256:
+		expected, _ := k.signature(signingInput)
+		if !hmac.Equal(expected, signature) {
+			return ErrInvalidSignature
+		}
+		return nil
+	case RS256:
+		digest := sha256.Sum256([]byte(signingInput))
+		return rsa.VerifyPKCS1v15(&k.privateKey.PublicKey, crypto.SHA256, digest[:], signature)
+	default:
+		return fmt.Errorf("unsupported algorithm %s", k.Algorithm)
+	}
+}
+
+func encodeSegment(v any) (string, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+func decodeSegment(segment string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, v)
+}
@@ -0,0 +1,57 @@
+package validator
+
+import (
+	"time"
+
+	"github.com/go-playground/validator/v10"
+)
+
+var (
+	peselWeights   = [10]int{1, 3, 7, 9, 1, 3, 7, 9, 1, 3}
+	peselCenturies = [5]int{1900, 2000, 2100, 2200, 1800}
+)
+
+// ParsePESEL checks the length, checksum and date of birth of a Polish
+// national identification number and returns the date of birth and whether
+// it was issued to a woman.
+func ParsePESEL(pesel string) (birthDate time.Time, female bool, ok bool) {
+	if len(pesel) != 11 {
+		return time.Time{}, false, false
+	}
+
+	digits := make([]int, 11)
+	for i, c := range pesel {
+		if c < '0' || c > '9' {
+			return time.Time{}, false, false
+		}
+		digits[i] = int(c - '0')
+	}
+
+	sum := 0
+	for i, w := range peselWeights {
+		sum += digits[i] * w
+	}
+	if (10-sum%10)%10 != digits[10] {
+		return time.Time{}, false, false
+	}
+
+	// The century is encoded in the month: +80 for the 1800s, +0 for the
+	// 1900s, +20 for the 2000s, +40 for the 2100s and +60 for the 2200s.
+	year := digits[0]*10 + digits[1]
+	month := digits[2]*10 + digits[3]
+	day := digits[4]*10 + digits[5]
+	year += peselCenturies[month/20]
+	month %= 20
+
+	birthDate = time.Date(year, time.Month(month), day, 0, 0, 0, 0, time.UTC)
+	if month < 1 || month > 12 || birthDate.Day() != day {
+		return time.Time{}, false, false
+	}
+
+	return birthDate, digits[9]%2 == 0, true
+}
+
+func isPESEL(fl validator.FieldLevel) bool {
+	_, _, ok := ParsePESEL(fl.Field().String())
+	return ok
+}
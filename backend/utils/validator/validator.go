@@ -6,6 +6,7 @@ import (
 	"regexp"
 	"slices"
 	"strings"
+	"time"
 
 	"github.com/go-playground/validator/v10"
 )
@@ -30,6 +31,11 @@ func New() *validator.Validate {
 	_ = validate.RegisterValidation("alpha_space", isAlphaSpace)
 	_ = validate.RegisterValidation("password", isPassword)
 	_ = validate.RegisterValidation("role", isRole)
+	_ = validate.RegisterValidation("scope", isScope)
+	_ = validate.RegisterValidation("slug", isSlug)
+	_ = validate.RegisterValidation("pesel", isPESEL)
+	_ = validate.RegisterValidation("past_date", isPastDate)
+	_ = validate.RegisterValidation("clock", isClock)
 	_ = validate.RegisterValidation("page", greaterOrEqual0)
 	_ = validate.RegisterValidation("limit", greaterOrEqual0)
 
@@ -56,8 +62,48 @@ func ToErrResponse(err error) *ErrResponse {
 				resp.Errors[i] = fmt.Sprintf("%s must contain at least one uppercase letter, one lowercase letter, one digit, and one special character", err.Field())
 			case "role":
 				resp.Errors[i] = fmt.Sprintf("%s must be one of the following: patient, doctor, admin", err.Field())
+			case "oneof":
+				resp.Errors[i] = fmt.Sprintf("%s must be one of the following: %s", err.Field(), strings.ReplaceAll(err.Param(), " ", ", "))
+			case "scope":
+				resp.Errors[i] = fmt.Sprintf("%s must be one of the following: users:read, users:write, users:admin", err.Field())
+			case "url":
+				resp.Errors[i] = fmt.Sprintf("%s must be a valid URL", err.Field())
+			case "fqdn":
+				resp.Errors[i] = fmt.Sprintf("%s must be a domain name, e.g. example.com", err.Field())
+			case "len":
+				resp.Errors[i] = fmt.Sprintf("%s must be exactly %s in length", err.Field(), err.Param())
+			case "numeric":
+				resp.Errors[i] = fmt.Sprintf("%s can only contain digits", err.Field())
+			case "min":
+				resp.Errors[i] = fmt.Sprintf("%s must be a minimum of %s in length", err.Field(), err.Param())
+			case "pesel":
+				resp.Errors[i] = fmt.Sprintf("%s must be a valid PESEL number", err.Field())
+			case "datetime":
+				resp.Errors[i] = fmt.Sprintf("%s must be a date in the %s format", err.Field(), err.Param())
+			case "past_date":
+				resp.Errors[i] = fmt.Sprintf("%s must be a date in the past", err.Field())
+			case "e164":
+				resp.Errors[i] = fmt.Sprintf("%s must be a phone number in the international format, e.g. +48123456789", err.Field())
+			case "iso3166_1_alpha2":
+				resp.Errors[i] = fmt.Sprintf("%s must be a two-letter country code", err.Field())
+			case "bcp47_language_tag":
+				resp.Errors[i] = fmt.Sprintf("%s must be a language tag, e.g. pl or en-GB", err.Field())
+			case "unique":
+				resp.Errors[i] = fmt.Sprintf("%s must not contain duplicates", err.Field())
+			case "clock":
+				resp.Errors[i] = fmt.Sprintf("%s must be a time of day in the HH:MM format", err.Field())
+			case "timezone":
+				resp.Errors[i] = fmt.Sprintf("%s must be an IANA time zone, e.g. Europe/Warsaw", err.Field())
+			case "gtfield":
+				resp.Errors[i] = fmt.Sprintf("%s must be after %s", err.Field(), strings.ToLower(err.Param()[:1])+err.Param()[1:])
+			case "slug":
+				resp.Errors[i] = fmt.Sprintf("%s can only contain lowercase letters, digits and single hyphens between them", err.Field())
+			case "required_with":
+				resp.Errors[i] = fmt.Sprintf("%s is required when another field is present", err.Field())
 			case "required_without":
 				resp.Errors[i] = fmt.Sprintf("%s is required when another field is absent", err.Field())
+			case "base64rawurl":
+				resp.Errors[i] = fmt.Sprintf("%s must be a cursor returned with a previous page", err.Field())
 			case "page":
 				resp.Errors[i] = fmt.Sprintf("%s must be greater than 0", err.Field())
 			case "limit":
@@ -95,6 +141,23 @@ func isPassword(fl validator.FieldLevel) bool {
 	return hasUpperCase && hasLowerCase && hasDigit && hasSpecial
 }
 
+// isPastDate accepts YYYY-MM-DD dates before today.
+func isPastDate(fl validator.FieldLevel) bool {
+	date, err := time.Parse(time.DateOnly, fl.Field().String())
+	return err == nil && date.Before(time.Now())
+}
+
+// isClock accepts HH:MM times of day, 24:00 being the end of the day.
+func isClock(fl validator.FieldLevel) bool {
+	reg := regexp.MustCompile("^(([01][0-9]|2[0-3]):[0-5][0-9]|24:00)$")
+	return reg.MatchString(fl.Field().String())
+}
+
+func isSlug(fl validator.FieldLevel) bool {
+	reg := regexp.MustCompile("^[a-z0-9]+(-[a-z0-9]+)*$")
+	return reg.MatchString(fl.Field().String())
+}
+
 func isRole(fl validator.FieldLevel) bool {
 	role := fl.Field().String()
 	roles := []string{"patient", "doctor", "admin"}
@@ -102,6 +165,13 @@ func isRole(fl validator.FieldLevel) bool {
 	return slices.Contains(roles, role)
 }
 
+func isScope(fl validator.FieldLevel) bool {
+	scope := fl.Field().String()
+	scopes := []string{"users:read", "users:write", "users:admin"}
+
+	return slices.Contains(scopes, scope)
+}
+
 func greaterOrEqual0(fl validator.FieldLevel) bool {
 	return fl.Field().Int() >= 0
 }